@@ -3,68 +3,112 @@ package blockchain
 import (
 	"bytes"
 	"crypto/sha256"
-	"encoding/gob"
 	"fmt"
 	"time"
+
+	"go.etcd.io/bbolt"
 )
 
+// Block is a header and its transactions. Version selects how the header
+// is hashed; see BlockVersion.
 type Block struct {
+	Version      uint32
+	Height       int
 	Timestamp    int64
 	Transactions []*Transaction
 	PrevHash     []byte
+	MerkleRoot   []byte // Root of the Merkle tree over transaction hashes
 	Hash         []byte
-	Nonce        int
+	Nonce        int    // Proof-of-work nonce, or the sealer's rank under engines that sign blocks
+	Bits         uint32 // Compact proof-of-work target
+	StateRoot    []byte // Key/value state after the block; empty while there is none
+	Signer       []byte // Public key of the sealer under engines that sign blocks
+	Proof        []byte // Sealer's VRF proof under proof of stake
+	R, S         string // Sealer's signature of Hash; not part of the header
 }
 
-func NewBlock(transactions []*Transaction, prevHash []byte) *Block {
+// NewBlock builds an unsealed block on top of parent. The engine fills in
+// what it needs in the header, such as the difficulty or the sealer,
+// against the chain state in tx; the block is sealed with engine.Seal.
+func NewBlock(tx *bbolt.Tx, transactions []*Transaction, parent *ParentState, stateRoot []byte, engine Consensus) (*Block, error) {
 	block := &Block{
+		Version:      BlockVersion,
+		Height:       parent.Height + 1,
 		Timestamp:    time.Now().Unix(),
 		Transactions: transactions,
-		PrevHash:     prevHash,
+		PrevHash:     parent.Hash,
+		StateRoot:    stateRoot,
 	}
-	pow := NewProofOfWork(block)
-	hash, nonce := pow.Run()
-	block.Hash = hash
-	block.Nonce = nonce
-	return block
+	block.MerkleRoot = block.ComputeMerkleRoot()
+	if err := engine.Prepare(tx, block, parent); err != nil {
+		return nil, err
+	}
+	return block, nil
 }
 
-func (b *Block) calculateHash() []byte {
-	// Create a combined hash of all transactions
-	txHashes := [][]byte{}
+// TxHashes returns the hashes of the block's transactions in block order.
+// They are the leaves of the block's Merkle tree.
+func (b *Block) TxHashes() [][]byte {
+	var hashes [][]byte
 	for _, tx := range b.Transactions {
-		txHashes = append(txHashes, tx.Hash())
+		hashes = append(hashes, tx.Hash())
 	}
-	txHash := sha256.Sum256(bytes.Join(txHashes, []byte{}))
+	return hashes
+}
+
+// ComputeMerkleRoot recomputes the Merkle root from the transactions.
+func (b *Block) ComputeMerkleRoot() []byte {
+	return MerkleRoot(b.TxHashes())
+}
+
+// MerkleProof returns the Merkle branch proving that the transaction with
+// the given hash is committed to by the block's Merkle root.
+func (b *Block) MerkleProof(txHash []byte) (int, []MerkleStep, error) {
+	hashes := b.TxHashes()
+	for i, h := range hashes {
+		if bytes.Equal(h, txHash) {
+			branch, err := MerkleBranch(hashes, i)
+			return i, branch, err
+		}
+	}
+	return -1, nil, fmt.Errorf("transaction %x not in block", txHash)
+}
 
-	data := bytes.Join([][]byte{
-		[]byte(fmt.Sprintf("%d", b.Timestamp)),
-		txHash[:],
-		b.PrevHash,
-		IntToHex(int64(b.Nonce)),
-	}, []byte{})
-	hash := sha256.Sum256(data)
+// HeaderHash recomputes the block hash from the header fields and nonce.
+func (b *Block) HeaderHash() []byte {
+	hash := sha256.Sum256(NewProofOfWork(b).prepareData(b.Nonce))
 	return hash[:]
 }
 
-func (b *Block) Serialize() []byte {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(b)
-	if err != nil {
-		fmt.Println("Error serializing block:", err)
-		return nil
+// Seed is the randomness the block passes on to its child: the output of
+// its VRF proof under proof of stake, and its hash otherwise.
+func (b *Block) Seed() []byte {
+	if out := VRFOutput(b.Proof); out != nil {
+		return out
 	}
-	return buf.Bytes()
+	return b.Hash
+}
+
+// Size returns the encoded size of the block in bytes.
+func (b *Block) Size() int {
+	return len(b.Serialize())
 }
 
+// Serialize returns the canonical encoding of the block in its envelope.
+func (b *Block) Serialize() []byte {
+	var e Encoder
+	putEnvelope(&e, blockMagic)
+	e.EncodeBlock(b)
+	return e.Bytes()
+}
+
+// Deserialize reads a block written by Serialize or, for older data, by
+// gob.
 func Deserialize(data []byte) *Block {
-	var block Block
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	err := dec.Decode(&block)
+	block, err := DecodeBlock(data)
 	if err != nil {
 		fmt.Println("Error deserializing block:", err)
 		return nil
 	}
-	return &block
+	return block
 }
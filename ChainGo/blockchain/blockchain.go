@@ -2,84 +2,550 @@ package blockchain
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
+	"math/big"
+	"sync"
 
 	"github.com/Vishal-2029/pkg"
 	"go.etcd.io/bbolt"
 )
 
+// Blockchain is the best chain stored in BoltDB. Blocks are keyed by hash,
+// with a height index and a persisted tip; only the tip summary and a small
+// cache of recent blocks are kept in memory.
 type Blockchain struct {
-	Block []*Block
-	DB    *pkg.BoltDB
+	DB     *pkg.BoltDB
+	UTXO   *UTXOSet
+	Params *ChainParams
+
+	// OnTipChange, if set, is called after ProcessBlock moved the tip, with
+	// the blocks that left and joined the best chain.
+	OnTipChange func(disconnected, connected []*Block)
+
+	mu        sync.RWMutex
+	tip       []byte
+	height    int
+	chainWork *big.Int
+	cache     *blockCache
+	reorgs    []ReorgEvent
 }
 
-func NewBlockchain(db *pkg.BoltDB) *Blockchain {
-	bc := &Blockchain{DB: db}
+// NewBlockchain opens the chain stored in db, creating it from the genesis
+// spec in params if the database is empty. A database whose genesis block
+// does not match the spec is refused.
+func NewBlockchain(db *pkg.BoltDB, params *ChainParams) (*Blockchain, error) {
+	bc := &Blockchain{
+		DB:     db,
+		UTXO:   &UTXOSet{DB: db},
+		Params: params,
+		cache:  newBlockCache(blockCacheSize),
+	}
+
+	if err := params.mineGenesis(); err != nil {
+		return nil, fmt.Errorf("build genesis block: %w", err)
+	}
+	genesis := params.genesis
 
 	// Try to load existing chain first
 	err := bc.LoadChain()
-	if err != nil || len(bc.Block) == 0 {
+	if err != nil || bc.tip == nil {
 		if err != nil {
 			log.Println("Error loading chain:", err)
 		}
 		log.Println("No existing chain found or chain empty, creating genesis block...")
-		genesisTx := &Transaction{From: "Genesis", To: "Genesis", Amount: 0}
-		genesis := NewBlock([]*Transaction{genesisTx}, []byte{})
-		bc.Block = append(bc.Block, genesis)
-
-		if err := bc.SaveBlock(genesis); err != nil {
-			log.Println("Error saving genesis block:", err)
+		bc.chainWork = big.NewInt(0)
+		if err := bc.connectTip(genesis); err != nil {
+			return nil, fmt.Errorf("save genesis block: %w", err)
 		}
 	} else {
-		log.Printf("Loaded existing chain with %d blocks\n", len(bc.Block))
+		stored, err := bc.BlockAtHeight(0)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(stored.Hash, genesis.Hash) {
+			return nil, fmt.Errorf("%w: database has %x, spec gives %x", ErrBadGenesis, stored.Hash, genesis.Hash)
+		}
+		log.Printf("Loaded existing chain with %d blocks\n", bc.height+1)
 	}
+	log.Printf("Genesis block %x\n", genesis.Hash)
 
-	return bc
-}
-
-func (bc *Blockchain) AddBlock(transactions []*Transaction) {
-	prevBlock := bc.Block[len(bc.Block)-1]
-	newBlock := NewBlock(transactions, prevBlock.Hash)
-	bc.Block = append(bc.Block, newBlock)
-	if err := bc.SaveBlock(newBlock); err != nil {
-		log.Println("Error saving block:", err)
+	if err := bc.migrateEncoding(); err != nil {
+		return nil, fmt.Errorf("migrate block encoding: %w", err)
+	}
+	if err := bc.indexIfNeeded(); err != nil {
+		log.Println("Error building block index:", err)
+	}
+	if err := bc.reindexIfNeeded(); err != nil {
+		log.Println("Error rebuilding chain state:", err)
+	}
+	if err := bc.DB.DB.Update(buildStateTree); err != nil {
+		log.Println("Error building state tree:", err)
 	}
-}
 
-func (bc *Blockchain) SaveBlock(block *Block) error {
-	data := block.Serialize()
-	return bc.DB.SaveWallet(string(block.Hash), data)
+	return bc, nil
 }
 
+// LoadChain reads the tip pointer and chain work from the meta bucket.
+// Blocks themselves stay on disk until they are asked for.
 func (bc *Blockchain) LoadChain() error {
 	return bc.DB.DB.View(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte("chaingo_blocks"))
-		if b == nil {
-			return fmt.Errorf("bucket not found")
+		meta := tx.Bucket(metaBucket)
+		if meta == nil || meta.Get(tipKey) == nil {
+			return nil
 		}
 
-		return b.ForEach(func(k, v []byte) error {
-			block := Deserialize(v)
-			bc.Block = append(bc.Block, block)
+		tip := append([]byte{}, meta.Get(tipKey)...)
+		block, err := getBlock(tx, tip)
+		if err != nil {
+			return err
+		}
+
+		bc.tip = tip
+		bc.height = block.Height
+		bc.chainWork = new(big.Int).SetBytes(meta.Get(workKey))
+		return nil
+	})
+}
+
+// migrateEncoding rewrites blocks stored with gob, before the canonical
+// encoding, in the canonical encoding. Hashes do not change, so neither do
+// the keys or anything that refers to the blocks.
+func (bc *Blockchain) migrateEncoding() error {
+	return bc.DB.DB.Update(func(tx *bbolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		if v := meta.Get(encodingKey); len(v) == 1 && v[0] == EncodingVersion {
 			return nil
-		})
+		}
+
+		var stale [][]byte
+		if b := tx.Bucket(blocksBucket); b != nil {
+			b.ForEach(func(k, v []byte) error {
+				if !bytes.HasPrefix(v, blockMagic) {
+					stale = append(stale, k)
+				}
+				return nil
+			})
+		}
+		for _, hash := range stale {
+			block, err := getBlock(tx, hash)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(block.HeaderHash(), hash) {
+				return fmt.Errorf("%w: stored block %x hashes to %x", ErrBadHeaderHash, hash, block.HeaderHash())
+			}
+			if err := putBlock(tx, block); err != nil {
+				return err
+			}
+		}
+		if len(stale) > 0 {
+			log.Printf("Rewrote %d blocks in encoding version %d\n", len(stale), EncodingVersion)
+		}
+		return meta.Put(encodingKey, []byte{EncodingVersion})
 	})
 }
 
-func (bc *Blockchain) Validate() error {
-	for i := 1; i < len(bc.Block); i++ {
-		prev := bc.Block[i-1]
-		curr := bc.Block[i]
+// indexIfNeeded builds block index entries for the best chain when the
+// database predates the block index.
+func (bc *Blockchain) indexIfNeeded() error {
+	return bc.DB.DB.Update(func(tx *bbolt.Tx) error {
+		if node, _ := getNode(tx, bc.tip); node != nil {
+			return nil
+		}
+		work := big.NewInt(0)
+		for h := 0; h <= bc.height; h++ {
+			block, err := getBlockAtHeight(tx, h)
+			if err != nil {
+				return err
+			}
+			work = new(big.Int).Add(work, bc.Params.Consensus.Work(block))
+			node := &blockNode{Hash: block.Hash, PrevHash: block.PrevHash, Height: block.Height, ChainWork: work}
+			if err := putNode(tx, node); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-		if !bytes.Equal(curr.PrevHash, prev.Hash) {
-			return fmt.Errorf("block %d previous hash mismatch", i)
+// reindexIfNeeded rebuilds the chain state when it does not match the tip,
+// for example on a database written by an older version.
+func (bc *Blockchain) reindexIfNeeded() error {
+	var stateTip []byte
+	bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket(stateMetaBucket); b != nil {
+			stateTip = append([]byte{}, b.Get(tipKey)...)
 		}
+		return nil
+	})
+	if bytes.Equal(stateTip, bc.tip) {
+		return nil
+	}
 
-		pow := NewProofOfWork(curr)
-		if !pow.Validate() {
-			return fmt.Errorf("block %d proof of work invalid", i)
+	log.Println("Chain state does not match tip, reindexing...")
+	if err := bc.Reindex(); err != nil {
+		return err
+	}
+	log.Printf("Chain state rebuilt with %d unspent outputs\n", bc.UTXO.Count())
+	return nil
+}
+
+// Reindex drops the chain state and rebuilds it by connecting every block
+// of the best chain in height order.
+func (bc *Blockchain) Reindex() error {
+	bc.mu.RLock()
+	height := bc.height
+	bc.mu.RUnlock()
+
+	return bc.DB.DB.Update(func(tx *bbolt.Tx) error {
+		if err := dropState(tx); err != nil {
+			return err
+		}
+		for h := 0; h <= height; h++ {
+			block, err := getBlockAtHeight(tx, h)
+			if err != nil {
+				return err
+			}
+			if err := connectBlock(tx, block, bc.Params); err != nil {
+				return fmt.Errorf("block %d: %w", h, err)
+			}
+		}
+		return nil
+	})
+}
+
+// AddBlock seals a block on top of the current tip with the consensus
+// engine and connects it to the UTXO set. The block is only appended if it
+// passes ValidateBlock and all of its inputs can be spent.
+func (bc *Blockchain) AddBlock(transactions []*Transaction) (*Block, error) {
+	tip := bc.Tip()
+	stateRoot, err := bc.nextStateRoot(transactions)
+	if err != nil {
+		return nil, err
+	}
+	var newBlock *Block
+	err = bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		parent, err := bc.parentState(tx, tip.Hash)
+		if err != nil {
+			return err
+		}
+		newBlock, err = NewBlock(tx, transactions, parent, stateRoot, bc.Params.Consensus)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Sealing may take a while under proof of work, so it happens outside
+	// the read transaction.
+	if err := bc.Params.Consensus.Seal(newBlock); err != nil {
+		return nil, err
+	}
+
+	if err := bc.ValidateBlock(newBlock); err != nil {
+		return nil, err
+	}
+	if err := bc.connectTip(newBlock); err != nil {
+		return nil, err
+	}
+	return newBlock, nil
+}
+
+// connectTip stores block, connects it to the chain state and moves the tip
+// to it, all in a single database transaction.
+func (bc *Blockchain) connectTip(block *Block) error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	if !bytes.Equal(block.PrevHash, bc.tip) {
+		return fmt.Errorf("block %x does not extend the tip", block.Hash)
+	}
+	node := &blockNode{
+		Hash:      block.Hash,
+		PrevHash:  block.PrevHash,
+		Height:    block.Height,
+		ChainWork: new(big.Int).Add(bc.chainWork, bc.Params.Consensus.Work(block)),
+	}
+	err := bc.DB.DB.Update(func(tx *bbolt.Tx) error {
+		if err := storeBlock(tx, block, node); err != nil {
+			return err
 		}
+		return connectTipTx(tx, block, node, bc.Params)
+	})
+	if err != nil {
+		return err
 	}
+
+	bc.setTip(node)
+	bc.cache.add(block)
 	return nil
 }
+
+// disconnectTip removes the tip block from the chain, the state and the
+// block store, and moves the tip back to its parent.
+func (bc *Blockchain) disconnectTip() error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	block, err := bc.BlockByHash(bc.tip)
+	if err != nil {
+		return err
+	}
+
+	var parent *blockNode
+	err = bc.DB.DB.Update(func(tx *bbolt.Tx) error {
+		if parent, err = disconnectTipTx(tx, block); err != nil {
+			return err
+		}
+		if err := tx.Bucket(indexBucket).Delete(block.Hash); err != nil {
+			return err
+		}
+		return tx.Bucket(blocksBucket).Delete(block.Hash)
+	})
+	if err != nil {
+		return err
+	}
+
+	bc.cache.remove(block.Hash)
+	bc.setTip(parent)
+	return nil
+}
+
+// connectTipTx connects an already stored block on top of the tip.
+func connectTipTx(tx *bbolt.Tx, block *Block, node *blockNode, p *ChainParams) error {
+	if err := connectBlock(tx, block, p); err != nil {
+		return err
+	}
+	heights, err := tx.CreateBucketIfNotExists(heightsBucket)
+	if err != nil {
+		return err
+	}
+	if err := heights.Put(heightKey(block.Height), block.Hash); err != nil {
+		return err
+	}
+	return putTip(tx, node)
+}
+
+// disconnectTipTx disconnects the tip block using its undo data and returns
+// the index entry of the new tip. The block itself stays stored.
+func disconnectTipTx(tx *bbolt.Tx, block *Block) (*blockNode, error) {
+	parent, err := getNode(tx, block.PrevHash)
+	if err != nil {
+		return nil, err
+	}
+	if err := disconnectBlock(tx, block); err != nil {
+		return nil, err
+	}
+	if err := tx.Bucket(heightsBucket).Delete(heightKey(block.Height)); err != nil {
+		return nil, err
+	}
+	return parent, putTip(tx, parent)
+}
+
+func putTip(tx *bbolt.Tx, node *blockNode) error {
+	meta, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+	if err := meta.Put(tipKey, node.Hash); err != nil {
+		return err
+	}
+	return meta.Put(workKey, node.ChainWork.Bytes())
+}
+
+// setTip updates the in-memory tip summary. bc.mu must be held.
+func (bc *Blockchain) setTip(node *blockNode) {
+	bc.tip = node.Hash
+	bc.height = node.Height
+	bc.chainWork = node.ChainWork
+}
+
+// Truncate disconnects blocks from the tip until only height blocks remain.
+func (bc *Blockchain) Truncate(height int) error {
+	for bc.Height() >= height {
+		if err := bc.disconnectTip(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Height returns the height of the tip; the genesis block is height 0.
+func (bc *Blockchain) Height() int {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.height
+}
+
+// TipHash returns the hash of the tip block.
+func (bc *Blockchain) TipHash() []byte {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.tip
+}
+
+// Tip returns the tip block.
+func (bc *Blockchain) Tip() *Block {
+	block, err := bc.BlockByHash(bc.TipHash())
+	if err != nil {
+		log.Println("Error reading tip block:", err)
+	}
+	return block
+}
+
+// BlockByHash returns a stored block, from the cache when possible.
+func (bc *Blockchain) BlockByHash(hash []byte) (*Block, error) {
+	if block := bc.cache.get(hash); block != nil {
+		return block, nil
+	}
+	var block *Block
+	err := bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		var err error
+		block, err = getBlock(tx, hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	bc.cache.add(block)
+	return block, nil
+}
+
+// BlockAtHeight returns the block of the best chain at height.
+func (bc *Blockchain) BlockAtHeight(height int) (*Block, error) {
+	var hash []byte
+	bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		hash = hashAtHeight(tx, height)
+		return nil
+	})
+	if hash == nil {
+		return nil, fmt.Errorf("no block at height %d", height)
+	}
+	return bc.BlockByHash(hash)
+}
+
+// Blocks returns the blocks from height start up to and including end.
+func (bc *Blockchain) Blocks(start, end int) ([]*Block, error) {
+	var blocks []*Block
+	for h := start; h <= end; h++ {
+		block, err := bc.BlockAtHeight(h)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// FindTransaction looks a confirmed transaction up by hash through the
+// transaction index.
+func (bc *Blockchain) FindTransaction(txHash []byte) (*Transaction, *Block, error) {
+	var blockHash []byte
+	bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket(txIndexBucket); b != nil {
+			blockHash = append([]byte{}, b.Get(txHash)...)
+		}
+		return nil
+	})
+	if len(blockHash) == 0 {
+		return nil, nil, fmt.Errorf("transaction %x not found", txHash)
+	}
+
+	block, err := bc.BlockByHash(blockHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, t := range block.Transactions {
+		if bytes.Equal(t.Hash(), txHash) {
+			return t, block, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("transaction %x not found in block %x", txHash, blockHash)
+}
+
+// TxCount returns the number of transactions in the chain.
+func (bc *Blockchain) TxCount() int {
+	count := 0
+	bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket(stateMetaBucket); b != nil && b.Get(txCountKey) != nil {
+			count = int(binary.BigEndian.Uint64(b.Get(txCountKey)))
+		}
+		return nil
+	})
+	return count
+}
+
+// NextBits returns the compact target the next block must meet.
+func (bc *Blockchain) NextBits() uint32 {
+	return bc.Params.NextBits(bc.Height()+1, bc.blockAt)
+}
+
+// ChainWork returns the total expected work of all blocks in the chain.
+// Competing chains are compared by this value rather than by length.
+func (bc *Blockchain) ChainWork() *big.Int {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return new(big.Int).Set(bc.chainWork)
+}
+
+func (bc *Blockchain) blockAt(height int) *Block {
+	block, err := bc.BlockAtHeight(height)
+	if err != nil {
+		log.Println("Error reading block:", err)
+	}
+	return block
+}
+
+// Validate checks every block of the best chain against the consensus
+// rules and then replays the chain state from scratch.
+func (bc *Blockchain) Validate() error {
+	height := bc.Height()
+	genesis, err := bc.BlockAtHeight(0)
+	if err != nil {
+		return err
+	}
+	if err := bc.Params.ValidateBlock(genesis, nil); err != nil {
+		return fmt.Errorf("block 0: %w", err)
+	}
+
+	for i := 1; i <= height; i++ {
+		curr, err := bc.BlockAtHeight(i)
+		if err != nil {
+			return err
+		}
+		parent, err := bc.Params.ParentStateAt(i-1, bc.blockAt)
+		if err != nil {
+			return err
+		}
+		if err := bc.Params.ValidateBlock(curr, parent); err != nil {
+			return fmt.Errorf("block %d: %w", i, err)
+		}
+	}
+
+	// Replay every block against an empty state so that spends of missing
+	// outputs and overdrawn accounts are caught. The replay is rolled back.
+	err = bc.DB.DB.Update(func(tx *bbolt.Tx) error {
+		if err := dropState(tx); err != nil {
+			return err
+		}
+		for i := 0; i <= height; i++ {
+			block, err := getBlockAtHeight(tx, i)
+			if err != nil {
+				return err
+			}
+			if err := connectBlock(tx, block, bc.Params); err != nil {
+				return fmt.Errorf("block %d: %w", i, err)
+			}
+		}
+		return errRollback
+	})
+	if errors.Is(err, errRollback) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,220 @@
+package blockchain
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	blocksBucket    = []byte("chaingo_blocks")
+	heightsBucket   = []byte("chaingo_heights")
+	indexBucket     = []byte("chaingo_index")
+	metaBucket      = []byte("chaingo_meta")
+	txIndexBucket   = []byte("chaingo_txindex")
+	stateMetaBucket = []byte("chaingo_statemeta")
+	// invalidBucket holds the hashes of blocks that failed to connect, and
+	// of blocks received on top of them, so that their branch is turned
+	// away without being connected again.
+	invalidBucket = []byte("chaingo_invalid")
+)
+
+var (
+	tipKey     = []byte("tip")
+	workKey    = []byte("work")
+	txCountKey = []byte("txcount")
+	// encodingKey records the EncodingVersion the stored blocks are in.
+	encodingKey = []byte("encoding")
+)
+
+// blockCacheSize is the number of recently used blocks kept in memory.
+const blockCacheSize = 256
+
+func heightKey(height int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(height))
+	return key
+}
+
+// blockNode is the block index entry kept for every stored block, on the
+// best chain or on a side branch.
+type blockNode struct {
+	Hash      []byte
+	PrevHash  []byte
+	Height    int
+	ChainWork *big.Int // Cumulative work up to and including this block
+}
+
+func putNode(tx *bbolt.Tx, node *blockNode) error {
+	b, err := tx.CreateBucketIfNotExists(indexBucket)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(node); err != nil {
+		return err
+	}
+	return b.Put(node.Hash, buf.Bytes())
+}
+
+func getNode(tx *bbolt.Tx, hash []byte) (*blockNode, error) {
+	b := tx.Bucket(indexBucket)
+	if b == nil || b.Get(hash) == nil {
+		return nil, fmt.Errorf("block %x not in index", hash)
+	}
+	var node blockNode
+	if err := gob.NewDecoder(bytes.NewReader(b.Get(hash))).Decode(&node); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// storeBlock writes a block and its index entry without connecting it.
+func storeBlock(tx *bbolt.Tx, block *Block, node *blockNode) error {
+	if err := putBlock(tx, block); err != nil {
+		return err
+	}
+	return putNode(tx, node)
+}
+
+func putBlock(tx *bbolt.Tx, block *Block) error {
+	b, err := tx.CreateBucketIfNotExists(blocksBucket)
+	if err != nil {
+		return err
+	}
+	data := block.Serialize()
+	if data == nil {
+		return fmt.Errorf("could not serialize block %x", block.Hash)
+	}
+	return b.Put(block.Hash, data)
+}
+
+func getBlock(tx *bbolt.Tx, hash []byte) (*Block, error) {
+	b := tx.Bucket(blocksBucket)
+	if b == nil {
+		return nil, fmt.Errorf("block %x not found", hash)
+	}
+	data := b.Get(hash)
+	if data == nil {
+		return nil, fmt.Errorf("block %x not found", hash)
+	}
+	block := Deserialize(data)
+	if block == nil {
+		return nil, fmt.Errorf("block %x is corrupt", hash)
+	}
+	return block, nil
+}
+
+func markInvalid(tx *bbolt.Tx, hash []byte) error {
+	b, err := tx.CreateBucketIfNotExists(invalidBucket)
+	if err != nil {
+		return err
+	}
+	return b.Put(hash, []byte{1})
+}
+
+func isInvalid(tx *bbolt.Tx, hash []byte) bool {
+	b := tx.Bucket(invalidBucket)
+	return b != nil && b.Get(hash) != nil
+}
+
+func hashAtHeight(tx *bbolt.Tx, height int) []byte {
+	b := tx.Bucket(heightsBucket)
+	if b == nil {
+		return nil
+	}
+	if hash := b.Get(heightKey(height)); hash != nil {
+		return append([]byte{}, hash...)
+	}
+	return nil
+}
+
+func getBlockAtHeight(tx *bbolt.Tx, height int) (*Block, error) {
+	hash := hashAtHeight(tx, height)
+	if hash == nil {
+		return nil, fmt.Errorf("no block at height %d", height)
+	}
+	return getBlock(tx, hash)
+}
+
+// blockCache is a fixed-size LRU cache of deserialized blocks keyed by hash.
+type blockCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+func newBlockCache(capacity int) *blockCache {
+	return &blockCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *blockCache) get(hash []byte) *Block {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[string(hash)]; ok {
+		c.ll.MoveToFront(el)
+		return el.Value.(*Block)
+	}
+	return nil
+}
+
+func (c *blockCache) add(block *Block) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[string(block.Hash)]; ok {
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[string(block.Hash)] = c.ll.PushFront(block)
+	if c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, string(oldest.Value.(*Block).Hash))
+	}
+}
+
+func (c *blockCache) remove(hash []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[string(hash)]; ok {
+		c.ll.Remove(el)
+		delete(c.items, string(hash))
+	}
+}
+
+// BlockchainIterator walks the chain from the tip back to genesis, reading
+// each block from disk (or the cache) as it goes.
+type BlockchainIterator struct {
+	currentHash []byte
+	bc          *Blockchain
+}
+
+// Iterator returns an iterator positioned at the current tip.
+func (bc *Blockchain) Iterator() *BlockchainIterator {
+	return &BlockchainIterator{currentHash: bc.TipHash(), bc: bc}
+}
+
+// Next returns the current block and steps to its parent. It returns nil
+// once the genesis block has been returned.
+func (it *BlockchainIterator) Next() *Block {
+	if len(it.currentHash) == 0 {
+		return nil
+	}
+	block, err := it.bc.BlockByHash(it.currentHash)
+	if err != nil {
+		return nil
+	}
+	it.currentHash = block.PrevHash
+	return block
+}
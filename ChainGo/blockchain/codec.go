@@ -0,0 +1,547 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	legacy "github.com/Vishal-2029/blockchain/legacy"
+)
+
+// The canonical encoding of blocks and transactions; see ENCODING.md.
+// Every value has exactly one encoding: integers are fixed-width big-endian,
+// byte strings and lists carry a 4-byte length, optional values a presence
+// byte, and decoding rejects anything else, including trailing bytes.
+
+const (
+	// EncodingVersion is the version of the envelope written by Serialize.
+	EncodingVersion = 1
+	// TxVersion is the version of newly built transactions. Version 0
+	// transactions predate the canonical encoding and are hashed with gob;
+	// version 2 added governance operations, version 3 stake operations and
+	// slashing evidence.
+	TxVersion = 3
+	// BlockVersion is the version of newly mined blocks. Version 0 headers
+	// predate the canonical encoding; version 2 added the sealer's key and
+	// signature, version 3 the sealer's VRF proof.
+	BlockVersion = 3
+)
+
+// Envelope magics. A serialized block or transaction starts with its magic
+// and EncodingVersion, which tells it apart from the gob data of older
+// databases.
+var (
+	blockMagic = []byte("CGB")
+	txMagic    = []byte("CGT")
+)
+
+var (
+	ErrBadEncoding = errors.New("invalid encoding")
+	ErrBadVersion  = errors.New("unsupported version")
+)
+
+// Encoder appends canonically encoded values to a buffer.
+type Encoder struct {
+	buf bytes.Buffer
+}
+
+// Bytes returns everything encoded so far.
+func (e *Encoder) Bytes() []byte { return e.buf.Bytes() }
+
+func (e *Encoder) PutU8(v uint8) { e.buf.WriteByte(v) }
+
+func (e *Encoder) PutU32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *Encoder) PutU64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.buf.Write(b[:])
+}
+
+// PutInt writes v as a signed 64-bit integer.
+func (e *Encoder) PutInt(v int) { e.PutU64(uint64(int64(v))) }
+
+func (e *Encoder) PutBool(v bool) {
+	if v {
+		e.PutU8(1)
+	} else {
+		e.PutU8(0)
+	}
+}
+
+// PutBytes writes the length of b and then b. Nil and empty are the same.
+func (e *Encoder) PutBytes(b []byte) {
+	e.PutU32(uint32(len(b)))
+	e.buf.Write(b)
+}
+
+func (e *Encoder) PutString(s string) { e.PutBytes([]byte(s)) }
+
+// PutRaw writes b as it is, without a length, e.g. for a magic.
+func (e *Encoder) PutRaw(b []byte) { e.buf.Write(b) }
+
+// Decoder reads canonically encoded values. The first error sticks: later
+// reads return zero values, and Err reports it.
+type Decoder struct {
+	data []byte
+	err  error
+}
+
+func NewDecoder(data []byte) *Decoder { return &Decoder{data: data} }
+
+// Err returns the first error met.
+func (d *Decoder) Err() error { return d.err }
+
+// Finish reports the first error, or an error if data is left over.
+func (d *Decoder) Finish() error {
+	if d.err == nil && len(d.data) > 0 {
+		d.fail("%d trailing bytes", len(d.data))
+	}
+	return d.err
+}
+
+func (d *Decoder) fail(format string, args ...interface{}) {
+	d.failWith(fmt.Errorf("%w: %s", ErrBadEncoding, fmt.Sprintf(format, args...)))
+}
+
+func (d *Decoder) failWith(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *Decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.data) {
+		d.fail("need %d bytes, have %d", n, len(d.data))
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *Decoder) U8() uint8 {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *Decoder) U32() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *Decoder) U64() uint64 {
+	if b := d.take(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *Decoder) Int() int { return int(int64(d.U64())) }
+
+func (d *Decoder) Bool() bool {
+	switch v := d.U8(); v {
+	case 0:
+		return false
+	case 1:
+		return true
+	default:
+		d.fail("bool byte %d", v)
+		return false
+	}
+}
+
+// Bytes reads a length-prefixed byte string. Empty decodes to nil.
+func (d *Decoder) Bytes() []byte {
+	n := d.U32()
+	if n == 0 {
+		return nil
+	}
+	b := d.take(int(n))
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func (d *Decoder) Text() string { return string(d.Bytes()) }
+
+// Count reads a list length. Every item takes at least one byte, so a
+// length beyond the remaining data is rejected before anything is
+// allocated for it.
+func (d *Decoder) Count() int {
+	n := d.U32()
+	if int(n) > len(d.data) {
+		d.fail("list of %d items in %d bytes", n, len(d.data))
+		return 0
+	}
+	return int(n)
+}
+
+// putList writes the length of a list; its items follow.
+func (e *Encoder) putList(n int) { e.PutU32(uint32(n)) }
+
+// putOptional writes whether an optional value is present; it follows if
+// so.
+func (e *Encoder) putOptional(present bool) { e.PutBool(present) }
+
+// EncodeTransaction appends the canonical encoding of tx.
+func (e *Encoder) EncodeTransaction(tx *Transaction) {
+	e.PutU32(tx.Version)
+	e.PutString(tx.From)
+	e.PutString(tx.To)
+	e.PutInt(tx.Amount)
+	e.PutInt(tx.Fee)
+	e.putList(len(tx.Inputs))
+	for _, in := range tx.Inputs {
+		e.PutBytes(in.TxID)
+		e.PutInt(in.Vout)
+		e.PutBytes(in.Data)
+		e.PutBytes(in.Unlock)
+	}
+	e.putList(len(tx.Outputs))
+	for _, out := range tx.Outputs {
+		e.PutInt(out.Amount)
+		e.PutString(out.Address)
+		e.PutInt(out.ReleaseHeight)
+		e.PutBytes(out.Script)
+	}
+	e.PutU64(tx.Nonce)
+	e.PutU32(tx.ChainID)
+	e.PutU64(uint64(tx.LockTime))
+	e.PutString(tx.R)
+	e.PutString(tx.S)
+	e.PutBytes(tx.PublicKey)
+	e.putSignatures(tx.Cosigners)
+	e.putOptional(tx.Multisig != nil)
+	if p := tx.Multisig; p != nil {
+		e.PutInt(p.Threshold)
+		e.putList(len(p.PublicKeys))
+		for _, key := range p.PublicKeys {
+			e.PutBytes(key)
+		}
+	}
+	e.putSignatures(tx.Signatures)
+	e.putOptional(tx.Contract != nil)
+	if c := tx.Contract; c != nil {
+		e.PutBytes(c.Code)
+		e.PutString(c.Address)
+		e.putList(len(c.Args))
+		for _, arg := range c.Args {
+			e.PutBytes(arg)
+		}
+		e.PutInt(c.GasLimit)
+	}
+	e.putOptional(tx.Token != nil)
+	if op := tx.Token; op != nil {
+		e.PutString(op.Kind)
+		e.PutString(op.Symbol)
+		e.PutString(op.Name)
+		e.PutInt(op.Amount)
+		e.PutString(op.To)
+		e.PutBool(op.Mintable)
+	}
+	e.putOptional(tx.Name != nil)
+	if op := tx.Name; op != nil {
+		e.PutString(op.Kind)
+		e.PutString(op.Name)
+		e.PutString(op.To)
+	}
+	e.PutBytes(tx.Memo)
+	if tx.Version >= 2 {
+		e.putOptional(tx.Governance != nil)
+		if op := tx.Governance; op != nil {
+			e.PutString(op.Kind)
+			e.PutString(op.Validator)
+		}
+	}
+	if tx.Version >= 3 {
+		e.putOptional(tx.Stake != nil)
+		if op := tx.Stake; op != nil {
+			e.PutString(op.Kind)
+			e.PutInt(op.Amount)
+		}
+		e.putOptional(tx.Evidence != nil)
+		if ev := tx.Evidence; ev != nil {
+			e.EncodeBlock(ev.First)
+			e.EncodeBlock(ev.Second)
+		}
+	}
+}
+
+func (e *Encoder) putSignatures(sigs []Signature) {
+	e.putList(len(sigs))
+	for _, sig := range sigs {
+		e.PutBytes(sig.PublicKey)
+		e.PutString(sig.R)
+		e.PutString(sig.S)
+	}
+}
+
+// Transaction reads a transaction written by EncodeTransaction.
+func (d *Decoder) Transaction() *Transaction {
+	tx := &Transaction{Version: d.U32()}
+	if tx.Version > TxVersion {
+		d.failWith(fmt.Errorf("%w: transaction version %d", ErrBadVersion, tx.Version))
+	}
+	tx.From = d.Text()
+	tx.To = d.Text()
+	tx.Amount = d.Int()
+	tx.Fee = d.Int()
+	if n := d.Count(); n > 0 {
+		tx.Inputs = make([]TxInput, n)
+		for i := range tx.Inputs {
+			tx.Inputs[i] = TxInput{TxID: d.Bytes(), Vout: d.Int(), Data: d.Bytes(), Unlock: d.Bytes()}
+		}
+	}
+	if n := d.Count(); n > 0 {
+		tx.Outputs = make([]TxOutput, n)
+		for i := range tx.Outputs {
+			tx.Outputs[i] = TxOutput{Amount: d.Int(), Address: d.Text(), ReleaseHeight: d.Int(), Script: d.Bytes()}
+		}
+	}
+	tx.Nonce = d.U64()
+	tx.ChainID = d.U32()
+	tx.LockTime = int64(d.U64())
+	tx.R = d.Text()
+	tx.S = d.Text()
+	tx.PublicKey = d.Bytes()
+	tx.Cosigners = d.signatures()
+	if d.Bool() {
+		tx.Multisig = &MultisigPolicy{Threshold: d.Int()}
+		if n := d.Count(); n > 0 {
+			tx.Multisig.PublicKeys = make([][]byte, n)
+			for i := range tx.Multisig.PublicKeys {
+				tx.Multisig.PublicKeys[i] = d.Bytes()
+			}
+		}
+	}
+	tx.Signatures = d.signatures()
+	if d.Bool() {
+		tx.Contract = &ContractCall{Code: d.Bytes(), Address: d.Text()}
+		if n := d.Count(); n > 0 {
+			tx.Contract.Args = make([][]byte, n)
+			for i := range tx.Contract.Args {
+				tx.Contract.Args[i] = d.Bytes()
+			}
+		}
+		tx.Contract.GasLimit = d.Int()
+	}
+	if d.Bool() {
+		tx.Token = &TokenOp{Kind: d.Text(), Symbol: d.Text(), Name: d.Text(), Amount: d.Int(), To: d.Text(), Mintable: d.Bool()}
+	}
+	if d.Bool() {
+		tx.Name = &NameOp{Kind: d.Text(), Name: d.Text(), To: d.Text()}
+	}
+	tx.Memo = d.Bytes()
+	if tx.Version >= 2 && d.Bool() {
+		tx.Governance = &GovernanceOp{Kind: d.Text(), Validator: d.Text()}
+	}
+	if tx.Version >= 3 {
+		if d.Bool() {
+			tx.Stake = &StakeOp{Kind: d.Text(), Amount: d.Int()}
+		}
+		if d.Bool() {
+			tx.Evidence = &SlashEvidence{First: d.Block(), Second: d.Block()}
+		}
+	}
+	return tx
+}
+
+func (d *Decoder) signatures() []Signature {
+	n := d.Count()
+	if n == 0 {
+		return nil
+	}
+	sigs := make([]Signature, n)
+	for i := range sigs {
+		sigs[i] = Signature{PublicKey: d.Bytes(), R: d.Text(), S: d.Text()}
+	}
+	return sigs
+}
+
+// EncodeHeader appends the canonical header of b with the given nonce. The
+// hash of a version 1 or later block is the SHA-256 of its header.
+func (e *Encoder) EncodeHeader(b *Block, nonce int) {
+	e.PutU32(b.Version)
+	e.PutInt(b.Height)
+	e.PutU64(uint64(b.Timestamp))
+	e.PutBytes(b.PrevHash)
+	e.PutBytes(b.MerkleRoot)
+	e.PutU32(b.Bits)
+	e.PutInt(nonce)
+	e.PutBytes(b.StateRoot)
+	if b.Version >= 2 {
+		e.PutBytes(b.Signer)
+	}
+	if b.Version >= 3 {
+		e.PutBytes(b.Proof)
+	}
+}
+
+// EncodeBlock appends the header of b, from version 2 the sealer's
+// signature, and its transactions. The block hash is not written; it is
+// recomputed from the header.
+func (e *Encoder) EncodeBlock(b *Block) {
+	e.EncodeHeader(b, b.Nonce)
+	if b.Version >= 2 {
+		e.PutString(b.R)
+		e.PutString(b.S)
+	}
+	e.putList(len(b.Transactions))
+	for _, tx := range b.Transactions {
+		e.EncodeTransaction(tx)
+	}
+}
+
+// Block reads a block written by EncodeBlock.
+func (d *Decoder) Block() *Block {
+	b := &Block{Version: d.U32()}
+	if b.Version > BlockVersion {
+		d.failWith(fmt.Errorf("%w: block version %d", ErrBadVersion, b.Version))
+	}
+	b.Height = d.Int()
+	b.Timestamp = int64(d.U64())
+	b.PrevHash = d.Bytes()
+	b.MerkleRoot = d.Bytes()
+	b.Bits = d.U32()
+	b.Nonce = d.Int()
+	b.StateRoot = d.Bytes()
+	if b.Version >= 2 {
+		b.Signer = d.Bytes()
+	}
+	if b.Version >= 3 {
+		b.Proof = d.Bytes()
+	}
+	if b.Version >= 2 {
+		b.R = d.Text()
+		b.S = d.Text()
+	}
+	if n := d.Count(); n > 0 {
+		b.Transactions = make([]*Transaction, n)
+		for i := range b.Transactions {
+			b.Transactions[i] = d.Transaction()
+		}
+	}
+	if d.err == nil {
+		b.Hash = b.HeaderHash()
+	}
+	return b
+}
+
+func putEnvelope(e *Encoder, magic []byte) {
+	e.PutRaw(magic)
+	e.PutU8(EncodingVersion)
+}
+
+// openEnvelope reports whether data starts with magic and, if so, returns
+// a decoder for what follows it.
+func openEnvelope(data, magic []byte) (*Decoder, bool) {
+	if !bytes.HasPrefix(data, magic) {
+		return nil, false
+	}
+	d := NewDecoder(data[len(magic):])
+	if v := d.U8(); v != EncodingVersion {
+		d.failWith(fmt.Errorf("%w: encoding version %d", ErrBadVersion, v))
+	}
+	return d, true
+}
+
+// DecodeBlock reads a block serialized by Serialize, or gob data written
+// before the canonical encoding.
+func DecodeBlock(data []byte) (*Block, error) {
+	d, ok := openEnvelope(data, blockMagic)
+	if !ok {
+		var block Block
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&block); err != nil {
+			return nil, fmt.Errorf("%w: neither canonical nor gob: %v", ErrBadEncoding, err)
+		}
+		return &block, nil
+	}
+	block := d.Block()
+	if err := d.Finish(); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// DecodeTransaction reads a transaction serialized by Serialize, or gob
+// data written before the canonical encoding.
+func DecodeTransaction(data []byte) (*Transaction, error) {
+	d, ok := openEnvelope(data, txMagic)
+	if !ok {
+		var tx Transaction
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&tx); err != nil {
+			return nil, fmt.Errorf("%w: neither canonical nor gob: %v", ErrBadEncoding, err)
+		}
+		return &tx, nil
+	}
+	tx := d.Transaction()
+	if err := d.Finish(); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// CheckVersion requires a new transaction to use the canonical encoding,
+// version 1 up to TxVersion. Version 0 is valid only in the blocks that
+// already carry it.
+func (tx *Transaction) CheckVersion() error {
+	if tx.Version == 0 || tx.Version > TxVersion {
+		return fmt.Errorf("%w: transaction version %d, expected 1 to %d", ErrBadVersion, tx.Version, TxVersion)
+	}
+	return nil
+}
+
+// legacyEncode is the gob encoding that version 0 transactions are hashed
+// over.
+func legacyEncode(tx *Transaction) []byte {
+	l := &legacy.Transaction{
+		From: tx.From, To: tx.To, Amount: tx.Amount, Fee: tx.Fee,
+		Nonce: tx.Nonce, ChainID: tx.ChainID, LockTime: tx.LockTime,
+		R: tx.R, S: tx.S, PublicKey: tx.PublicKey,
+		Cosigners:  legacySignatures(tx.Cosigners),
+		Signatures: legacySignatures(tx.Signatures),
+		Memo:       tx.Memo,
+	}
+	for _, in := range tx.Inputs {
+		l.Inputs = append(l.Inputs, legacy.TxInput{TxID: in.TxID, Vout: in.Vout, Data: in.Data, Unlock: legacy.Script(in.Unlock)})
+	}
+	for _, out := range tx.Outputs {
+		l.Outputs = append(l.Outputs, legacy.TxOutput{Amount: out.Amount, Address: out.Address, ReleaseHeight: out.ReleaseHeight, Script: legacy.Script(out.Script)})
+	}
+	if p := tx.Multisig; p != nil {
+		l.Multisig = &legacy.MultisigPolicy{Threshold: p.Threshold, PublicKeys: p.PublicKeys}
+	}
+	if c := tx.Contract; c != nil {
+		l.Contract = &legacy.ContractCall{Code: c.Code, Address: c.Address, Args: c.Args, GasLimit: c.GasLimit}
+	}
+	if op := tx.Token; op != nil {
+		l.Token = &legacy.TokenOp{Kind: op.Kind, Symbol: op.Symbol, Name: op.Name, Amount: op.Amount, To: op.To, Mintable: op.Mintable}
+	}
+	if op := tx.Name; op != nil {
+		l.Name = &legacy.NameOp{Kind: op.Kind, Name: op.Name, To: op.To}
+	}
+	return legacy.Encode(l)
+}
+
+func legacySignatures(sigs []Signature) []legacy.Signature {
+	var out []legacy.Signature
+	for _, sig := range sigs {
+		out = append(out, legacy.Signature{PublicKey: sig.PublicKey, R: sig.R, S: sig.S})
+	}
+	return out
+}
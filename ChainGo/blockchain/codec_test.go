@@ -0,0 +1,255 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The vectors of ENCODING.md.
+const (
+	vectorCoinbaseBody = "0000000100000008436f696e62617365000000056d696e657200000000000000320000000000000000" +
+		"000000010000000000000000000000010000000000000000000000010000000000000032000000056d" +
+		"696e657200000000000000000000000000000000000000000000000100000000000000000000000000" +
+		"0000000000000000000000000000000000000000000000"
+	vectorCoinbaseID = "293d0ce0c7f436b31e5ec3e68acc01eaa1f3320eeda69c254155554143dd2b0d"
+
+	vectorPaymentBody = "0000000100000005616c69636500000003626f6200000000000000070000000000000001000000010000" +
+		"0002aabb0000000000000000000000000000000000000002000000000000000700000003626f620000" +
+		"00000000000000000000000000000000000200000005616c6963650000000000000000000000000000" +
+		"000000000003000000010000000000000000000000000000000000000000000000000000000000000000" +
+		"000000026869"
+	vectorPaymentID = "0052aba7bc9e9b00b66e86ae1eb33587c77759022e494346c3c00a7980ab53da"
+
+	vectorHeader = "000000010000000000000001000000006754a55800000002010200000020293d0ce0c7f436b31e5ec3" +
+		"e68acc01eaa1f3320eeda69c254155554143dd2b0d1f010000000000000000002a00000000"
+	vectorHeaderHash = "cf222357f067a6224f8ad8de1b93f014a8fb4c8f38753829b74af4e5a040a9ec"
+)
+
+func vectorCoinbase() *Transaction {
+	tx := NewCoinbaseTx(1, "miner", 50, 1)
+	tx.Version = 1
+	return tx
+}
+
+func vectorPayment() *Transaction {
+	return &Transaction{
+		Version: 1,
+		From:    "alice",
+		To:      "bob",
+		Amount:  7,
+		Fee:     1,
+		Inputs:  []TxInput{{TxID: []byte{0xaa, 0xbb}, Vout: 0}},
+		Outputs: []TxOutput{{Amount: 7, Address: "bob"}, {Amount: 2, Address: "alice"}},
+		Nonce:   3,
+		ChainID: 1,
+		Memo:    []byte("hi"),
+	}
+}
+
+func vectorBlock() *Block {
+	block := &Block{
+		Version:      1,
+		Height:       1,
+		Timestamp:    1733600600,
+		PrevHash:     []byte{0x01, 0x02},
+		Transactions: []*Transaction{vectorCoinbase()},
+		Bits:         0x1f010000,
+		Nonce:        42,
+	}
+	block.MerkleRoot = block.ComputeMerkleRoot()
+	block.Hash = block.HeaderHash()
+	return block
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestEncodingVectors(t *testing.T) {
+	tests := []struct {
+		name string
+		tx   *Transaction
+		body string
+		id   string
+	}{
+		{"coinbase", vectorCoinbase(), vectorCoinbaseBody, vectorCoinbaseID},
+		{"payment", vectorPayment(), vectorPaymentBody, vectorPaymentID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e Encoder
+			e.EncodeTransaction(tt.tx)
+			if got := hex.EncodeToString(e.Bytes()); got != tt.body {
+				t.Errorf("body = %s, want %s", got, tt.body)
+			}
+			if got := hex.EncodeToString(tt.tx.Hash()); got != tt.id {
+				t.Errorf("id = %s, want %s", got, tt.id)
+			}
+			want := append(append([]byte{}, txMagic...), EncodingVersion)
+			if got := tt.tx.Serialize(); !bytes.Equal(got, append(want, mustHex(t, tt.body)...)) {
+				t.Errorf("serialized = %x, want %x followed by the body", got, want)
+			}
+		})
+	}
+
+	t.Run("header", func(t *testing.T) {
+		block := vectorBlock()
+		var e Encoder
+		e.EncodeHeader(block, block.Nonce)
+		if got := hex.EncodeToString(e.Bytes()); got != vectorHeader {
+			t.Errorf("header = %s, want %s", got, vectorHeader)
+		}
+		if got := hex.EncodeToString(block.Hash); got != vectorHeaderHash {
+			t.Errorf("hash = %s, want %s", got, vectorHeaderHash)
+		}
+		want := append(append([]byte{}, blockMagic...), EncodingVersion)
+		want = append(want, mustHex(t, vectorHeader)...)
+		want = append(want, 0, 0, 0, 1)
+		want = append(want, mustHex(t, vectorCoinbaseBody)...)
+		if got := block.Serialize(); !bytes.Equal(got, want) {
+			t.Errorf("serialized = %x, want %x", got, want)
+		}
+	})
+}
+
+func TestTransactionRoundTrip(t *testing.T) {
+	first, second := vectorBlock(), vectorBlock()
+	second.Nonce++
+	tests := []struct {
+		name string
+		tx   *Transaction
+	}{
+		{"coinbase", vectorCoinbase()},
+		{"payment", vectorPayment()},
+		{"signed", &Transaction{Version: TxVersion, From: "a", To: "b", R: "1f", S: "2e", PublicKey: []byte{4, 5}, LockTime: 500, ChainID: 3}},
+		{"script", &Transaction{Version: TxVersion, Inputs: []TxInput{{TxID: []byte{1}, Unlock: []byte{0x51}}}, Outputs: []TxOutput{{Amount: 1, Address: "x", Script: []byte{0x51}, ReleaseHeight: 9}}}},
+		{"multisig", &Transaction{
+			Version:    TxVersion,
+			Cosigners:  []Signature{{PublicKey: []byte{1}, R: "a", S: "b"}},
+			Multisig:   &MultisigPolicy{Threshold: 2, PublicKeys: [][]byte{{1}, {2}, {3}}},
+			Signatures: []Signature{{PublicKey: []byte{2}, R: "c", S: "d"}},
+		}},
+		{"contract", &Transaction{Version: TxVersion, Contract: &ContractCall{Code: []byte{OpStop}, Address: "c", Args: [][]byte{{1}, {}}, GasLimit: 500}}},
+		{"token", &Transaction{Version: TxVersion, Token: &TokenOp{Kind: TokenIssue, Symbol: "TOK", Name: "Token", Amount: 10, Mintable: true}}},
+		{"name", &Transaction{Version: TxVersion, Name: &NameOp{Kind: NameRegister, Name: "alice"}}},
+		{"governance", &Transaction{Version: 2, Governance: &GovernanceOp{Kind: GovernanceAdd, Validator: "v"}}},
+		{"stake", &Transaction{Version: 3, Stake: &StakeOp{Kind: StakeDeposit, Amount: 5}}},
+		{"evidence", &Transaction{Version: 3, Evidence: &SlashEvidence{First: first, Second: second}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeTransaction(tt.tx.Serialize())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Serialize(), tt.tx.Serialize()) {
+				t.Errorf("re-encoded %x, want %x", got.Serialize(), tt.tx.Serialize())
+			}
+			if !bytes.Equal(got.Hash(), tt.tx.Hash()) {
+				t.Errorf("hash %x, want %x", got.Hash(), tt.tx.Hash())
+			}
+		})
+	}
+}
+
+func TestBlockRoundTrip(t *testing.T) {
+	signed := vectorBlock()
+	signed.Version = 3
+	signed.Signer = []byte{4, 1, 2}
+	signed.Proof = []byte{9, 9}
+	signed.R, signed.S = "ab", "cd"
+	signed.StateRoot = bytes.Repeat([]byte{7}, 32)
+	signed.Hash = signed.HeaderHash()
+
+	tests := []struct {
+		name  string
+		block *Block
+	}{
+		{"vector", vectorBlock()},
+		{"signed", signed},
+		{"empty", &Block{Version: 1, PrevHash: []byte{}, MerkleRoot: MerkleRoot(nil)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeBlock(tt.block.Serialize())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Hash, tt.block.HeaderHash()) {
+				t.Errorf("hash %x, want %x", got.Hash, tt.block.HeaderHash())
+			}
+			if !bytes.Equal(got.Serialize(), tt.block.Serialize()) {
+				t.Errorf("re-encoded %x, want %x", got.Serialize(), tt.block.Serialize())
+			}
+			if got.R != tt.block.R || got.S != tt.block.S || !reflect.DeepEqual(got.Signer, tt.block.Signer) {
+				t.Errorf("signature %s %s %x, want %s %s %x", got.R, got.S, got.Signer, tt.block.R, tt.block.S, tt.block.Signer)
+			}
+		})
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	tx := vectorPayment().Serialize()
+	block := vectorBlock().Serialize()
+	future := append([]byte{}, tx...)
+	copy(future[len(txMagic)+1:], []byte{0, 0, 0, byte(TxVersion + 1)})
+
+	tests := []struct {
+		name   string
+		decode func([]byte) error
+		data   []byte
+		want   error
+	}{
+		{"transaction trailing bytes", decodeTx, append(append([]byte{}, tx...), 0), ErrBadEncoding},
+		{"transaction truncated", decodeTx, tx[:len(tx)-1], ErrBadEncoding},
+		{"transaction encoding version", decodeTx, append(append(append([]byte{}, txMagic...), EncodingVersion+1), tx[len(txMagic)+1:]...), ErrBadVersion},
+		{"transaction version", decodeTx, future, ErrBadVersion},
+		{"transaction garbage", decodeTx, []byte("not a transaction"), ErrBadEncoding},
+		{"block trailing bytes", decodeBlock, append(append([]byte{}, block...), 0), ErrBadEncoding},
+		{"block truncated", decodeBlock, block[:len(block)-1], ErrBadEncoding},
+		{"block garbage", decodeBlock, []byte("not a block"), ErrBadEncoding},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.decode(tt.data); !errors.Is(err, tt.want) {
+				t.Errorf("error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func decodeTx(data []byte) error {
+	_, err := DecodeTransaction(data)
+	return err
+}
+
+func decodeBlock(data []byte) error {
+	_, err := DecodeBlock(data)
+	return err
+}
+
+// TestEncodingDoc keeps the vectors in ENCODING.md in step with the ones
+// tested here.
+func TestEncodingDoc(t *testing.T) {
+	doc, err := os.ReadFile(filepath.Join("..", "ENCODING.md"))
+	if err != nil {
+		t.Skip(err)
+	}
+	flat := strings.Join(strings.Fields(string(doc)), "")
+	for _, v := range []string{vectorCoinbaseBody, vectorCoinbaseID, vectorPaymentBody, vectorPaymentID, vectorHeader, vectorHeaderHash} {
+		if !strings.Contains(flat, v) {
+			t.Errorf("ENCODING.md lacks %s", v)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	ErrBadSeal   = errors.New("invalid block seal")
+	ErrBadSealer = errors.New("block sealed by the wrong key")
+)
+
+// Consensus decides who may produce blocks and which branch is best. A
+// block is built by NewBlock, which lets the engine Prepare the header
+// against the chain state the block builds on, and then sealed with Seal.
+// Peers check it with VerifyHeader, which needs only the block and its
+// parent, and VerifySealer, which runs against the chain state the block
+// builds on. Between branches the one with the most Work wins.
+type Consensus interface {
+	// Name identifies the engine, e.g. in the API.
+	Name() string
+	// Prepare fills in the header fields the engine controls for a child
+	// of parent, against the state of parent.
+	Prepare(tx *bbolt.Tx, block *Block, parent *ParentState) error
+	// Seal makes a prepared block valid, setting its Hash.
+	Seal(block *Block) error
+	// VerifyHeader checks the seal and the header fields the engine
+	// controls.
+	VerifyHeader(block *Block, parent *ParentState) error
+	// VerifySealer checks that the block was sealed by someone allowed to,
+	// against the state of its parent. It is not called for genesis.
+	VerifySealer(tx *bbolt.Tx, block *Block) error
+	// Work is what the block adds to the work of its branch.
+	Work(block *Block) *big.Int
+}
+
+// PowEngine is proof of work: the block hash must meet the target in
+// Bits, which follows the difficulty retargeting of the chain.
+type PowEngine struct{}
+
+func (PowEngine) Name() string { return "pow" }
+
+func (PowEngine) Prepare(tx *bbolt.Tx, block *Block, parent *ParentState) error {
+	block.Bits = parent.Bits
+	return nil
+}
+
+func (PowEngine) Seal(block *Block) error {
+	block.Hash, block.Nonce = NewProofOfWork(block).Run()
+	return nil
+}
+
+func (PowEngine) VerifyHeader(block *Block, parent *ParentState) error {
+	if block.Bits != parent.Bits {
+		return fmt.Errorf("%w: %08x, expected %08x", ErrBadDifficulty, block.Bits, parent.Bits)
+	}
+	if len(block.Signer) > 0 || len(block.Proof) > 0 || block.R != "" || block.S != "" {
+		return fmt.Errorf("%w: proof-of-work block carries a signature", ErrBadSeal)
+	}
+	if !NewProofOfWork(block).Validate() {
+		return fmt.Errorf("%w: %x", ErrBadProofOfWork, block.Hash)
+	}
+	return nil
+}
+
+func (PowEngine) VerifySealer(tx *bbolt.Tx, block *Block) error { return nil }
+
+func (PowEngine) Work(block *Block) *big.Int { return CalcWork(block.Bits) }
+
+// sealSigned seals a block prepared for key by signing its hash, for
+// engines where blocks are signed rather than mined.
+func sealSigned(block *Block, key *Wallet) {
+	block.Hash = block.HeaderHash()
+	block.R, block.S = key.Sign(block.Hash)
+}
+
+// checkSigned checks the header of a signed block: the difficulty is the
+// parent's and unused, the block has at least version and is signed by
+// its Signer. The nonce holds the rank of the sealer, 0 for the one whose
+// turn it is, and is checked by the engine.
+func checkSigned(block *Block, parent *ParentState, version uint32) error {
+	if block.Bits != parent.Bits {
+		return fmt.Errorf("%w: %08x, expected %08x", ErrBadDifficulty, block.Bits, parent.Bits)
+	}
+	if block.Version < version || len(block.Signer) == 0 {
+		return fmt.Errorf("%w: block is not signed", ErrBadSeal)
+	}
+	if block.Nonce < 0 {
+		return fmt.Errorf("%w: negative sealer rank %d", ErrBadSeal, block.Nonce)
+	}
+	if !VerifySignature(block.Signer, block.Hash, block.R, block.S) {
+		return fmt.Errorf("%w: signature does not match the sealer", ErrBadSeal)
+	}
+	return nil
+}
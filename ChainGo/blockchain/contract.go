@@ -0,0 +1,386 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// MaxContractSize is the largest contract code, in bytes.
+	MaxContractSize = 24576
+	// MaxContractArgs bounds the arguments of a deploy or call.
+	MaxContractArgs = 16
+	// MaxTxGas is the highest gas limit a single transaction may set.
+	MaxTxGas = 1000000
+	// GasPerCoin is how much gas one coin of fee buys.
+	GasPerCoin = 1000
+)
+
+var (
+	contractCodeBucket    = []byte("chaingo_contract_code")
+	contractStorageBucket = []byte("chaingo_contract_storage")
+	receiptBucket         = []byte("chaingo_receipts")
+)
+
+var (
+	ErrBadContractCall = errors.New("invalid contract transaction")
+	ErrNoContract      = errors.New("contract not found")
+	ErrBlockGas        = errors.New("block exceeds gas limit")
+)
+
+// ContractCall turns a transaction into a contract deploy, when Code is
+// set, or a call of the contract at Address. Args are passed to the
+// contract. The sender pays for GasLimit gas up front in the fee, at
+// GasPerCoin gas per coin, whether the contract uses it or not.
+type ContractCall struct {
+	Code     []byte   `json:"code,omitempty"`
+	Address  string   `json:"address,omitempty"`
+	Args     [][]byte `json:"args,omitempty"`
+	GasLimit int      `json:"gasLimit"`
+}
+
+// Contract is a deployed contract.
+type Contract struct {
+	Address string `json:"address"`
+	Creator string `json:"creator"`
+	Height  int    `json:"height"`
+	Code    []byte `json:"code"`
+}
+
+// Receipt records what a contract transaction did. A failed run still
+// pays its fee and uses its nonce, but its storage changes are dropped and
+// a failed deploy creates no contract.
+type Receipt struct {
+	TxHash   string   `json:"txHash"`
+	Contract string   `json:"contract"`
+	Deploy   bool     `json:"deploy"`
+	Height   int      `json:"height"`
+	Success  bool     `json:"success"`
+	GasUsed  int      `json:"gasUsed"`
+	GasLimit int      `json:"gasLimit"`
+	Return   []byte   `json:"return,omitempty"`
+	Logs     [][]byte `json:"logs,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// GasFee returns the fee needed to buy gasLimit gas, rounded up.
+func GasFee(gasLimit int) int {
+	return (gasLimit + GasPerCoin - 1) / GasPerCoin
+}
+
+// ContractAddress returns the address of the contract deployed by creator
+// in its transaction with nonce.
+func ContractAddress(creator string, nonce uint64) string {
+	var buf bytes.Buffer
+	buf.WriteString("contract")
+	buf.WriteString(creator)
+	binary.Write(&buf, binary.BigEndian, nonce)
+	hash := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(hash[:])
+}
+
+// NewContractTransaction builds an unsigned contract transaction from the
+// spendable outputs of from. It pays nothing but fee, which must cover the
+// gas limit, and returns the change to from.
+func NewContractTransaction(chainID uint32, from string, call *ContractCall, fee int, nonce uint64, spendable []UTXO) (*Transaction, error) {
+	tx := &Transaction{
+		Version:  TxVersion,
+		From:     from,
+		To:       call.Address,
+		Fee:      fee,
+		Nonce:    nonce,
+		ChainID:  chainID,
+		Contract: call,
+	}
+	if len(call.Code) > 0 {
+		tx.To = ContractAddress(from, nonce)
+	}
+	if err := tx.CheckContract(); err != nil {
+		return nil, err
+	}
+	if err := tx.fundFee(spendable); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// fundFee adds inputs from spendable to a transaction that pays nothing
+// but its fee, returning the change to the sender.
+func (tx *Transaction) fundFee(spendable []UTXO) error {
+	return tx.fund(tx.Fee, spendable)
+}
+
+// fund adds inputs from spendable until they cover need, paying the rest
+// back to From.
+func (tx *Transaction) fund(need int, spendable []UTXO) error {
+	collected := 0
+	for _, u := range spendable {
+		if collected >= need {
+			break
+		}
+		tx.Inputs = append(tx.Inputs, TxInput{TxID: u.TxID, Vout: u.Vout})
+		collected += u.Output.Amount
+	}
+	if collected < need {
+		return fmt.Errorf("%w: %s has %d, needs %d", ErrInsufficientFunds, tx.From, collected, need)
+	}
+	if collected > need {
+		tx.Outputs = []TxOutput{{Amount: collected - need, Address: tx.From}}
+	}
+	return nil
+}
+
+// CheckContract checks the shape of a contract transaction: exactly one of
+// code and address, well-formed code, bounded arguments and a fee that
+// buys the gas limit. Contracts hold no coins, so nothing is paid to them.
+func (tx *Transaction) CheckContract() error {
+	c := tx.Contract
+	if c == nil {
+		return nil
+	}
+	if tx.IsCoinbase() {
+		return fmt.Errorf("%w: coinbase carries a contract call", ErrBadContractCall)
+	}
+	if (len(c.Code) > 0) == (c.Address != "") {
+		return fmt.Errorf("%w: set either code to deploy or the address to call", ErrBadContractCall)
+	}
+	if len(c.Code) > 0 {
+		if _, err := AnalyzeContract(c.Code); err != nil {
+			return err
+		}
+	}
+	if len(c.Args) > MaxContractArgs {
+		return fmt.Errorf("%w: %d arguments, limit %d", ErrBadContractCall, len(c.Args), MaxContractArgs)
+	}
+	for i, arg := range c.Args {
+		if len(arg) > MaxContractItem {
+			return fmt.Errorf("%w: argument %d has %d bytes, limit %d", ErrBadContractCall, i, len(arg), MaxContractItem)
+		}
+	}
+	if c.GasLimit <= 0 || c.GasLimit > MaxTxGas {
+		return fmt.Errorf("%w: gas limit %d, must be 1 to %d", ErrBadContractCall, c.GasLimit, MaxTxGas)
+	}
+	if need := GasFee(c.GasLimit); tx.Fee < need {
+		return fmt.Errorf("%w: fee %d does not buy %d gas, needs %d", ErrBadContractCall, tx.Fee, c.GasLimit, need)
+	}
+	if tx.Amount != 0 {
+		return fmt.Errorf("%w: contracts can't receive coins, amount is %d", ErrBadContractCall, tx.Amount)
+	}
+	return nil
+}
+
+// GasLimit returns the gas t may use, 0 if it calls no contract.
+func (tx *Transaction) GasLimit() int {
+	if tx.Contract == nil {
+		return 0
+	}
+	return tx.Contract.GasLimit
+}
+
+// checkContractTarget requires a called contract to exist. It runs with the
+// other checks of connectTx, before anything is written.
+func checkContractTarget(tx *bbolt.Tx, t *Transaction) error {
+	if t.Contract == nil || t.Contract.Address == "" {
+		return nil
+	}
+	if _, err := getContract(tx, t.Contract.Address); err != nil {
+		return err
+	}
+	return nil
+}
+
+// applyContract runs the contract transaction t at height and, if the run
+// succeeds, commits its storage writes and, for a deploy, the contract.
+// The receipt is stored either way. An error means the state could not be
+// written; a failing contract is not an error.
+func applyContract(tx *bbolt.Tx, t *Transaction, height int) error {
+	c := t.Contract
+	txHash := t.Hash()
+	receipt := &Receipt{
+		TxHash:   hex.EncodeToString(txHash),
+		Contract: c.Address,
+		Deploy:   len(c.Code) > 0,
+		Height:   height,
+		GasLimit: c.GasLimit,
+	}
+	code := c.Code
+	if receipt.Deploy {
+		receipt.Contract = ContractAddress(t.From, t.Nonce)
+	} else {
+		contract, err := getContract(tx, c.Address)
+		if err != nil {
+			return err
+		}
+		code = contract.Code
+	}
+
+	ctx := ContractContext{
+		Caller:  t.From,
+		Address: receipt.Contract,
+		Height:  height,
+		Args:    c.Args,
+		Init:    receipt.Deploy,
+	}
+	result, err := ExecuteContract(code, ctx, c.GasLimit, func(key []byte) []byte {
+		return getContractStorage(tx, receipt.Contract, key)
+	})
+	receipt.GasUsed = result.GasUsed
+	receipt.Return = result.Return
+	receipt.Logs = result.Logs
+
+	var undo []stateChange
+	if err != nil {
+		receipt.Error = err.Error()
+	} else {
+		receipt.Success = true
+		if receipt.Deploy {
+			contract := &Contract{Address: receipt.Contract, Creator: t.From, Height: height, Code: c.Code}
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(contract); err != nil {
+				return err
+			}
+			change, err := putState(tx, contractCodeBucket, []byte(receipt.Contract), buf.Bytes())
+			if err != nil {
+				return err
+			}
+			undo = append(undo, change)
+		}
+		for _, w := range result.Writes {
+			change, err := putState(tx, contractStorageBucket, storageKey(receipt.Contract, w.Key), w.Value)
+			if err != nil {
+				return err
+			}
+			undo = append(undo, change)
+		}
+	}
+
+	if err := saveUndo(tx, txHash, undo); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(receipt); err != nil {
+		return err
+	}
+	return putBucket(tx, receiptBucket, txHash, buf.Bytes())
+}
+
+// disconnectContract removes the receipt of t. Its state changes are
+// undone with the rest of the transaction's; see undoTx.
+func disconnectContract(tx *bbolt.Tx, t *Transaction) error {
+	if b := tx.Bucket(receiptBucket); b != nil {
+		return b.Delete(t.Hash())
+	}
+	return nil
+}
+
+// storageKey places the keys of one contract together, behind its
+// fixed-length address.
+func storageKey(address string, key []byte) []byte {
+	return append([]byte(address), key...)
+}
+
+func getContractStorage(tx *bbolt.Tx, address string, key []byte) []byte {
+	b := tx.Bucket(contractStorageBucket)
+	if b == nil {
+		return nil
+	}
+	if v := b.Get(storageKey(address, key)); v != nil {
+		return append([]byte{}, v...)
+	}
+	return nil
+}
+
+func getContract(tx *bbolt.Tx, address string) (*Contract, error) {
+	b := tx.Bucket(contractCodeBucket)
+	if b == nil || b.Get([]byte(address)) == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoContract, address)
+	}
+	var contract Contract
+	if err := gob.NewDecoder(bytes.NewReader(b.Get([]byte(address)))).Decode(&contract); err != nil {
+		return nil, err
+	}
+	return &contract, nil
+}
+
+// Contract returns the contract deployed at address.
+func (bc *Blockchain) Contract(address string) (*Contract, error) {
+	var contract *Contract
+	err := bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		var err error
+		contract, err = getContract(tx, address)
+		return err
+	})
+	return contract, err
+}
+
+// ContractStorage returns the storage of the contract at address, keyed by
+// the hex encoding of each key.
+func (bc *Blockchain) ContractStorage(address string) (map[string][]byte, error) {
+	storage := make(map[string][]byte)
+	err := bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		if _, err := getContract(tx, address); err != nil {
+			return err
+		}
+		b := tx.Bucket(contractStorageBucket)
+		if b == nil {
+			return nil
+		}
+		prefix := []byte(address)
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			storage[hex.EncodeToString(k[len(prefix):])] = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return storage, err
+}
+
+// Receipt returns the receipt of a confirmed contract transaction.
+func (bc *Blockchain) Receipt(txHash []byte) (*Receipt, error) {
+	var receipt *Receipt
+	err := bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(receiptBucket)
+		if b == nil || b.Get(txHash) == nil {
+			return fmt.Errorf("no receipt for transaction %x", txHash)
+		}
+		receipt = &Receipt{}
+		return gob.NewDecoder(bytes.NewReader(b.Get(txHash))).Decode(receipt)
+	})
+	return receipt, err
+}
+
+// ReadContract runs the contract at address against the state at the tip
+// without a transaction, for reading its state. Nothing is written and no
+// gas is paid, but the run is still limited to gasLimit, at most MaxTxGas.
+func (bc *Blockchain) ReadContract(address, caller string, args [][]byte, gasLimit int) (*Receipt, error) {
+	receipt := &Receipt{Contract: address, Height: bc.Height(), GasLimit: min(gasLimit, MaxTxGas)}
+	err := bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		contract, err := getContract(tx, address)
+		if err != nil {
+			return err
+		}
+		ctx := ContractContext{Caller: caller, Address: address, Height: receipt.Height, Args: args}
+		result, runErr := ExecuteContract(contract.Code, ctx, receipt.GasLimit, func(key []byte) []byte {
+			return getContractStorage(tx, address, key)
+		})
+		receipt.Success = runErr == nil
+		receipt.GasUsed = result.GasUsed
+		receipt.Return = result.Return
+		receipt.Logs = result.Logs
+		if runErr != nil {
+			receipt.Error = runErr.Error()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
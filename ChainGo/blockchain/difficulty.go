@@ -0,0 +1,122 @@
+package blockchain
+
+import (
+	"math/big"
+)
+
+// maxRetargetFactor bounds how much the target may move in one retarget.
+const maxRetargetFactor = 4
+
+var oneLsh256 = new(big.Int).Lsh(big.NewInt(1), 256)
+
+// CompactToBig expands a compact target (the Bits field of a block) into the
+// full 256-bit target. The encoding is the one Bitcoin uses: the high byte
+// is a base-256 exponent and the low three bytes are the mantissa.
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	negative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	var bn *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		bn = big.NewInt(int64(mantissa))
+	} else {
+		bn = big.NewInt(int64(mantissa))
+		bn.Lsh(bn, 8*(exponent-3))
+	}
+
+	if negative {
+		bn = bn.Neg(bn)
+	}
+	return bn
+}
+
+// BigToCompact packs a target into its compact form. Precision below the
+// top three bytes of the target is lost.
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() == 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(n.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(n.Bits()[0])
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tn := new(big.Int).Set(n)
+		mantissa = uint32(tn.Rsh(tn, 8*(exponent-3)).Bits()[0])
+	}
+
+	// The sign bit would make the mantissa negative; move a byte into the
+	// exponent instead.
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	compact := uint32(exponent<<24) | mantissa
+	if n.Sign() < 0 {
+		compact |= 0x00800000
+	}
+	return compact
+}
+
+// CalcWork returns the expected number of hashes needed to find a block with
+// the given compact target: 2^256 / (target + 1).
+func CalcWork(bits uint32) *big.Int {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	return new(big.Int).Div(oneLsh256, denominator)
+}
+
+// Difficulty expresses a compact target as a multiple of the easiest
+// allowed target.
+func (p *ChainParams) Difficulty(bits uint32) float64 {
+	target := new(big.Float).SetInt(CompactToBig(bits))
+	limit := new(big.Float).SetInt(p.PowLimit)
+	d, _ := new(big.Float).Quo(limit, target).Float64()
+	return d
+}
+
+// RetargetBits scales the previous target by how long the last retarget
+// window actually took compared with how long it should have taken. The
+// change is clamped to a factor of maxRetargetFactor either way and never
+// goes easier than the proof-of-work limit.
+func (p *ChainParams) RetargetBits(prevBits uint32, actualTimespan int64) uint32 {
+	expected := p.TargetBlockTime * int64(p.RetargetInterval)
+	if actualTimespan < expected/maxRetargetFactor {
+		actualTimespan = expected / maxRetargetFactor
+	}
+	if actualTimespan > expected*maxRetargetFactor {
+		actualTimespan = expected * maxRetargetFactor
+	}
+
+	target := CompactToBig(prevBits)
+	target.Mul(target, big.NewInt(actualTimespan))
+	target.Div(target, big.NewInt(expected))
+	if target.Cmp(p.PowLimit) > 0 {
+		target.Set(p.PowLimit)
+	}
+	return BigToCompact(target)
+}
+
+// NextBits returns the compact target the block at height must use, given
+// a function that returns the blocks before it. The target only changes on
+// the first block of each retarget window, and never if NoRetarget is set.
+func (p *ChainParams) NextBits(height int, blockAt func(int) *Block) uint32 {
+	if height == 0 || p.NoRetarget {
+		return p.GenesisBits()
+	}
+	prev := blockAt(height - 1)
+	if height%p.RetargetInterval != 0 {
+		return prev.Bits
+	}
+
+	first := blockAt(height - p.RetargetInterval)
+	return p.RetargetBits(prev.Bits, prev.Timestamp-first.Timestamp)
+}
@@ -0,0 +1,165 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// templateReserve is the room BlockTemplate leaves for the block header
+	// and the coinbase.
+	templateReserve = 2000
+	// FeeEstimateBlocks is how many recent blocks fee estimates look at.
+	FeeEstimateBlocks = 20
+)
+
+var ErrBlockTooLarge = errors.New("block exceeds maximum size")
+
+// FeeRate returns the fee of t in coins per 1000 bytes.
+func FeeRate(t *Transaction) float64 {
+	return float64(t.Fee) * 1000 / float64(t.Size())
+}
+
+// FeeFor returns the fee a transaction of size bytes needs to pay to reach
+// rate, rounded up.
+func FeeFor(rate float64, size int) int {
+	return int(math.Ceil(rate * float64(size) / 1000))
+}
+
+// BlockTemplate picks the transactions for the next block from candidates,
+// highest fee rate first, until the block size or gas limit is reached. The
+// transactions of one sender stay in nonce order, so a sender's next
+// transaction competes on its own fee rate. It returns the chosen
+// transactions, the fees they pay and errors for candidates that no longer
+// apply. Candidates left out for lack of space are neither chosen nor
+// rejected. The chain state is not modified.
+func (bc *Blockchain) BlockTemplate(candidates []*Transaction) ([]*Transaction, int, []error) {
+	queues := make(map[string][]*Transaction)
+	var senders []string
+	for _, t := range candidates {
+		if _, ok := queues[t.From]; !ok {
+			senders = append(senders, t.From)
+		}
+		queues[t.From] = append(queues[t.From], t)
+	}
+	for _, q := range queues {
+		sort.SliceStable(q, func(i, j int) bool { return q[i].Nonce < q[j].Nonce })
+	}
+
+	var selected []*Transaction
+	var rejected []error
+	fees := 0
+	space := bc.Params.MaxBlockSize - templateReserve
+	gas := bc.Params.MaxBlockGas
+	height, mtp := bc.finalityContext()
+
+	bc.DB.DB.Update(func(tx *bbolt.Tx) error {
+		for {
+			// The sender whose next transaction pays the best rate goes
+			// first; ties go to the sender seen first.
+			best := ""
+			for _, from := range senders {
+				q := queues[from]
+				if len(q) > 0 && (best == "" || FeeRate(q[0]) > FeeRate(queues[best][0])) {
+					best = from
+				}
+			}
+			if best == "" {
+				break
+			}
+
+			t := queues[best][0]
+			if size := t.Size(); size > space || t.GasLimit() > gas {
+				// Later nonces cannot go in without this one.
+				delete(queues, best)
+				continue
+			}
+			if err := t.CheckFinal(height, mtp); err != nil {
+				rejected = append(rejected, fmt.Errorf("tx %x: %w", t.Hash(), err))
+				delete(queues, best)
+				continue
+			}
+			if _, err := connectTx(tx, t, height, bc.Params); err != nil {
+				rejected = append(rejected, err)
+				delete(queues, best)
+				continue
+			}
+			selected = append(selected, t)
+			fees += t.Fee
+			space -= t.Size()
+			gas -= t.GasLimit()
+			queues[best] = queues[best][1:]
+		}
+		return errRollback
+	})
+	return selected, fees, rejected
+}
+
+// FeeEstimate suggests fee rates, in coins per 1000 bytes, for getting a
+// transaction into the next block (High), within a few blocks (Medium) or
+// eventually (Low).
+type FeeEstimate struct {
+	Low          float64 `json:"low"`
+	Medium       float64 `json:"medium"`
+	High         float64 `json:"high"`
+	NextBlockMin float64 `json:"nextBlockMin"` // Lowest rate that fits in the next block after the pending pool
+	Blocks       int     `json:"blocks"`       // Recent blocks sampled
+	Samples      int     `json:"samples"`      // Transactions sampled from them
+	Pending      int     `json:"pending"`
+	PendingBytes int     `json:"pendingBytes"`
+	TypicalSize  int     `json:"typicalSize"` // Median size of the sampled transactions
+}
+
+// EstimateFees derives fee rates from the transactions of the last
+// FeeEstimateBlocks blocks and from the competition in the pending pool.
+func (bc *Blockchain) EstimateFees(pending []*Transaction) (*FeeEstimate, error) {
+	est := &FeeEstimate{Pending: len(pending)}
+
+	var rates []float64
+	var sizes []int
+	for h := bc.Height(); h > 0 && est.Blocks < FeeEstimateBlocks; h-- {
+		block, err := bc.BlockAtHeight(h)
+		if err != nil {
+			return nil, err
+		}
+		est.Blocks++
+		for _, t := range block.Transactions[1:] {
+			rates = append(rates, FeeRate(t))
+			sizes = append(sizes, t.Size())
+		}
+	}
+	est.Samples = len(rates)
+	if len(rates) > 0 {
+		sort.Float64s(rates)
+		sort.Ints(sizes)
+		est.Low = percentile(rates, 0.25)
+		est.Medium = percentile(rates, 0.50)
+		est.High = percentile(rates, 0.90)
+		est.TypicalSize = sizes[len(sizes)/2]
+	}
+
+	// If the pending pool holds more than a block, a new transaction has
+	// to outbid the last one that would still fit.
+	sorted := append([]*Transaction{}, pending...)
+	sort.SliceStable(sorted, func(i, j int) bool { return FeeRate(sorted[i]) > FeeRate(sorted[j]) })
+	space := bc.Params.MaxBlockSize - templateReserve
+	for _, t := range sorted {
+		est.PendingBytes += t.Size()
+		if est.PendingBytes > space && est.NextBlockMin == 0 {
+			est.NextBlockMin = FeeRate(t)
+		}
+	}
+
+	est.High = math.Max(est.High, est.NextBlockMin)
+	est.Medium = math.Max(est.Medium, est.Low)
+	return est, nil
+}
+
+// percentile returns the value at fraction q of sorted values.
+func percentile(sorted []float64, q float64) float64 {
+	return sorted[int(math.Round(q*float64(len(sorted)-1)))]
+}
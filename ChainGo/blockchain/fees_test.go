@@ -0,0 +1,163 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestFeeFor(t *testing.T) {
+	tests := []struct {
+		rate float64
+		size int
+		want int
+	}{
+		{0, 250, 0},
+		{1, 1000, 1},
+		{1, 1001, 2},
+		{4, 250, 1},
+		{4, 251, 2},
+		{2.5, 400, 1},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%g per 1000 for %d bytes", tt.rate, tt.size), func(t *testing.T) {
+			if got := FeeFor(tt.rate, tt.size); got != tt.want {
+				t.Errorf("fee %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlockTemplate(t *testing.T) {
+	alice, bob, carol := NewWallet(), NewWallet(), NewWallet()
+	// A candidate pays fee from output utxo of its sender with nonce.
+	type candidate struct {
+		from  *Wallet
+		nonce uint64
+		utxo  int
+		fee   int
+	}
+	tests := []struct {
+		name       string
+		size       func(size int) int // The block size limit, given the largest candidate
+		candidates []candidate
+		selected   []int
+		rejected   int
+	}{
+		{
+			name:       "highest rate first",
+			candidates: []candidate{{alice, 0, 0, 1}, {bob, 0, 0, 3}, {carol, 0, 0, 2}},
+			selected:   []int{1, 2, 0},
+		},
+		{
+			name:       "nonces stay in order",
+			candidates: []candidate{{alice, 1, 1, 9}, {alice, 0, 0, 1}, {bob, 0, 0, 3}},
+			selected:   []int{2, 1, 0},
+		},
+		{
+			name:       "full block",
+			size:       func(size int) int { return templateReserve + 2*size + size/2 },
+			candidates: []candidate{{alice, 0, 0, 1}, {bob, 0, 0, 3}, {carol, 0, 0, 2}},
+			selected:   []int{1, 2},
+		},
+		{
+			name:       "too large to fit holds back later nonces",
+			size:       func(size int) int { return templateReserve + 2*size + size/2 },
+			candidates: []candidate{{alice, 0, 0, 1}, {alice, 1, 1, 9}, {bob, 0, 0, 3}, {carol, 0, 0, 2}},
+			selected:   []int{2, 3},
+		},
+		{
+			name:       "double spend rejected",
+			candidates: []candidate{{alice, 0, 0, 2}, {alice, 0, 0, 1}, {bob, 0, 0, 3}},
+			selected:   []int{2, 0},
+			rejected:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := newTestChain(t, regtestParams(t))
+			for _, w := range []*Wallet{alice, bob, carol} {
+				fundTestWallet(t, bc, w)
+				fundTestWallet(t, bc, w)
+			}
+			var txs []*Transaction
+			largest := 0
+			for _, c := range tt.candidates {
+				utxo := spendable(t, bc, c.from.Address())[c.utxo]
+				tx, err := NewUTXOTransaction(bc.Params.ChainID, c.from.Address(), "shop", 1, c.fee, c.nonce, []UTXO{utxo})
+				if err != nil {
+					t.Fatal(err)
+				}
+				tx.Sign(c.from)
+				txs = append(txs, tx)
+				largest = max(largest, tx.Size())
+			}
+			if tt.size != nil {
+				bc.Params.MaxBlockSize = tt.size(largest)
+			}
+
+			selected, fees, rejected := bc.BlockTemplate(txs)
+			var want []*Transaction
+			wantFees := 0
+			for _, i := range tt.selected {
+				want = append(want, txs[i])
+				wantFees += txs[i].Fee
+			}
+			if !reflect.DeepEqual(selected, want) {
+				t.Errorf("selected %v, want %v", selected, want)
+			}
+			if fees != wantFees {
+				t.Errorf("fees %d, want %d", fees, wantFees)
+			}
+			if len(rejected) != tt.rejected {
+				t.Errorf("rejected %v, want %d", rejected, tt.rejected)
+			}
+		})
+	}
+}
+
+// TestFeeRules mines a payment from alice, changed by edit and signed
+// again, with a coinbase claiming extra on top of the subsidy and fee.
+func TestFeeRules(t *testing.T) {
+	alice := NewWallet()
+	tests := []struct {
+		name  string
+		edit  func(tx *Transaction)
+		extra int
+		want  error
+	}{
+		{"as built", func(tx *Transaction) {}, 0, nil},
+		{"coinbase claims less", func(tx *Transaction) {}, -1, nil},
+		{"coinbase claims more than the fee", func(tx *Transaction) {}, 1, ErrBadCoinbase},
+		{"fee understated", func(tx *Transaction) { tx.Fee-- }, 0, ErrFeeMismatch},
+		{"fee overstated", func(tx *Transaction) { tx.Fee++ }, 0, ErrOverdraw},
+		{"negative fee", func(tx *Transaction) { tx.Fee = -1; tx.Outputs[1].Amount += 6 }, 0, ErrInvalidAmount},
+		{"no fee", func(tx *Transaction) { tx.Fee = 0; tx.Outputs[1].Amount += 5 }, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := newTestChain(t, regtestParams(t))
+			fundTestWallet(t, bc, alice)
+			tx, err := signTestTx(t, bc, alice, func(nonce uint64, utxos []UTXO) (*Transaction, error) {
+				tx, err := NewUTXOTransaction(bc.Params.ChainID, alice.Address(), "shop", 10, 5, nonce, utxos)
+				if err == nil {
+					tt.edit(tx)
+				}
+				return tx, err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			height := bc.Height() + 1
+			coinbase := NewCoinbaseTx(bc.Params.ChainID, "miner", bc.Params.Subsidy(height)+max(tx.Fee, 0)+tt.extra, height)
+			_, err = bc.AddBlock([]*Transaction{coinbase, tx})
+			if tt.want == nil && err != nil {
+				t.Fatalf("error %v, want none", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
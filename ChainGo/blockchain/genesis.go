@@ -0,0 +1,218 @@
+package blockchain
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GenesisSpec describes the genesis block. Everything that goes into the
+// block comes from the spec, so every node loading the same spec mines the
+// same genesis hash.
+type GenesisSpec struct {
+	Version   uint32         `json:"version,omitempty"` // Block and coinbase version; 0 keeps the gob-era hash
+	Timestamp int64          `json:"timestamp"`
+	Bits      string         `json:"bits"`      // Compact target as 8 hex digits
+	ExtraData string         `json:"extraData"` // Carried in the coinbase input
+	Alloc     map[string]int `json:"alloc"`     // Initial balance per address
+
+	// Consensus names the engine of the chain, "pow" (the default), "poa"
+	// or "pos". Validators is the initial validator set under "poa" and
+	// Stakes the initial bonded stakes under "pos". Except under "pow",
+	// the engine, the sorted validator set and the stakes in address order
+	// follow ExtraData in the coinbase input, so chains that differ in them
+	// have different genesis blocks.
+	Consensus  string         `json:"consensus,omitempty"`
+	Validators []string       `json:"validators,omitempty"`
+	Stakes     map[string]int `json:"stakes,omitempty"`
+}
+
+// DefaultGenesis is the mainnet genesis, used when no genesis spec file is
+// given. It predates the canonical encoding and stays at version 0 so its
+// hash does not change.
+var DefaultGenesis = &GenesisSpec{
+	Timestamp: 1733600000,
+	Bits:      "1f010000",
+	ExtraData: "ChainGo genesis block",
+}
+
+// TestnetGenesis is the genesis of the test network.
+var TestnetGenesis = &GenesisSpec{
+	Version:   1,
+	Timestamp: 1790000000,
+	Bits:      "1f0fffff",
+	ExtraData: "ChainGo testnet genesis block",
+}
+
+// RegtestGenesis is the genesis of local test networks.
+var RegtestGenesis = &GenesisSpec{
+	Version:   1,
+	Timestamp: 1790000000,
+	Bits:      "207fffff",
+	ExtraData: "ChainGo regtest genesis block",
+}
+
+// DevGenesis is the genesis of development chains. It funds DevAccount.
+var DevGenesis = &GenesisSpec{
+	Version:   1,
+	Timestamp: 1790000000,
+	Bits:      "207fffff",
+	ExtraData: "ChainGo dev genesis block",
+	Alloc:     map[string]int{DevAccount: 1000000},
+}
+
+// DevAccountKey is the private key of the dev account, which DevGenesis
+// funds and dev nodes pay the rewards of the blocks they seal to unless
+// told otherwise. The key is public, so the account is only safe to use
+// on dev chains.
+const DevAccountKey = "8de94ea0f0e5603732aba1595a2ca9d6cc9fcdf8e8cfb77c0e644479f556286b"
+
+// DevAccount is the address of DevAccountKey.
+var DevAccount = devAccount()
+
+func devAccount() string {
+	w, err := WalletFromPrivateKey(DevAccountKey)
+	if err != nil {
+		panic(err)
+	}
+	return w.Address()
+}
+
+// LoadGenesisSpec reads a genesis spec from a JSON file.
+func LoadGenesisSpec(path string) (*GenesisSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var spec GenesisSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("parse genesis spec %s: %w", path, err)
+	}
+	return &spec, nil
+}
+
+// CompactBits parses the spec's difficulty.
+func (s *GenesisSpec) CompactBits() (uint32, error) {
+	bits, err := strconv.ParseUint(s.Bits, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("genesis bits %q: %w", s.Bits, err)
+	}
+	return uint32(bits), nil
+}
+
+// Engine returns the consensus engine the spec names.
+func (s *GenesisSpec) Engine() (Consensus, error) {
+	if len(s.Validators) > 0 && s.Consensus != "poa" {
+		return nil, fmt.Errorf("validators given for a chain without proof of authority")
+	}
+	if len(s.Stakes) > 0 && s.Consensus != "pos" {
+		return nil, fmt.Errorf("stakes given for a chain without proof of stake")
+	}
+	switch s.Consensus {
+	case "", "pow":
+		return PowEngine{}, nil
+	case "poa":
+		if len(s.Validators) == 0 {
+			return nil, fmt.Errorf("proof of authority needs at least one validator")
+		}
+		return &PoaEngine{Validators: s.Validators}, nil
+	case "pos":
+		if len(s.Stakes) == 0 {
+			return nil, fmt.Errorf("proof of stake needs at least one stake")
+		}
+		for addr, amount := range s.Stakes {
+			if amount <= 0 {
+				return nil, fmt.Errorf("%w: stake of %d for %s", ErrInvalidAmount, amount, addr)
+			}
+		}
+		return &PosEngine{Stakes: s.Stakes}, nil
+	default:
+		return nil, fmt.Errorf("unknown consensus %q", s.Consensus)
+	}
+}
+
+// consensusData describes the engine the spec names, for the genesis
+// coinbase: nothing under proof of work, so the built-in genesis blocks
+// keep their hashes, and otherwise one line per setting.
+func (s *GenesisSpec) consensusData() []byte {
+	if s.Consensus == "" || s.Consensus == "pow" {
+		return nil
+	}
+	data := "\nconsensus " + s.Consensus
+	if len(s.Validators) > 0 {
+		data += "\nvalidators " + strings.Join(uniqueSorted(s.Validators), ",")
+	}
+	if len(s.Stakes) > 0 {
+		addresses := make([]string, 0, len(s.Stakes))
+		for addr := range s.Stakes {
+			addresses = append(addresses, addr)
+		}
+		sort.Strings(addresses)
+		stakes := make([]string, len(addresses))
+		for i, addr := range addresses {
+			stakes[i] = addr + ":" + strconv.Itoa(s.Stakes[addr])
+		}
+		data += "\nstakes " + strings.Join(stakes, ",")
+	}
+	return []byte(data)
+}
+
+func uniqueSorted(list []string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, v := range list {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Block builds and mines the genesis block of the chain chainID.
+// Allocations become coinbase outputs in address order, so map ordering
+// does not affect the hash.
+func (s *GenesisSpec) Block(chainID uint32) (*Block, error) {
+	bits, err := s.CompactBits()
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := make([]string, 0, len(s.Alloc))
+	for addr := range s.Alloc {
+		addresses = append(addresses, addr)
+	}
+	sort.Strings(addresses)
+
+	coinbase := NewCoinbaseTx(chainID, "Genesis", 0, 0)
+	coinbase.Version = s.Version
+	coinbase.Inputs[0].Data = append([]byte(s.ExtraData), s.consensusData()...)
+	coinbase.Outputs = nil
+	for _, addr := range addresses {
+		amount := s.Alloc[addr]
+		if amount <= 0 {
+			return nil, fmt.Errorf("%w: allocation of %d to %s", ErrInvalidAmount, amount, addr)
+		}
+		coinbase.Amount += amount
+		coinbase.Outputs = append(coinbase.Outputs, TxOutput{Amount: amount, Address: addr})
+	}
+	if err := coinbase.CheckAmounts(); err != nil {
+		return nil, err
+	}
+
+	block := &Block{
+		Version:      s.Version,
+		Height:       0,
+		Timestamp:    s.Timestamp,
+		Transactions: []*Transaction{coinbase},
+		PrevHash:     []byte{},
+		Bits:         bits,
+	}
+	block.MerkleRoot = block.ComputeMerkleRoot()
+	block.Hash, block.Nonce = NewProofOfWork(block).Run()
+	return block, nil
+}
@@ -0,0 +1,324 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
+
+// scriptVM runs scripts for one input of a transaction.
+type scriptVM struct {
+	tx      *Transaction
+	sigHash []byte // What CHECKSIG verifies against: the transaction hash
+	stack   [][]byte
+	ops     int
+}
+
+// VerifyScript runs the unlocking script of an input of tx followed by the
+// locking script of the output it spends. The input may be spent if
+// both run to the end and leave a true value on top of the stack. The
+// unlocking script may only push data, so it can't change the meaning of
+// the locking script.
+func VerifyScript(unlock, lock Script, tx *Transaction) error {
+	if !unlock.IsPushOnly() {
+		return fmt.Errorf("%w: unlocking script must only push data", ErrBadScript)
+	}
+	vm := &scriptVM{tx: tx, sigHash: tx.Hash()}
+	if err := vm.run(unlock); err != nil {
+		return err
+	}
+	if err := vm.run(lock); err != nil {
+		return err
+	}
+	if len(vm.stack) == 0 || !scriptBool(vm.stack[len(vm.stack)-1]) {
+		return fmt.Errorf("%w: ends without a true value", ErrScriptFailed)
+	}
+	return nil
+}
+
+func (vm *scriptVM) run(s Script) error {
+	ops, err := s.parse()
+	if err != nil {
+		return err
+	}
+
+	// exec holds one entry per open OP_IF: whether its current branch runs.
+	var exec []bool
+	running := func() bool {
+		for _, e := range exec {
+			if !e {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, op := range ops {
+		if !op.isPush() {
+			vm.ops++
+			if vm.ops > MaxScriptOps {
+				return fmt.Errorf("%w: more than %d operations", ErrScriptLimit, MaxScriptOps)
+			}
+		}
+		if len(op.data) > MaxScriptElementSize {
+			return fmt.Errorf("%w: push of %d bytes", ErrScriptLimit, len(op.data))
+		}
+
+		switch op.code {
+		case OP_IF, OP_NOTIF:
+			branch := false
+			if running() {
+				top, err := vm.pop()
+				if err != nil {
+					return err
+				}
+				branch = scriptBool(top) == (op.code == OP_IF)
+			}
+			exec = append(exec, branch)
+			continue
+		case OP_ELSE:
+			if len(exec) == 0 {
+				return fmt.Errorf("%w: OP_ELSE without OP_IF", ErrBadScript)
+			}
+			exec[len(exec)-1] = !exec[len(exec)-1]
+			continue
+		case OP_ENDIF:
+			if len(exec) == 0 {
+				return fmt.Errorf("%w: OP_ENDIF without OP_IF", ErrBadScript)
+			}
+			exec = exec[:len(exec)-1]
+			continue
+		}
+		if !running() {
+			continue
+		}
+		if err := vm.step(op); err != nil {
+			return err
+		}
+		if len(vm.stack) > MaxScriptStackSize {
+			return fmt.Errorf("%w: stack holds more than %d items", ErrScriptLimit, MaxScriptStackSize)
+		}
+	}
+	if len(exec) > 0 {
+		return fmt.Errorf("%w: OP_IF without OP_ENDIF", ErrBadScript)
+	}
+	return nil
+}
+
+func (vm *scriptVM) step(op scriptOp) error {
+	switch {
+	case op.code == OP_0:
+		vm.push(nil)
+		return nil
+	case op.code == OP_1NEGATE:
+		vm.push(encodeScriptNum(-1))
+		return nil
+	case op.code >= OP_1 && op.code <= OP_16:
+		vm.push(encodeScriptNum(int64(op.code-OP_1) + 1))
+		return nil
+	case op.isPush():
+		vm.push(op.data)
+		return nil
+	}
+
+	switch op.code {
+	case OP_VERIFY:
+		return vm.verify("OP_VERIFY")
+	case OP_RETURN:
+		return fmt.Errorf("%w: OP_RETURN", ErrScriptFailed)
+	case OP_DROP:
+		_, err := vm.pop()
+		return err
+	case OP_DUP:
+		top, err := vm.peek()
+		if err != nil {
+			return err
+		}
+		vm.push(top)
+	case OP_SWAP:
+		a, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		b, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		vm.push(a)
+		vm.push(b)
+	case OP_SIZE:
+		top, err := vm.peek()
+		if err != nil {
+			return err
+		}
+		vm.push(encodeScriptNum(int64(len(top))))
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		b, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		vm.pushBool(bytes.Equal(a, b))
+		if op.code == OP_EQUALVERIFY {
+			return vm.verify("OP_EQUALVERIFY")
+		}
+	case OP_SHA256:
+		top, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(top)
+		vm.push(hash[:])
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		pubKey, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		sig, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		vm.pushBool(vm.checkSig(pubKey, sig))
+		if op.code == OP_CHECKSIGVERIFY {
+			return vm.verify("OP_CHECKSIGVERIFY")
+		}
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		ok, err := vm.checkMultisig()
+		if err != nil {
+			return err
+		}
+		vm.pushBool(ok)
+		if op.code == OP_CHECKMULTISIGVERIFY {
+			return vm.verify("OP_CHECKMULTISIGVERIFY")
+		}
+	case OP_CHECKLOCKTIMEVERIFY:
+		return vm.checkLockTime()
+	default:
+		return fmt.Errorf("%w: unknown opcode 0x%02x", ErrBadScript, op.code)
+	}
+	return nil
+}
+
+func (vm *scriptVM) push(data []byte) {
+	vm.stack = append(vm.stack, data)
+}
+
+func (vm *scriptVM) pushBool(b bool) {
+	if b {
+		vm.push([]byte{1})
+	} else {
+		vm.push(nil)
+	}
+}
+
+func (vm *scriptVM) pop() ([]byte, error) {
+	top, err := vm.peek()
+	if err != nil {
+		return nil, err
+	}
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return top, nil
+}
+
+func (vm *scriptVM) peek() ([]byte, error) {
+	if len(vm.stack) == 0 {
+		return nil, fmt.Errorf("%w: stack empty", ErrScriptFailed)
+	}
+	return vm.stack[len(vm.stack)-1], nil
+}
+
+func (vm *scriptVM) popInt() (int64, error) {
+	top, err := vm.pop()
+	if err != nil {
+		return 0, err
+	}
+	return decodeScriptNum(top)
+}
+
+// verify pops the top value and fails unless it is true.
+func (vm *scriptVM) verify(name string) error {
+	top, err := vm.pop()
+	if err != nil {
+		return err
+	}
+	if !scriptBool(top) {
+		return fmt.Errorf("%w: %s", ErrScriptFailed, name)
+	}
+	return nil
+}
+
+func (vm *scriptVM) checkSig(pubKey, sig []byte) bool {
+	r, s, ok := splitSignature(sig)
+	return ok && VerifySignature(pubKey, vm.sigHash, r, s)
+}
+
+// checkMultisig pops n, n keys, m and m signatures and reports whether the
+// signatures match m of the keys, in the order the keys are given.
+func (vm *scriptVM) checkMultisig() (bool, error) {
+	n, err := vm.popInt()
+	if err != nil {
+		return false, err
+	}
+	if n < 1 || n > MaxMultisigKeys {
+		return false, fmt.Errorf("%w: %d multisig keys", ErrScriptFailed, n)
+	}
+	keys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		if keys[i], err = vm.pop(); err != nil {
+			return false, err
+		}
+	}
+	m, err := vm.popInt()
+	if err != nil {
+		return false, err
+	}
+	if m < 1 || m > n {
+		return false, fmt.Errorf("%w: %d-of-%d multisig", ErrScriptFailed, m, n)
+	}
+	sigs := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		if sigs[i], err = vm.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	k := 0
+	for _, sig := range sigs {
+		for k < len(keys) && !vm.checkSig(keys[k], sig) {
+			k++
+		}
+		if k == len(keys) {
+			return false, nil
+		}
+		k++
+	}
+	return true, nil
+}
+
+// checkLockTime fails unless the transaction's lock time has reached the
+// number on top of the stack, which stays there. Because CheckFinal keeps
+// the transaction out of blocks until its lock time, this makes the output
+// unspendable until that height or time.
+func (vm *scriptVM) checkLockTime() error {
+	top, err := vm.peek()
+	if err != nil {
+		return err
+	}
+	lock, err := decodeScriptNum(top)
+	if err != nil {
+		return err
+	}
+	if lock < 0 {
+		return fmt.Errorf("%w: negative lock time", ErrScriptFailed)
+	}
+	if (lock < LockTimeThreshold) != (vm.tx.LockTime < LockTimeThreshold) {
+		return fmt.Errorf("%w: lock time %d and transaction lock time %d are of different kinds", ErrScriptFailed, lock, vm.tx.LockTime)
+	}
+	if vm.tx.LockTime < lock {
+		return fmt.Errorf("%w: transaction lock time %d is before %d", ErrScriptFailed, vm.tx.LockTime, lock)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func mustScript(t *testing.T, asm string) Script {
+	t.Helper()
+	s, err := ParseScript(asm)
+	if err != nil {
+		t.Fatalf("parse %q: %v", asm, err)
+	}
+	return s
+}
+
+// scriptSig signs tx with w for use in a script, as hex assembly.
+func scriptSig(t *testing.T, w *Wallet, tx *Transaction) string {
+	t.Helper()
+	sig, err := SignatureBytes(w.Sign(tx.Hash()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "0x" + hex.EncodeToString(sig)
+}
+
+func TestVerifyScript(t *testing.T) {
+	tx := &Transaction{Version: TxVersion, From: "a", To: "b", Amount: 1, LockTime: 100}
+	w1, w2, w3 := NewWallet(), NewWallet(), NewWallet()
+	pk := func(w *Wallet) string { return "0x" + hex.EncodeToString(w.PublicKey) }
+	sig1, sig2, sig3 := scriptSig(t, w1, tx), scriptSig(t, w2, tx), scriptSig(t, w3, tx)
+	secret := sha256.Sum256([]byte("secret"))
+	multisig := fmt.Sprintf("2 %s %s %s 3 OP_CHECKMULTISIG", pk(w1), pk(w2), pk(w3))
+
+	tests := []struct {
+		name   string
+		unlock string
+		lock   string
+		want   error
+	}{
+		{"true", "", "1", nil},
+		{"false", "", "0", ErrScriptFailed},
+		{"empty stack", "", "", ErrScriptFailed},
+		{"equal", "0x0102", "0x0102 OP_EQUAL", nil},
+		{"not equal", "0x0102", "0x0103 OP_EQUAL", ErrScriptFailed},
+		{"hash lock", "0x" + hex.EncodeToString([]byte("secret")), "OP_SHA256 0x" + hex.EncodeToString(secret[:]) + " OP_EQUAL", nil},
+		{"hash lock wrong preimage", "0x00", "OP_SHA256 0x" + hex.EncodeToString(secret[:]) + " OP_EQUAL", ErrScriptFailed},
+		{"checksig", sig1, pk(w1) + " OP_CHECKSIG", nil},
+		{"checksig other key", sig2, pk(w1) + " OP_CHECKSIG", ErrScriptFailed},
+		{"checksigverify", sig1, pk(w1) + " OP_CHECKSIGVERIFY 1", nil},
+		{"checksigverify fails", sig2, pk(w1) + " OP_CHECKSIGVERIFY 1", ErrScriptFailed},
+		{"multisig", sig1 + " " + sig3, multisig, nil},
+		{"multisig out of order", sig3 + " " + sig1, multisig, ErrScriptFailed},
+		{"multisig same signature twice", sig2 + " " + sig2, multisig, ErrScriptFailed},
+		{"multisig too few", sig1, multisig, ErrScriptFailed},
+		{"if", "1", "OP_IF 2 OP_ELSE 0 OP_ENDIF", nil},
+		{"else", "0", "OP_IF 2 OP_ELSE 0 OP_ENDIF", ErrScriptFailed},
+		{"notif", "0", "OP_NOTIF 2 OP_ELSE 0 OP_ENDIF", nil},
+		{"if without endif", "1", "OP_IF 1", ErrBadScript},
+		{"endif without if", "", "1 OP_ENDIF", ErrBadScript},
+		{"return", "", "1 OP_RETURN", ErrScriptFailed},
+		{"verify", "1", "OP_VERIFY 1", nil},
+		{"drop from empty stack", "", "OP_DROP 1", ErrScriptFailed},
+		{"size", "0x010203", "OP_SIZE 3 OP_EQUALVERIFY", nil},
+		{"unlock not push only", "1 OP_DUP", "OP_EQUAL", ErrBadScript},
+		{"lock time reached", "", "100 OP_CLTV OP_DROP 1", nil},
+		{"lock time not reached", "", "101 OP_CLTV OP_DROP 1", ErrScriptFailed},
+		{"lock time of other kind", "", "500000001 OP_CLTV OP_DROP 1", ErrScriptFailed},
+		{"negative lock time", "", "-1 OP_CLTV OP_DROP 1", ErrScriptFailed},
+		{"too many operations", "1", strings.Repeat("OP_DUP OP_DROP ", MaxScriptOps/2+1), ErrScriptLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyScript(mustScript(t, tt.unlock), mustScript(t, tt.lock), tx)
+			if tt.want == nil && err != nil {
+				t.Fatalf("error %v, want none", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestScriptNum(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, ""},
+		{1, "01"},
+		{-1, "81"},
+		{127, "7f"},
+		{128, "8000"},
+		{-128, "8080"},
+		{255, "ff00"},
+		{256, "0001"},
+		{-256, "0081"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.n), func(t *testing.T) {
+			got := encodeScriptNum(tt.n)
+			if hex.EncodeToString(got) != tt.want {
+				t.Errorf("encode %d = %x, want %s", tt.n, got, tt.want)
+			}
+			back, err := decodeScriptNum(got)
+			if err != nil || back != tt.n {
+				t.Errorf("decode %x = %d, %v, want %d", got, back, err, tt.n)
+			}
+		})
+	}
+}
+
+func TestParseScriptRoundTrip(t *testing.T) {
+	for _, asm := range []string{
+		"OP_DUP OP_SHA256 0x0102 OP_EQUALVERIFY OP_CHECKSIG",
+		"0 -1 1 16 17 1000",
+		"OP_IF 1 OP_ELSE 0 OP_ENDIF",
+		"0x" + strings.Repeat("ab", 100),
+	} {
+		s := mustScript(t, asm)
+		if again := mustScript(t, s.String()); string(again) != string(s) {
+			t.Errorf("%q: %q assembles to %x, want %x", asm, s.String(), again, s)
+		}
+	}
+	for _, asm := range []string{"OP_NOPE", "0xzz", "word"} {
+		if _, err := ParseScript(asm); !errors.Is(err, ErrBadScript) {
+			t.Errorf("%q: error %v, want %v", asm, err, ErrBadScript)
+		}
+	}
+}
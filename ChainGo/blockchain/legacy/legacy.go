@@ -0,0 +1,94 @@
+// Package legacy freezes the gob layout that version 0 transactions are
+// hashed over. gob writes a description of each type, field names
+// included, ahead of the values, so these types must match the layout of
+// blockchain.Transaction before versioning exactly and must never change.
+// The package is named blockchain, not legacy, because gob also writes the
+// package name into the names of slice types; import it as legacy.
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+type Script []byte
+
+type TxInput struct {
+	TxID   []byte
+	Vout   int
+	Data   []byte
+	Unlock Script
+}
+
+type TxOutput struct {
+	Amount        int
+	Address       string
+	ReleaseHeight int
+	Script        Script
+}
+
+type Signature struct {
+	PublicKey []byte
+	R         string
+	S         string
+}
+
+type MultisigPolicy struct {
+	Threshold  int
+	PublicKeys [][]byte
+}
+
+type ContractCall struct {
+	Code     []byte
+	Address  string
+	Args     [][]byte
+	GasLimit int
+}
+
+type TokenOp struct {
+	Kind     string
+	Symbol   string
+	Name     string
+	Amount   int
+	To       string
+	Mintable bool
+}
+
+type NameOp struct {
+	Kind string
+	Name string
+	To   string
+}
+
+type Transaction struct {
+	From      string
+	To        string
+	Amount    int
+	Fee       int
+	Inputs    []TxInput
+	Outputs   []TxOutput
+	Nonce     uint64
+	ChainID   uint32
+	LockTime  int64
+	R         string
+	S         string
+	PublicKey []byte
+	Cosigners []Signature
+
+	Multisig   *MultisigPolicy
+	Signatures []Signature
+
+	Contract *ContractCall
+	Token    *TokenOp
+	Name     *NameOp
+	Memo     []byte
+}
+
+// Encode returns the gob encoding of tx.
+func Encode(tx *Transaction) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(tx); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,53 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+)
+
+// LockTimeThreshold separates the two meanings of Transaction.LockTime:
+// values below it are block heights, values at or above it are Unix
+// timestamps.
+const LockTimeThreshold = 500000000
+
+var (
+	ErrNonFinal     = errors.New("transaction is time-locked")
+	ErrLockedOutput = errors.New("output is time-locked")
+)
+
+// CheckFinal reports whether t may be included in the block at height,
+// whose parent has median time past medianTime. A lock time is the earliest
+// height, or the earliest median time past, at which t is valid. Time locks
+// are compared with the median time past rather than the block timestamp,
+// which the miner chooses.
+func (t *Transaction) CheckFinal(height int, medianTime int64) error {
+	switch {
+	case t.LockTime == 0:
+		return nil
+	case t.LockTime < LockTimeThreshold:
+		if int64(height) < t.LockTime {
+			return fmt.Errorf("%w: until height %d, block is at %d", ErrNonFinal, t.LockTime, height)
+		}
+	case medianTime < t.LockTime:
+		return fmt.Errorf("%w: until time %d, median time past is %d", ErrNonFinal, t.LockTime, medianTime)
+	}
+	return nil
+}
+
+// IsReleased reports whether out may be spent by a transaction in the block
+// at height. Outputs without a release height are always spendable.
+func IsReleased(out TxOutput, height int) bool {
+	return height >= out.ReleaseHeight
+}
+
+// finalityContext returns the height and median time past that lock times
+// are checked against for the next block.
+func (bc *Blockchain) finalityContext() (int, int64) {
+	height := bc.Height()
+	mtp, err := MedianTimePast(height, bc.blockAt)
+	if err != nil {
+		// Without a median time no time lock can be shown to have expired.
+		return height + 1, 0
+	}
+	return height + 1, mtp
+}
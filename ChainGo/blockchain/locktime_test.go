@@ -0,0 +1,125 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCheckFinal(t *testing.T) {
+	const mtp = LockTimeThreshold + 1000
+	tests := []struct {
+		name     string
+		lockTime int64
+		height   int
+		want     error
+	}{
+		{"no lock", 0, 1, nil},
+		{"height reached", 10, 10, nil},
+		{"height passed", 10, 11, nil},
+		{"height ahead", 10, 9, ErrNonFinal},
+		{"last height value", LockTimeThreshold - 1, 100, ErrNonFinal},
+		{"time passed", mtp - 1, 1, nil},
+		{"time reached", mtp, 1, nil},
+		{"time ahead", mtp + 1, 1 << 30, ErrNonFinal},
+		{"first time value", LockTimeThreshold, 1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := &Transaction{LockTime: tt.lockTime}
+			err := tx.CheckFinal(tt.height, mtp)
+			if tt.want == nil && err != nil {
+				t.Fatalf("error %v, want none", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsReleased(t *testing.T) {
+	tests := []struct {
+		release, height int
+		want            bool
+	}{
+		{0, 0, true},
+		{0, 5, true},
+		{5, 4, false},
+		{5, 5, true},
+		{5, 6, true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("release %d at %d", tt.release, tt.height), func(t *testing.T) {
+			if got := IsReleased(TxOutput{Amount: 1, ReleaseHeight: tt.release}, tt.height); got != tt.want {
+				t.Errorf("released %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestLocksOnChain mines transactions with lock times and spends of vault
+// outputs, each after waiting a number of blocks.
+func TestLocksOnChain(t *testing.T) {
+	alice, bob := NewWallet(), NewWallet()
+	tests := []struct {
+		name string
+		// lock returns the lock time, or the release height of a vault
+		// output to bob if vault, given the height of the next block.
+		lock  func(next int) int64
+		vault bool
+		wait  int // Blocks mined before the transaction, or before bob spends
+		want  error
+	}{
+		{"height lock ahead", func(next int) int64 { return int64(next + 2) }, false, 1, ErrNonFinal},
+		{"height lock reached", func(next int) int64 { return int64(next + 2) }, false, 2, nil},
+		{"time lock ahead", func(int) int64 { return 1 << 40 }, false, 0, ErrNonFinal},
+		{"time lock passed", func(int) int64 { return LockTimeThreshold }, false, 0, nil},
+		{"vault before release", func(next int) int64 { return int64(next + 3) }, true, 1, ErrLockedOutput},
+		{"vault at release", func(next int) int64 { return int64(next + 3) }, true, 2, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := newTestChain(t, regtestParams(t))
+			fundTestWallet(t, bc, alice)
+			lock := tt.lock(bc.Height() + 1)
+			tx, err := signTestTx(t, bc, alice, func(nonce uint64, utxos []UTXO) (*Transaction, error) {
+				payment := TxOutput{Amount: 10, Address: bob.Address()}
+				if tt.vault {
+					payment.ReleaseHeight = int(lock)
+				}
+				tx, err := NewBatchTransaction(bc.Params.ChainID, alice.Address(), []TxOutput{payment}, 1, nonce, utxos)
+				if err == nil && !tt.vault {
+					tx.LockTime = lock
+				}
+				return tx, err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.vault {
+				mineTestBlock(t, bc, "miner", tx)
+				tx, err = signTestTx(t, bc, bob, func(nonce uint64, utxos []UTXO) (*Transaction, error) {
+					// The output is not spendable yet, so it is passed in
+					// directly.
+					vault := UTXO{OutPoint: OutPoint{TxID: tx.Hash(), Vout: 0}, Output: tx.Outputs[0]}
+					return NewUTXOTransaction(bc.Params.ChainID, bob.Address(), alice.Address(), 5, 1, nonce, []UTXO{vault})
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < tt.wait; i++ {
+				mineTestBlock(t, bc, "miner")
+			}
+			height := bc.Height() + 1
+			_, err = bc.AddBlock([]*Transaction{NewCoinbaseTx(bc.Params.ChainID, "miner", bc.Params.Subsidy(height)+tx.Fee, height), tx})
+			if tt.want == nil && err != nil {
+				t.Fatalf("error %v, want none", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+
+	"go.etcd.io/bbolt"
+)
+
+// MaxMemoSize is the largest memo a transaction may carry, in bytes.
+const MaxMemoSize = 256
+
+// memoIndexBucket maps the SHA-256 of each confirmed memo, followed by the
+// hash of the transaction carrying it, to nothing. Hashing the memo gives
+// keys of one length, so the transactions carrying a memo share a prefix.
+var memoIndexBucket = []byte("chaingo_memo_index")
+
+var (
+	ErrBadMemo = errors.New("invalid memo")
+	ErrNoMemo  = errors.New("memo not found")
+)
+
+// NewMemoTransaction builds an unsigned transaction that records memo on
+// chain, e.g. to anchor a document digest, paying nothing but fee.
+func NewMemoTransaction(chainID uint32, from string, memo []byte, fee int, nonce uint64, spendable []UTXO) (*Transaction, error) {
+	if fee < 0 {
+		return nil, fmt.Errorf("%w: fee %d is negative", ErrInvalidAmount, fee)
+	}
+	tx := &Transaction{
+		Version: TxVersion,
+		From:    from,
+		Fee:     fee,
+		Nonce:   nonce,
+		ChainID: chainID,
+		Memo:    memo,
+	}
+	if len(memo) == 0 {
+		return nil, fmt.Errorf("%w: memo is empty", ErrBadMemo)
+	}
+	if err := tx.CheckMemo(); err != nil {
+		return nil, err
+	}
+	if err := tx.fundFee(spendable); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// CheckMemo bounds the memo of a transaction. A coinbase carries its data
+// in its input instead.
+func (tx *Transaction) CheckMemo() error {
+	if len(tx.Memo) > MaxMemoSize {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrBadMemo, len(tx.Memo), MaxMemoSize)
+	}
+	if tx.IsCoinbase() && len(tx.Memo) > 0 {
+		return fmt.Errorf("%w: coinbase carries a memo", ErrBadMemo)
+	}
+	return nil
+}
+
+func memoIndexKey(memo, txHash []byte) []byte {
+	key := sha256.Sum256(memo)
+	return append(key[:], txHash...)
+}
+
+// indexMemo adds t to the memo index if it carries a memo.
+func indexMemo(tx *bbolt.Tx, t *Transaction) error {
+	if len(t.Memo) == 0 {
+		return nil
+	}
+	return putBucket(tx, memoIndexBucket, memoIndexKey(t.Memo, t.Hash()), []byte{})
+}
+
+// unindexMemo reverses indexMemo.
+func unindexMemo(tx *bbolt.Tx, t *Transaction) error {
+	b := tx.Bucket(memoIndexBucket)
+	if len(t.Memo) == 0 || b == nil {
+		return nil
+	}
+	return b.Delete(memoIndexKey(t.Memo, t.Hash()))
+}
+
+// MemoAnchor is a confirmed transaction carrying a memo and its block.
+type MemoAnchor struct {
+	Tx    *Transaction
+	Block *Block
+}
+
+// FindMemo returns the confirmed transactions carrying memo, earliest block
+// first.
+func (bc *Blockchain) FindMemo(memo []byte) ([]MemoAnchor, error) {
+	var hashes [][]byte
+	bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(memoIndexBucket)
+		if b == nil {
+			return nil
+		}
+		prefix := sha256.Sum256(memo)
+		c := b.Cursor()
+		for k, _ := c.Seek(prefix[:]); k != nil && bytes.HasPrefix(k, prefix[:]); k, _ = c.Next() {
+			hashes = append(hashes, append([]byte{}, k[len(prefix):]...))
+		}
+		return nil
+	})
+	if len(hashes) == 0 {
+		return nil, fmt.Errorf("%w: no transaction carries %x", ErrNoMemo, memo)
+	}
+
+	anchors := make([]MemoAnchor, 0, len(hashes))
+	for _, hash := range hashes {
+		t, block, err := bc.FindTransaction(hash)
+		if err != nil {
+			return nil, err
+		}
+		anchors = append(anchors, MemoAnchor{Tx: t, Block: block})
+	}
+	sort.SliceStable(anchors, func(i, j int) bool { return anchors[i].Block.Height < anchors[j].Block.Height })
+	return anchors, nil
+}
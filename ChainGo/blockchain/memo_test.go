@@ -0,0 +1,146 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// TestMemoSize builds and mines memo transactions of each size. A memo the
+// builder refuses is forced into a signed transaction to check that blocks
+// refuse it too.
+func TestMemoSize(t *testing.T) {
+	alice := NewWallet()
+	tests := []struct {
+		name     string
+		size     int
+		payment  bool // Carried by a payment rather than on its own
+		coinbase bool // Carried by the coinbase
+		want     error
+	}{
+		{"one byte", 1, false, false, nil},
+		{"limit", MaxMemoSize, false, false, nil},
+		{"over the limit", MaxMemoSize + 1, false, false, ErrBadMemo},
+		{"far over the limit", 4 * MaxMemoSize, false, false, ErrBadMemo},
+		{"empty", 0, false, false, ErrBadMemo},
+		{"on a payment", MaxMemoSize, true, false, nil},
+		{"on a payment over the limit", MaxMemoSize + 1, true, false, ErrBadMemo},
+		{"on the coinbase", 1, false, true, ErrBadMemo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := newTestChain(t, regtestParams(t))
+			fundTestWallet(t, bc, alice)
+			memo := bytes.Repeat([]byte{'m'}, tt.size)
+
+			height := bc.Height() + 1
+			coinbase := NewCoinbaseTx(bc.Params.ChainID, "miner", bc.Params.Subsidy(height), height)
+			if tt.coinbase {
+				coinbase.Memo = memo
+				_, err := bc.AddBlock([]*Transaction{coinbase})
+				if !errors.Is(err, tt.want) {
+					t.Fatalf("error %v, want %v", err, tt.want)
+				}
+				return
+			}
+
+			tx, err := signTestTx(t, bc, alice, func(nonce uint64, utxos []UTXO) (*Transaction, error) {
+				if tt.payment {
+					tx, err := NewUTXOTransaction(bc.Params.ChainID, alice.Address(), "shop", 1, 1, nonce, utxos)
+					if err == nil {
+						tx.Memo = memo
+						err = tx.CheckMemo()
+					}
+					return tx, err
+				}
+				return NewMemoTransaction(bc.Params.ChainID, alice.Address(), memo, 1, nonce, utxos)
+			})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("building: error %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				if tt.size == 0 {
+					return
+				}
+				// Sign the memo in anyway.
+				if tx, err = signTestTx(t, bc, alice, func(nonce uint64, utxos []UTXO) (*Transaction, error) {
+					tx, err := NewMemoTransaction(bc.Params.ChainID, alice.Address(), []byte{'m'}, 1, nonce, utxos)
+					if err == nil {
+						tx.Memo = memo
+					}
+					return tx, err
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			coinbase.Outputs[0].Amount += tx.Fee
+			coinbase.Amount = coinbase.Outputs[0].Amount
+			_, err = bc.AddBlock([]*Transaction{coinbase, tx})
+			if tt.want == nil && err != nil {
+				t.Fatalf("error %v, want none", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindMemo(t *testing.T) {
+	alice := NewWallet()
+	bc := newTestChain(t, regtestParams(t))
+	fundTestWallet(t, bc, alice)
+	digest := []byte("sha256:0123456789abcdef")
+
+	var sent []*Transaction
+	for i := 0; i < 2; i++ {
+		tx, err := signTestTx(t, bc, alice, func(nonce uint64, utxos []UTXO) (*Transaction, error) {
+			return NewMemoTransaction(bc.Params.ChainID, alice.Address(), digest, 1, nonce, utxos)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mineTestBlock(t, bc, "miner", tx)
+		sent = append(sent, tx)
+	}
+
+	tests := []struct {
+		name     string
+		truncate bool // Disconnect the last block first
+		memo     []byte
+		want     []*Transaction
+		err      error
+	}{
+		{"both, earliest first", false, digest, sent, nil},
+		{"unknown memo", false, []byte("sha256:other"), nil, ErrNoMemo},
+		{"prefix of the memo", false, digest[:10], nil, ErrNoMemo},
+		{"after a disconnect", true, digest, sent[:1], nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.truncate {
+				if err := bc.Truncate(bc.Height()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			anchors, err := bc.FindMemo(tt.memo)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(anchors) != len(tt.want) {
+				t.Fatalf("found %d transactions, want %d", len(anchors), len(tt.want))
+			}
+			for i, a := range anchors {
+				if !bytes.Equal(a.Tx.Hash(), tt.want[i].Hash()) {
+					t.Errorf("anchor %d is %x, want %x", i, a.Tx.Hash(), tt.want[i].Hash())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
+
+// MerkleStep is one level of a Merkle branch: the sibling hash and which
+// side of the running hash it sits on.
+type MerkleStep struct {
+	Hash []byte `json:"hash"`
+	Left bool   `json:"left"`
+}
+
+func hashPair(left, right []byte) []byte {
+	h := sha256.Sum256(append(append([]byte{}, left...), right...))
+	return h[:]
+}
+
+// nextLevel pairs up the hashes of one tree level. An odd hash out is paired
+// with itself.
+func nextLevel(level [][]byte) [][]byte {
+	var next [][]byte
+	for i := 0; i < len(level); i += 2 {
+		right := level[i]
+		if i+1 < len(level) {
+			right = level[i+1]
+		}
+		next = append(next, hashPair(level[i], right))
+	}
+	return next
+}
+
+// MerkleRoot builds a binary Merkle tree over the given leaf hashes and
+// returns its root. A single leaf is its own root.
+func MerkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	}
+	level := leaves
+	for len(level) > 1 {
+		level = nextLevel(level)
+	}
+	return level[0]
+}
+
+// MerkleBranch returns the sibling hashes needed to recompute the root from
+// the leaf at index.
+func MerkleBranch(leaves [][]byte, index int) ([]MerkleStep, error) {
+	if index < 0 || index >= len(leaves) {
+		return nil, fmt.Errorf("leaf index %d out of range", index)
+	}
+
+	var branch []MerkleStep
+	level := leaves
+	for len(level) > 1 {
+		if index%2 == 0 {
+			sibling := level[index]
+			if index+1 < len(level) {
+				sibling = level[index+1]
+			}
+			branch = append(branch, MerkleStep{Hash: sibling, Left: false})
+		} else {
+			branch = append(branch, MerkleStep{Hash: level[index-1], Left: true})
+		}
+		level = nextLevel(level)
+		index /= 2
+	}
+	return branch, nil
+}
+
+// VerifyMerkleProof reports whether leaf, combined with branch, hashes up to
+// root. It needs nothing but the block header's Merkle root.
+func VerifyMerkleProof(leaf []byte, branch []MerkleStep, root []byte) bool {
+	hash := leaf
+	for _, step := range branch {
+		if step.Left {
+			hash = hashPair(step.Hash, hash)
+		} else {
+			hash = hashPair(hash, step.Hash)
+		}
+	}
+	return bytes.Equal(hash, root)
+}
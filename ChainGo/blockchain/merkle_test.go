@@ -0,0 +1,93 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func testLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		h := sha256.Sum256([]byte{byte(i)})
+		leaves[i] = h[:]
+	}
+	return leaves
+}
+
+func TestMerkleRoot(t *testing.T) {
+	l := testLeaves(3)
+	empty := sha256.Sum256(nil)
+	tests := []struct {
+		name   string
+		leaves [][]byte
+		want   []byte
+	}{
+		{"empty", nil, empty[:]},
+		{"one leaf", l[:1], l[0]},
+		{"two leaves", l[:2], hashPair(l[0], l[1])},
+		{"odd leaf paired with itself", l, hashPair(hashPair(l[0], l[1]), hashPair(l[2], l[2]))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MerkleRoot(tt.leaves); !bytes.Equal(got, tt.want) {
+				t.Errorf("root %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMerkleProofs(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 4, 5, 7, 8, 9, 16} {
+		leaves := testLeaves(n)
+		root := MerkleRoot(leaves)
+		for i := range leaves {
+			branch, err := MerkleBranch(leaves, i)
+			if err != nil {
+				t.Fatalf("%d leaves, index %d: %v", n, i, err)
+			}
+			if !VerifyMerkleProof(leaves[i], branch, root) {
+				t.Errorf("%d leaves, index %d: proof does not verify", n, i)
+			}
+		}
+	}
+}
+
+func TestMerkleProofRejects(t *testing.T) {
+	leaves := testLeaves(5)
+	root := MerkleRoot(leaves)
+	branch, err := MerkleBranch(leaves, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flipped := append([]MerkleStep{}, branch...)
+	flipped[0].Left = !flipped[0].Left
+	tampered := append([]MerkleStep{}, branch...)
+	tampered[1] = MerkleStep{Hash: leaves[0], Left: tampered[1].Left}
+
+	tests := []struct {
+		name   string
+		leaf   []byte
+		branch []MerkleStep
+		root   []byte
+	}{
+		{"other leaf", leaves[3], branch, root},
+		{"side flipped", leaves[2], flipped, root},
+		{"sibling replaced", leaves[2], tampered, root},
+		{"step dropped", leaves[2], branch[1:], root},
+		{"other root", leaves[2], branch, MerkleRoot(leaves[:4])},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if VerifyMerkleProof(tt.leaf, tt.branch, tt.root) {
+				t.Error("proof verifies")
+			}
+		})
+	}
+
+	for _, index := range []int{-1, len(leaves)} {
+		if _, err := MerkleBranch(leaves, index); err == nil {
+			t.Errorf("branch for index %d of %d leaves", index, len(leaves))
+		}
+	}
+}
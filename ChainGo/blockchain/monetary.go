@@ -0,0 +1,97 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"go.etcd.io/bbolt"
+)
+
+var supplyKey = []byte("supply")
+
+var ErrImmatureCoinbase = errors.New("coinbase output not yet mature")
+
+// scheduledSubsidy is the subsidy of the halving schedule alone, before the
+// supply cap is applied.
+func (p *ChainParams) scheduledSubsidy(height int) int {
+	if height == 0 {
+		return 0
+	}
+	halvings := height / p.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return p.InitialSubsidy >> uint(halvings)
+}
+
+// ScheduledSupply returns the most coins that can exist once the block at
+// height is connected: the genesis allocations plus every subsidy up to
+// height, capped at MaxSupply.
+func (p *ChainParams) ScheduledSupply(height int) int {
+	supply := 0
+	if genesis, err := p.GenesisBlock(); err == nil {
+		supply = genesis.Transactions[0].OutputTotal()
+	}
+
+	// Sum era by era rather than block by block.
+	for era := 0; ; era++ {
+		first := era * p.HalvingInterval
+		if first == 0 {
+			first = 1
+		}
+		last := (era+1)*p.HalvingInterval - 1
+		if last > height {
+			last = height
+		}
+		subsidy := p.scheduledSubsidy(first)
+		if first > height || subsidy == 0 {
+			break
+		}
+		supply += (last - first + 1) * subsidy
+		if supply >= p.MaxSupply {
+			return p.MaxSupply
+		}
+	}
+	return supply
+}
+
+// Subsidy returns the amount the coinbase of the block at height may mint
+// on top of the fees it collects. It halves every HalvingInterval blocks
+// and drops to zero once MaxSupply is reached.
+func (p *ChainParams) Subsidy(height int) int {
+	if height == 0 {
+		return 0
+	}
+	return p.ScheduledSupply(height) - p.ScheduledSupply(height-1)
+}
+
+// NextHalving returns the first height after height at which the subsidy
+// is halved.
+func (p *ChainParams) NextHalving(height int) int {
+	return (height/p.HalvingInterval + 1) * p.HalvingInterval
+}
+
+// IsMature reports whether u may be spent by a transaction in the block at
+// height. Only coinbase outputs have to wait.
+func (p *ChainParams) IsMature(u UTXO, height int) bool {
+	return !u.Coinbase || height-u.Height >= p.CoinbaseMaturity
+}
+
+// Supply returns the number of coins in existence at the tip, which is the
+// total of the UTXO set.
+func (bc *Blockchain) Supply() int {
+	supply := 0
+	bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		supply = getSupply(tx)
+		return nil
+	})
+	return supply
+}
+
+func getSupply(tx *bbolt.Tx) int {
+	b := tx.Bucket(stateMetaBucket)
+	if b == nil || b.Get(supplyKey) == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(b.Get(supplyKey)))
+}
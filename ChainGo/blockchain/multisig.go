@@ -0,0 +1,144 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// MaxMultisigKeys bounds the number of keys behind a multisig address.
+const MaxMultisigKeys = 15
+
+var ErrBadMultisig = errors.New("invalid multisig policy")
+
+// MultisigPolicy describes an M-of-N multisig address: any Threshold of the
+// PublicKeys can spend its outputs. Keys are kept sorted so the same set of
+// keys always gives the same address.
+type MultisigPolicy struct {
+	Threshold  int      `json:"threshold"`
+	PublicKeys [][]byte `json:"publicKeys"`
+}
+
+// NewMultisigPolicy builds the policy requiring threshold of keys.
+func NewMultisigPolicy(threshold int, keys [][]byte) (*MultisigPolicy, error) {
+	sorted := make([][]byte, len(keys))
+	copy(sorted, keys)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+
+	p := &MultisigPolicy{Threshold: threshold, PublicKeys: sorted}
+	if err := p.Check(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Check validates the threshold and keys.
+func (p *MultisigPolicy) Check() error {
+	n := len(p.PublicKeys)
+	if n == 0 || n > MaxMultisigKeys {
+		return fmt.Errorf("%w: %d keys, must be 1 to %d", ErrBadMultisig, n, MaxMultisigKeys)
+	}
+	if p.Threshold < 1 || p.Threshold > n {
+		return fmt.Errorf("%w: threshold %d of %d keys", ErrBadMultisig, p.Threshold, n)
+	}
+	for i, key := range p.PublicKeys {
+		if len(key) == 0 {
+			return fmt.Errorf("%w: key %d is empty", ErrBadMultisig, i)
+		}
+		if i > 0 && bytes.Compare(p.PublicKeys[i-1], key) >= 0 {
+			return fmt.Errorf("%w: keys must be sorted and distinct", ErrBadMultisig)
+		}
+	}
+	return nil
+}
+
+// Address derives the multisig address. The encoding is tagged so it can't
+// collide with the hash of a single public key.
+func (p *MultisigPolicy) Address() string {
+	var buf bytes.Buffer
+	buf.WriteString("multisig")
+	binary.Write(&buf, binary.BigEndian, uint32(p.Threshold))
+	for _, key := range p.PublicKeys {
+		binary.Write(&buf, binary.BigEndian, uint32(len(key)))
+		buf.Write(key)
+	}
+	hash := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(hash[:])
+}
+
+// HasKey reports whether pubKey is one of the policy's keys.
+func (p *MultisigPolicy) HasKey(pubKey []byte) bool {
+	for _, key := range p.PublicKeys {
+		if bytes.Equal(key, pubKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// CountSignatures returns how many distinct policy keys validly signed
+// hash. Signatures by other keys are an error rather than ignored, so a
+// transaction carries no data that isn't checked.
+func (p *MultisigPolicy) CountSignatures(hash []byte, sigs []Signature) (int, error) {
+	seen := make(map[string]bool)
+	for _, sig := range sigs {
+		if !p.HasKey(sig.PublicKey) {
+			return 0, fmt.Errorf("%w: key %x is not part of the multisig policy", ErrBadSignature, sig.PublicKey)
+		}
+		if seen[string(sig.PublicKey)] {
+			return 0, fmt.Errorf("%w: key %x signs twice", ErrBadSignature, sig.PublicKey)
+		}
+		seen[string(sig.PublicKey)] = true
+		if !VerifySignature(sig.PublicKey, hash, sig.R, sig.S) {
+			return 0, fmt.Errorf("%w: signature by %x does not verify", ErrBadSignature, sig.PublicKey)
+		}
+	}
+	return len(seen), nil
+}
+
+func (p *MultisigPolicy) Serialize() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(p); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func DeserializeMultisigPolicy(data []byte) (*MultisigPolicy, error) {
+	var p MultisigPolicy
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&p); err != nil {
+		return nil, err
+	}
+	return &p, p.Check()
+}
+
+// MultisigProgress reports how many of the required signatures a multisig
+// transaction holds. Invalid signatures are an error.
+func (tx *Transaction) MultisigProgress() (have, need int, err error) {
+	if tx.Multisig == nil {
+		return 0, 0, fmt.Errorf("%w: transaction is not from a multisig address", ErrBadMultisig)
+	}
+	have, err = tx.Multisig.CountSignatures(tx.Hash(), tx.Signatures)
+	return have, tx.Multisig.Threshold, err
+}
+
+// AddMultisigSignature adds a signature made outside this node by one of
+// the policy's key holders, replacing an earlier one by the same key.
+func (tx *Transaction) AddMultisigSignature(sig Signature) error {
+	if tx.Multisig == nil {
+		return fmt.Errorf("%w: transaction is not from a multisig address", ErrBadMultisig)
+	}
+	if !tx.Multisig.HasKey(sig.PublicKey) {
+		return fmt.Errorf("%w: key %x is not part of the multisig policy", ErrBadSignature, sig.PublicKey)
+	}
+	if !VerifySignature(sig.PublicKey, tx.Hash(), sig.R, sig.S) {
+		return fmt.Errorf("%w: signature by %x does not verify", ErrBadSignature, sig.PublicKey)
+	}
+	tx.Signatures = addSignature(tx.Signatures, sig)
+	return nil
+}
@@ -0,0 +1,159 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+func TestNewMultisigPolicy(t *testing.T) {
+	a, b, c := NewWallet(), NewWallet(), NewWallet()
+	many := make([][]byte, MaxMultisigKeys+1)
+	for i := range many {
+		many[i] = NewWallet().PublicKey
+	}
+	tests := []struct {
+		name      string
+		threshold int
+		keys      [][]byte
+		want      error
+	}{
+		{"1 of 1", 1, [][]byte{a.PublicKey}, nil},
+		{"2 of 3", 2, [][]byte{a.PublicKey, b.PublicKey, c.PublicKey}, nil},
+		{"3 of 3", 3, [][]byte{c.PublicKey, b.PublicKey, a.PublicKey}, nil},
+		{"most keys", 1, many[:MaxMultisigKeys], nil},
+		{"no keys", 1, nil, ErrBadMultisig},
+		{"too many keys", 1, many, ErrBadMultisig},
+		{"zero threshold", 0, [][]byte{a.PublicKey}, ErrBadMultisig},
+		{"threshold above keys", 3, [][]byte{a.PublicKey, b.PublicKey}, ErrBadMultisig},
+		{"duplicate key", 2, [][]byte{a.PublicKey, b.PublicKey, a.PublicKey}, ErrBadMultisig},
+		{"empty key", 1, [][]byte{a.PublicKey, nil}, ErrBadMultisig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewMultisigPolicy(tt.threshold, tt.keys)
+			if tt.want == nil && err != nil {
+				t.Fatalf("error %v, want none", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("error %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// The address depends on the keys and threshold, not the key order.
+	p1, _ := NewMultisigPolicy(2, [][]byte{a.PublicKey, b.PublicKey, c.PublicKey})
+	p2, _ := NewMultisigPolicy(2, [][]byte{c.PublicKey, a.PublicKey, b.PublicKey})
+	p3, _ := NewMultisigPolicy(3, [][]byte{a.PublicKey, b.PublicKey, c.PublicKey})
+	if p1.Address() != p2.Address() {
+		t.Errorf("address %s for reordered keys, want %s", p2.Address(), p1.Address())
+	}
+	if p1.Address() == p3.Address() {
+		t.Errorf("2 of 3 and 3 of 3 share address %s", p1.Address())
+	}
+}
+
+func TestCountSignatures(t *testing.T) {
+	a, b, c, outsider := NewWallet(), NewWallet(), NewWallet(), NewWallet()
+	policy, err := NewMultisigPolicy(2, [][]byte{a.PublicKey, b.PublicKey, c.PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte("transaction"))
+	other := sha256.Sum256([]byte("another transaction"))
+	sign := func(w *Wallet, hash [32]byte) Signature {
+		r, s := w.Sign(hash[:])
+		return Signature{PublicKey: w.PublicKey, R: r, S: s}
+	}
+	tests := []struct {
+		name string
+		sigs []Signature
+		want int
+		err  error
+	}{
+		{"none", nil, 0, nil},
+		{"1 of 3", []Signature{sign(b, hash)}, 1, nil},
+		{"2 of 3", []Signature{sign(a, hash), sign(c, hash)}, 2, nil},
+		{"3 of 3", []Signature{sign(c, hash), sign(a, hash), sign(b, hash)}, 3, nil},
+		{"duplicate key", []Signature{sign(a, hash), sign(a, hash)}, 0, ErrBadSignature},
+		{"foreign key", []Signature{sign(a, hash), sign(outsider, hash)}, 0, ErrBadSignature},
+		{"signature of another hash", []Signature{sign(a, hash), sign(b, other)}, 0, ErrBadSignature},
+		{"key of another signer", []Signature{sign(a, hash), {PublicKey: b.PublicKey, R: sign(c, hash).R, S: sign(c, hash).S}}, 0, ErrBadSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := policy.CountSignatures(hash[:], tt.sigs)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("counted %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCheckMultisig signs a transaction from a 2-of-3 address with the
+// given wallets, changes it with edit and checks it.
+func TestCheckMultisig(t *testing.T) {
+	a, b, c, outsider := NewWallet(), NewWallet(), NewWallet(), NewWallet()
+	policy, err := NewMultisigPolicy(2, [][]byte{a.PublicKey, b.PublicKey, c.PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		signers []*Wallet
+		edit    func(tx *Transaction)
+		want    error
+	}{
+		{"threshold met", []*Wallet{a, c}, nil, nil},
+		{"all keys", []*Wallet{a, b, c}, nil, nil},
+		{"threshold not met", []*Wallet{b}, nil, ErrBadSignature},
+		{"signing twice counts once", []*Wallet{b, b}, nil, ErrBadSignature},
+		{"outsider among the signatures", []*Wallet{a, b}, func(tx *Transaction) {
+			r, s := outsider.Sign(tx.Hash())
+			tx.Signatures = append(tx.Signatures, Signature{PublicKey: outsider.PublicKey, R: r, S: s})
+		}, ErrBadSignature},
+		{"policy of another address", []*Wallet{a, b}, func(tx *Transaction) {
+			other, _ := NewMultisigPolicy(1, [][]byte{a.PublicKey, b.PublicKey, c.PublicKey})
+			tx.Multisig = other
+		}, ErrBadSignature},
+		{"single-key signature too", []*Wallet{a, b}, func(tx *Transaction) {
+			tx.PublicKey = a.PublicKey
+		}, ErrBadSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := &Transaction{
+				Version:  TxVersion,
+				From:     policy.Address(),
+				To:       "shop",
+				Amount:   5,
+				Fee:      1,
+				Inputs:   []TxInput{{TxID: []byte("funding"), Vout: 0}},
+				Outputs:  []TxOutput{{Amount: 5, Address: "shop"}},
+				Multisig: policy,
+			}
+			for _, w := range tt.signers {
+				tx.Sign(w)
+			}
+			if tt.edit != nil {
+				tt.edit(tx)
+			}
+			err := CheckSignature(tx)
+			if tt.want == nil && err != nil {
+				t.Fatalf("error %v, want none", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
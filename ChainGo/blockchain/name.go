@@ -0,0 +1,278 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// MinNameLength and MaxNameLength bound registered names. Names are
+	// shorter than addresses, so the two can't be confused.
+	MinNameLength = 3
+	MaxNameLength = 32
+)
+
+// Name operations.
+const (
+	NameRegister = "register"
+	NameRenew    = "renew"
+	NameTransfer = "transfer"
+)
+
+var nameBucket = []byte("chaingo_names")
+
+var (
+	ErrBadNameOp   = errors.New("invalid name operation")
+	ErrNoName      = errors.New("name not registered")
+	ErrNameTaken   = errors.New("name already registered")
+	ErrNameExpired = errors.New("name expired")
+)
+
+// NameOp turns a transaction into an operation on the name registry:
+//
+//   - register claims Name for To, or for From if To is empty. A name can
+//     be claimed when it is free or its registration has expired.
+//   - renew extends the registration of a name owned by From.
+//   - transfer hands a live name owned by From to To.
+//
+// A registration lasts ChainParams.NameLifetime blocks from the block it is
+// made or renewed in. The transaction pays only its fee in coins.
+type NameOp struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	To   string `json:"to,omitempty"`
+}
+
+// NameRecord is a registered name. It resolves to Owner in blocks below
+// Expires.
+type NameRecord struct {
+	Name       string `json:"name"`
+	Owner      string `json:"owner"`
+	Registered int    `json:"registered"`
+	Expires    int    `json:"expires"`
+}
+
+// NewNameTransaction builds an unsigned name transaction from the
+// spendable outputs of from, paying fee and returning the change to from.
+func NewNameTransaction(chainID uint32, from string, op *NameOp, fee int, nonce uint64, spendable []UTXO) (*Transaction, error) {
+	if fee < 0 {
+		return nil, fmt.Errorf("%w: fee %d is negative", ErrInvalidAmount, fee)
+	}
+	tx := &Transaction{
+		Version: TxVersion,
+		From:    from,
+		To:      op.To,
+		Fee:     fee,
+		Nonce:   nonce,
+		ChainID: chainID,
+		Name:    op,
+	}
+	if err := tx.CheckName(); err != nil {
+		return nil, err
+	}
+	if err := tx.fundFee(spendable); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// CheckName checks the shape of a name transaction. Ownership and expiry
+// are checked when it is connected.
+func (tx *Transaction) CheckName() error {
+	op := tx.Name
+	if op == nil {
+		return nil
+	}
+	if tx.IsCoinbase() {
+		return fmt.Errorf("%w: coinbase carries a name operation", ErrBadNameOp)
+	}
+	if tx.Contract != nil || tx.Token != nil {
+		return fmt.Errorf("%w: transaction also carries a contract or token operation", ErrBadNameOp)
+	}
+	if tx.Amount != 0 {
+		return fmt.Errorf("%w: coin amount is %d, names pay only the fee", ErrBadNameOp, tx.Amount)
+	}
+	if err := CheckNameSyntax(op.Name); err != nil {
+		return err
+	}
+	switch op.Kind {
+	case NameRegister:
+	case NameRenew:
+		if op.To != "" {
+			return fmt.Errorf("%w: renew has no recipient", ErrBadNameOp)
+		}
+	case NameTransfer:
+		if op.To == "" || op.To == tx.From {
+			return fmt.Errorf("%w: transfer needs a recipient other than the owner", ErrBadNameOp)
+		}
+	default:
+		return fmt.Errorf("%w: unknown kind %q", ErrBadNameOp, op.Kind)
+	}
+	return nil
+}
+
+// CheckNameSyntax requires MinNameLength to MaxNameLength lower-case
+// letters, digits and inner hyphens.
+func CheckNameSyntax(name string) error {
+	if len(name) < MinNameLength || len(name) > MaxNameLength {
+		return fmt.Errorf("%w: name %q must have %d to %d characters", ErrBadNameOp, name, MinNameLength, MaxNameLength)
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return fmt.Errorf("%w: name %q may only hold lower-case letters, digits and hyphens", ErrBadNameOp, name)
+		}
+	}
+	if strings.HasPrefix(name, "-") || strings.HasSuffix(name, "-") {
+		return fmt.Errorf("%w: name %q starts or ends with a hyphen", ErrBadNameOp, name)
+	}
+	return nil
+}
+
+// checkName checks a name operation against the registry at height. It
+// runs with the other checks of connectTx, before anything is written.
+func checkName(tx *bbolt.Tx, t *Transaction, height int) error {
+	op := t.Name
+	if op == nil {
+		return nil
+	}
+	record, err := getName(tx, op.Name)
+	switch op.Kind {
+	case NameRegister:
+		if err == nil && height < record.Expires {
+			return fmt.Errorf("%w: %s is owned by %s until height %d", ErrNameTaken, op.Name, record.Owner, record.Expires)
+		}
+		return nil
+	case NameRenew:
+		if err != nil {
+			return err
+		}
+		if record.Owner != t.From {
+			return fmt.Errorf("%w: %s is owned by %s", ErrBadNameOp, op.Name, record.Owner)
+		}
+	case NameTransfer:
+		if err != nil {
+			return err
+		}
+		if record.Owner != t.From {
+			return fmt.Errorf("%w: %s is owned by %s", ErrBadNameOp, op.Name, record.Owner)
+		}
+		if height >= record.Expires {
+			return fmt.Errorf("%w: %s expired at height %d", ErrNameExpired, op.Name, record.Expires)
+		}
+	}
+	return nil
+}
+
+// applyName carries out the name operation of t at height, journaling the
+// write so that it can be undone.
+func applyName(tx *bbolt.Tx, t *Transaction, height int, p *ChainParams) error {
+	op := t.Name
+	record := &NameRecord{Name: op.Name}
+	if op.Kind != NameRegister {
+		var err error
+		if record, err = getName(tx, op.Name); err != nil {
+			return err
+		}
+	}
+	switch op.Kind {
+	case NameRegister:
+		record.Owner = op.To
+		if record.Owner == "" {
+			record.Owner = t.From
+		}
+		record.Registered = height
+		record.Expires = height + p.NameLifetime
+	case NameRenew:
+		record.Expires = max(record.Expires, height) + p.NameLifetime
+	case NameTransfer:
+		record.Owner = op.To
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(record); err != nil {
+		return err
+	}
+	change, err := putState(tx, nameBucket, []byte(op.Name), buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return saveUndo(tx, t.Hash(), []stateChange{change})
+}
+
+func getName(tx *bbolt.Tx, name string) (*NameRecord, error) {
+	b := tx.Bucket(nameBucket)
+	if b == nil || b.Get([]byte(name)) == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoName, name)
+	}
+	var record NameRecord
+	if err := gob.NewDecoder(bytes.NewReader(b.Get([]byte(name)))).Decode(&record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// nameCommitment is what the state root commits to for a name record.
+func nameCommitment(v []byte) []byte {
+	var record NameRecord
+	if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&record); err != nil {
+		return v
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(record.Owner)))
+	buf.WriteString(record.Owner)
+	binary.Write(&buf, binary.BigEndian, int64(record.Registered))
+	binary.Write(&buf, binary.BigEndian, int64(record.Expires))
+	return buf.Bytes()
+}
+
+// Name returns the registry record of name, expired or not.
+func (bc *Blockchain) Name(name string) (*NameRecord, error) {
+	var record *NameRecord
+	err := bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		var err error
+		record, err = getName(tx, name)
+		return err
+	})
+	return record, err
+}
+
+// ResolveName returns the address name points to in the next block.
+func (bc *Blockchain) ResolveName(name string) (string, error) {
+	record, err := bc.Name(strings.ToLower(name))
+	if err != nil {
+		return "", err
+	}
+	if height := bc.Height() + 1; height >= record.Expires {
+		return "", fmt.Errorf("%w: %s expired at height %d", ErrNameExpired, record.Name, record.Expires)
+	}
+	return record.Owner, nil
+}
+
+// NamesOf returns the live names owned by address, ordered by name.
+func (bc *Blockchain) NamesOf(address string) []string {
+	height := bc.Height() + 1
+	var names []string
+	bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(nameBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var record NameRecord
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&record); err != nil {
+				return err
+			}
+			if record.Owner == address && height < record.Expires {
+				names = append(names, record.Name)
+			}
+			return nil
+		})
+	})
+	return names
+}
@@ -0,0 +1,126 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNameOps(t *testing.T) {
+	alice, bob := NewWallet(), NewWallet()
+	const lifetime = 5
+	// A step mines wait empty blocks and then a block with op sent by from.
+	// It expects err, or else the name "alice" to be owned by owner and to
+	// expire expiresIn blocks after the step's block.
+	type step struct {
+		wait      int
+		from      *Wallet
+		op        NameOp
+		err       error
+		owner     *Wallet
+		expiresIn int
+	}
+	register := NameOp{Kind: NameRegister, Name: "alice"}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"register", []step{
+			{from: alice, op: register, owner: alice, expiresIn: lifetime},
+		}},
+		{"register for another", []step{
+			{from: alice, op: NameOp{Kind: NameRegister, Name: "alice", To: bob.Address()}, owner: bob, expiresIn: lifetime},
+		}},
+		{"register a taken name", []step{
+			{from: alice, op: register, owner: alice, expiresIn: lifetime},
+			{wait: lifetime - 2, from: bob, op: register, err: ErrNameTaken},
+		}},
+		{"register an expired name", []step{
+			{from: alice, op: register, owner: alice, expiresIn: lifetime},
+			{wait: lifetime - 1, from: bob, op: register, owner: bob, expiresIn: lifetime},
+		}},
+		{"renew", []step{
+			{from: alice, op: register, owner: alice, expiresIn: lifetime},
+			{wait: 2, from: alice, op: NameOp{Kind: NameRenew, Name: "alice"}, owner: alice, expiresIn: 2*lifetime - 3},
+		}},
+		{"renew after expiry", []step{
+			{from: alice, op: register, owner: alice, expiresIn: lifetime},
+			{wait: lifetime + 1, from: alice, op: NameOp{Kind: NameRenew, Name: "alice"}, owner: alice, expiresIn: lifetime},
+		}},
+		{"renew by another", []step{
+			{from: alice, op: register, owner: alice, expiresIn: lifetime},
+			{from: bob, op: NameOp{Kind: NameRenew, Name: "alice"}, err: ErrBadNameOp},
+		}},
+		{"renew an unknown name", []step{
+			{from: alice, op: NameOp{Kind: NameRenew, Name: "alice"}, err: ErrNoName},
+		}},
+		{"transfer", []step{
+			{from: alice, op: register, owner: alice, expiresIn: lifetime},
+			{from: alice, op: NameOp{Kind: NameTransfer, Name: "alice", To: bob.Address()}, owner: bob, expiresIn: lifetime - 1},
+			{from: bob, op: NameOp{Kind: NameTransfer, Name: "alice", To: alice.Address()}, owner: alice, expiresIn: lifetime - 2},
+		}},
+		{"transfer an expired name", []step{
+			{from: alice, op: register, owner: alice, expiresIn: lifetime},
+			{wait: lifetime - 1, from: alice, op: NameOp{Kind: NameTransfer, Name: "alice", To: bob.Address()}, err: ErrNameExpired},
+		}},
+		{"transfer by another", []step{
+			{from: alice, op: register, owner: alice, expiresIn: lifetime},
+			{from: bob, op: NameOp{Kind: NameTransfer, Name: "alice", To: bob.Address()}, err: ErrBadNameOp},
+		}},
+		{"transfer to the owner", []step{
+			{from: alice, op: register, owner: alice, expiresIn: lifetime},
+			{from: alice, op: NameOp{Kind: NameTransfer, Name: "alice", To: alice.Address()}, err: ErrBadNameOp},
+		}},
+		{"bad name", []step{
+			{from: alice, op: NameOp{Kind: NameRegister, Name: "Alice"}, err: ErrBadNameOp},
+		}},
+		{"unknown kind", []step{
+			{from: alice, op: NameOp{Kind: "steal", Name: "alice"}, err: ErrBadNameOp},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := regtestParams(t)
+			params.NameLifetime = lifetime
+			bc := newTestChain(t, params)
+			fundTestWallet(t, bc, alice)
+			fundTestWallet(t, bc, bob)
+			history := stateHistory{}
+			for i, s := range tt.steps {
+				for j := 0; j < s.wait; j++ {
+					mineTestBlock(t, bc, "miner")
+				}
+				op := s.op
+				tx, err := signTestTx(t, bc, s.from, func(nonce uint64, utxos []UTXO) (*Transaction, error) {
+					return NewNameTransaction(bc.Params.ChainID, s.from.Address(), &op, 1, nonce, utxos)
+				})
+				if err == nil {
+					history.record(t, bc)
+					_, err = bc.AddBlock([]*Transaction{NewCoinbaseTx(bc.Params.ChainID, "miner", bc.Params.Subsidy(bc.Height()+1)+tx.Fee, bc.Height()+1), tx})
+				}
+				if s.err != nil {
+					if !errors.Is(err, s.err) {
+						t.Fatalf("step %d: error %v, want %v", i, err, s.err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				record, err := bc.Name("alice")
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				if record.Owner != s.owner.Address() {
+					t.Errorf("step %d: owner %s, want %s", i, record.Owner, s.owner.Address())
+				}
+				if got := record.Expires - bc.Height(); got != s.expiresIn {
+					t.Errorf("step %d: expires in %d blocks, want %d", i, got, s.expiresIn)
+				}
+				if addr, err := bc.ResolveName("alice"); err != nil || addr != s.owner.Address() {
+					t.Errorf("step %d: resolves to %q, %v, want %s", i, addr, err, s.owner.Address())
+				}
+			}
+			history.unwind(t, bc)
+		})
+	}
+}
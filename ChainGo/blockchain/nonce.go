@@ -0,0 +1,74 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"go.etcd.io/bbolt"
+)
+
+var nonceBucket = []byte("chaingo_nonces")
+
+var (
+	ErrNonceTooLow  = errors.New("nonce too low")
+	ErrNonceTooHigh = errors.New("nonce too high")
+	ErrWrongChainID = errors.New("wrong chain id")
+)
+
+// CheckNonce compares the nonce of a transaction with the next nonce
+// expected for its sender. Nonces must be used in order, starting at 0.
+func CheckNonce(expected, got uint64) error {
+	switch {
+	case got < expected:
+		return fmt.Errorf("%w: expected %d, got %d (already used)", ErrNonceTooLow, expected, got)
+	case got > expected:
+		return fmt.Errorf("%w: expected %d, got %d (missing earlier nonces)", ErrNonceTooHigh, expected, got)
+	}
+	return nil
+}
+
+// CheckReplay verifies that a transaction was signed for the chain chainID
+// and carries the next nonce of its sender.
+func CheckReplay(tx *Transaction, chainID uint32, expectedNonce uint64) error {
+	if tx.ChainID != chainID {
+		return fmt.Errorf("%w: expected %d, got %d", ErrWrongChainID, chainID, tx.ChainID)
+	}
+	return CheckNonce(expectedNonce, tx.Nonce)
+}
+
+// NextNonce returns the nonce the next confirmed transaction from address
+// must carry.
+func (bc *Blockchain) NextNonce(address string) (uint64, error) {
+	var nonce uint64
+	err := bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		nonce = getNonce(tx, address)
+		return nil
+	})
+	return nonce, err
+}
+
+func getNonce(tx *bbolt.Tx, address string) uint64 {
+	b := tx.Bucket(nonceBucket)
+	if b == nil {
+		return 0
+	}
+	v := b.Get([]byte(address))
+	if v == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func putNonce(tx *bbolt.Tx, address string, next uint64) error {
+	b, err := tx.CreateBucketIfNotExists(nonceBucket)
+	if err != nil {
+		return err
+	}
+	if next == 0 {
+		return b.Delete([]byte(address))
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, next)
+	return b.Put([]byte(address), v)
+}
@@ -0,0 +1,267 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+var ErrUnknownNetwork = errors.New("unknown network")
+
+// ChainParams holds the consensus settings a node runs with, together with
+// the identity of its network. Nodes only talk to peers with the same
+// Magic and only accept transactions signed for the same ChainID.
+type ChainParams struct {
+	// Name is the name of the network, e.g. "mainnet".
+	Name string
+	// Magic starts every peer message, so nodes of different networks
+	// ignore each other.
+	Magic [4]byte
+	// ChainID is signed into every transaction, so a transaction cannot be
+	// replayed on another network. Builders take it from here.
+	ChainID uint32
+	// APIPort and P2PPort are the ports a node listens on unless told
+	// otherwise.
+	APIPort string
+	P2PPort string
+
+	// Consensus seals and verifies blocks and weighs branches.
+	Consensus Consensus
+	// PowLimit is the easiest target any block may use.
+	PowLimit *big.Int
+	// Genesis describes the genesis block; its difficulty is the one the
+	// chain starts at.
+	Genesis *GenesisSpec
+	// TargetBlockTime is the block interval, in seconds, that difficulty
+	// retargeting aims for.
+	TargetBlockTime int64
+	// RetargetInterval is the number of blocks between difficulty changes.
+	RetargetInterval int
+	// NoRetarget keeps every block at the genesis difficulty.
+	NoRetarget bool
+	// InitialSubsidy is the amount a coinbase may mint, on top of fees, in
+	// every block of the first halving era.
+	InitialSubsidy int
+	// HalvingInterval is the number of blocks after which the subsidy is
+	// halved.
+	HalvingInterval int
+	// MaxSupply caps the coins that can ever exist, genesis allocations
+	// included.
+	MaxSupply int
+	// MaxBlockSize is the largest encoded block, in bytes, that is valid.
+	MaxBlockSize int
+	// CoinbaseMaturity is the number of blocks a coinbase output must wait
+	// before it can be spent.
+	CoinbaseMaturity int
+	// MaxBlockGas caps the gas limits of all contract transactions in a
+	// block.
+	MaxBlockGas int
+	// NameLifetime is the number of blocks a name registration or renewal
+	// lasts.
+	NameLifetime int
+	// StakeUnbonding is the number of blocks withdrawn stake stays locked
+	// under proof of stake.
+	StakeUnbonding int
+	// Dev lets nodes seal blocks on their own, as soon as a transaction is
+	// pending or on a timer, and generate blocks on request.
+	Dev bool
+
+	genesis *Block // Mined from Genesis by SetGenesis or NewBlockchain
+}
+
+// MainnetParams starts from DefaultGenesis at 16 leading zero bits and aims
+// for one block every 10 seconds, retargeting every 10 blocks. The subsidy
+// starts at 50 and halves every 210000 blocks, up to 21 million coins.
+// Names are registered for about a year.
+var MainnetParams = &ChainParams{
+	Name:             "mainnet",
+	Magic:            [4]byte{0xc6, 0xa1, 0x9e, 0x01},
+	ChainID:          1,
+	APIPort:          "8080",
+	P2PPort:          "9000",
+	Consensus:        PowEngine{},
+	PowLimit:         targetFromZeroBits(8),
+	Genesis:          DefaultGenesis,
+	TargetBlockTime:  10,
+	RetargetInterval: 10,
+	InitialSubsidy:   50,
+	HalvingInterval:  210000,
+	MaxSupply:        21000000,
+	MaxBlockSize:     1000000,
+	CoinbaseMaturity: 1,
+	MaxBlockGas:      10000000,
+	NameLifetime:     3153600,
+	StakeUnbonding:   8640,
+}
+
+// TestnetParams is a public test network with mainnet's rules at a lower
+// difficulty: 12 leading zero bits at genesis, never harder to reach than
+// 4. Names last about a week.
+var TestnetParams = &ChainParams{
+	Name:             "testnet",
+	Magic:            [4]byte{0xc6, 0xa1, 0x9e, 0x02},
+	ChainID:          2,
+	APIPort:          "18080",
+	P2PPort:          "19000",
+	Consensus:        PowEngine{},
+	PowLimit:         targetFromZeroBits(4),
+	Genesis:          TestnetGenesis,
+	TargetBlockTime:  10,
+	RetargetInterval: 10,
+	InitialSubsidy:   50,
+	HalvingInterval:  210000,
+	MaxSupply:        21000000,
+	MaxBlockSize:     1000000,
+	CoinbaseMaturity: 1,
+	MaxBlockGas:      10000000,
+	NameLifetime:     60480,
+	StakeUnbonding:   360,
+}
+
+// RegtestParams is for local testing: blocks are found almost at once and
+// the difficulty never changes, subsidies halve every 150 blocks and names
+// last 100 blocks, so long-running behaviour can be reached quickly.
+var RegtestParams = &ChainParams{
+	Name:             "regtest",
+	Magic:            [4]byte{0xc6, 0xa1, 0x9e, 0x03},
+	ChainID:          3,
+	APIPort:          "28080",
+	P2PPort:          "29000",
+	Consensus:        PowEngine{},
+	PowLimit:         targetFromZeroBits(1),
+	Genesis:          RegtestGenesis,
+	TargetBlockTime:  10,
+	RetargetInterval: 10,
+	NoRetarget:       true,
+	InitialSubsidy:   50,
+	HalvingInterval:  150,
+	MaxSupply:        21000000,
+	MaxBlockSize:     1000000,
+	CoinbaseMaturity: 1,
+	MaxBlockGas:      10000000,
+	NameLifetime:     100,
+	StakeUnbonding:   10,
+}
+
+// DevParams is for integration tests: regtest's rules on a network of its
+// own, where the node seals blocks itself instead of waiting to be asked.
+var DevParams = &ChainParams{
+	Name:             "dev",
+	Magic:            [4]byte{0xc6, 0xa1, 0x9e, 0x04},
+	ChainID:          4,
+	APIPort:          "38080",
+	P2PPort:          "39000",
+	Consensus:        PowEngine{},
+	PowLimit:         targetFromZeroBits(1),
+	Genesis:          DevGenesis,
+	TargetBlockTime:  10,
+	RetargetInterval: 10,
+	NoRetarget:       true,
+	InitialSubsidy:   50,
+	HalvingInterval:  150,
+	MaxSupply:        21000000,
+	MaxBlockSize:     1000000,
+	CoinbaseMaturity: 1,
+	MaxBlockGas:      10000000,
+	NameLifetime:     100,
+	StakeUnbonding:   10,
+	Dev:              true,
+}
+
+// DefaultParams is the network a node joins when none is named.
+var DefaultParams = MainnetParams
+
+// Networks holds the built-in network profiles by name.
+var Networks = map[string]*ChainParams{
+	MainnetParams.Name: MainnetParams,
+	TestnetParams.Name: TestnetParams,
+	RegtestParams.Name: RegtestParams,
+	DevParams.Name:     DevParams,
+}
+
+// NetworkParams returns a copy of the profile of the named network, which
+// the caller may adjust.
+func NetworkParams(name string) (*ChainParams, error) {
+	p, ok := Networks[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q, have %v", ErrUnknownNetwork, name, NetworkNames())
+	}
+	params := *p
+	return &params, nil
+}
+
+// NetworkNames returns the names of the built-in networks in order.
+func NetworkNames() []string {
+	names := make([]string, 0, len(Networks))
+	for name := range Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetGenesis replaces the genesis spec, and the consensus engine with the
+// one it names, after checking that it describes a valid genesis block.
+func (p *ChainParams) SetGenesis(spec *GenesisSpec) error {
+	bits, err := spec.CompactBits()
+	if err != nil {
+		return err
+	}
+	engine, err := spec.Engine()
+	if err != nil {
+		return err
+	}
+	if target := CompactToBig(bits); target.Sign() <= 0 || target.Cmp(p.PowLimit) > 0 {
+		return fmt.Errorf("genesis bits %08x outside the proof-of-work limit", bits)
+	}
+	p.Genesis = spec
+	p.Consensus = engine
+	p.genesis = nil
+	if err := p.mineGenesis(); err != nil {
+		return err
+	}
+	alloc := p.genesis.Transactions[0].OutputTotal()
+	for _, amount := range spec.Stakes {
+		alloc += amount
+	}
+	if alloc > p.MaxSupply {
+		return fmt.Errorf("genesis allocates %d, more than the maximum supply of %d", alloc, p.MaxSupply)
+	}
+	return nil
+}
+
+// GenesisBits returns the compact target of the genesis block.
+func (p *ChainParams) GenesisBits() uint32 {
+	bits, _ := p.Genesis.CompactBits()
+	return bits
+}
+
+// GenesisBlock returns the genesis block described by the genesis spec.
+// Once SetGenesis or NewBlockchain has mined it, the block is reused;
+// before that it is mined on every call. It never writes to p, so nodes
+// may call it from any goroutine.
+func (p *ChainParams) GenesisBlock() (*Block, error) {
+	if p.genesis != nil {
+		return p.genesis, nil
+	}
+	return p.Genesis.Block(p.ChainID)
+}
+
+// mineGenesis mines the genesis block for GenesisBlock to reuse. It runs
+// before the params are shared.
+func (p *ChainParams) mineGenesis() error {
+	if p.genesis != nil {
+		return nil
+	}
+	block, err := p.Genesis.Block(p.ChainID)
+	if err != nil {
+		return err
+	}
+	p.genesis = block
+	return nil
+}
+
+func targetFromZeroBits(bits uint) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), 256-bits)
+}
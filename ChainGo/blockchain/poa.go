@@ -0,0 +1,378 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"go.etcd.io/bbolt"
+)
+
+// Governance operations.
+const (
+	GovernanceAdd    = "add"
+	GovernanceRemove = "remove"
+)
+
+var (
+	// validatorBucket holds the validator set as address -> nothing once
+	// governance has changed it; while it is empty the set is the one in
+	// PoaEngine.Validators.
+	validatorBucket = []byte("chaingo_validators")
+	// voteBucket holds pending governance votes as kind, validator and
+	// voter joined by zero bytes -> nothing.
+	voteBucket = []byte("chaingo_validator_votes")
+)
+
+var (
+	ErrBadGovernance = errors.New("invalid governance operation")
+	ErrNotValidator  = errors.New("not a validator")
+	ErrRecentSealer  = errors.New("sealed too recently")
+)
+
+// PoaEngine is proof of authority: blocks are signed by a set of
+// validators taking turns, the validator at index height mod n of the set
+// sorted by address being in turn for the block at height. The set starts
+// as Validators and is changed by governance transactions.
+//
+// Any other validator may seal out of turn, so an offline validator does
+// not halt the chain, but no validator may seal more than one of any
+// n/2+1 consecutive blocks. The block nonce is 0 in turn and 1 out of
+// turn. An in-turn block adds 2 to the work of its branch and an
+// out-of-turn one 1, so the branch sealed in turn wins.
+type PoaEngine struct {
+	// Validators is the validator set at genesis.
+	Validators []string
+	// Key is the key this node seals blocks with; nil if it is not a
+	// validator.
+	Key *Wallet
+}
+
+func (e *PoaEngine) Name() string { return "poa" }
+
+// Prepare keeps the difficulty of the chain, which proof of authority
+// does not use, and names the sealer and whether it is in turn.
+func (e *PoaEngine) Prepare(tx *bbolt.Tx, block *Block, parent *ParentState) error {
+	if e.Key == nil {
+		return fmt.Errorf("%w: this node has no validator key", ErrNotValidator)
+	}
+	if block.Version < 2 {
+		return fmt.Errorf("%w: block version %d cannot carry a sealer", ErrBadSeal, block.Version)
+	}
+	rank, err := e.sealerRank(tx, block, e.Key.Address())
+	if err != nil {
+		return err
+	}
+	block.Bits = parent.Bits
+	block.Signer = e.Key.PublicKey
+	block.Nonce = rank
+	return nil
+}
+
+func (e *PoaEngine) Seal(block *Block) error {
+	sealSigned(block, e.Key)
+	return nil
+}
+
+func (e *PoaEngine) VerifyHeader(block *Block, parent *ParentState) error {
+	if len(block.Proof) > 0 {
+		return fmt.Errorf("%w: proof-of-authority block carries a VRF proof", ErrBadSeal)
+	}
+	if block.Nonce > 1 {
+		return fmt.Errorf("%w: sealer rank %d, expected 0 or 1", ErrBadSeal, block.Nonce)
+	}
+	return checkSigned(block, parent, 2)
+}
+
+// VerifySealer requires the sealer to be a validator that may seal the
+// block, in turn or not as the block claims.
+func (e *PoaEngine) VerifySealer(tx *bbolt.Tx, block *Block) error {
+	rank, err := e.sealerRank(tx, block, AddressFromPublicKey(block.Signer))
+	if err != nil {
+		return fmt.Errorf("%w: block %d: %w", ErrBadSealer, block.Height, err)
+	}
+	if rank != block.Nonce {
+		return fmt.Errorf("%w: block %d claims sealer rank %d, the sealer has rank %d", ErrBadSealer, block.Height, block.Nonce, rank)
+	}
+	return nil
+}
+
+func (e *PoaEngine) Work(block *Block) *big.Int {
+	if block.Nonce == 0 {
+		return big.NewInt(2)
+	}
+	return big.NewInt(1)
+}
+
+func (e *PoaEngine) sealerAt(validators []string, height int) string {
+	return validators[height%len(validators)]
+}
+
+// sealerRank returns 0 if it is address's turn to seal block and 1 if it
+// may seal it out of turn. It fails if address is not a validator or
+// sealed one of the len(set)/2 blocks before block.
+func (e *PoaEngine) sealerRank(tx *bbolt.Tx, block *Block, address string) (int, error) {
+	set := validatorSet(tx, e)
+	if !isValidator(set, address) {
+		return 0, fmt.Errorf("%w: %s", ErrNotValidator, address)
+	}
+	hash := block.PrevHash
+	for i := 0; i < len(set)/2; i++ {
+		recent, err := getBlock(tx, hash)
+		if err != nil {
+			return 0, err
+		}
+		if len(recent.Signer) == 0 {
+			break
+		}
+		if AddressFromPublicKey(recent.Signer) == address {
+			return 0, fmt.Errorf("%w: %s sealed block %d, one of the last %d", ErrRecentSealer, address, recent.Height, len(set)/2)
+		}
+		hash = recent.PrevHash
+	}
+	if e.sealerAt(set, block.Height) == address {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+// validatorSet returns the current validators sorted by address.
+func validatorSet(tx *bbolt.Tx, e *PoaEngine) []string {
+	var set []string
+	if b := tx.Bucket(validatorBucket); b != nil {
+		b.ForEach(func(k, v []byte) error {
+			set = append(set, string(k))
+			return nil
+		})
+	}
+	if len(set) == 0 {
+		set = uniqueSorted(e.Validators)
+	}
+	return set
+}
+
+func firstKey(b *bbolt.Bucket) []byte {
+	k, _ := b.Cursor().First()
+	return k
+}
+
+func isValidator(set []string, address string) bool {
+	i := sort.SearchStrings(set, address)
+	return i < len(set) && set[i] == address
+}
+
+// GovernanceOp proposes a change to the validator set of a
+// proof-of-authority chain:
+//
+//   - add makes Validator a validator.
+//   - remove takes Validator out of the set.
+//
+// Each transaction is the vote of From, who must be a validator. The
+// change is made in the block where more than half of the current
+// validators have voted for it. The transaction pays only its fee in
+// coins.
+type GovernanceOp struct {
+	Kind      string `json:"kind"`
+	Validator string `json:"validator"`
+}
+
+// NewGovernanceTransaction builds an unsigned governance vote from the
+// spendable outputs of from, paying fee and returning the change to from.
+func NewGovernanceTransaction(chainID uint32, from string, op *GovernanceOp, fee int, nonce uint64, spendable []UTXO) (*Transaction, error) {
+	if fee < 0 {
+		return nil, fmt.Errorf("%w: fee %d is negative", ErrInvalidAmount, fee)
+	}
+	tx := &Transaction{
+		Version:    TxVersion,
+		From:       from,
+		Fee:        fee,
+		Nonce:      nonce,
+		ChainID:    chainID,
+		Governance: op,
+	}
+	if err := tx.CheckGovernance(); err != nil {
+		return nil, err
+	}
+	if err := tx.fundFee(spendable); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// CheckGovernance checks the shape of a governance transaction. Who may
+// vote is checked when it is connected.
+func (tx *Transaction) CheckGovernance() error {
+	op := tx.Governance
+	if op == nil {
+		return nil
+	}
+	if tx.IsCoinbase() {
+		return fmt.Errorf("%w: coinbase carries a governance operation", ErrBadGovernance)
+	}
+	if tx.Version < 2 {
+		return fmt.Errorf("%w: transaction version %d", ErrBadGovernance, tx.Version)
+	}
+	if tx.Contract != nil || tx.Token != nil || tx.Name != nil || tx.Stake != nil || tx.Evidence != nil {
+		return fmt.Errorf("%w: transaction also carries another operation", ErrBadGovernance)
+	}
+	if tx.Amount != 0 {
+		return fmt.Errorf("%w: coin amount is %d, votes pay only the fee", ErrBadGovernance, tx.Amount)
+	}
+	if op.Kind != GovernanceAdd && op.Kind != GovernanceRemove {
+		return fmt.Errorf("%w: unknown kind %q", ErrBadGovernance, op.Kind)
+	}
+	if op.Validator == "" {
+		return fmt.Errorf("%w: no validator", ErrBadGovernance)
+	}
+	return nil
+}
+
+func voteKey(kind, validator, voter string) []byte {
+	return []byte(kind + "\x00" + validator + "\x00" + voter)
+}
+
+// checkGovernance checks a vote against the validator set. It runs with
+// the other checks of connectTx, before anything is written.
+func checkGovernance(tx *bbolt.Tx, t *Transaction, p *ChainParams) error {
+	op := t.Governance
+	if op == nil {
+		return nil
+	}
+	e, ok := p.Consensus.(*PoaEngine)
+	if !ok {
+		return fmt.Errorf("%w: the chain does not use proof of authority", ErrBadGovernance)
+	}
+	set := validatorSet(tx, e)
+	if !isValidator(set, t.From) {
+		return fmt.Errorf("%w: %s cannot vote", ErrNotValidator, t.From)
+	}
+	switch member := isValidator(set, op.Validator); {
+	case op.Kind == GovernanceAdd && member:
+		return fmt.Errorf("%w: %s is already a validator", ErrBadGovernance, op.Validator)
+	case op.Kind == GovernanceRemove && !member:
+		return fmt.Errorf("%w: %s", ErrNotValidator, op.Validator)
+	case op.Kind == GovernanceRemove && len(set) == 1:
+		return fmt.Errorf("%w: cannot remove the last validator", ErrBadGovernance)
+	}
+	if b := tx.Bucket(voteBucket); b != nil && b.Get(voteKey(op.Kind, op.Validator, t.From)) != nil {
+		return fmt.Errorf("%w: %s already voted to %s %s", ErrBadGovernance, t.From, op.Kind, op.Validator)
+	}
+	return nil
+}
+
+// applyGovernance records the vote of t and, once a majority of the
+// current validators agree, changes the validator set and clears the votes
+// on the validator. The writes are journaled so that they can be undone.
+func applyGovernance(tx *bbolt.Tx, t *Transaction, p *ChainParams) error {
+	op := t.Governance
+	e := p.Consensus.(*PoaEngine)
+	var undo []stateChange
+	put := func(bucket, key, value []byte) error {
+		change, err := putState(tx, bucket, key, value)
+		undo = append(undo, change)
+		return err
+	}
+
+	if err := put(voteBucket, voteKey(op.Kind, op.Validator, t.From), []byte{1}); err != nil {
+		return err
+	}
+	set := validatorSet(tx, e)
+	votes := 0
+	for _, v := range set {
+		if tx.Bucket(voteBucket).Get(voteKey(op.Kind, op.Validator, v)) != nil {
+			votes++
+		}
+	}
+	if 2*votes > len(set) {
+		// The set is stored from its first change on.
+		if b := tx.Bucket(validatorBucket); b == nil || firstKey(b) == nil {
+			for _, v := range set {
+				if err := put(validatorBucket, []byte(v), []byte{1}); err != nil {
+					return err
+				}
+			}
+		}
+		value := []byte{1}
+		if op.Kind == GovernanceRemove {
+			value = nil
+		}
+		if err := put(validatorBucket, []byte(op.Validator), value); err != nil {
+			return err
+		}
+
+		var stale [][]byte
+		prefixes := [][]byte{voteKey(GovernanceAdd, op.Validator, ""), voteKey(GovernanceRemove, op.Validator, "")}
+		c := tx.Bucket(voteBucket).Cursor()
+		for _, prefix := range prefixes {
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				stale = append(stale, append([]byte{}, k...))
+			}
+		}
+		for _, k := range stale {
+			if err := put(voteBucket, k, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return saveUndo(tx, t.Hash(), undo)
+}
+
+// GovernanceVote is a pending change to the validator set and the
+// validators who voted for it.
+type GovernanceVote struct {
+	Kind      string   `json:"kind"`
+	Validator string   `json:"validator"`
+	Voters    []string `json:"voters"`
+}
+
+// Validators returns the current validator set sorted by address, or nil
+// if the chain does not use proof of authority.
+func (bc *Blockchain) Validators() []string {
+	e, ok := bc.Params.Consensus.(*PoaEngine)
+	if !ok {
+		return nil
+	}
+	var set []string
+	bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		set = validatorSet(tx, e)
+		return nil
+	})
+	return set
+}
+
+// NextSealer returns the validator whose turn it is to seal the next
+// block, or "" if the chain does not use proof of authority.
+func (bc *Blockchain) NextSealer() string {
+	e, ok := bc.Params.Consensus.(*PoaEngine)
+	if !ok {
+		return ""
+	}
+	return e.sealerAt(bc.Validators(), bc.Height()+1)
+}
+
+// GovernanceVotes returns the pending governance votes ordered by kind and
+// validator.
+func (bc *Blockchain) GovernanceVotes() []GovernanceVote {
+	var votes []GovernanceVote
+	bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(voteBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			parts := bytes.SplitN(k, []byte{0}, 3)
+			if len(parts) != 3 {
+				return nil
+			}
+			kind, validator := string(parts[0]), string(parts[1])
+			if n := len(votes); n == 0 || votes[n-1].Kind != kind || votes[n-1].Validator != validator {
+				votes = append(votes, GovernanceVote{Kind: kind, Validator: validator})
+			}
+			votes[len(votes)-1].Voters = append(votes[len(votes)-1].Voters, string(parts[2]))
+			return nil
+		})
+	})
+	return votes
+}
@@ -0,0 +1,155 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// testKeys returns n wallets with fixed keys, sorted by address.
+func testKeys(t *testing.T, n int) []*Wallet {
+	t.Helper()
+	var keys []*Wallet
+	for i := 1; i <= n; i++ {
+		w, err := WalletFromPrivateKey(fmt.Sprintf("%064x", i*7919))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, w)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Address() < keys[j].Address() })
+	return keys
+}
+
+func poaChain(t *testing.T, validators []*Wallet) (*Blockchain, *PoaEngine) {
+	t.Helper()
+	spec := &GenesisSpec{Version: 2, Timestamp: 1790000000, Bits: "207fffff", ExtraData: "poa test", Consensus: "poa"}
+	for _, v := range validators {
+		spec.Validators = append(spec.Validators, v.Address())
+	}
+	params := regtestParams(t)
+	if err := params.SetGenesis(spec); err != nil {
+		t.Fatal(err)
+	}
+	bc := newTestChain(t, params)
+	return bc, bc.Params.Consensus.(*PoaEngine)
+}
+
+func TestPoaSealerRank(t *testing.T) {
+	outsider := NewWallet()
+	// A step seals the next block with validator sealer of the set sorted
+	// by address, or outsider if it is -1, and expects the block to get
+	// rank or to be refused with err.
+	type step struct {
+		sealer int
+		rank   int
+		err    error
+	}
+	tests := []struct {
+		name       string
+		validators int
+		steps      []step
+	}{
+		{"in turn", 3, []step{{1, 0, nil}, {2, 0, nil}, {0, 0, nil}, {1, 0, nil}}},
+		{"out of turn", 3, []step{{0, 1, nil}, {2, 0, nil}, {1, 1, nil}}},
+		{"twice in a row", 3, []step{{1, 0, nil}, {1, 0, ErrRecentSealer}}},
+		{"again after another", 3, []step{{1, 0, nil}, {0, 1, nil}, {1, 1, nil}}},
+		{"recent window of two", 4, []step{{1, 0, nil}, {2, 0, nil}, {1, 0, ErrRecentSealer}, {3, 0, nil}, {1, 1, nil}}},
+		{"single validator", 1, []step{{0, 0, nil}, {0, 0, nil}, {0, 0, nil}}},
+		{"outsider", 3, []step{{-1, 0, ErrNotValidator}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := testKeys(t, tt.validators)
+			bc, engine := poaChain(t, keys)
+			for i, s := range tt.steps {
+				engine.Key = outsider
+				if s.sealer >= 0 {
+					engine.Key = keys[s.sealer]
+				}
+				block, err := bc.AddBlock([]*Transaction{NewCoinbaseTx(bc.Params.ChainID, engine.Key.Address(), bc.Params.Subsidy(bc.Height()+1), bc.Height()+1)})
+				if s.err != nil {
+					if !errors.Is(err, s.err) {
+						t.Fatalf("step %d: error %v, want %v", i, err, s.err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				if block.Nonce != s.rank {
+					t.Errorf("step %d: rank %d, want %d", i, block.Nonce, s.rank)
+				}
+			}
+			if err := bc.Validate(); err != nil {
+				t.Errorf("chain invalid: %v", err)
+			}
+		})
+	}
+}
+
+func TestPoaVerifySealer(t *testing.T) {
+	keys := testKeys(t, 3)
+	a, engine := poaChain(t, keys)
+	engine.Key = keys[0] // Out of turn at height 1
+	block := mineTestBlock(t, a, "miner")
+	if block.Nonce != 1 {
+		t.Fatalf("rank %d, want 1", block.Nonce)
+	}
+
+	forge := func(rank int, key *Wallet) *Block {
+		forged := *block
+		forged.Nonce = rank
+		forged.Signer = key.PublicKey
+		sealSigned(&forged, key)
+		return &forged
+	}
+	tests := []struct {
+		name  string
+		block *Block
+		want  error
+	}{
+		{"claims to be in turn", forge(0, keys[0]), ErrBadSealer},
+		{"rank out of range", forge(2, keys[0]), ErrBadSeal},
+		{"negative rank", forge(-1, keys[0]), ErrBadSeal},
+		{"outsider", forge(1, NewWallet()), ErrBadSealer},
+		{"signed by another key", func() *Block { b := forge(1, keys[0]); b.R, b.S = keys[1].Sign(b.Hash); return b }(), ErrBadSeal},
+		{"as sealed", block, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := poaChain(t, keys)
+			err := b.ProcessBlock(tt.block)
+			if tt.want == nil && err != nil {
+				t.Fatalf("error %v, want none", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoaWorkPrefersInTurn(t *testing.T) {
+	keys := testKeys(t, 3)
+	inTurn, engine := poaChain(t, keys)
+	engine.Key = keys[1]
+	mineTestBlock(t, inTurn, "miner")
+
+	outOfTurn, engine := poaChain(t, keys)
+	engine.Key = keys[0]
+	mineTestBlock(t, outOfTurn, "miner")
+
+	if inTurn.ChainWork().Cmp(outOfTurn.ChainWork()) <= 0 {
+		t.Errorf("in-turn work %s, out-of-turn work %s", inTurn.ChainWork(), outOfTurn.ChainWork())
+	}
+	// The in-turn block replaces the out-of-turn one at the same height.
+	if err := outOfTurn.ProcessBlock(inTurn.Tip()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := outOfTurn.TipHash(), inTurn.TipHash(); !bytes.Equal(got, want) {
+		t.Errorf("tip %x, want the in-turn block %x", got, want)
+	}
+}
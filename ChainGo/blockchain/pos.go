@@ -0,0 +1,588 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// Stake operations.
+const (
+	StakeDeposit  = "deposit"
+	StakeWithdraw = "withdraw"
+)
+
+// ProposerTimeout is how long, in seconds, each proposer rank waits after
+// the one before it: the proposer of rank r may propose a block timestamped
+// r*ProposerTimeout seconds after its parent.
+const ProposerTimeout = 10
+
+var (
+	// stakeBucket holds the bonded stake of each address as a big-endian
+	// uint64, once a stake operation has changed it; while it is empty the
+	// stakes are the ones in PosEngine.Stakes.
+	stakeBucket = []byte("chaingo_stakes")
+	// slashBucket records each slashing as address and big-endian height
+	// -> nothing, so the same double-signing is punished once.
+	slashBucket = []byte("chaingo_slashes")
+)
+
+var (
+	ErrBadStakeOp  = errors.New("invalid stake operation")
+	ErrNoStake     = errors.New("insufficient stake")
+	ErrBadEvidence = errors.New("invalid slashing evidence")
+	ErrTooEarly    = errors.New("too early for this proposer")
+)
+
+// PosEngine is proof of stake. The proposers of each block are ranked by
+// drawing from the bonded stakes, weighted by amount, with the randomness
+// of the parent block: the output of the VRF proof its proposer made over
+// the seed before it and the height. No proposer can choose that output,
+// so none can steer who comes next. The proposer signs the block, and its
+// rank is the block nonce. The first ranked may propose at once, and each
+// next rank ProposerTimeout seconds later, so an offline staker does not
+// halt the chain. A block by the first ranked adds 2 to the work of its
+// branch and one by a backup 1, so the branch proposed in turn wins. A
+// validator who signs two blocks at the same height has its whole stake
+// burnt once anyone submits both headers as evidence; the submitter gets
+// nothing, so a validator can't win its stake back by reporting itself.
+type PosEngine struct {
+	// Stakes is the bonded stake of each address at genesis.
+	Stakes map[string]int
+	// Key is the key this node proposes blocks with; nil if it has no
+	// stake.
+	Key *Wallet
+}
+
+func (e *PosEngine) Name() string { return "pos" }
+
+// Prepare keeps the unused difficulty of the chain and names the proposer
+// with its VRF proof and rank. It fails if the rank of the proposer has
+// not come yet.
+func (e *PosEngine) Prepare(tx *bbolt.Tx, block *Block, parent *ParentState) error {
+	if e.Key == nil {
+		return fmt.Errorf("%w: this node has no validator key", ErrNotValidator)
+	}
+	if block.Version < 3 {
+		return fmt.Errorf("%w: block version %d cannot carry a VRF proof", ErrBadSeal, block.Version)
+	}
+	rank, err := e.proposerRank(tx, block, e.Key.Address())
+	if err != nil {
+		return err
+	}
+	proof, _, err := VRFProve(e.Key, vrfInput(parent.Seed, block.Height))
+	if err != nil {
+		return err
+	}
+	block.Bits = parent.Bits
+	block.Signer = e.Key.PublicKey
+	block.Proof = proof
+	block.Nonce = rank
+	return nil
+}
+
+func (e *PosEngine) Seal(block *Block) error {
+	sealSigned(block, e.Key)
+	return nil
+}
+
+func (e *PosEngine) VerifyHeader(block *Block, parent *ParentState) error {
+	if err := checkSigned(block, parent, 3); err != nil {
+		return err
+	}
+	if _, err := VRFVerify(block.Signer, vrfInput(parent.Seed, block.Height), block.Proof); err != nil {
+		return fmt.Errorf("%w: %w", ErrBadSeal, err)
+	}
+	return nil
+}
+
+// VerifySealer requires the proposer to have the rank the block claims in
+// the draw with the randomness of the parent block, and the block to be
+// timestamped no earlier than that rank may propose.
+func (e *PosEngine) VerifySealer(tx *bbolt.Tx, block *Block) error {
+	rank, err := e.proposerRank(tx, block, AddressFromPublicKey(block.Signer))
+	if err != nil {
+		return fmt.Errorf("%w: block %d: %w", ErrBadSealer, block.Height, err)
+	}
+	if rank != block.Nonce {
+		return fmt.Errorf("%w: block %d claims proposer rank %d, the proposer has rank %d", ErrBadSealer, block.Height, block.Nonce, rank)
+	}
+	return nil
+}
+
+func (e *PosEngine) Work(block *Block) *big.Int {
+	if block.Nonce == 0 {
+		return big.NewInt(2)
+	}
+	return big.NewInt(1)
+}
+
+// proposerRank returns the rank of address among the proposers of block,
+// failing if it has no stake or block is timestamped before its rank may
+// propose. A backup must also wait for its turn by the local clock, so
+// that it can't skip the wait with a timestamp in the future.
+func (e *PosEngine) proposerRank(tx *bbolt.Tx, block *Block, address string) (int, error) {
+	parent, err := getBlock(tx, block.PrevHash)
+	if err != nil {
+		return 0, err
+	}
+	rank := -1
+	for i, proposer := range rankProposers(stakeSet(tx, e), parent.Seed()) {
+		if proposer == address {
+			rank = i
+			break
+		}
+	}
+	if rank < 0 {
+		return 0, fmt.Errorf("%w: %s has no stake", ErrNotValidator, address)
+	}
+	from := parent.Timestamp + int64(rank)*ProposerTimeout
+	if block.Timestamp < from {
+		return 0, fmt.Errorf("%w: %s has rank %d for block %d and may propose from time %d", ErrTooEarly, address, rank, block.Height, from)
+	}
+	if now := time.Now().Unix(); rank > 0 && now < from {
+		return 0, fmt.Errorf("%w: %s has rank %d for block %d and may propose from time %d, it is %d", ErrTooEarly, address, rank, block.Height, from, now)
+	}
+	return rank, nil
+}
+
+// vrfInput is what the proposer of the block at height proves its VRF
+// output over.
+func vrfInput(seed []byte, height int) []byte {
+	return append(append([]byte{}, seed...), heightKey(height)...)
+}
+
+// Stake is the bonded stake of an address.
+type Stake struct {
+	Address string `json:"address"`
+	Amount  int    `json:"amount"`
+}
+
+// stakeSet returns the bonded stakes sorted by address.
+func stakeSet(tx *bbolt.Tx, e *PosEngine) []Stake {
+	var stakes []Stake
+	if b := tx.Bucket(stakeBucket); b != nil {
+		b.ForEach(func(k, v []byte) error {
+			stakes = append(stakes, Stake{Address: string(k), Amount: int(binary.BigEndian.Uint64(v))})
+			return nil
+		})
+	}
+	if len(stakes) == 0 {
+		for addr, amount := range e.Stakes {
+			stakes = append(stakes, Stake{Address: addr, Amount: amount})
+		}
+		sort.Slice(stakes, func(i, j int) bool { return stakes[i].Address < stakes[j].Address })
+	}
+	return stakes
+}
+
+func stakeOf(stakes []Stake, address string) int {
+	for _, s := range stakes {
+		if s.Address == address {
+			return s.Amount
+		}
+	}
+	return 0
+}
+
+func totalStake(stakes []Stake) int {
+	total := 0
+	for _, s := range stakes {
+		total += s.Amount
+	}
+	return total
+}
+
+// rankProposers orders the stakers for the block after the one with seed.
+// The first is drawn with seed, and each next one from the stakers not yet
+// drawn with seed hashed with its rank.
+func rankProposers(stakes []Stake, seed []byte) []string {
+	left := append([]Stake{}, stakes...)
+	var ranks []string
+	for rank := 0; len(left) > 0; rank++ {
+		draw := seed
+		if rank > 0 {
+			sum := sha256.Sum256(append(append([]byte{}, seed...), heightKey(rank)...))
+			draw = sum[:]
+		}
+		proposer := drawProposer(left, draw)
+		if proposer == "" {
+			break
+		}
+		ranks = append(ranks, proposer)
+		for i, s := range left {
+			if s.Address == proposer {
+				left = append(left[:i], left[i+1:]...)
+				break
+			}
+		}
+	}
+	return ranks
+}
+
+// drawProposer picks an address with probability proportional to its
+// stake, taking seed as a number below the total stake.
+func drawProposer(stakes []Stake, seed []byte) string {
+	total := totalStake(stakes)
+	if total == 0 {
+		return ""
+	}
+	r := new(big.Int).Mod(new(big.Int).SetBytes(seed), big.NewInt(int64(total))).Int64()
+	for _, s := range stakes {
+		if r < int64(s.Amount) {
+			return s.Address
+		}
+		r -= int64(s.Amount)
+	}
+	return ""
+}
+
+// putStake journals a change to the stake of address, storing the genesis
+// stakes first if the bucket is still empty.
+func putStake(tx *bbolt.Tx, e *PosEngine, address string, amount int, undo *[]stateChange) error {
+	if b := tx.Bucket(stakeBucket); b == nil || firstKey(b) == nil {
+		for _, s := range stakeSet(tx, e) {
+			change, err := putState(tx, stakeBucket, []byte(s.Address), heightKey(s.Amount))
+			*undo = append(*undo, change)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	var value []byte
+	if amount > 0 {
+		value = heightKey(amount)
+	}
+	change, err := putState(tx, stakeBucket, []byte(address), value)
+	*undo = append(*undo, change)
+	return err
+}
+
+// StakeOp bonds or unbonds coins of From:
+//
+//   - deposit moves Amount coins of From into its stake. The inputs pay
+//     for it on top of the outputs and fee.
+//   - withdraw takes Amount out of the stake of From and pays it as the
+//     first output, to From, released no earlier than
+//     ChainParams.StakeUnbonding blocks after the block it is in.
+//
+// The bonded stakes can never all be withdrawn.
+type StakeOp struct {
+	Kind   string `json:"kind"`
+	Amount int    `json:"amount"`
+}
+
+// SlashEvidence is a pair of headers a validator signed at the same
+// height, each extending a block stored on this chain. Transactions are
+// left out of the blocks; the headers commit to them.
+type SlashEvidence struct {
+	First  *Block `json:"first"`
+	Second *Block `json:"second"`
+}
+
+// NewStakeTransaction builds an unsigned stake transaction from the
+// spendable outputs of from, returning the change to from. A withdrawal is
+// released at releaseHeight.
+func NewStakeTransaction(chainID uint32, from string, op *StakeOp, fee int, nonce uint64, spendable []UTXO, releaseHeight int) (*Transaction, error) {
+	if fee < 0 {
+		return nil, fmt.Errorf("%w: fee %d is negative", ErrInvalidAmount, fee)
+	}
+	tx := &Transaction{
+		Version: TxVersion,
+		From:    from,
+		Fee:     fee,
+		Nonce:   nonce,
+		ChainID: chainID,
+		Stake:   op,
+	}
+	need := fee
+	if op.Kind == StakeDeposit {
+		need += op.Amount
+	}
+	if err := tx.fund(need, spendable); err != nil {
+		return nil, err
+	}
+	if op.Kind == StakeWithdraw {
+		payout := TxOutput{Amount: op.Amount, Address: from, ReleaseHeight: releaseHeight}
+		tx.Outputs = append([]TxOutput{payout}, tx.Outputs...)
+	}
+	if err := tx.CheckStake(); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// NewSlashTransaction builds an unsigned transaction submitting evidence
+// that the signer of first and second signed both, paying fee.
+func NewSlashTransaction(chainID uint32, from string, first, second *Block, fee int, nonce uint64, spendable []UTXO) (*Transaction, error) {
+	if fee < 0 {
+		return nil, fmt.Errorf("%w: fee %d is negative", ErrInvalidAmount, fee)
+	}
+	header := func(b *Block) *Block {
+		h := *b
+		h.Transactions = nil
+		return &h
+	}
+	tx := &Transaction{
+		Version:  TxVersion,
+		From:     from,
+		Fee:      fee,
+		Nonce:    nonce,
+		ChainID:  chainID,
+		Evidence: &SlashEvidence{First: header(first), Second: header(second)},
+	}
+	if err := tx.CheckEvidence(); err != nil {
+		return nil, err
+	}
+	if err := tx.fundFee(spendable); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// stakeFlow returns the coins a stake transaction takes from its inputs
+// into the stake, and the coins it pays out of the stake.
+func (tx *Transaction) stakeFlow() (deposited, withdrawn int) {
+	switch op := tx.Stake; {
+	case op == nil:
+	case op.Kind == StakeDeposit:
+		deposited = op.Amount
+	case op.Kind == StakeWithdraw:
+		withdrawn = op.Amount
+	}
+	return deposited, withdrawn
+}
+
+// CheckStake checks the shape of a stake transaction. The stake and the
+// release height of a withdrawal are checked when it is connected.
+func (tx *Transaction) CheckStake() error {
+	op := tx.Stake
+	if op == nil {
+		return nil
+	}
+	if tx.IsCoinbase() {
+		return fmt.Errorf("%w: coinbase carries a stake operation", ErrBadStakeOp)
+	}
+	if tx.Version < 3 {
+		return fmt.Errorf("%w: transaction version %d", ErrBadStakeOp, tx.Version)
+	}
+	if tx.Contract != nil || tx.Token != nil || tx.Name != nil || tx.Governance != nil || tx.Evidence != nil {
+		return fmt.Errorf("%w: transaction also carries another operation", ErrBadStakeOp)
+	}
+	if tx.Amount != 0 {
+		return fmt.Errorf("%w: coin amount is %d, set the stake amount instead", ErrBadStakeOp, tx.Amount)
+	}
+	if op.Amount <= 0 {
+		return fmt.Errorf("%w: amount %d must be positive", ErrBadStakeOp, op.Amount)
+	}
+	switch op.Kind {
+	case StakeDeposit:
+	case StakeWithdraw:
+		if len(tx.Outputs) == 0 {
+			return fmt.Errorf("%w: withdrawal pays no output", ErrBadStakeOp)
+		}
+		if out := tx.Outputs[0]; out.Address != tx.From || out.Amount != op.Amount || len(out.Script) > 0 {
+			return fmt.Errorf("%w: first output must pay %d to %s", ErrBadStakeOp, op.Amount, tx.From)
+		}
+	default:
+		return fmt.Errorf("%w: unknown kind %q", ErrBadStakeOp, op.Kind)
+	}
+	return nil
+}
+
+// CheckEvidence checks that the evidence of a slashing transaction shows
+// one key signing two different headers at the same height.
+func (tx *Transaction) CheckEvidence() error {
+	ev := tx.Evidence
+	if ev == nil {
+		return nil
+	}
+	if tx.IsCoinbase() {
+		return fmt.Errorf("%w: coinbase carries evidence", ErrBadEvidence)
+	}
+	if tx.Version < 3 {
+		return fmt.Errorf("%w: transaction version %d", ErrBadEvidence, tx.Version)
+	}
+	if tx.Contract != nil || tx.Token != nil || tx.Name != nil || tx.Governance != nil || tx.Stake != nil {
+		return fmt.Errorf("%w: transaction also carries another operation", ErrBadEvidence)
+	}
+	if tx.Amount != 0 {
+		return fmt.Errorf("%w: coin amount is %d, evidence pays only the fee", ErrBadEvidence, tx.Amount)
+	}
+	if ev.First == nil || ev.Second == nil {
+		return fmt.Errorf("%w: two headers are needed", ErrBadEvidence)
+	}
+	if ev.First.Height != ev.Second.Height {
+		return fmt.Errorf("%w: heights %d and %d differ", ErrBadEvidence, ev.First.Height, ev.Second.Height)
+	}
+	if !bytes.Equal(ev.First.Signer, ev.Second.Signer) || len(ev.First.Signer) == 0 {
+		return fmt.Errorf("%w: headers have different signers", ErrBadEvidence)
+	}
+	if bytes.Equal(ev.First.HeaderHash(), ev.Second.HeaderHash()) {
+		return fmt.Errorf("%w: headers are the same", ErrBadEvidence)
+	}
+	for _, b := range []*Block{ev.First, ev.Second} {
+		if len(b.Transactions) > 0 {
+			return fmt.Errorf("%w: evidence carries transactions", ErrBadEvidence)
+		}
+		if b.Version < 3 || !VerifySignature(b.Signer, b.HeaderHash(), b.R, b.S) {
+			return fmt.Errorf("%w: header %x is not signed by its signer", ErrBadEvidence, b.HeaderHash())
+		}
+	}
+	return nil
+}
+
+func slashKey(address string, height int) []byte {
+	return append([]byte(address), heightKey(height)...)
+}
+
+// checkStake checks a stake operation or slashing evidence against the
+// bonded stakes at height. It runs with the other checks of connectTx,
+// before anything is written.
+func checkStake(tx *bbolt.Tx, t *Transaction, height int, p *ChainParams) error {
+	if t.Stake == nil && t.Evidence == nil {
+		return nil
+	}
+	e, ok := p.Consensus.(*PosEngine)
+	if !ok {
+		return fmt.Errorf("%w: the chain does not use proof of stake", ErrBadStakeOp)
+	}
+	stakes := stakeSet(tx, e)
+	total := totalStake(stakes)
+
+	if ev := t.Evidence; ev != nil {
+		// Both headers must extend blocks of this chain, so that headers
+		// a validator signed on another network can't slash it here.
+		for _, b := range []*Block{ev.First, ev.Second} {
+			parent, err := getNode(tx, b.PrevHash)
+			if err != nil {
+				return fmt.Errorf("%w: header %x does not extend this chain", ErrBadEvidence, b.HeaderHash())
+			}
+			if parent.Height != b.Height-1 {
+				return fmt.Errorf("%w: header %x at height %d extends block %d", ErrBadEvidence, b.HeaderHash(), b.Height, parent.Height)
+			}
+		}
+		offender := AddressFromPublicKey(ev.First.Signer)
+		stake := stakeOf(stakes, offender)
+		if stake == 0 {
+			return fmt.Errorf("%w: %s has no stake to slash", ErrBadEvidence, offender)
+		}
+		if b := tx.Bucket(slashBucket); b != nil && b.Get(slashKey(offender, ev.First.Height)) != nil {
+			return fmt.Errorf("%w: %s was already slashed for height %d", ErrBadEvidence, offender, ev.First.Height)
+		}
+		if stake == total {
+			return fmt.Errorf("%w: %s holds all the stake", ErrBadEvidence, offender)
+		}
+		return nil
+	}
+
+	op := t.Stake
+	switch op.Kind {
+	case StakeDeposit:
+		if total+op.Amount < total {
+			return fmt.Errorf("%w: total stake overflows", ErrBadStakeOp)
+		}
+	case StakeWithdraw:
+		if stake := stakeOf(stakes, t.From); stake < op.Amount {
+			return fmt.Errorf("%w: %s has %d bonded, withdraws %d", ErrNoStake, t.From, stake, op.Amount)
+		}
+		if op.Amount == total {
+			return fmt.Errorf("%w: the last stake can't be withdrawn", ErrBadStakeOp)
+		}
+		if release := t.Outputs[0].ReleaseHeight; release < height+p.StakeUnbonding {
+			return fmt.Errorf("%w: withdrawal released at height %d, unbonding lasts until %d", ErrBadStakeOp, release, height+p.StakeUnbonding)
+		}
+	}
+	return nil
+}
+
+// applyStake changes the bonded stake for a stake operation, or burns the
+// stake of the signer of slashing evidence, journaling the writes so that
+// they can be undone.
+func applyStake(tx *bbolt.Tx, t *Transaction, p *ChainParams) error {
+	e := p.Consensus.(*PosEngine)
+	stakes := stakeSet(tx, e)
+	var undo []stateChange
+
+	if ev := t.Evidence; ev != nil {
+		offender := AddressFromPublicKey(ev.First.Signer)
+		if err := putStake(tx, e, offender, 0, &undo); err != nil {
+			return err
+		}
+		change, err := putState(tx, slashBucket, slashKey(offender, ev.First.Height), []byte{1})
+		undo = append(undo, change)
+		if err != nil {
+			return err
+		}
+		return saveUndo(tx, t.Hash(), undo)
+	}
+
+	amount := stakeOf(stakes, t.From)
+	if t.Stake.Kind == StakeDeposit {
+		amount += t.Stake.Amount
+	} else {
+		amount -= t.Stake.Amount
+	}
+	if err := putStake(tx, e, t.From, amount, &undo); err != nil {
+		return err
+	}
+	return saveUndo(tx, t.Hash(), undo)
+}
+
+// Slash is a recorded slashing.
+type Slash struct {
+	Address string `json:"address"`
+	Height  int    `json:"height"`
+}
+
+// Stakes returns the bonded stakes sorted by address, or nil if the chain
+// does not use proof of stake.
+func (bc *Blockchain) Stakes() []Stake {
+	e, ok := bc.Params.Consensus.(*PosEngine)
+	if !ok {
+		return nil
+	}
+	var stakes []Stake
+	bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		stakes = stakeSet(tx, e)
+		return nil
+	})
+	return stakes
+}
+
+// NextProposer returns the address drawn to propose the next block, or ""
+// if the chain does not use proof of stake.
+func (bc *Blockchain) NextProposer() string {
+	stakes := bc.Stakes()
+	if stakes == nil {
+		return ""
+	}
+	return drawProposer(stakes, bc.Tip().Seed())
+}
+
+// Slashes returns the recorded slashings ordered by address and height.
+func (bc *Blockchain) Slashes() []Slash {
+	var slashes []Slash
+	bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(slashBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if len(k) < 8 {
+				return nil
+			}
+			n := len(k) - 8
+			slashes = append(slashes, Slash{Address: string(k[:n]), Height: int(binary.BigEndian.Uint64(k[n:]))})
+			return nil
+		})
+	})
+	return slashes
+}
@@ -0,0 +1,205 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+func TestRankProposers(t *testing.T) {
+	seed := sha256.Sum256([]byte("seed"))
+	tests := []struct {
+		name   string
+		stakes []Stake
+		want   int // Number ranked
+	}{
+		{"none", nil, 0},
+		{"one", []Stake{{"a", 10}}, 1},
+		{"equal", []Stake{{"a", 5}, {"b", 5}, {"c", 5}}, 3},
+		{"uneven", []Stake{{"a", 1}, {"b", 1000}, {"c", 30}}, 3},
+		{"zero stake is not ranked", []Stake{{"a", 5}, {"b", 0}, {"c", 5}}, 2},
+		{"all zero", []Stake{{"a", 0}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranks := rankProposers(tt.stakes, seed[:])
+			if len(ranks) != tt.want {
+				t.Fatalf("ranked %v, want %d proposers", ranks, tt.want)
+			}
+			seen := make(map[string]bool)
+			for _, addr := range ranks {
+				if seen[addr] || stakeOf(tt.stakes, addr) <= 0 {
+					t.Fatalf("ranked %v: %s twice or without stake", ranks, addr)
+				}
+				seen[addr] = true
+			}
+			if len(ranks) > 0 && ranks[0] != drawProposer(tt.stakes, seed[:]) {
+				t.Errorf("first ranked %s, drawn %s", ranks[0], drawProposer(tt.stakes, seed[:]))
+			}
+			if again := rankProposers(tt.stakes, seed[:]); fmt.Sprint(again) != fmt.Sprint(ranks) {
+				t.Errorf("ranked %v, then %v", ranks, again)
+			}
+		})
+	}
+}
+
+func TestDrawProposerWeights(t *testing.T) {
+	stakes := []Stake{{"a", 600}, {"b", 300}, {"c", 100}}
+	const draws = 6000
+	counts := make(map[string]int)
+	for i := 0; i < draws; i++ {
+		seed := sha256.Sum256([]byte(fmt.Sprint(i)))
+		counts[drawProposer(stakes, seed[:])]++
+	}
+	for _, s := range stakes {
+		want := draws * s.Amount / totalStake(stakes)
+		if got := counts[s.Address]; got < want*9/10 || got > want*11/10 {
+			t.Errorf("%s drawn %d times, want about %d", s.Address, got, want)
+		}
+	}
+}
+
+func posChain(t *testing.T, stakers []*Wallet) (*Blockchain, *PosEngine) {
+	t.Helper()
+	spec := &GenesisSpec{Version: 3, Timestamp: 1790000000, Bits: "207fffff", ExtraData: "pos test", Consensus: "pos", Stakes: map[string]int{}}
+	for i, s := range stakers {
+		spec.Stakes[s.Address()] = 100 * (i + 1)
+	}
+	params := regtestParams(t)
+	if err := params.SetGenesis(spec); err != nil {
+		t.Fatal(err)
+	}
+	bc := newTestChain(t, params)
+	return bc, bc.Params.Consensus.(*PosEngine)
+}
+
+func TestProposerRank(t *testing.T) {
+	keys := testKeys(t, 3)
+	bc, engine := posChain(t, keys)
+	genesis := bc.Tip()
+
+	var ranks []string
+	bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		ranks = rankProposers(stakeSet(tx, engine), genesis.Seed())
+		return nil
+	})
+	if len(ranks) != len(keys) {
+		t.Fatalf("ranked %v", ranks)
+	}
+
+	type check struct {
+		name    string
+		address string
+		delay   int64 // Seconds after the parent
+		rank    int
+		err     error
+	}
+	checks := []check{{"outsider", NewWallet().Address(), 100, 0, ErrNotValidator}}
+	for r, addr := range ranks {
+		checks = append(checks, check{fmt.Sprintf("rank %d on time", r), addr, int64(r) * ProposerTimeout, r, nil})
+		checks = append(checks, check{fmt.Sprintf("rank %d later", r), addr, int64(r)*ProposerTimeout + 1000, r, nil})
+		if r > 0 {
+			checks = append(checks, check{fmt.Sprintf("rank %d early", r), addr, int64(r)*ProposerTimeout - 1, 0, ErrTooEarly})
+		}
+	}
+	for _, c := range checks {
+		t.Run(c.name, func(t *testing.T) {
+			block := &Block{Height: 1, PrevHash: genesis.Hash, Timestamp: genesis.Timestamp + c.delay}
+			var rank int
+			var err error
+			bc.DB.DB.View(func(tx *bbolt.Tx) error {
+				rank, err = engine.proposerRank(tx, block, c.address)
+				return nil
+			})
+			if c.err != nil {
+				if !errors.Is(err, c.err) {
+					t.Fatalf("error %v, want %v", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rank != c.rank {
+				t.Errorf("rank %d, want %d", rank, c.rank)
+			}
+		})
+	}
+}
+
+func TestPosProposeAndVerify(t *testing.T) {
+	keys := testKeys(t, 3)
+	a, engine := posChain(t, keys)
+	byAddress := make(map[string]*Wallet)
+	for _, k := range keys {
+		byAddress[k.Address()] = k
+	}
+	ranked := func(bc *Blockchain) []string {
+		var ranks []string
+		bc.DB.DB.View(func(tx *bbolt.Tx) error {
+			ranks = rankProposers(stakeSet(tx, engine), bc.Tip().Seed())
+			return nil
+		})
+		return ranks
+	}
+
+	// The genesis block is long past, so any rank may propose block 1, but
+	// only the first may follow a block made just now.
+	engine.Key = byAddress[ranked(a)[0]]
+	first := mineTestBlock(t, a, "miner")
+	if first.Nonce != 0 {
+		t.Fatalf("rank %d, want 0", first.Nonce)
+	}
+	engine.Key = byAddress[ranked(a)[1]]
+	if _, err := a.AddBlock([]*Transaction{NewCoinbaseTx(a.Params.ChainID, "miner", a.Params.Subsidy(2), 2)}); !errors.Is(err, ErrTooEarly) {
+		t.Fatalf("backup proposing at once: error %v, want %v", err, ErrTooEarly)
+	}
+	// Nor may it skip the wait with a timestamp in the future.
+	ahead := &Block{Height: 2, PrevHash: first.Hash, Timestamp: first.Timestamp + ProposerTimeout}
+	var err error
+	a.DB.DB.View(func(tx *bbolt.Tx) error {
+		_, err = engine.proposerRank(tx, ahead, ranked(a)[1])
+		return nil
+	})
+	if !errors.Is(err, ErrTooEarly) {
+		t.Fatalf("backup timestamped in the future: error %v, want %v", err, ErrTooEarly)
+	}
+
+	forge := func(edit func(b *Block)) *Block {
+		forged := *first
+		edit(&forged)
+		sealSigned(&forged, byAddress[AddressFromPublicKey(forged.Signer)])
+		return &forged
+	}
+	other := byAddress[ranked(a)[1]]
+	tests := []struct {
+		name  string
+		block *Block
+		want  error
+	}{
+		{"as proposed", first, nil},
+		{"claims another rank", forge(func(b *Block) { b.Nonce = 1 }), ErrBadSealer},
+		{"proof of another block", forge(func(b *Block) { b.Proof = append([]byte{}, b.Proof...); b.Proof[len(b.Proof)-1] ^= 1 }), ErrBadSeal},
+		{"proof by another proposer", forge(func(b *Block) { b.Signer = other.PublicKey }), ErrBadSeal},
+		{"no proof", forge(func(b *Block) { b.Proof = nil }), ErrBadSeal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := posChain(t, keys)
+			err := b.ProcessBlock(tt.block)
+			if tt.want == nil && err != nil {
+				t.Fatalf("error %v, want none", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("error %v, want %v", err, tt.want)
+			}
+			if tt.want == nil && !bytes.Equal(b.TipHash(), tt.block.Hash) {
+				t.Errorf("tip %x, want %x", b.TipHash(), tt.block.Hash)
+			}
+		})
+	}
+}
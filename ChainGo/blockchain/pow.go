@@ -9,36 +9,44 @@ import (
 	"math/big"
 )
 
-const targetBits = 16
-
 type ProofOfWork struct {
 	block  *Block
 	target *big.Int
 }
 
+// NewProofOfWork prepares mining or validation of b against the target
+// encoded in its own Bits field.
 func NewProofOfWork(b *Block) *ProofOfWork {
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256-targetBits))
+	target := CompactToBig(b.Bits)
 	return &ProofOfWork{b, target}
 }
 
+// prepareData returns the header that is hashed with nonce: the canonical
+// header from version 1 on, and the older fixed layout before that.
 func (pow *ProofOfWork) prepareData(nonce int) []byte {
+	if pow.block.Version > 0 {
+		var e Encoder
+		e.EncodeHeader(pow.block, nonce)
+		return e.Bytes()
+	}
 	timestampBytes := make([]byte, 8)
 	binary.BigEndian.PutUint64(timestampBytes, uint64(pow.block.Timestamp))
-
-	// Hash all transactions to include in the block data
-	txHashes := [][]byte{}
-	for _, tx := range pow.block.Transactions {
-		txHashes = append(txHashes, tx.Hash())
-	}
-	txHash := sha256.Sum256(bytes.Join(txHashes, []byte{}))
+	bitsBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(bitsBytes, pow.block.Bits)
 
 	data := bytes.Join([][]byte{
+		IntToHex(int64(pow.block.Height)),
 		timestampBytes,
-		txHash[:],
+		pow.block.MerkleRoot,
 		pow.block.PrevHash,
+		bitsBytes,
 		IntToHex(int64(nonce)),
 	}, []byte{})
+	// Appended only when set, so blocks from before contracts keep their
+	// hashes.
+	if len(pow.block.StateRoot) > 0 {
+		data = append(data, pow.block.StateRoot...)
+	}
 	return data
 }
 
@@ -62,6 +70,9 @@ func (pow *ProofOfWork) Run() ([]byte, int) {
 }
 
 func (pow *ProofOfWork) Validate() bool {
+	if pow.target.Sign() <= 0 {
+		return false
+	}
 	var hashInt big.Int
 	data := pow.prepareData(pow.block.Nonce)
 	hash := sha256.Sum256(data)
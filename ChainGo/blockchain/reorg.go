@@ -0,0 +1,278 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// maxReorgEvents bounds how many reorganisations are remembered.
+const maxReorgEvents = 100
+
+var (
+	ErrKnownBlock   = errors.New("block already known")
+	ErrOrphanBlock  = errors.New("parent block unknown")
+	ErrInvalidChain = errors.New("block extends an invalid block")
+)
+
+// ReorgEvent records a switch of the best chain to a branch with more work.
+type ReorgEvent struct {
+	Time         int64  `json:"time"`
+	OldTip       string `json:"oldTip"`
+	NewTip       string `json:"newTip"`
+	ForkHeight   int    `json:"forkHeight"`
+	Depth        int    `json:"depth"` // Blocks disconnected from the old chain
+	Connected    int    `json:"connected"`
+	OrphanedTxs  int    `json:"orphanedTxs"`
+	OldChainWork string `json:"oldChainWork"`
+	NewChainWork string `json:"newChainWork"`
+}
+
+// ForkInfo describes the tip of a stored branch.
+type ForkInfo struct {
+	Hash       string `json:"hash"`
+	Height     int    `json:"height"`
+	ChainWork  string `json:"chainWork"`
+	ForkHeight int    `json:"forkHeight"`
+	Length     int    `json:"length"` // Blocks on the branch after the fork point
+	Active     bool   `json:"active"`
+}
+
+// ProcessBlock accepts a block received from a peer. The block is stored
+// even when it extends a side branch; if its branch then has more
+// cumulative work than the best chain, the chain is reorganised onto it in
+// a single database transaction. OnTipChange is called after the tip moved.
+// A block that fails to connect is remembered as invalid, and so is every
+// block received on top of it, so that a branch is only tried once.
+func (bc *Blockchain) ProcessBlock(block *Block) error {
+	disconnected, connected, err := bc.processBlock(block)
+	if err != nil {
+		return err
+	}
+	if len(connected) > 0 && bc.OnTipChange != nil {
+		bc.OnTipChange(disconnected, connected)
+	}
+	return nil
+}
+
+func (bc *Blockchain) processBlock(block *Block) (disconnected, connected []*Block, err error) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	var node *blockNode
+	var invalid []byte
+	err = bc.DB.DB.Update(func(tx *bbolt.Tx) error {
+		if known, _ := getNode(tx, block.Hash); known != nil {
+			return fmt.Errorf("%w: %x", ErrKnownBlock, block.Hash)
+		}
+		if isInvalid(tx, block.Hash) || isInvalid(tx, block.PrevHash) {
+			invalid = block.Hash
+			return fmt.Errorf("%w: %x", ErrInvalidChain, block.Hash)
+		}
+		parent, err := getNode(tx, block.PrevHash)
+		if err != nil {
+			return fmt.Errorf("%w: %x", ErrOrphanBlock, block.PrevHash)
+		}
+		state, err := bc.parentState(tx, block.PrevHash)
+		if err != nil {
+			return err
+		}
+		if err := bc.Params.ValidateBlock(block, state); err != nil {
+			return err
+		}
+
+		node = &blockNode{
+			Hash:      block.Hash,
+			PrevHash:  block.PrevHash,
+			Height:    block.Height,
+			ChainWork: new(big.Int).Add(parent.ChainWork, bc.Params.Consensus.Work(block)),
+		}
+		if err := storeBlock(tx, block, node); err != nil {
+			return err
+		}
+		if node.ChainWork.Cmp(bc.chainWork) <= 0 {
+			return nil
+		}
+
+		disconnected, connected, err = reorganize(tx, bc.tip, node, bc.Params, &invalid)
+		return err
+	})
+	// A proposer that is early may be on time once the clock catches up.
+	if invalid != nil && !errors.Is(err, ErrTooEarly) {
+		if markErr := bc.DB.DB.Update(func(tx *bbolt.Tx) error { return markInvalid(tx, invalid) }); markErr != nil {
+			return nil, nil, markErr
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(connected) == 0 {
+		return nil, nil, nil
+	}
+
+	if len(disconnected) > 0 {
+		orphaned := 0
+		for _, b := range disconnected {
+			orphaned += len(b.Transactions) - 1
+		}
+		bc.recordReorg(ReorgEvent{
+			Time:         time.Now().Unix(),
+			OldTip:       fmt.Sprintf("%x", bc.tip),
+			NewTip:       fmt.Sprintf("%x", node.Hash),
+			ForkHeight:   connected[0].Height - 1,
+			Depth:        len(disconnected),
+			Connected:    len(connected),
+			OrphanedTxs:  orphaned,
+			OldChainWork: bc.chainWork.String(),
+			NewChainWork: node.ChainWork.String(),
+		})
+	}
+	bc.setTip(node)
+	bc.cache.add(block)
+	return disconnected, connected, nil
+}
+
+// reorganize moves the chain state from oldTip to the branch ending at
+// node: blocks back to the fork point are disconnected using their undo
+// data, then the branch is connected in height order. Blocks are returned
+// in the order they were disconnected and connected. If the branch holds a
+// block known to be invalid, node is set in invalid, and if a block fails
+// to connect, that block.
+func reorganize(tx *bbolt.Tx, oldTip []byte, node *blockNode, p *ChainParams, invalid *[]byte) (disconnected, connected []*Block, err error) {
+	// Walk the new branch back until it meets the best chain.
+	var branch []*Block
+	fork := node
+	for !bytes.Equal(hashAtHeight(tx, fork.Height), fork.Hash) {
+		if isInvalid(tx, fork.Hash) {
+			*invalid = node.Hash
+			return nil, nil, fmt.Errorf("%w: block %d %x is invalid", ErrInvalidChain, fork.Height, fork.Hash)
+		}
+		block, err := getBlock(tx, fork.Hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		branch = append(branch, block)
+		if fork, err = getNode(tx, fork.PrevHash); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	tip := oldTip
+	for !bytes.Equal(tip, fork.Hash) {
+		block, err := getBlock(tx, tip)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := disconnectTipTx(tx, block); err != nil {
+			return nil, nil, fmt.Errorf("disconnect block %d: %w", block.Height, err)
+		}
+		disconnected = append(disconnected, block)
+		tip = block.PrevHash
+	}
+
+	for i := len(branch) - 1; i >= 0; i-- {
+		block := branch[i]
+		n, err := getNode(tx, block.Hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := connectTipTx(tx, block, n, p); err != nil {
+			*invalid = block.Hash
+			return nil, nil, fmt.Errorf("connect block %d: %w", block.Height, err)
+		}
+		connected = append(connected, block)
+	}
+	return disconnected, connected, nil
+}
+
+// branchBlockAt returns a lookup of the ancestors of the block with hash
+// tip, used to compute the difficulty of blocks on side branches.
+func branchBlockAt(tx *bbolt.Tx, tip []byte) func(int) *Block {
+	return func(height int) *Block {
+		hash := tip
+		for {
+			node, err := getNode(tx, hash)
+			if err != nil {
+				return nil
+			}
+			if node.Height == height {
+				block, _ := getBlock(tx, node.Hash)
+				return block
+			}
+			if bytes.Equal(hashAtHeight(tx, node.Height), node.Hash) {
+				block, _ := getBlockAtHeight(tx, height)
+				return block
+			}
+			hash = node.PrevHash
+		}
+	}
+}
+
+func (bc *Blockchain) recordReorg(event ReorgEvent) {
+	bc.reorgs = append(bc.reorgs, event)
+	if len(bc.reorgs) > maxReorgEvents {
+		bc.reorgs = bc.reorgs[len(bc.reorgs)-maxReorgEvents:]
+	}
+}
+
+// Reorgs returns the reorganisations seen since the node started, oldest
+// first.
+func (bc *Blockchain) Reorgs() []ReorgEvent {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return append([]ReorgEvent{}, bc.reorgs...)
+}
+
+// Forks returns the tips of all stored branches, including the best chain.
+func (bc *Blockchain) Forks() ([]ForkInfo, error) {
+	tip := bc.TipHash()
+	var forks []ForkInfo
+	err := bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(indexBucket)
+		if b == nil {
+			return nil
+		}
+		hasChild := make(map[string]bool)
+		var nodes []*blockNode
+		err := b.ForEach(func(k, v []byte) error {
+			node, err := getNode(tx, k)
+			if err != nil {
+				return err
+			}
+			hasChild[string(node.PrevHash)] = true
+			nodes = append(nodes, node)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+	branches:
+		for _, node := range nodes {
+			if hasChild[string(node.Hash)] {
+				continue
+			}
+			fork := node
+			for !bytes.Equal(hashAtHeight(tx, fork.Height), fork.Hash) {
+				if fork, err = getNode(tx, fork.PrevHash); err != nil {
+					// The fork point was truncated away.
+					continue branches
+				}
+			}
+			forks = append(forks, ForkInfo{
+				Hash:       fmt.Sprintf("%x", node.Hash),
+				Height:     node.Height,
+				ChainWork:  node.ChainWork.String(),
+				ForkHeight: fork.Height,
+				Length:     node.Height - fork.Height,
+				Active:     bytes.Equal(node.Hash, tip),
+			})
+		}
+		return nil
+	})
+	return forks, err
+}
@@ -0,0 +1,419 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Vishal-2029/pkg"
+	"go.etcd.io/bbolt"
+)
+
+// newTestChain opens a chain with params in a temporary database.
+func newTestChain(t *testing.T, params *ChainParams) *Blockchain {
+	t.Helper()
+	db, err := pkg.NewBoltDB(filepath.Join(t.TempDir(), "chain.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	bc, err := NewBlockchain(db, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bc
+}
+
+func regtestParams(t *testing.T) *ChainParams {
+	t.Helper()
+	params, err := NetworkParams(RegtestParams.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return params
+}
+
+// mineTestBlock adds a block of txs to bc, paying the reward to miner.
+func mineTestBlock(t *testing.T, bc *Blockchain, miner string, txs ...*Transaction) *Block {
+	t.Helper()
+	height := bc.Height() + 1
+	reward := bc.Params.Subsidy(height)
+	for _, tx := range txs {
+		reward += tx.Fee
+	}
+	coinbase := NewCoinbaseTx(bc.Params.ChainID, miner, reward, height)
+	block, err := bc.AddBlock(append([]*Transaction{coinbase}, txs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// spendable returns the outputs of address that can be spent in the next
+// block.
+func spendable(t *testing.T, bc *Blockchain, address string) []UTXO {
+	t.Helper()
+	utxos, err := bc.UTXO.FindByAddress(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []UTXO
+	for _, u := range utxos {
+		if bc.Params.IsMature(u, bc.Height()+1) && IsReleased(u.Output, bc.Height()+1) {
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+// stateDump returns every entry of the chain state.
+func stateDump(t *testing.T, bc *Blockchain) map[string]string {
+	t.Helper()
+	dump := make(map[string]string)
+	err := bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		for _, name := range stateBuckets {
+			b := tx.Bucket(name)
+			if b == nil {
+				continue
+			}
+			b.ForEach(func(k, v []byte) error {
+				dump[fmt.Sprintf("%s/%x", name, k)] = fmt.Sprintf("%x", v)
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dump
+}
+
+func diffDumps(t *testing.T, what string, got, want map[string]string) {
+	t.Helper()
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: %s is %q, want %q", what, k, got[k], v)
+		}
+	}
+	for k, v := range got {
+		if _, ok := want[k]; !ok {
+			t.Errorf("%s: extra %s = %q", what, k, v)
+		}
+	}
+}
+
+// TestReorgUndoRoundTrip connects a block of each kind of state change on
+// one branch, disconnects and reconnects it, and then reorganizes to a
+// longer branch without it. Each time the state must match exactly what
+// connecting the blocks of the best chain from genesis gives.
+func TestReorgUndoRoundTrip(t *testing.T) {
+	counter, err := AssembleContract(`"n" SLOAD 1 ADD "n" OVER SSTORE "counted" LOG RETURN`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type build func(t *testing.T, bc *Blockchain, w *Wallet) []*Transaction
+	// sign builds one transaction per maker from w, with nonces in order.
+	sign := func(makers ...func(nonce uint64, utxos []UTXO) (*Transaction, error)) build {
+		return func(t *testing.T, bc *Blockchain, w *Wallet) []*Transaction {
+			nonce, err := bc.NextNonce(w.Address())
+			if err != nil {
+				t.Fatal(err)
+			}
+			utxos := spendable(t, bc, w.Address())
+			var txs []*Transaction
+			for i, mk := range makers {
+				tx, err := mk(nonce+uint64(i), utxos)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tx.Sign(w)
+				txs = append(txs, tx)
+				// Later transactions pay from the change of this one.
+				utxos = nil
+				for vout, out := range tx.Outputs {
+					if out.Address == w.Address() {
+						utxos = append(utxos, UTXO{OutPoint: OutPoint{TxID: tx.Hash(), Vout: vout}, Output: out})
+					}
+				}
+			}
+			return txs
+		}
+	}
+	chainID := RegtestParams.ChainID
+	payment := func(from string) func(uint64, []UTXO) (*Transaction, error) {
+		return func(nonce uint64, utxos []UTXO) (*Transaction, error) {
+			return NewUTXOTransaction(chainID, from, "bob", 7, 1, nonce, utxos)
+		}
+	}
+	token := func(from string, op *TokenOp) func(uint64, []UTXO) (*Transaction, error) {
+		return func(nonce uint64, utxos []UTXO) (*Transaction, error) {
+			return NewTokenTransaction(chainID, from, op, 1, nonce, utxos)
+		}
+	}
+	name := func(from string, op *NameOp) func(uint64, []UTXO) (*Transaction, error) {
+		return func(nonce uint64, utxos []UTXO) (*Transaction, error) {
+			return NewNameTransaction(chainID, from, op, 1, nonce, utxos)
+		}
+	}
+	memo := func(from string) func(uint64, []UTXO) (*Transaction, error) {
+		return func(nonce uint64, utxos []UTXO) (*Transaction, error) {
+			return NewMemoTransaction(chainID, from, []byte("note"), 1, nonce, utxos)
+		}
+	}
+	deploy := func(from string) func(uint64, []UTXO) (*Transaction, error) {
+		return func(nonce uint64, utxos []UTXO) (*Transaction, error) {
+			return NewContractTransaction(chainID, from, &ContractCall{Code: counter, GasLimit: 1000}, 1, nonce, utxos)
+		}
+	}
+
+	call := func(from string) func(uint64, []UTXO) (*Transaction, error) {
+		return func(nonce uint64, utxos []UTXO) (*Transaction, error) {
+			to := ContractAddress(from, 0)
+			return NewContractTransaction(chainID, from, &ContractCall{Address: to, GasLimit: 1000}, 1, nonce, utxos)
+		}
+	}
+
+	tests := []struct {
+		name string
+		// setup is confirmed on both branches before they part, fork only
+		// on the branch that is reorganized away.
+		setup, fork func(w *Wallet) build
+	}{
+		{
+			name: "payment",
+			fork: func(w *Wallet) build { return sign(payment(w.Address()), payment(w.Address())) },
+		},
+		{
+			name: "token issue",
+			fork: func(w *Wallet) build {
+				return sign(token(w.Address(), &TokenOp{Kind: TokenIssue, Symbol: "TOK", Name: "Token", Amount: 100}))
+			},
+		},
+		{
+			name: "token transfer",
+			setup: func(w *Wallet) build {
+				return sign(token(w.Address(), &TokenOp{Kind: TokenIssue, Symbol: "TOK", Name: "Token", Amount: 100}))
+			},
+			fork: func(w *Wallet) build {
+				return sign(token(w.Address(), &TokenOp{Kind: TokenTransfer, Symbol: "TOK", Amount: 40, To: "bob"}))
+			},
+		},
+		{
+			name: "name register",
+			fork: func(w *Wallet) build {
+				return sign(name(w.Address(), &NameOp{Kind: NameRegister, Name: "alice"}))
+			},
+		},
+		{
+			name: "name transfer",
+			setup: func(w *Wallet) build {
+				return sign(name(w.Address(), &NameOp{Kind: NameRegister, Name: "alice"}))
+			},
+			fork: func(w *Wallet) build {
+				return sign(name(w.Address(), &NameOp{Kind: NameTransfer, Name: "alice", To: "bob"}))
+			},
+		},
+		{
+			name: "memo",
+			fork: func(w *Wallet) build { return sign(memo(w.Address())) },
+		},
+		{
+			name: "contract deploy",
+			fork: func(w *Wallet) build { return sign(deploy(w.Address())) },
+		},
+		{
+			name:  "contract call",
+			setup: func(w *Wallet) build { return sign(deploy(w.Address())) },
+			fork:  func(w *Wallet) build { return sign(call(w.Address()), call(w.Address())) },
+		},
+		{
+			name: "mixed",
+			fork: func(w *Wallet) build {
+				return sign(
+					payment(w.Address()),
+					token(w.Address(), &TokenOp{Kind: TokenIssue, Symbol: "MIX", Name: "Mixed", Amount: 5}),
+					name(w.Address(), &NameOp{Kind: NameRegister, Name: "mixed"}),
+					memo(w.Address()),
+					deploy(w.Address()),
+				)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewWallet()
+			a := newTestChain(t, regtestParams(t))
+			b := newTestChain(t, regtestParams(t))
+			share := func(block *Block) {
+				t.Helper()
+				if err := b.ProcessBlock(block); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			share(mineTestBlock(t, a, w.Address()))
+			share(mineTestBlock(t, a, "miner"))
+			if tt.setup != nil {
+				share(mineTestBlock(t, a, "miner", tt.setup(w)(t, a, w)...))
+			}
+			before, rootBefore := stateDump(t, a), a.StateRoot()
+
+			forked := mineTestBlock(t, a, "miner", tt.fork(w)(t, a, w)...)
+			after, rootAfter := stateDump(t, a), a.StateRoot()
+			if reflect.DeepEqual(after, before) {
+				t.Fatal("the fork block changed no state")
+			}
+			if !bytes.Equal(forked.StateRoot, rootAfter) {
+				t.Fatalf("block state root %x, chain state root %x", forked.StateRoot, rootAfter)
+			}
+
+			// Disconnect and reconnect the fork block.
+			if err := a.Truncate(forked.Height); err != nil {
+				t.Fatal(err)
+			}
+			diffDumps(t, "after disconnecting", stateDump(t, a), before)
+			if root := a.StateRoot(); !bytes.Equal(root, rootBefore) {
+				t.Errorf("state root %x after disconnecting, want %x", root, rootBefore)
+			}
+			if err := a.ProcessBlock(forked); err != nil {
+				t.Fatal(err)
+			}
+			diffDumps(t, "after reconnecting", stateDump(t, a), after)
+
+			// Reorganize to a longer branch that lacks the fork block.
+			mineTestBlock(t, b, "other")
+			mineTestBlock(t, b, "other")
+			for h := forked.Height; h <= b.Height(); h++ {
+				block, err := b.BlockAtHeight(h)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := a.ProcessBlock(block); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(a.TipHash(), b.TipHash()) {
+				t.Fatalf("tip %x after the reorg, want %x", a.TipHash(), b.TipHash())
+			}
+			diffDumps(t, "after the reorg", stateDump(t, a), stateDump(t, b))
+			if !bytes.Equal(a.StateRoot(), b.StateRoot()) {
+				t.Errorf("state root %x after the reorg, want %x", a.StateRoot(), b.StateRoot())
+			}
+			if err := a.Validate(); err != nil {
+				t.Errorf("chain invalid after the reorg: %v", err)
+			}
+		})
+	}
+}
+
+// TestInvalidBranch reorganizes onto a heavier branch whose first block
+// fails to connect, and checks that the branch is then turned away without
+// another attempt.
+func TestInvalidBranch(t *testing.T) {
+	a := newTestChain(t, regtestParams(t))
+	b := newTestChain(t, regtestParams(t))
+	mineTestBlock(t, a, "miner")
+	good1 := mineTestBlock(t, b, "other")
+	good2 := mineTestBlock(t, b, "other")
+
+	// The block header is well formed, but its state root is wrong.
+	reseal := func(block *Block) *Block {
+		if err := a.Params.Consensus.Seal(block); err != nil {
+			t.Fatal(err)
+		}
+		return block
+	}
+	bad1 := *good1
+	bad1.StateRoot = bytes.Repeat([]byte{1}, 32)
+	reseal(&bad1)
+	child := func(ts int64) *Block {
+		block := *good2
+		block.PrevHash = bad1.Hash
+		block.Timestamp = ts
+		return reseal(&block)
+	}
+
+	if err := a.ProcessBlock(&bad1); err != nil {
+		t.Fatalf("side branch block: %v", err)
+	}
+	tip := a.TipHash()
+	if err := a.ProcessBlock(child(good2.Timestamp)); !errors.Is(err, ErrBadStateRoot) {
+		t.Fatalf("reorg onto the bad branch: error %v, want %v", err, ErrBadStateRoot)
+	}
+	if !bytes.Equal(a.TipHash(), tip) {
+		t.Fatalf("tip moved to %x", a.TipHash())
+	}
+	tests := []struct {
+		name  string
+		block *Block
+	}{
+		{"the same block", child(good2.Timestamp)},
+		{"another block on the bad one", child(good2.Timestamp + 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := a.ProcessBlock(tt.block); !errors.Is(err, ErrInvalidChain) {
+				t.Fatalf("error %v, want %v", err, ErrInvalidChain)
+			}
+		})
+	}
+	if err := a.Validate(); err != nil {
+		t.Errorf("chain invalid: %v", err)
+	}
+}
+
+// fundTestWallet mines a block paying w, and one more so that its reward
+// can be spent.
+func fundTestWallet(t *testing.T, bc *Blockchain, w *Wallet) {
+	t.Helper()
+	mineTestBlock(t, bc, w.Address())
+	mineTestBlock(t, bc, "miner")
+}
+
+// signTestTx builds a transaction with mk from the next nonce and the
+// spendable outputs of w, and signs it.
+func signTestTx(t *testing.T, bc *Blockchain, w *Wallet, mk func(nonce uint64, utxos []UTXO) (*Transaction, error)) (*Transaction, error) {
+	t.Helper()
+	nonce, err := bc.NextNonce(w.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := mk(nonce, spendable(t, bc, w.Address()))
+	if err != nil {
+		return nil, err
+	}
+	tx.Sign(w)
+	return tx, nil
+}
+
+// stateHistory holds the state at chosen heights, to check disconnecting
+// blocks against.
+type stateHistory map[int]map[string]string
+
+func (s stateHistory) record(t *testing.T, bc *Blockchain) {
+	t.Helper()
+	s[bc.Height()] = stateDump(t, bc)
+}
+
+// unwind disconnects the blocks above the lowest recorded height one by
+// one, checking the state at each recorded height on the way.
+func (s stateHistory) unwind(t *testing.T, bc *Blockchain) {
+	t.Helper()
+	low := bc.Height()
+	for h := range s {
+		low = min(low, h)
+	}
+	for h := bc.Height(); h > low; h-- {
+		if err := bc.Truncate(h); err != nil {
+			t.Fatal(err)
+		}
+		if want, ok := s[h-1]; ok {
+			diffDumps(t, fmt.Sprintf("after disconnecting block %d", h), stateDump(t, bc), want)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Script is a program in the stack language used for spending conditions.
+// A locking script on an output states the condition; the unlocking script
+// in the input that spends it pushes the data that meets it. Scripts are
+// byte code: opcodes, and data pushes made of a length byte followed by
+// the data.
+type Script []byte
+
+// Execution limits. Scripts cannot loop, so these bound the work a single
+// input can cause.
+const (
+	MaxScriptSize        = 10000
+	MaxScriptElementSize = 520 // Largest data push
+	MaxScriptOps         = 201 // Opcodes that are not pushes
+	MaxScriptStackSize   = 1000
+	maxScriptNumLen      = 8
+)
+
+// Opcodes. Values 0x01 to 0x4b push that many bytes of data.
+const (
+	OP_0                   byte = 0x00
+	OP_PUSHDATA1           byte = 0x4c // Next byte is the length of the push
+	OP_PUSHDATA2           byte = 0x4d // Next two bytes, little-endian, are the length
+	OP_1NEGATE             byte = 0x4f
+	OP_1                   byte = 0x51 // OP_1 to OP_16 push the numbers 1 to 16
+	OP_16                  byte = 0x60
+	OP_IF                  byte = 0x63
+	OP_NOTIF               byte = 0x64
+	OP_ELSE                byte = 0x67
+	OP_ENDIF               byte = 0x68
+	OP_VERIFY              byte = 0x69
+	OP_RETURN              byte = 0x6a
+	OP_DROP                byte = 0x75
+	OP_DUP                 byte = 0x76
+	OP_SWAP                byte = 0x7c
+	OP_SIZE                byte = 0x82
+	OP_EQUAL               byte = 0x87
+	OP_EQUALVERIFY         byte = 0x88
+	OP_SHA256              byte = 0xa8
+	OP_CHECKSIG            byte = 0xac
+	OP_CHECKSIGVERIFY      byte = 0xad
+	OP_CHECKMULTISIG       byte = 0xae
+	OP_CHECKMULTISIGVERIFY byte = 0xaf
+	OP_CHECKLOCKTIMEVERIFY byte = 0xb1
+)
+
+var opNames = map[byte]string{
+	OP_0:                   "OP_0",
+	OP_PUSHDATA1:           "OP_PUSHDATA1",
+	OP_PUSHDATA2:           "OP_PUSHDATA2",
+	OP_1NEGATE:             "OP_1NEGATE",
+	OP_IF:                  "OP_IF",
+	OP_NOTIF:               "OP_NOTIF",
+	OP_ELSE:                "OP_ELSE",
+	OP_ENDIF:               "OP_ENDIF",
+	OP_VERIFY:              "OP_VERIFY",
+	OP_RETURN:              "OP_RETURN",
+	OP_DROP:                "OP_DROP",
+	OP_DUP:                 "OP_DUP",
+	OP_SWAP:                "OP_SWAP",
+	OP_SIZE:                "OP_SIZE",
+	OP_EQUAL:               "OP_EQUAL",
+	OP_EQUALVERIFY:         "OP_EQUALVERIFY",
+	OP_SHA256:              "OP_SHA256",
+	OP_CHECKSIG:            "OP_CHECKSIG",
+	OP_CHECKSIGVERIFY:      "OP_CHECKSIGVERIFY",
+	OP_CHECKMULTISIG:       "OP_CHECKMULTISIG",
+	OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+}
+
+var opCodes = func() map[string]byte {
+	codes := make(map[string]byte)
+	for op, name := range opNames {
+		codes[name] = op
+	}
+	for n := 1; n <= 16; n++ {
+		codes["OP_"+strconv.Itoa(n)] = OP_1 + byte(n-1)
+	}
+	codes["OP_FALSE"] = OP_0
+	codes["OP_TRUE"] = OP_1
+	codes["OP_CLTV"] = OP_CHECKLOCKTIMEVERIFY
+	return codes
+}()
+
+var (
+	ErrBadScript    = errors.New("malformed script")
+	ErrScriptLimit  = errors.New("script exceeds execution limits")
+	ErrScriptFailed = errors.New("script failed")
+)
+
+// scriptOp is a decoded instruction: an opcode and, for pushes, its data.
+type scriptOp struct {
+	code byte
+	data []byte
+}
+
+func (op scriptOp) isPush() bool {
+	return op.code <= OP_16 && op.code != 0x50
+}
+
+// parse decodes the instructions of s.
+func (s Script) parse() ([]scriptOp, error) {
+	if len(s) > MaxScriptSize {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrScriptLimit, len(s), MaxScriptSize)
+	}
+	var ops []scriptOp
+	for i := 0; i < len(s); {
+		code := s[i]
+		i++
+		n := 0
+		switch {
+		case code >= 0x01 && code <= 0x4b:
+			n = int(code)
+		case code == OP_PUSHDATA1:
+			if i+1 > len(s) {
+				return nil, fmt.Errorf("%w: truncated OP_PUSHDATA1", ErrBadScript)
+			}
+			n = int(s[i])
+			i++
+		case code == OP_PUSHDATA2:
+			if i+2 > len(s) {
+				return nil, fmt.Errorf("%w: truncated OP_PUSHDATA2", ErrBadScript)
+			}
+			n = int(binary.LittleEndian.Uint16(s[i:]))
+			i += 2
+		case code == OP_0 || code == OP_1NEGATE || (code >= OP_1 && code <= OP_16):
+		default:
+			if _, ok := opNames[code]; !ok {
+				return nil, fmt.Errorf("%w: unknown opcode 0x%02x", ErrBadScript, code)
+			}
+		}
+		if i+n > len(s) {
+			return nil, fmt.Errorf("%w: push of %d bytes runs past the end", ErrBadScript, n)
+		}
+		op := scriptOp{code: code}
+		if n > 0 {
+			op.data = s[i : i+n]
+		}
+		i += n
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// Check reports whether s is well formed.
+func (s Script) Check() error {
+	_, err := s.parse()
+	return err
+}
+
+// IsPushOnly reports whether s only pushes data, as unlocking scripts must.
+func (s Script) IsPushOnly() bool {
+	ops, err := s.parse()
+	if err != nil {
+		return false
+	}
+	for _, op := range ops {
+		if !op.isPush() {
+			return false
+		}
+	}
+	return true
+}
+
+// Address returns the address outputs locked by s are paid to. The
+// encoding is tagged so it can't collide with a key or multisig address.
+func (s Script) Address() string {
+	hash := sha256.Sum256(append([]byte("script"), s...))
+	return hex.EncodeToString(hash[:])
+}
+
+// String disassembles s in the syntax ParseScript reads.
+func (s Script) String() string {
+	ops, err := s.parse()
+	if err != nil {
+		return "[" + err.Error() + "]"
+	}
+	var parts []string
+	for _, op := range ops {
+		switch {
+		case op.code >= OP_1 && op.code <= OP_16:
+			parts = append(parts, strconv.Itoa(int(op.code-OP_1)+1))
+		case op.code == OP_0:
+			parts = append(parts, "0")
+		case op.code == OP_1NEGATE:
+			parts = append(parts, "-1")
+		case op.isPush():
+			parts = append(parts, "0x"+hex.EncodeToString(op.data))
+		default:
+			parts = append(parts, opNames[op.code])
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// ParseScript assembles a script from space-separated tokens: opcode names
+// such as OP_CHECKSIG, decimal numbers, which are pushed as script numbers,
+// and data written as 0x followed by hex digits.
+func ParseScript(asm string) (Script, error) {
+	var b ScriptBuilder
+	for _, tok := range strings.Fields(asm) {
+		switch {
+		case strings.HasPrefix(tok, "0x"):
+			data, err := hex.DecodeString(tok[2:])
+			if err != nil {
+				return nil, fmt.Errorf("%w: bad data %q", ErrBadScript, tok)
+			}
+			b.AddData(data)
+		case strings.HasPrefix(strings.ToUpper(tok), "OP_"):
+			code, ok := opCodes[strings.ToUpper(tok)]
+			if !ok {
+				return nil, fmt.Errorf("%w: unknown opcode %s", ErrBadScript, tok)
+			}
+			b.AddOp(code)
+		default:
+			n, err := strconv.ParseInt(tok, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: unknown token %q", ErrBadScript, tok)
+			}
+			b.AddInt(n)
+		}
+	}
+	s := b.Script()
+	return s, s.Check()
+}
+
+// ScriptBuilder assembles a script instruction by instruction.
+type ScriptBuilder struct {
+	buf bytes.Buffer
+}
+
+func (b *ScriptBuilder) AddOp(code byte) *ScriptBuilder {
+	b.buf.WriteByte(code)
+	return b
+}
+
+// AddData pushes data with the shortest encoding.
+func (b *ScriptBuilder) AddData(data []byte) *ScriptBuilder {
+	switch n := len(data); {
+	case n <= 0x4b:
+		b.buf.WriteByte(byte(n))
+	case n <= 0xff:
+		b.buf.WriteByte(OP_PUSHDATA1)
+		b.buf.WriteByte(byte(n))
+	default:
+		b.buf.WriteByte(OP_PUSHDATA2)
+		binary.Write(&b.buf, binary.LittleEndian, uint16(n))
+	}
+	b.buf.Write(data)
+	return b
+}
+
+// AddInt pushes a number, using the small-number opcodes where possible.
+func (b *ScriptBuilder) AddInt(n int64) *ScriptBuilder {
+	switch {
+	case n == 0:
+		return b.AddOp(OP_0)
+	case n == -1:
+		return b.AddOp(OP_1NEGATE)
+	case n >= 1 && n <= 16:
+		return b.AddOp(OP_1 + byte(n-1))
+	}
+	return b.AddData(encodeScriptNum(n))
+}
+
+func (b *ScriptBuilder) Script() Script {
+	return Script(append([]byte{}, b.buf.Bytes()...))
+}
+
+// encodeScriptNum encodes n little-endian with the sign in the top bit of
+// the last byte, in as few bytes as possible.
+func encodeScriptNum(n int64) []byte {
+	if n == 0 {
+		return nil
+	}
+	neg := n < 0
+	abs := uint64(n)
+	if neg {
+		abs = uint64(-n)
+	}
+	var out []byte
+	for abs > 0 {
+		out = append(out, byte(abs))
+		abs >>= 8
+	}
+	if out[len(out)-1]&0x80 != 0 {
+		out = append(out, 0)
+	}
+	if neg {
+		out[len(out)-1] |= 0x80
+	}
+	return out
+}
+
+// decodeScriptNum reverses encodeScriptNum. Numbers longer than needed are
+// rejected so every number has a single encoding.
+func decodeScriptNum(data []byte) (int64, error) {
+	if len(data) > maxScriptNumLen {
+		return 0, fmt.Errorf("%w: number of %d bytes", ErrScriptFailed, len(data))
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	last := data[len(data)-1]
+	if last&0x7f == 0 && (len(data) == 1 || data[len(data)-2]&0x80 == 0) {
+		return 0, fmt.Errorf("%w: number not minimally encoded", ErrScriptFailed)
+	}
+	var n uint64
+	for i := len(data) - 1; i >= 0; i-- {
+		b := data[i]
+		if i == len(data)-1 {
+			b &= 0x7f
+		}
+		n = n<<8 | uint64(b)
+	}
+	if last&0x80 != 0 {
+		return -int64(n), nil
+	}
+	return int64(n), nil
+}
+
+// scriptBool interprets a stack element as a boolean: any non-zero byte is
+// true, except for a lone sign bit (negative zero).
+func scriptBool(data []byte) bool {
+	for i, b := range data {
+		if b != 0 {
+			return !(i == len(data)-1 && b == 0x80)
+		}
+	}
+	return false
+}
+
+// SignatureBytes encodes an ECDSA signature for use in scripts as r and s,
+// 32 bytes each.
+func SignatureBytes(r, s string) ([]byte, error) {
+	out := make([]byte, 64)
+	for i, text := range []string{r, s} {
+		n, ok := new(big.Int).SetString(text, 16)
+		if !ok || n.Sign() < 0 || n.BitLen() > 256 {
+			return nil, fmt.Errorf("%w: bad signature value %q", ErrBadSignature, text)
+		}
+		n.FillBytes(out[i*32 : (i+1)*32])
+	}
+	return out, nil
+}
+
+func splitSignature(sig []byte) (r, s string, ok bool) {
+	if len(sig) != 64 {
+		return "", "", false
+	}
+	return new(big.Int).SetBytes(sig[:32]).Text(16), new(big.Int).SetBytes(sig[32:]).Text(16), true
+}
+
+// MarshalJSON writes a script as hex.
+func (s Script) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + hex.EncodeToString(s) + `"`), nil
+}
+
+// UnmarshalJSON reads a script written as hex.
+func (s *Script) UnmarshalJSON(data []byte) error {
+	text := strings.Trim(string(data), `"`)
+	raw, err := hex.DecodeString(text)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadScript, err)
+	}
+	*s = raw
+	return nil
+}
+
+// CheckScripts checks the scripts of a transaction without running them:
+// locking scripts must be well formed and paid to their own address, and
+// unlocking scripts may only push data.
+func (tx *Transaction) CheckScripts() error {
+	for i, out := range tx.Outputs {
+		if len(out.Script) == 0 {
+			continue
+		}
+		if err := out.Script.Check(); err != nil {
+			return fmt.Errorf("output %d: %w", i, err)
+		}
+		if out.Address != out.Script.Address() {
+			return fmt.Errorf("output %d: %w: address %s is not the script's address %s", i, ErrBadScript, out.Address, out.Script.Address())
+		}
+	}
+	for i, in := range tx.Inputs {
+		if len(in.Unlock) == 0 {
+			continue
+		}
+		if tx.IsCoinbase() {
+			return fmt.Errorf("%w: coinbase input has an unlocking script", ErrBadScript)
+		}
+		if !in.Unlock.IsPushOnly() {
+			return fmt.Errorf("input %d: %w: unlocking script must only push data", i, ErrBadScript)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,407 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	"go.etcd.io/bbolt"
+)
+
+// errRollback is returned from a bbolt update to discard its changes after
+// the state has been used for a trial run.
+var errRollback = errors.New("rollback")
+
+// connectTx applies a single transaction to the chain state and returns the
+// outputs it spent. All checks run before anything is written, so a failed
+// transaction leaves the state untouched.
+func connectTx(tx *bbolt.Tx, t *Transaction, height int, p *ChainParams) ([]UTXO, error) {
+	if err := t.CheckAmounts(); err != nil {
+		return nil, fmt.Errorf("tx %x: %w", t.Hash(), err)
+	}
+	if err := t.CheckScripts(); err != nil {
+		return nil, fmt.Errorf("tx %x: %w", t.Hash(), err)
+	}
+	if err := t.CheckContract(); err != nil {
+		return nil, fmt.Errorf("tx %x: %w", t.Hash(), err)
+	}
+	if err := t.CheckToken(); err != nil {
+		return nil, fmt.Errorf("tx %x: %w", t.Hash(), err)
+	}
+	if err := t.CheckName(); err != nil {
+		return nil, fmt.Errorf("tx %x: %w", t.Hash(), err)
+	}
+	if err := t.CheckMemo(); err != nil {
+		return nil, fmt.Errorf("tx %x: %w", t.Hash(), err)
+	}
+	if err := t.CheckGovernance(); err != nil {
+		return nil, fmt.Errorf("tx %x: %w", t.Hash(), err)
+	}
+	if err := t.CheckStake(); err != nil {
+		return nil, fmt.Errorf("tx %x: %w", t.Hash(), err)
+	}
+	if err := t.CheckEvidence(); err != nil {
+		return nil, fmt.Errorf("tx %x: %w", t.Hash(), err)
+	}
+
+	var spent []UTXO
+	if !t.IsCoinbase() {
+		if err := CheckReplay(t, p.ChainID, getNonce(tx, t.From)); err != nil {
+			return nil, fmt.Errorf("tx %x: %w", t.Hash(), err)
+		}
+
+		// Every input must belong to a signer, and every cosigner must
+		// spend at least one input.
+		signers := make(map[string]bool)
+		for _, signer := range t.Signers() {
+			signers[signer] = false
+		}
+		seen := make(map[string]bool)
+		inputTotal := 0
+		for _, in := range t.Inputs {
+			op := OutPoint{TxID: in.TxID, Vout: in.Vout}
+			if seen[op.String()] {
+				return nil, fmt.Errorf("tx %x: %w: %s spent twice", t.Hash(), ErrMissingInput, op)
+			}
+			seen[op.String()] = true
+
+			entry, err := getUTXO(tx, op)
+			if err != nil {
+				return nil, fmt.Errorf("tx %x: %w", t.Hash(), err)
+			}
+			if len(entry.Output.Script) > 0 {
+				// The script decides who may spend the output.
+				if err := VerifyScript(in.Unlock, entry.Output.Script, t); err != nil {
+					return nil, fmt.Errorf("tx %x: input %s: %w", t.Hash(), op, err)
+				}
+			} else {
+				if len(in.Unlock) > 0 {
+					return nil, fmt.Errorf("tx %x: input %s: %w: unlocking script for an output without a script", t.Hash(), op, ErrBadScript)
+				}
+				if _, ok := signers[entry.Output.Address]; !ok {
+					return nil, fmt.Errorf("tx %x: input %s is owned by %s, who did not sign", t.Hash(), op, entry.Output.Address)
+				}
+				signers[entry.Output.Address] = true
+			}
+			if !p.IsMature(*entry, height) {
+				return nil, fmt.Errorf("tx %x: %w: %s created at height %d, spendable from %d", t.Hash(), ErrImmatureCoinbase, op, entry.Height, entry.Height+p.CoinbaseMaturity)
+			}
+			if !IsReleased(entry.Output, height) {
+				return nil, fmt.Errorf("tx %x: %w: %s is released at height %d", t.Hash(), ErrLockedOutput, op, entry.Output.ReleaseHeight)
+			}
+			inputTotal += entry.Output.Amount
+			spent = append(spent, *entry)
+		}
+
+		for _, signer := range t.Signers()[1:] {
+			if !signers[signer] {
+				return nil, fmt.Errorf("tx %x: cosigner %s spends no input", t.Hash(), signer)
+			}
+		}
+
+		// Deposits leave the inputs for the stake; withdrawals are paid
+		// out of it.
+		deposited, withdrawn := t.stakeFlow()
+		inputTotal += withdrawn
+		outputTotal := t.OutputTotal() + t.Fee + deposited
+		if outputTotal > inputTotal {
+			return nil, fmt.Errorf("tx %x: %w: %s spends %d but only has %d", t.Hash(), ErrOverdraw, t.From, outputTotal, inputTotal)
+		}
+		if outputTotal < inputTotal {
+			return nil, fmt.Errorf("tx %x: %w: inputs hold %d, outputs and fee %d", t.Hash(), ErrFeeMismatch, inputTotal, outputTotal)
+		}
+		if err := checkContractTarget(tx, t); err != nil {
+			return nil, fmt.Errorf("tx %x: %w", t.Hash(), err)
+		}
+		if err := checkToken(tx, t); err != nil {
+			return nil, fmt.Errorf("tx %x: %w", t.Hash(), err)
+		}
+		if err := checkName(tx, t, height); err != nil {
+			return nil, fmt.Errorf("tx %x: %w", t.Hash(), err)
+		}
+		if err := checkGovernance(tx, t, p); err != nil {
+			return nil, fmt.Errorf("tx %x: %w", t.Hash(), err)
+		}
+		if err := checkStake(tx, t, height, p); err != nil {
+			return nil, fmt.Errorf("tx %x: %w", t.Hash(), err)
+		}
+
+		if err := putNonce(tx, t.From, t.Nonce+1); err != nil {
+			return nil, err
+		}
+		for _, entry := range spent {
+			if err := deleteUTXO(tx, entry); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	txID := t.Hash()
+	for vout, out := range t.Outputs {
+		entry := UTXO{
+			OutPoint: OutPoint{TxID: txID, Vout: vout},
+			Output:   out,
+			Height:   height,
+			Coinbase: t.IsCoinbase(),
+		}
+		if err := putUTXO(tx, entry); err != nil {
+			return nil, err
+		}
+	}
+	if t.Contract != nil {
+		if err := applyContract(tx, t, height); err != nil {
+			return nil, err
+		}
+	}
+	if t.Token != nil {
+		if err := applyToken(tx, t, height); err != nil {
+			return nil, err
+		}
+	}
+	if t.Name != nil {
+		if err := applyName(tx, t, height, p); err != nil {
+			return nil, err
+		}
+	}
+	if t.Governance != nil {
+		if err := applyGovernance(tx, t, p); err != nil {
+			return nil, err
+		}
+	}
+	if t.Stake != nil || t.Evidence != nil {
+		if err := applyStake(tx, t, p); err != nil {
+			return nil, err
+		}
+	}
+	return spent, nil
+}
+
+// connectBlock checks the sealer of block against the consensus engine,
+// then spends the inputs and adds the outputs of every transaction in
+// block, advancing the nonce of each sender and indexing the transaction
+// hashes and memos. The coinbase may claim the block subsidy plus the fees
+// left by the other transactions. The key/value state must match the block's state
+// root afterwards. The spent outputs are written to the undo bucket so
+// that the block can be disconnected again.
+func connectBlock(tx *bbolt.Tx, block *Block, p *ChainParams) error {
+	txIndex, err := tx.CreateBucketIfNotExists(txIndexBucket)
+	if err != nil {
+		return err
+	}
+
+	if block.Height > 0 {
+		if err := p.Consensus.VerifySealer(tx, block); err != nil {
+			return err
+		}
+	}
+
+	var spent []UTXO
+	fees := 0
+	for _, t := range block.Transactions {
+		txSpent, err := connectTx(tx, t, block.Height, p)
+		if err != nil {
+			return err
+		}
+		spent = append(spent, txSpent...)
+		fees += t.Fee
+		if err := txIndex.Put(t.Hash(), block.Hash); err != nil {
+			return err
+		}
+		if err := indexMemo(tx, t); err != nil {
+			return err
+		}
+	}
+
+	// The genesis coinbase pays the genesis allocations instead.
+	if claimed, allowed := block.Transactions[0].OutputTotal(), p.Subsidy(block.Height)+fees; block.Height > 0 && claimed > allowed {
+		return fmt.Errorf("%w: pays %d, subsidy plus fees is %d", ErrBadCoinbase, claimed, allowed)
+	}
+	if root := stateRoot(tx); !bytes.Equal(root, block.StateRoot) {
+		return fmt.Errorf("%w: block has %x, state gives %x", ErrBadStateRoot, block.StateRoot, root)
+	}
+
+	if err := putStateTip(tx, block.Hash, len(block.Transactions), blockOutputTotal(block)-spentTotal(spent)); err != nil {
+		return err
+	}
+
+	undo, err := tx.CreateBucketIfNotExists(undoBucket)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(spent); err != nil {
+		return err
+	}
+	return undo.Put(block.Hash, buf.Bytes())
+}
+
+// disconnectBlock reverses connectBlock: outputs created by block are
+// removed and the outputs it spent are restored from its undo data.
+func disconnectBlock(tx *bbolt.Tx, block *Block) error {
+	undo := tx.Bucket(undoBucket)
+	if undo == nil || undo.Get(block.Hash) == nil {
+		return fmt.Errorf("no undo data for block %x", block.Hash)
+	}
+	var spent []UTXO
+	if err := gob.NewDecoder(bytes.NewReader(undo.Get(block.Hash))).Decode(&spent); err != nil {
+		return err
+	}
+	supplyDelta := spentTotal(spent) - blockOutputTotal(block)
+
+	// Walk the block backwards so that outputs created and spent within the
+	// same block are restored before they are removed.
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		t := block.Transactions[i]
+		txID := t.Hash()
+		for vout := range t.Outputs {
+			entry, err := getUTXO(tx, OutPoint{TxID: txID, Vout: vout})
+			if err != nil {
+				return err
+			}
+			if err := deleteUTXO(tx, *entry); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Bucket(txIndexBucket).Delete(txID); err != nil {
+			return err
+		}
+		if err := unindexMemo(tx, t); err != nil {
+			return err
+		}
+		if err := undoTx(tx, txID); err != nil {
+			return err
+		}
+		if t.Contract != nil {
+			if err := disconnectContract(tx, t); err != nil {
+				return err
+			}
+		}
+
+		if t.IsCoinbase() {
+			continue
+		}
+		if err := putNonce(tx, t.From, t.Nonce); err != nil {
+			return err
+		}
+		restore := spent[len(spent)-len(t.Inputs):]
+		spent = spent[:len(spent)-len(t.Inputs)]
+		for _, entry := range restore {
+			if err := putUTXO(tx, entry); err != nil {
+				return err
+			}
+		}
+	}
+	if err := putStateTip(tx, block.PrevHash, -len(block.Transactions), supplyDelta); err != nil {
+		return err
+	}
+	return undo.Delete(block.Hash)
+}
+
+func spentTotal(spent []UTXO) int {
+	total := 0
+	for _, entry := range spent {
+		total += entry.Output.Amount
+	}
+	return total
+}
+
+func blockOutputTotal(block *Block) int {
+	total := 0
+	for _, t := range block.Transactions {
+		total += t.OutputTotal()
+	}
+	return total
+}
+
+// putStateTip records which block the chain state reflects and adjusts the
+// running transaction count and coin supply.
+func putStateTip(tx *bbolt.Tx, hash []byte, txDelta, supplyDelta int) error {
+	b, err := tx.CreateBucketIfNotExists(stateMetaBucket)
+	if err != nil {
+		return err
+	}
+	count := 0
+	if v := b.Get(txCountKey); v != nil {
+		count = int(binary.BigEndian.Uint64(v))
+	}
+	if err := b.Put(txCountKey, heightKey(count+txDelta)); err != nil {
+		return err
+	}
+	if err := b.Put(supplyKey, heightKey(getSupply(tx)+supplyDelta)); err != nil {
+		return err
+	}
+	return b.Put(tipKey, hash)
+}
+
+// dropState deletes every bucket derived from connecting blocks.
+func dropState(tx *bbolt.Tx) error {
+	for _, name := range stateBuckets {
+		if tx.Bucket(name) != nil {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SelectTransactions applies candidates in order on top of the current tip
+// and returns those that are still valid in the next block. Each
+// transaction sees the effects of the ones accepted before it, so two
+// pending spends of the same funds cannot both be selected. The chain state
+// is not modified.
+func (bc *Blockchain) SelectTransactions(candidates []*Transaction) ([]*Transaction, []error) {
+	var valid []*Transaction
+	var rejected []error
+	height, mtp := bc.finalityContext()
+
+	bc.DB.DB.Update(func(tx *bbolt.Tx) error {
+		for _, t := range candidates {
+			if err := t.CheckVersion(); err != nil {
+				rejected = append(rejected, fmt.Errorf("tx %x: %w", t.Hash(), err))
+				continue
+			}
+			if err := t.CheckFinal(height, mtp); err != nil {
+				rejected = append(rejected, fmt.Errorf("tx %x: %w", t.Hash(), err))
+				continue
+			}
+			if _, err := connectTx(tx, t, height, bc.Params); err != nil {
+				rejected = append(rejected, err)
+				continue
+			}
+			valid = append(valid, t)
+		}
+		return errRollback
+	})
+	return valid, rejected
+}
+
+// CheckTransaction reports whether t can go into the next block after the
+// given pending transactions.
+func (bc *Blockchain) CheckTransaction(t *Transaction, pending []*Transaction) error {
+	height, mtp := bc.finalityContext()
+	if err := t.CheckVersion(); err != nil {
+		return fmt.Errorf("tx %x: %w", t.Hash(), err)
+	}
+	if err := t.CheckFinal(height, mtp); err != nil {
+		return fmt.Errorf("tx %x: %w", t.Hash(), err)
+	}
+	err := bc.DB.DB.Update(func(tx *bbolt.Tx) error {
+		for _, p := range pending {
+			if _, err := connectTx(tx, p, height, bc.Params); err != nil {
+				return fmt.Errorf("pending %w", err)
+			}
+		}
+		if _, err := connectTx(tx, t, height, bc.Params); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if errors.Is(err, errRollback) {
+		return nil
+	}
+	return err
+}
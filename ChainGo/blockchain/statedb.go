@@ -0,0 +1,157 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+
+	"go.etcd.io/bbolt"
+)
+
+// Contracts, tokens and names keep key/value state next to the UTXO set. Every
+// write is journaled per transaction so that disconnecting a block can undo
+// it, and the state as a whole is committed to by each block's state root;
+// see statetree.go.
+
+var stateUndoBucket = []byte("chaingo_state_undo")
+
+var ErrBadStateRoot = errors.New("state root does not match chain state")
+
+// stateChange is the undo record of one write: the bucket and key written
+// and the value before, nil if there was none.
+type stateChange struct {
+	Bucket []byte
+	Key    []byte
+	Old    []byte
+}
+
+// committedState lists the buckets the state root covers, each with the
+// value it commits to for a stored record. Committing to a canonical value
+// rather than the stored encoding keeps the root independent of how
+// records are encoded.
+var committedState = []struct {
+	bucket []byte
+	value  func(v []byte) []byte
+}{
+	{contractCodeBucket, func(v []byte) []byte {
+		var contract Contract
+		if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&contract); err != nil {
+			return v
+		}
+		return contract.Code
+	}},
+	{contractStorageBucket, nil},
+	{tokenBucket, tokenCommitment},
+	{tokenBalanceBucket, nil},
+	{nameBucket, nameCommitment},
+	{validatorBucket, nil},
+	{voteBucket, nil},
+	{stakeBucket, nil},
+	{slashBucket, nil},
+}
+
+// putState writes value under key, deleting the key if value is empty, and
+// returns what is needed to undo the write.
+func putState(tx *bbolt.Tx, bucket, key, value []byte) (stateChange, error) {
+	b, err := tx.CreateBucketIfNotExists(bucket)
+	if err != nil {
+		return stateChange{}, err
+	}
+	change := stateChange{Bucket: bucket, Key: key}
+	if old := b.Get(key); old != nil {
+		change.Old = append([]byte{}, old...)
+	}
+	if len(value) == 0 {
+		err = b.Delete(key)
+	} else {
+		err = b.Put(key, value)
+	}
+	if err != nil {
+		return change, err
+	}
+	return change, updateStateTree(tx, bucket, key, value)
+}
+
+func putBucket(tx *bbolt.Tx, bucket, key, value []byte) error {
+	b, err := tx.CreateBucketIfNotExists(bucket)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
+
+// saveUndo journals the state changes made by the transaction txHash.
+func saveUndo(tx *bbolt.Tx, txHash []byte, undo []stateChange) error {
+	if len(undo) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(undo); err != nil {
+		return err
+	}
+	return putBucket(tx, stateUndoBucket, txHash, buf.Bytes())
+}
+
+// undoTx reverts the journaled state changes of the transaction txHash,
+// newest first.
+func undoTx(tx *bbolt.Tx, txHash []byte) error {
+	b := tx.Bucket(stateUndoBucket)
+	if b == nil || b.Get(txHash) == nil {
+		return nil
+	}
+	var undo []stateChange
+	if err := gob.NewDecoder(bytes.NewReader(b.Get(txHash))).Decode(&undo); err != nil {
+		return err
+	}
+	for i := len(undo) - 1; i >= 0; i-- {
+		if _, err := putState(tx, undo[i].Bucket, undo[i].Key, undo[i].Old); err != nil {
+			return err
+		}
+	}
+	return b.Delete(txHash)
+}
+
+// stateRoot commits to the key/value state: the root of the state tree
+// over the entries of the committed buckets. It is nil while the state is
+// empty, so blocks from before any contract, token or name carry no root.
+func stateRoot(tx *bbolt.Tx) []byte {
+	b := tx.Bucket(stateTreeBucket)
+	if b == nil {
+		return nil
+	}
+	if root := getTreeNode(b, 0, make([]byte, sha256.Size)); root != nil {
+		return root.hash
+	}
+	return nil
+}
+
+// StateRoot returns the state root at the tip.
+func (bc *Blockchain) StateRoot() []byte {
+	var root []byte
+	bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		root = stateRoot(tx)
+		return nil
+	})
+	return root
+}
+
+// nextStateRoot returns the state root after transactions are connected
+// on top of the tip. The chain state is not modified.
+func (bc *Blockchain) nextStateRoot(transactions []*Transaction) ([]byte, error) {
+	height := bc.Height() + 1
+	var root []byte
+	err := bc.DB.DB.Update(func(tx *bbolt.Tx) error {
+		for _, t := range transactions {
+			if _, err := connectTx(tx, t, height, bc.Params); err != nil {
+				return err
+			}
+		}
+		root = stateRoot(tx)
+		return errRollback
+	})
+	if errors.Is(err, errRollback) {
+		return root, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,214 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"go.etcd.io/bbolt"
+)
+
+// The state root is the root of a sparse Merkle tree over the committed
+// key/value state. Each entry is a leaf at the path given by the hash of
+// its bucket and key, and a subtree holding a single leaf is that leaf, so
+// the tree is only as deep as it takes to tell the paths apart. putState
+// updates the tree for every write, which touches one path, so the root
+// costs the same however large the state is.
+//
+// Nodes are stored by depth and path:
+//
+//	uint16 depth || path with the bits from depth on cleared
+//	-> 0x00 || key hash || leaf hash, or 0x01 || node hash
+var stateTreeBucket = []byte("chaingo_state_tree")
+
+const (
+	treeLeaf byte = iota
+	treeInner
+)
+
+// treeNode is a node of the state tree; nil is an empty subtree.
+type treeNode struct {
+	leaf bool
+	key  []byte // Hash of bucket and key, for a leaf
+	hash []byte
+}
+
+// stateKeyHash is the path of the entry key in bucket.
+func stateKeyHash(bucket, key []byte) []byte {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, uint32(len(bucket)))
+	h.Write(bucket)
+	h.Write(key)
+	return h.Sum(nil)
+}
+
+// stateLeafHash commits to the entry at keyHash holding value.
+func stateLeafHash(keyHash, value []byte) []byte {
+	valueHash := sha256.Sum256(value)
+	h := sha256.New()
+	h.Write([]byte{treeLeaf})
+	h.Write(keyHash)
+	h.Write(valueHash[:])
+	return h.Sum(nil)
+}
+
+func treeHash(n *treeNode) []byte {
+	if n == nil {
+		return make([]byte, sha256.Size)
+	}
+	return n.hash
+}
+
+func treeBit(path []byte, depth int) int {
+	return int(path[depth/8]>>(7-depth%8)) & 1
+}
+
+// treeChild returns the path of the child of the node at depth on path
+// that takes bit.
+func treeChild(path []byte, depth, bit int) []byte {
+	child := append([]byte{}, path...)
+	if bit == 1 {
+		child[depth/8] |= 1 << (7 - depth%8)
+	}
+	return child
+}
+
+func treeNodeKey(depth int, path []byte) []byte {
+	key := make([]byte, 2, 2+len(path))
+	binary.BigEndian.PutUint16(key, uint16(depth))
+	return append(key, path...)
+}
+
+func getTreeNode(b *bbolt.Bucket, depth int, path []byte) *treeNode {
+	v := b.Get(treeNodeKey(depth, path))
+	switch {
+	case len(v) == 1+2*sha256.Size && v[0] == treeLeaf:
+		return &treeNode{leaf: true, key: append([]byte{}, v[1:1+sha256.Size]...), hash: append([]byte{}, v[1+sha256.Size:]...)}
+	case len(v) == 1+sha256.Size && v[0] == treeInner:
+		return &treeNode{hash: append([]byte{}, v[1:]...)}
+	}
+	return nil
+}
+
+func putTreeNode(b *bbolt.Bucket, depth int, path []byte, n *treeNode) error {
+	key := treeNodeKey(depth, path)
+	switch {
+	case n == nil:
+		return b.Delete(key)
+	case n.leaf:
+		return b.Put(key, append(append([]byte{treeLeaf}, n.key...), n.hash...))
+	default:
+		return b.Put(key, append([]byte{treeInner}, n.hash...))
+	}
+}
+
+// treeUpdate sets the leaf of keyHash below the node at depth on path to
+// leafHash, or removes it if leafHash is nil, and returns the node that is
+// there afterwards.
+func treeUpdate(b *bbolt.Bucket, depth int, path, keyHash, leafHash []byte) (*treeNode, error) {
+	node := getTreeNode(b, depth, path)
+	switch {
+	case node == nil:
+		if leafHash == nil {
+			return nil, nil
+		}
+		node = &treeNode{leaf: true, key: keyHash, hash: leafHash}
+	case node.leaf && bytes.Equal(node.key, keyHash):
+		node.hash = leafHash
+		if leafHash == nil {
+			node = nil
+		}
+	case node.leaf:
+		if leafHash == nil {
+			return node, nil
+		}
+		// Push the leaf that is here one level down, then insert next to
+		// it.
+		if err := putTreeNode(b, depth+1, treeChild(path, depth, treeBit(node.key, depth)), node); err != nil {
+			return nil, err
+		}
+		fallthrough
+	default:
+		if _, err := treeUpdate(b, depth+1, treeChild(path, depth, treeBit(keyHash, depth)), keyHash, leafHash); err != nil {
+			return nil, err
+		}
+		var err error
+		if node, err = treeJoin(b, depth, path); err != nil {
+			return nil, err
+		}
+	}
+	return node, putTreeNode(b, depth, path, node)
+}
+
+// treeJoin returns the node at depth on path made from its children. A
+// lone leaf moves up to take the node's place.
+func treeJoin(b *bbolt.Bucket, depth int, path []byte) (*treeNode, error) {
+	left := getTreeNode(b, depth+1, treeChild(path, depth, 0))
+	right := getTreeNode(b, depth+1, treeChild(path, depth, 1))
+	if left == nil && right == nil {
+		return nil, nil
+	}
+	if left == nil && right.leaf || right == nil && left.leaf {
+		lone, bit := left, 0
+		if left == nil {
+			lone, bit = right, 1
+		}
+		return lone, putTreeNode(b, depth+1, treeChild(path, depth, bit), nil)
+	}
+	h := sha256.New()
+	h.Write([]byte{treeInner})
+	h.Write(treeHash(left))
+	h.Write(treeHash(right))
+	return &treeNode{hash: h.Sum(nil)}, nil
+}
+
+// updateStateTree records that key in bucket now holds the stored value,
+// or nothing if value is empty. Buckets the state root does not cover are
+// ignored.
+func updateStateTree(tx *bbolt.Tx, bucket, key, value []byte) error {
+	for _, c := range committedState {
+		if !bytes.Equal(c.bucket, bucket) {
+			continue
+		}
+		b, err := tx.CreateBucketIfNotExists(stateTreeBucket)
+		if err != nil {
+			return err
+		}
+		keyHash := stateKeyHash(bucket, key)
+		var leafHash []byte
+		if len(value) > 0 {
+			if c.value != nil {
+				value = c.value(value)
+			}
+			leafHash = stateLeafHash(keyHash, value)
+		}
+		_, err = treeUpdate(b, 0, make([]byte, sha256.Size), keyHash, leafHash)
+		return err
+	}
+	return nil
+}
+
+// buildStateTree fills the state tree from the committed buckets, for
+// state written before the tree was kept.
+func buildStateTree(tx *bbolt.Tx) error {
+	if b := tx.Bucket(stateTreeBucket); b != nil && firstKey(b) != nil {
+		return nil
+	}
+	for _, c := range committedState {
+		b := tx.Bucket(c.bucket)
+		if b == nil {
+			continue
+		}
+		var entries [][2][]byte
+		b.ForEach(func(k, v []byte) error {
+			entries = append(entries, [2][]byte{append([]byte{}, k...), append([]byte{}, v...)})
+			return nil
+		})
+		for _, e := range entries {
+			if err := updateStateTree(tx, c.bucket, e[0], e[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+func openTestDB(t *testing.T) *bbolt.DB {
+	t.Helper()
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "state.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// stateWrite is a write to contract storage; an empty value deletes.
+type stateWrite struct {
+	key, value string
+}
+
+// applyWrites journals writes through putState and returns the state root
+// and the entries left.
+func applyWrites(t *testing.T, db *bbolt.DB, writes []stateWrite) ([]byte, map[string]string) {
+	t.Helper()
+	var root []byte
+	err := db.Update(func(tx *bbolt.Tx) error {
+		for _, w := range writes {
+			if _, err := putState(tx, contractStorageBucket, []byte(w.key), []byte(w.value)); err != nil {
+				return err
+			}
+		}
+		root = stateRoot(tx)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]string)
+	for _, w := range writes {
+		if w.value == "" {
+			delete(entries, w.key)
+		} else {
+			entries[w.key] = w.value
+		}
+	}
+	return root, entries
+}
+
+// rebuiltRoot is the root buildStateTree computes for entries from scratch.
+func rebuiltRoot(t *testing.T, entries map[string]string) []byte {
+	t.Helper()
+	var root []byte
+	err := openTestDB(t).Update(func(tx *bbolt.Tx) error {
+		for k, v := range entries {
+			if err := putBucket(tx, contractStorageBucket, []byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+		if err := buildStateTree(tx); err != nil {
+			return err
+		}
+		root = stateRoot(tx)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestStateTree(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var random []stateWrite
+	for i := 0; i < 300; i++ {
+		w := stateWrite{key: fmt.Sprint(rng.Intn(60))}
+		if rng.Intn(3) > 0 {
+			w.value = fmt.Sprint(rng.Int())
+		}
+		random = append(random, w)
+	}
+
+	tests := []struct {
+		name   string
+		writes []stateWrite
+	}{
+		{"empty", nil},
+		{"one entry", []stateWrite{{"a", "1"}}},
+		{"two entries", []stateWrite{{"a", "1"}, {"b", "2"}}},
+		{"overwrite", []stateWrite{{"a", "1"}, {"b", "2"}, {"a", "3"}}},
+		{"delete", []stateWrite{{"a", "1"}, {"b", "2"}, {"c", "3"}, {"b", ""}}},
+		{"delete missing", []stateWrite{{"a", "1"}, {"b", ""}}},
+		{"delete all", []stateWrite{{"a", "1"}, {"b", "2"}, {"a", ""}, {"b", ""}}},
+		{"random", random},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t)
+			root, entries := applyWrites(t, db, tt.writes)
+			if want := rebuiltRoot(t, entries); !bytes.Equal(root, want) {
+				t.Errorf("root %x, rebuilt from the entries %x", root, want)
+			}
+			if len(entries) == 0 {
+				if root != nil {
+					t.Errorf("root %x of the empty state, want none", root)
+				}
+				db.View(func(tx *bbolt.Tx) error {
+					if b := tx.Bucket(stateTreeBucket); b != nil && firstKey(b) != nil {
+						t.Error("empty state leaves tree nodes")
+					}
+					return nil
+				})
+			}
+		})
+	}
+}
+
+func TestStateTreeShape(t *testing.T) {
+	leaf := func(key, value string) []byte {
+		return stateLeafHash(stateKeyHash(contractStorageBucket, []byte(key)), []byte(value))
+	}
+	inner := func(left, right []byte) []byte {
+		h := sha256.New()
+		h.Write([]byte{treeInner})
+		h.Write(left)
+		h.Write(right)
+		return h.Sum(nil)
+	}
+
+	// Find two keys whose paths part at the first bit and two that share
+	// it.
+	first := func(key string) int { return treeBit(stateKeyHash(contractStorageBucket, []byte(key)), 0) }
+	var zero, one []string
+	for i := 0; len(zero) < 2 || len(one) < 1; i++ {
+		k := fmt.Sprint("k", i)
+		if first(k) == 0 {
+			zero = append(zero, k)
+		} else {
+			one = append(one, k)
+		}
+	}
+
+	root, _ := applyWrites(t, openTestDB(t), []stateWrite{{zero[0], "v"}})
+	if want := leaf(zero[0], "v"); !bytes.Equal(root, want) {
+		t.Errorf("root of one entry %x, want its leaf %x", root, want)
+	}
+	root, _ = applyWrites(t, openTestDB(t), []stateWrite{{one[0], "w"}, {zero[0], "v"}})
+	if want := inner(leaf(zero[0], "v"), leaf(one[0], "w")); !bytes.Equal(root, want) {
+		t.Errorf("root of two entries %x, want %x", root, want)
+	}
+	root, _ = applyWrites(t, openTestDB(t), []stateWrite{{one[0], "w"}, {zero[0], "v"}, {zero[1], "x"}, {zero[1], ""}})
+	if want := inner(leaf(zero[0], "v"), leaf(one[0], "w")); !bytes.Equal(root, want) {
+		t.Errorf("root after a delete %x, want the leaf moved back up %x", root, want)
+	}
+}
+
+func TestStateTreeIgnoresUncommittedBuckets(t *testing.T) {
+	db := openTestDB(t)
+	err := db.Update(func(tx *bbolt.Tx) error {
+		if _, err := putState(tx, receiptBucket, []byte("k"), []byte("v")); err != nil {
+			return err
+		}
+		if root := stateRoot(tx); root != nil {
+			t.Errorf("root %x after writing a bucket the root does not cover", root)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,120 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+
+	"go.etcd.io/bbolt"
+)
+
+// MaxHeadersPerMessage caps the headers HeadersAfter returns at once.
+const MaxHeadersPerMessage = 2000
+
+// Locator returns hashes of the best chain from the tip back to genesis,
+// the last ten one block apart and then doubling the step, so a peer can
+// find where its chain and ours fork in a few dozen hashes.
+func (bc *Blockchain) Locator() [][]byte {
+	var locator [][]byte
+	bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		step := 1
+		for h := bc.Height(); h >= 0; h -= step {
+			if hash := hashAtHeight(tx, h); hash != nil {
+				locator = append(locator, hash)
+			}
+			if h == 0 {
+				return nil
+			}
+			if len(locator) >= 10 {
+				step *= 2
+			}
+			if h-step < 0 {
+				step = h
+			}
+		}
+		return nil
+	})
+	return locator
+}
+
+// HeadersAfter returns the headers of the best chain after the first
+// locator hash that is on it, or after genesis if none is, up to max of
+// them. Headers are blocks without their transactions.
+func (bc *Blockchain) HeadersAfter(locator [][]byte, max int) ([]*Block, error) {
+	start := 0
+	bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		for _, hash := range locator {
+			node, err := getNode(tx, hash)
+			if err != nil {
+				continue
+			}
+			if bytes.Equal(hashAtHeight(tx, node.Height), hash) {
+				start = node.Height + 1
+				return nil
+			}
+		}
+		start = 1
+		return nil
+	})
+
+	var headers []*Block
+	for h := start; h <= bc.Height() && len(headers) < max; h++ {
+		block, err := bc.BlockAtHeight(h)
+		if err != nil {
+			return nil, err
+		}
+		header := *block
+		header.Transactions = nil
+		headers = append(headers, &header)
+	}
+	return headers, nil
+}
+
+// HasBlock reports whether a block is stored, on any branch.
+func (bc *Blockchain) HasBlock(hash []byte) bool {
+	found := false
+	bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		_, err := getNode(tx, hash)
+		found = err == nil
+		return nil
+	})
+	return found
+}
+
+// CheckHeaders checks that headers, as a peer sent them, extend a stored
+// block one after the other and that each passes ValidateHeader, so that
+// blocks are only fetched for headers someone sealed. Headers on top of a
+// block known to be invalid are refused.
+func (bc *Blockchain) CheckHeaders(headers []*Block) error {
+	return bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		if len(headers) == 0 {
+			return nil
+		}
+		base, err := getNode(tx, headers[0].PrevHash)
+		if err != nil {
+			return fmt.Errorf("%w: %x", ErrOrphanBlock, headers[0].PrevHash)
+		}
+		stored := branchBlockAt(tx, base.Hash)
+		blockAt := func(height int) *Block {
+			if i := height - base.Height - 1; i >= 0 {
+				if i < len(headers) {
+					return headers[i]
+				}
+				return nil
+			}
+			return stored(height)
+		}
+		for i, header := range headers {
+			if isInvalid(tx, header.PrevHash) || isInvalid(tx, header.Hash) {
+				return fmt.Errorf("%w: header %d %x", ErrInvalidChain, header.Height, header.Hash)
+			}
+			parent, err := bc.Params.ParentStateAt(base.Height+i, blockAt)
+			if err != nil {
+				return err
+			}
+			if err := bc.Params.ValidateHeader(header, parent); err != nil {
+				return fmt.Errorf("header %d: %w", header.Height, err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,69 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCheckHeaders(t *testing.T) {
+	a := newTestChain(t, regtestParams(t))
+	b := newTestChain(t, regtestParams(t))
+	for i := 0; i < 3; i++ {
+		mineTestBlock(t, b, "other")
+	}
+	var good []*Block
+	for h := 1; h <= b.Height(); h++ {
+		block, err := b.BlockAtHeight(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := *block
+		header.Transactions = nil
+		good = append(good, &header)
+	}
+
+	// edit returns the headers with header i changed by fn and, if
+	// rehash, hashed again without meeting the proof of work.
+	edit := func(i int, rehash bool, fn func(h *Block)) []*Block {
+		headers := make([]*Block, len(good))
+		for j, h := range good {
+			c := *h
+			headers[j] = &c
+		}
+		fn(headers[i])
+		if rehash {
+			for headers[i].Hash = headers[i].HeaderHash(); NewProofOfWork(headers[i]).Validate(); headers[i].Hash = headers[i].HeaderHash() {
+				headers[i].Nonce++
+			}
+		}
+		return headers
+	}
+	tests := []struct {
+		name    string
+		headers []*Block
+		want    error
+	}{
+		{"sealed", good, nil},
+		{"unknown parent", good[1:], ErrOrphanBlock},
+		{"gap", append([]*Block{good[0]}, good[2:]...), ErrBadPrevHash},
+		{"hash not of the header", edit(1, false, func(h *Block) { h.Timestamp++ }), ErrBadHeaderHash},
+		{"not mined", edit(1, true, func(h *Block) {}), ErrBadProofOfWork},
+		{"wrong difficulty", edit(0, false, func(h *Block) { h.Bits--; h.Hash = h.HeaderHash() }), ErrBadDifficulty},
+		{"far in the future", edit(2, false, func(h *Block) {
+			h.Timestamp = time.Now().Unix() + 2*MaxFutureBlockTime
+			h.Hash, h.Nonce = NewProofOfWork(h).Run()
+		}), ErrTimeTooNew},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := a.CheckHeaders(tt.headers)
+			if tt.want == nil && err != nil {
+				t.Fatalf("error %v, want none", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
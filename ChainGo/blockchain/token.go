@@ -0,0 +1,354 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// MaxTokenSymbol is the longest token symbol.
+	MaxTokenSymbol = 12
+	// MaxTokenName is the longest token name, in bytes.
+	MaxTokenName = 64
+)
+
+// Token operations.
+const (
+	TokenIssue    = "issue"
+	TokenMint     = "mint"
+	TokenTransfer = "transfer"
+	TokenBurn     = "burn"
+)
+
+var (
+	tokenBucket        = []byte("chaingo_tokens")
+	tokenBalanceBucket = []byte("chaingo_token_balances")
+)
+
+var (
+	ErrBadTokenOp   = errors.New("invalid token operation")
+	ErrNoToken      = errors.New("token not found")
+	ErrTokenExists  = errors.New("token already exists")
+	ErrTokenBalance = errors.New("insufficient token balance")
+)
+
+// TokenOp turns a transaction into an operation on a token:
+//
+//   - issue creates the token Symbol with Name, crediting Amount to From.
+//     Only a Mintable token can be minted later, and only by its issuer.
+//   - mint creates Amount new units, credited to To or else to From.
+//   - transfer moves Amount from From to To.
+//   - burn destroys Amount of From's balance.
+//
+// The transaction pays only its fee in coins.
+type TokenOp struct {
+	Kind     string `json:"kind"`
+	Symbol   string `json:"symbol"`
+	Name     string `json:"name,omitempty"`
+	Amount   int    `json:"amount"`
+	To       string `json:"to,omitempty"`
+	Mintable bool   `json:"mintable,omitempty"`
+}
+
+// Token is an issued token. Supply is the amount in circulation.
+type Token struct {
+	Symbol   string `json:"symbol"`
+	Name     string `json:"name"`
+	Issuer   string `json:"issuer"`
+	Supply   int    `json:"supply"`
+	Mintable bool   `json:"mintable"`
+	Height   int    `json:"height"`
+}
+
+// NewTokenTransaction builds an unsigned token transaction from the
+// spendable outputs of from, paying fee and returning the change to from.
+// The fee may be zero, in which case nothing is spent.
+func NewTokenTransaction(chainID uint32, from string, op *TokenOp, fee int, nonce uint64, spendable []UTXO) (*Transaction, error) {
+	if fee < 0 {
+		return nil, fmt.Errorf("%w: fee %d is negative", ErrInvalidAmount, fee)
+	}
+	tx := &Transaction{
+		Version: TxVersion,
+		From:    from,
+		To:      op.To,
+		Fee:     fee,
+		Nonce:   nonce,
+		ChainID: chainID,
+		Token:   op,
+	}
+	if err := tx.CheckToken(); err != nil {
+		return nil, err
+	}
+	if err := tx.fundFee(spendable); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// CheckToken checks the shape of a token transaction. Whether the
+// operation is allowed by the token and the balances is checked when it is
+// connected.
+func (tx *Transaction) CheckToken() error {
+	op := tx.Token
+	if op == nil {
+		return nil
+	}
+	if tx.IsCoinbase() {
+		return fmt.Errorf("%w: coinbase carries a token operation", ErrBadTokenOp)
+	}
+	if tx.Contract != nil {
+		return fmt.Errorf("%w: transaction also calls a contract", ErrBadTokenOp)
+	}
+	if tx.Amount != 0 {
+		return fmt.Errorf("%w: coin amount is %d, tokens pay only the fee", ErrBadTokenOp, tx.Amount)
+	}
+	if err := checkTokenSymbol(op.Symbol); err != nil {
+		return err
+	}
+	if op.Amount < 0 || (op.Amount == 0 && !(op.Kind == TokenIssue && op.Mintable)) {
+		return fmt.Errorf("%w: amount %d must be positive", ErrBadTokenOp, op.Amount)
+	}
+	if op.Kind != TokenIssue && (op.Name != "" || op.Mintable) {
+		return fmt.Errorf("%w: name and mintable are set only on issue", ErrBadTokenOp)
+	}
+	switch op.Kind {
+	case TokenIssue:
+		if len(op.Name) > MaxTokenName {
+			return fmt.Errorf("%w: name has %d bytes, limit %d", ErrBadTokenOp, len(op.Name), MaxTokenName)
+		}
+		if op.To != "" {
+			return fmt.Errorf("%w: issue credits the issuer", ErrBadTokenOp)
+		}
+	case TokenMint:
+	case TokenTransfer:
+		if op.To == "" || op.To == tx.From {
+			return fmt.Errorf("%w: transfer needs a recipient other than the sender", ErrBadTokenOp)
+		}
+	case TokenBurn:
+		if op.To != "" {
+			return fmt.Errorf("%w: burn has no recipient", ErrBadTokenOp)
+		}
+	default:
+		return fmt.Errorf("%w: unknown kind %q", ErrBadTokenOp, op.Kind)
+	}
+	return nil
+}
+
+// checkTokenSymbol requires 1 to MaxTokenSymbol upper-case letters and
+// digits, starting with a letter.
+func checkTokenSymbol(symbol string) error {
+	if len(symbol) == 0 || len(symbol) > MaxTokenSymbol {
+		return fmt.Errorf("%w: symbol %q must have 1 to %d characters", ErrBadTokenOp, symbol, MaxTokenSymbol)
+	}
+	for i, r := range symbol {
+		if (r < 'A' || r > 'Z') && (i == 0 || r < '0' || r > '9') {
+			return fmt.Errorf("%w: symbol %q must be upper-case letters and digits, starting with a letter", ErrBadTokenOp, symbol)
+		}
+	}
+	return nil
+}
+
+// checkToken checks a token operation against the chain state. It runs
+// with the other checks of connectTx, before anything is written.
+func checkToken(tx *bbolt.Tx, t *Transaction) error {
+	op := t.Token
+	if op == nil {
+		return nil
+	}
+	token, err := getToken(tx, op.Symbol)
+	if op.Kind == TokenIssue {
+		if err == nil {
+			return fmt.Errorf("%w: %s issued by %s", ErrTokenExists, op.Symbol, token.Issuer)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switch op.Kind {
+	case TokenMint:
+		if !token.Mintable {
+			return fmt.Errorf("%w: %s has a fixed supply", ErrBadTokenOp, op.Symbol)
+		}
+		if t.From != token.Issuer {
+			return fmt.Errorf("%w: only %s can mint %s", ErrBadTokenOp, token.Issuer, op.Symbol)
+		}
+		if token.Supply+op.Amount < token.Supply {
+			return fmt.Errorf("%w: supply of %s overflows", ErrBadTokenOp, op.Symbol)
+		}
+	case TokenTransfer, TokenBurn:
+		if balance := getTokenBalance(tx, t.From, op.Symbol); balance < op.Amount {
+			return fmt.Errorf("%w: %s has %d %s, needs %d", ErrTokenBalance, t.From, balance, op.Symbol, op.Amount)
+		}
+	}
+	return nil
+}
+
+// applyToken carries out the token operation of t at height, journaling
+// every write so that it can be undone.
+func applyToken(tx *bbolt.Tx, t *Transaction, height int) error {
+	op := t.Token
+	var token *Token
+	if op.Kind == TokenIssue {
+		token = &Token{Symbol: op.Symbol, Name: op.Name, Issuer: t.From, Mintable: op.Mintable, Height: height}
+	} else {
+		var err error
+		if token, err = getToken(tx, op.Symbol); err != nil {
+			return err
+		}
+	}
+
+	var undo []stateChange
+	credit := func(address string, delta int) error {
+		balance := getTokenBalance(tx, address, op.Symbol) + delta
+		var value []byte
+		if balance != 0 {
+			value = heightKey(balance)
+		}
+		change, err := putState(tx, tokenBalanceBucket, tokenBalanceKey(address, op.Symbol), value)
+		undo = append(undo, change)
+		return err
+	}
+
+	var err error
+	switch op.Kind {
+	case TokenIssue:
+		token.Supply = op.Amount
+		err = credit(t.From, op.Amount)
+	case TokenMint:
+		token.Supply += op.Amount
+		to := op.To
+		if to == "" {
+			to = t.From
+		}
+		err = credit(to, op.Amount)
+	case TokenTransfer:
+		if err = credit(t.From, -op.Amount); err == nil {
+			err = credit(op.To, op.Amount)
+		}
+	case TokenBurn:
+		token.Supply -= op.Amount
+		err = credit(t.From, -op.Amount)
+	}
+	if err != nil {
+		return err
+	}
+
+	if op.Kind != TokenTransfer {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(token); err != nil {
+			return err
+		}
+		change, err := putState(tx, tokenBucket, []byte(op.Symbol), buf.Bytes())
+		if err != nil {
+			return err
+		}
+		undo = append(undo, change)
+	}
+	return saveUndo(tx, t.Hash(), undo)
+}
+
+// tokenBalanceKey keeps the balances of one address together. Recipients
+// are any string, so the address is prefixed with its length to keep one
+// holder's keys from running into another's.
+func tokenBalanceKey(address, symbol string) []byte {
+	return append(tokenHolderPrefix(address), symbol...)
+}
+
+func tokenHolderPrefix(address string) []byte {
+	return append(binary.AppendUvarint(nil, uint64(len(address))), address...)
+}
+
+func getTokenBalance(tx *bbolt.Tx, address, symbol string) int {
+	b := tx.Bucket(tokenBalanceBucket)
+	if b == nil {
+		return 0
+	}
+	if v := b.Get(tokenBalanceKey(address, symbol)); v != nil {
+		return int(binary.BigEndian.Uint64(v))
+	}
+	return 0
+}
+
+func getToken(tx *bbolt.Tx, symbol string) (*Token, error) {
+	b := tx.Bucket(tokenBucket)
+	if b == nil || b.Get([]byte(symbol)) == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoToken, symbol)
+	}
+	var token Token
+	if err := gob.NewDecoder(bytes.NewReader(b.Get([]byte(symbol)))).Decode(&token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// tokenCommitment is what the state root commits to for a token record.
+func tokenCommitment(v []byte) []byte {
+	var token Token
+	if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&token); err != nil {
+		return v
+	}
+	var buf bytes.Buffer
+	for _, field := range []string{token.Name, token.Issuer} {
+		binary.Write(&buf, binary.BigEndian, uint32(len(field)))
+		buf.WriteString(field)
+	}
+	binary.Write(&buf, binary.BigEndian, int64(token.Supply))
+	binary.Write(&buf, binary.BigEndian, token.Mintable)
+	binary.Write(&buf, binary.BigEndian, int64(token.Height))
+	return buf.Bytes()
+}
+
+// Token returns the token with symbol.
+func (bc *Blockchain) Token(symbol string) (*Token, error) {
+	var token *Token
+	err := bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		var err error
+		token, err = getToken(tx, symbol)
+		return err
+	})
+	return token, err
+}
+
+// Tokens returns every issued token, ordered by symbol.
+func (bc *Blockchain) Tokens() ([]*Token, error) {
+	var tokens []*Token
+	err := bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(tokenBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var token Token
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&token); err != nil {
+				return err
+			}
+			tokens = append(tokens, &token)
+			return nil
+		})
+	})
+	return tokens, err
+}
+
+// TokenBalances returns the non-zero token balances of address by symbol.
+func (bc *Blockchain) TokenBalances(address string) map[string]int {
+	balances := make(map[string]int)
+	bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(tokenBalanceBucket)
+		if b == nil {
+			return nil
+		}
+		prefix := tokenHolderPrefix(address)
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			balances[string(k[len(prefix):])] = int(binary.BigEndian.Uint64(v))
+		}
+		return nil
+	})
+	return balances
+}
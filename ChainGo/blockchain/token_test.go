@@ -0,0 +1,148 @@
+package blockchain
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTokenOps(t *testing.T) {
+	alice, bob := NewWallet(), NewWallet()
+	// A step sends op from the sender and expects err, or else the token
+	// TOK to have supply and the holders the balances afterwards.
+	type step struct {
+		from     *Wallet
+		op       TokenOp
+		err      error
+		supply   int
+		balances map[*Wallet]int
+	}
+	issue := TokenOp{Kind: TokenIssue, Symbol: "TOK", Name: "Token", Amount: 100}
+	mintable := TokenOp{Kind: TokenIssue, Symbol: "TOK", Name: "Token", Mintable: true}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"issue", []step{
+			{from: alice, op: issue, supply: 100, balances: map[*Wallet]int{alice: 100}},
+		}},
+		{"issue twice", []step{
+			{from: alice, op: issue, supply: 100, balances: map[*Wallet]int{alice: 100}},
+			{from: bob, op: issue, err: ErrTokenExists},
+		}},
+		{"mint", []step{
+			{from: alice, op: mintable, balances: map[*Wallet]int{}},
+			{from: alice, op: TokenOp{Kind: TokenMint, Symbol: "TOK", Amount: 50, To: bob.Address()}, supply: 50, balances: map[*Wallet]int{bob: 50}},
+			{from: alice, op: TokenOp{Kind: TokenMint, Symbol: "TOK", Amount: 5}, supply: 55, balances: map[*Wallet]int{alice: 5, bob: 50}},
+		}},
+		{"mint a fixed supply", []step{
+			{from: alice, op: issue, supply: 100, balances: map[*Wallet]int{alice: 100}},
+			{from: alice, op: TokenOp{Kind: TokenMint, Symbol: "TOK", Amount: 1}, err: ErrBadTokenOp},
+		}},
+		{"mint by another", []step{
+			{from: alice, op: mintable, balances: map[*Wallet]int{}},
+			{from: bob, op: TokenOp{Kind: TokenMint, Symbol: "TOK", Amount: 1}, err: ErrBadTokenOp},
+		}},
+		{"transfer", []step{
+			{from: alice, op: issue, supply: 100, balances: map[*Wallet]int{alice: 100}},
+			{from: alice, op: TokenOp{Kind: TokenTransfer, Symbol: "TOK", Amount: 40, To: bob.Address()}, supply: 100, balances: map[*Wallet]int{alice: 60, bob: 40}},
+			{from: bob, op: TokenOp{Kind: TokenTransfer, Symbol: "TOK", Amount: 40, To: alice.Address()}, supply: 100, balances: map[*Wallet]int{alice: 100}},
+		}},
+		{"transfer more than held", []step{
+			{from: alice, op: issue, supply: 100, balances: map[*Wallet]int{alice: 100}},
+			{from: alice, op: TokenOp{Kind: TokenTransfer, Symbol: "TOK", Amount: 101, To: bob.Address()}, err: ErrTokenBalance},
+		}},
+		{"transfer to self", []step{
+			{from: alice, op: issue, supply: 100, balances: map[*Wallet]int{alice: 100}},
+			{from: alice, op: TokenOp{Kind: TokenTransfer, Symbol: "TOK", Amount: 1, To: alice.Address()}, err: ErrBadTokenOp},
+		}},
+		{"transfer unknown token", []step{
+			{from: alice, op: TokenOp{Kind: TokenTransfer, Symbol: "TOK", Amount: 1, To: bob.Address()}, err: ErrNoToken},
+		}},
+		{"burn", []step{
+			{from: alice, op: issue, supply: 100, balances: map[*Wallet]int{alice: 100}},
+			{from: alice, op: TokenOp{Kind: TokenBurn, Symbol: "TOK", Amount: 30}, supply: 70, balances: map[*Wallet]int{alice: 70}},
+			{from: alice, op: TokenOp{Kind: TokenBurn, Symbol: "TOK", Amount: 70}, supply: 0, balances: map[*Wallet]int{}},
+		}},
+		{"burn more than held", []step{
+			{from: alice, op: issue, supply: 100, balances: map[*Wallet]int{alice: 100}},
+			{from: alice, op: TokenOp{Kind: TokenBurn, Symbol: "TOK", Amount: 101}, err: ErrTokenBalance},
+		}},
+		{"bad symbol", []step{
+			{from: alice, op: TokenOp{Kind: TokenIssue, Symbol: "tok", Amount: 1}, err: ErrBadTokenOp},
+		}},
+		{"zero amount", []step{
+			{from: alice, op: TokenOp{Kind: TokenIssue, Symbol: "TOK", Amount: 0}, err: ErrBadTokenOp},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := newTestChain(t, regtestParams(t))
+			fundTestWallet(t, bc, alice)
+			fundTestWallet(t, bc, bob)
+			history := stateHistory{}
+			for i, s := range tt.steps {
+				op := s.op
+				tx, err := signTestTx(t, bc, s.from, func(nonce uint64, utxos []UTXO) (*Transaction, error) {
+					return NewTokenTransaction(bc.Params.ChainID, s.from.Address(), &op, 1, nonce, utxos)
+				})
+				if err == nil {
+					history.record(t, bc)
+					_, err = bc.AddBlock([]*Transaction{NewCoinbaseTx(bc.Params.ChainID, "miner", bc.Params.Subsidy(bc.Height()+1)+tx.Fee, bc.Height()+1), tx})
+				}
+				if s.err != nil {
+					if !errors.Is(err, s.err) {
+						t.Fatalf("step %d: error %v, want %v", i, err, s.err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				token, err := bc.Token("TOK")
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				if token.Supply != s.supply {
+					t.Errorf("step %d: supply %d, want %d", i, token.Supply, s.supply)
+				}
+				for _, w := range []*Wallet{alice, bob} {
+					want := map[string]int{}
+					if s.balances[w] != 0 {
+						want["TOK"] = s.balances[w]
+					}
+					if got := bc.TokenBalances(w.Address()); !reflect.DeepEqual(got, want) {
+						t.Errorf("step %d: balances %v, want %v", i, got, want)
+					}
+				}
+			}
+			history.unwind(t, bc)
+		})
+	}
+}
+
+// TestTokenHolderKeys credits a holder whose name starts with another's
+// address and checks that the balances stay apart.
+func TestTokenHolderKeys(t *testing.T) {
+	alice := NewWallet()
+	bc := newTestChain(t, regtestParams(t))
+	fundTestWallet(t, bc, alice)
+	for _, op := range []TokenOp{
+		{Kind: TokenIssue, Symbol: "TOK", Name: "Token", Amount: 100},
+		{Kind: TokenTransfer, Symbol: "TOK", Amount: 10, To: alice.Address() + "\x00FOO"},
+	} {
+		tx, err := signTestTx(t, bc, alice, func(nonce uint64, utxos []UTXO) (*Transaction, error) {
+			return NewTokenTransaction(bc.Params.ChainID, alice.Address(), &op, 1, nonce, utxos)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mineTestBlock(t, bc, "miner", tx)
+	}
+	if got, want := bc.TokenBalances(alice.Address()), map[string]int{"TOK": 90}; !reflect.DeepEqual(got, want) {
+		t.Errorf("balances %v, want %v", got, want)
+	}
+	if got, want := bc.TokenBalances(alice.Address()+"\x00FOO"), map[string]int{"TOK": 10}; !reflect.DeepEqual(got, want) {
+		t.Errorf("balances of the other holder %v, want %v", got, want)
+	}
+}
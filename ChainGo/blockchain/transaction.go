@@ -3,35 +3,371 @@ package blockchain
 import (
 	"bytes"
 	"crypto/sha256"
-	"encoding/gob"
+	"errors"
+	"fmt"
+	"slices"
 	"strconv"
 )
 
-type Transaction struct {
-	From      string `json:"from"`
-	To        string `json:"to"`
-	Amount    int    `json:"amount"`
+var (
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrInvalidAmount     = errors.New("invalid amount")
+	ErrOverdraw          = errors.New("outputs exceed inputs")
+	ErrFeeMismatch       = errors.New("inputs do not match outputs plus fee")
+)
+
+// TxInput spends an output created by an earlier transaction. A coinbase
+// input spends nothing and may carry arbitrary Data instead. Spending a
+// script-locked output takes an Unlock script that meets its condition.
+type TxInput struct {
+	TxID   []byte `json:"txid"`
+	Vout   int    `json:"vout"`
+	Data   []byte `json:"data,omitempty"`
+	Unlock Script `json:"unlock,omitempty"`
+}
+
+// TxOutput locks an amount to an address until it is spent. A vault output
+// cannot be spent before the block at ReleaseHeight. An output with a
+// Script is locked by the script instead of a key, and its Address is the
+// script's address.
+type TxOutput struct {
+	Amount        int    `json:"amount"`
+	Address       string `json:"address"`
+	ReleaseHeight int    `json:"releaseHeight,omitempty"`
+	Script        Script `json:"script,omitempty"`
+}
+
+// Signature is an ECDSA signature over the transaction hash together with
+// the public key that made it.
+type Signature struct {
+	PublicKey []byte `json:"publicKey"`
 	R         string `json:"r"`
 	S         string `json:"s"`
-	PublicKey []byte `json:"publicKey"`
 }
 
+// Transaction moves value by spending outputs and creating new ones. From
+// signs the transaction in R, S and PublicKey, pays the fee and supplies
+// the nonce; other owners of spent outputs add their own signatures as
+// Cosigners. When From is a multisig address, Multisig reveals its policy
+// and the key holders sign in Signatures instead of R, S and PublicKey.
+// To and Amount describe the payment and are kept for display:
+// To is the recipient of a single payment and empty for a batch, Amount is
+// the total paid to others than the signers. Inputs and Outputs are what the ledger acts
+// on. The inputs must cover the outputs plus Fee exactly; the fee goes to
+// the miner. Nonce and ChainID are signed with the rest of the transaction
+// to prevent replays. Version selects how the transaction is encoded and
+// hashed; see TxVersion. A non-zero LockTime keeps the transaction out of
+// blocks until a height or time; see CheckFinal. Contract deploys or calls
+// a contract; see ContractCall. Token issues, mints, transfers or burns a
+// token; see TokenOp. Name registers, renews or transfers a name; see
+// NameOp. Memo is arbitrary data of up to MaxMemoSize bytes; it is signed
+// with the rest of the transaction. Governance votes on the validator set
+// of a proof-of-authority chain; see GovernanceOp. Stake bonds or unbonds
+// coins and Evidence slashes a double-signing validator under proof of
+// stake; see StakeOp and SlashEvidence.
+type Transaction struct {
+	Version   uint32      `json:"version"`
+	From      string      `json:"from"`
+	To        string      `json:"to"`
+	Amount    int         `json:"amount"`
+	Fee       int         `json:"fee"`
+	Inputs    []TxInput   `json:"inputs"`
+	Outputs   []TxOutput  `json:"outputs"`
+	Nonce     uint64      `json:"nonce"`
+	ChainID   uint32      `json:"chainId"`
+	LockTime  int64       `json:"lockTime,omitempty"`
+	R         string      `json:"r"`
+	S         string      `json:"s"`
+	PublicKey []byte      `json:"publicKey"`
+	Cosigners []Signature `json:"cosigners,omitempty"`
+
+	Multisig   *MultisigPolicy `json:"multisig,omitempty"`
+	Signatures []Signature     `json:"signatures,omitempty"`
+
+	Contract *ContractCall `json:"contract,omitempty"`
+	Token    *TokenOp      `json:"token,omitempty"`
+	Name     *NameOp       `json:"name,omitempty"`
+	Memo     []byte        `json:"memo,omitempty"`
+
+	Governance *GovernanceOp  `json:"governance,omitempty"`
+	Stake      *StakeOp       `json:"stake,omitempty"`
+	Evidence   *SlashEvidence `json:"evidence,omitempty"`
+}
+
+// Contribution is the share of a transaction funded by an address other
+// than the sender: Amount is taken from its Spendable outputs and any
+// change goes back to it.
+type Contribution struct {
+	Address   string
+	Amount    int
+	Spendable []UTXO
+}
+
+// NewCoinbaseTx creates the reward transaction of a block. A coinbase has a
+// single input with no previous transaction; its Vout carries the block
+// height so that two coinbases paying the same miner still hash differently.
+func NewCoinbaseTx(chainID uint32, to string, amount int, height int) *Transaction {
+	return &Transaction{
+		Version: TxVersion,
+		From:    "Coinbase",
+		To:      to,
+		Amount:  amount,
+		Inputs:  []TxInput{{TxID: nil, Vout: height}},
+		Outputs: []TxOutput{{Amount: amount, Address: to}},
+		ChainID: chainID,
+	}
+}
+
+// NewUTXOTransaction builds an unsigned transfer from the given spendable
+// outputs of from, paying amount to to plus fee to the miner and returning
+// any change to from.
+func NewUTXOTransaction(chainID uint32, from, to string, amount, fee int, nonce uint64, spendable []UTXO) (*Transaction, error) {
+	return NewBatchTransaction(chainID, from, []TxOutput{{Amount: amount, Address: to}}, fee, nonce, spendable)
+}
+
+// NewBatchTransaction builds an unsigned transaction paying every output in
+// payments at once. Each contribution is funded from its own outputs; from
+// covers the rest plus fee. Payments come first in the outputs, followed by
+// the change of from and then of each contributor. Every contributor has
+// to sign the result as well as from.
+func NewBatchTransaction(chainID uint32, from string, payments []TxOutput, fee int, nonce uint64, spendable []UTXO, contributions ...Contribution) (*Transaction, error) {
+	if len(payments) == 0 {
+		return nil, fmt.Errorf("%w: no payments", ErrInvalidAmount)
+	}
+	if fee < 0 {
+		return nil, fmt.Errorf("%w: fee %d is negative", ErrInvalidAmount, fee)
+	}
+	total := 0
+	for i, out := range payments {
+		if out.Amount <= 0 {
+			return nil, fmt.Errorf("%w: payment %d of %d must be positive", ErrInvalidAmount, i, out.Amount)
+		}
+		total += out.Amount
+	}
+
+	need := total + fee
+	funders := []Contribution{{Address: from, Spendable: spendable}}
+	for _, c := range contributions {
+		if c.Address == from {
+			return nil, fmt.Errorf("%w: %s contributes to its own transaction", ErrInvalidAmount, from)
+		}
+		if c.Amount <= 0 {
+			return nil, fmt.Errorf("%w: contribution of %d from %s must be positive", ErrInvalidAmount, c.Amount, c.Address)
+		}
+		funders = append(funders, c)
+		need -= c.Amount
+	}
+
+	if need < 0 {
+		return nil, fmt.Errorf("%w: contributions exceed payments plus fee by %d", ErrInvalidAmount, -need)
+	}
+	funders[0].Amount = need
+
+	var inputs []TxInput
+	var change []TxOutput
+	for _, f := range funders {
+		collected := 0
+		for _, u := range f.Spendable {
+			if collected >= f.Amount {
+				break
+			}
+			inputs = append(inputs, TxInput{TxID: u.TxID, Vout: u.Vout})
+			collected += u.Output.Amount
+		}
+		if collected < f.Amount {
+			return nil, fmt.Errorf("%w: %s has %d, needs %d", ErrInsufficientFunds, f.Address, collected, f.Amount)
+		}
+		if collected > f.Amount {
+			change = append(change, TxOutput{Amount: collected - f.Amount, Address: f.Address})
+		}
+	}
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("%w: transaction spends nothing", ErrInvalidAmount)
+	}
+
+	to := ""
+	if len(payments) == 1 {
+		to = payments[0].Address
+	}
+	// Payments back to a funder are no different from change.
+	paid := 0
+	for _, out := range payments {
+		if !slices.ContainsFunc(funders, func(f Contribution) bool { return f.Address == out.Address }) {
+			paid += out.Amount
+		}
+	}
+	return &Transaction{
+		Version: TxVersion,
+		From:    from,
+		To:      to,
+		Amount:  paid,
+		Fee:     fee,
+		Inputs:  inputs,
+		Outputs: append(append([]TxOutput{}, payments...), change...),
+		Nonce:   nonce,
+		ChainID: chainID,
+	}, nil
+}
+
+// CheckAmounts rejects transfers that create no value and outputs or fees
+// with negative amounts, which would otherwise mint coins out of thin air.
+// A coinbase pays no fee. Contract, token, name and memo transactions may
+// pay nothing but their fee. Amount must be what the outputs pay to anyone
+// but the signers, so it cannot misstate the payment; coins sent back to a
+// signer count as change.
+func (tx *Transaction) CheckAmounts() error {
+	if !tx.IsCoinbase() && tx.Contract == nil && tx.Token == nil && tx.Name == nil && tx.Governance == nil && tx.Stake == nil && tx.Evidence == nil && len(tx.Memo) == 0 && tx.OutputTotal() <= 0 {
+		return fmt.Errorf("%w: transfer creates no outputs of value", ErrInvalidAmount)
+	}
+	if tx.Fee < 0 || (tx.IsCoinbase() && tx.Fee != 0) {
+		return fmt.Errorf("%w: fee %d", ErrInvalidAmount, tx.Fee)
+	}
+	if tx.LockTime < 0 {
+		return fmt.Errorf("%w: lock time %d is negative", ErrInvalidAmount, tx.LockTime)
+	}
+	total := tx.Fee
+	for i, out := range tx.Outputs {
+		if out.Amount < 0 {
+			return fmt.Errorf("%w: output %d has negative amount %d", ErrInvalidAmount, i, out.Amount)
+		}
+		if out.ReleaseHeight < 0 {
+			return fmt.Errorf("%w: output %d has negative release height %d", ErrInvalidAmount, i, out.ReleaseHeight)
+		}
+		if total+out.Amount < total {
+			return fmt.Errorf("%w: output total overflows", ErrInvalidAmount)
+		}
+		total += out.Amount
+	}
+	if paid := tx.PaidTotal(); tx.Amount != paid {
+		return fmt.Errorf("%w: amount %d, outputs pay %d to others than the signers", ErrInvalidAmount, tx.Amount, paid)
+	}
+	return nil
+}
+
+// PaidTotal sums the outputs that do not go back to a signer, leaving out
+// change.
+func (tx *Transaction) PaidTotal() int {
+	signers := make(map[string]bool)
+	for _, signer := range tx.Signers() {
+		signers[signer] = true
+	}
+	total := 0
+	for _, out := range tx.Outputs {
+		if !signers[out.Address] {
+			total += out.Amount
+		}
+	}
+	return total
+}
+
+// OutputTotal sums the amounts of all outputs.
+func (tx *Transaction) OutputTotal() int {
+	total := 0
+	for _, out := range tx.Outputs {
+		total += out.Amount
+	}
+	return total
+}
+
+// Size returns the encoded size of the transaction in bytes, which is what
+// fee rates and block size limits are measured in.
+func (tx *Transaction) Size() int {
+	return len(tx.Serialize())
+}
+
+// IsCoinbase reports whether the transaction mints new coins.
+func (tx *Transaction) IsCoinbase() bool {
+	return len(tx.Inputs) == 1 && len(tx.Inputs[0].TxID) == 0
+}
+
+// Hash returns the transaction ID: the SHA-256 of its canonical encoding,
+// or of its gob encoding for version 0. Signature fields, including those
+// of cosigners and unlocking scripts, are left out so the ID is fixed
+// before signing, every signer signs the same hash, and re-signing cannot
+// change it.
 func (tx *Transaction) Hash() []byte {
-	data := []byte(tx.From + tx.To + strconv.Itoa(tx.Amount))
-	hash := sha256.Sum256(data)
+	txCopy := *tx
+	txCopy.Inputs = make([]TxInput, len(tx.Inputs))
+	for i, in := range tx.Inputs {
+		in.Unlock = nil
+		txCopy.Inputs[i] = in
+	}
+	txCopy.R = ""
+	txCopy.S = ""
+	txCopy.PublicKey = nil
+	txCopy.Cosigners = nil
+	txCopy.Signatures = nil
+
+	if tx.Version == 0 {
+		hash := sha256.Sum256(legacyEncode(&txCopy))
+		return hash[:]
+	}
+	var e Encoder
+	e.EncodeTransaction(&txCopy)
+	hash := sha256.Sum256(e.Bytes())
 	return hash[:]
 }
 
+// Sign adds the signature of w. The wallet of From signs in R, S and
+// PublicKey, and a key holder of a multisig From signs in Signatures; any
+// other wallet is added to, or replaces its entry in, Cosigners.
 func (tx *Transaction) Sign(w *Wallet) {
 	hash := tx.Hash()
 	rText, sText := w.Sign(hash)
-	tx.R = rText
-	tx.S = sText
-	tx.PublicKey = w.PublicKey // Store public key for verification
+	if tx.Multisig != nil && tx.Multisig.HasKey(w.PublicKey) {
+		tx.Signatures = addSignature(tx.Signatures, Signature{PublicKey: w.PublicKey, R: rText, S: sText})
+		return
+	}
+	if w.Address() == tx.From {
+		tx.R = rText
+		tx.S = sText
+		tx.PublicKey = w.PublicKey // Store public key for verification
+		return
+	}
+
+	tx.Cosigners = addSignature(tx.Cosigners, Signature{PublicKey: w.PublicKey, R: rText, S: sText})
+}
+
+// addSignature adds sig to sigs, replacing an earlier signature by the same
+// key.
+func addSignature(sigs []Signature, sig Signature) []Signature {
+	for i, s := range sigs {
+		if bytes.Equal(s.PublicKey, sig.PublicKey) {
+			sigs[i] = sig
+			return sigs
+		}
+	}
+	return append(sigs, sig)
 }
 
+// Verify checks the signature of From, or the threshold of a multisig From,
+// and the signature of every cosigner.
 func (tx *Transaction) Verify() bool {
-	return VerifySignature(tx.PublicKey, tx.Hash(), tx.R, tx.S)
+	hash := tx.Hash()
+	if tx.Multisig != nil {
+		have, err := tx.Multisig.CountSignatures(hash, tx.Signatures)
+		if err != nil || have < tx.Multisig.Threshold {
+			return false
+		}
+	} else if !VerifySignature(tx.PublicKey, hash, tx.R, tx.S) {
+		return false
+	}
+	for _, c := range tx.Cosigners {
+		if !VerifySignature(c.PublicKey, hash, c.R, c.S) {
+			return false
+		}
+	}
+	return true
+}
+
+// Signers returns the addresses that signed the transaction: From first,
+// then the cosigners in order.
+func (tx *Transaction) Signers() []string {
+	signers := []string{tx.From}
+	for _, c := range tx.Cosigners {
+		signers = append(signers, AddressFromPublicKey(c.PublicKey))
+	}
+	return signers
 }
 
 // Helper function to convert transaction to string
@@ -39,22 +375,20 @@ func (tx *Transaction) String() string {
 	return tx.From + "->" + tx.To + ":" + strconv.Itoa(tx.Amount)
 }
 
+// Serialize returns the canonical encoding of tx in its envelope.
 func (tx *Transaction) Serialize() []byte {
-	var encoded bytes.Buffer
-	enc := gob.NewEncoder(&encoded)
-	err := enc.Encode(tx)
-	if err != nil {
-		panic(err)
-	}
-	return encoded.Bytes()
+	var e Encoder
+	putEnvelope(&e, txMagic)
+	e.EncodeTransaction(tx)
+	return e.Bytes()
 }
 
+// DeserializeTransaction reads a transaction written by Serialize or, for
+// older data, by gob.
 func DeserializeTransaction(data []byte) *Transaction {
-	var tx Transaction
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&tx)
+	tx, err := DecodeTransaction(data)
 	if err != nil {
 		panic(err)
 	}
-	return &tx
+	return tx
 }
@@ -0,0 +1,100 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCheckAmountsPaid(t *testing.T) {
+	alice, bob, carol := NewWallet(), NewWallet(), NewWallet()
+	coins := func(w *Wallet, amounts ...int) []UTXO {
+		var utxos []UTXO
+		for i, amount := range amounts {
+			utxos = append(utxos, UTXO{
+				OutPoint: OutPoint{TxID: []byte(fmt.Sprint(w.Address(), i)), Vout: i},
+				Output:   TxOutput{Amount: amount, Address: w.Address()},
+			})
+		}
+		return utxos
+	}
+	build := func(payments []TxOutput, contributions ...Contribution) *Transaction {
+		tx, err := NewBatchTransaction(1, alice.Address(), payments, 1, 0, coins(alice, 50, 50), contributions...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+	cosigned := func() *Transaction {
+		tx := build([]TxOutput{{Amount: 70, Address: carol.Address()}}, Contribution{Address: bob.Address(), Amount: 20, Spendable: coins(bob, 30)})
+		tx.Sign(alice)
+		tx.Sign(bob)
+		return tx
+	}
+
+	tests := []struct {
+		name string
+		tx   func() *Transaction
+		want error
+	}{
+		{"single payment", func() *Transaction {
+			return build([]TxOutput{{Amount: 60, Address: bob.Address()}})
+		}, nil},
+		{"batch", func() *Transaction {
+			return build([]TxOutput{{Amount: 10, Address: bob.Address()}, {Amount: 20, Address: carol.Address()}})
+		}, nil},
+		{"cosigned", cosigned, nil},
+		{"payment to self", func() *Transaction {
+			tx := build([]TxOutput{{Amount: 60, Address: alice.Address()}})
+			if tx.Amount != 0 {
+				t.Fatalf("amount %d, want 0", tx.Amount)
+			}
+			return tx
+		}, nil},
+		{"payment to a cosigner", func() *Transaction {
+			tx := build([]TxOutput{{Amount: 70, Address: carol.Address()}, {Amount: 5, Address: bob.Address()}}, Contribution{Address: bob.Address(), Amount: 20, Spendable: coins(bob, 30)})
+			tx.Sign(alice)
+			tx.Sign(bob)
+			if tx.Amount != 70 {
+				t.Fatalf("amount %d, want 70", tx.Amount)
+			}
+			return tx
+		}, nil},
+		{"payment to self claimed", func() *Transaction {
+			tx := build([]TxOutput{{Amount: 60, Address: alice.Address()}})
+			tx.Amount = 60
+			return tx
+		}, ErrInvalidAmount},
+		{"amount counts change", func() *Transaction {
+			tx := build([]TxOutput{{Amount: 60, Address: bob.Address()}})
+			tx.Amount = tx.OutputTotal()
+			return tx
+		}, ErrInvalidAmount},
+		{"amount understated", func() *Transaction {
+			tx := build([]TxOutput{{Amount: 10, Address: bob.Address()}, {Amount: 20, Address: carol.Address()}})
+			tx.Amount = 10
+			return tx
+		}, ErrInvalidAmount},
+		{"cosigner change as payment", func() *Transaction {
+			tx := cosigned()
+			tx.Amount += 10
+			return tx
+		}, ErrInvalidAmount},
+		{"cosigner change unsigned", func() *Transaction {
+			tx := cosigned()
+			tx.Cosigners = nil
+			return tx
+		}, ErrInvalidAmount},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.tx().CheckAmounts()
+			if tt.want == nil && err != nil {
+				t.Fatalf("error %v, want none", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
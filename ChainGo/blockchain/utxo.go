@@ -0,0 +1,177 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/Vishal-2029/pkg"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	utxoBucket     = []byte("chaingo_utxo")
+	utxoAddrBucket = []byte("chaingo_utxo_addr")
+	undoBucket     = []byte("chaingo_undo")
+)
+
+// stateBuckets hold everything derived from connecting blocks and are
+// dropped on reindex.
+var stateBuckets = [][]byte{
+	utxoBucket, utxoAddrBucket, undoBucket, nonceBucket, txIndexBucket, stateMetaBucket,
+	stateUndoBucket, contractCodeBucket, contractStorageBucket, receiptBucket,
+	tokenBucket, tokenBalanceBucket, nameBucket, memoIndexBucket,
+	validatorBucket, voteBucket, stakeBucket, slashBucket, stateTreeBucket,
+}
+
+var ErrMissingInput = errors.New("input not found in UTXO set")
+
+// OutPoint identifies a single output of a transaction.
+type OutPoint struct {
+	TxID []byte `json:"txid"`
+	Vout int    `json:"vout"`
+}
+
+func (op OutPoint) key() []byte {
+	key := make([]byte, len(op.TxID)+4)
+	copy(key, op.TxID)
+	binary.BigEndian.PutUint32(key[len(op.TxID):], uint32(op.Vout))
+	return key
+}
+
+func (op OutPoint) String() string {
+	return fmt.Sprintf("%s:%d", hex.EncodeToString(op.TxID), op.Vout)
+}
+
+// UTXO is an unspent output together with where it was created.
+type UTXO struct {
+	OutPoint
+	Output   TxOutput `json:"output"`
+	Height   int      `json:"height"`
+	Coinbase bool     `json:"coinbase"`
+}
+
+// UTXOSet is the persistent index of unspent outputs. Entries are keyed by
+// outpoint, with a secondary index by address so that balance lookups only
+// touch the outputs of one address.
+type UTXOSet struct {
+	DB *pkg.BoltDB
+}
+
+func addrKey(address string, op OutPoint) []byte {
+	return append(addrPrefix(address), op.key()...)
+}
+
+func addrPrefix(address string) []byte {
+	return append([]byte(address), 0)
+}
+
+// FindByAddress returns all unspent outputs locked to address.
+func (u *UTXOSet) FindByAddress(address string) ([]UTXO, error) {
+	var utxos []UTXO
+	err := u.DB.DB.View(func(tx *bbolt.Tx) error {
+		idx := tx.Bucket(utxoAddrBucket)
+		set := tx.Bucket(utxoBucket)
+		if idx == nil || set == nil {
+			return nil
+		}
+
+		prefix := addrPrefix(address)
+		c := idx.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			entry, err := decodeUTXO(set.Get(k[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			utxos = append(utxos, *entry)
+		}
+		return nil
+	})
+	return utxos, err
+}
+
+// Balance sums the unspent outputs locked to address.
+func (u *UTXOSet) Balance(address string) (int, error) {
+	utxos, err := u.FindByAddress(address)
+	if err != nil {
+		return 0, err
+	}
+	balance := 0
+	for _, entry := range utxos {
+		balance += entry.Output.Amount
+	}
+	return balance, nil
+}
+
+// Get looks up a single unspent output.
+func (u *UTXOSet) Get(op OutPoint) (*UTXO, error) {
+	var entry *UTXO
+	err := u.DB.DB.View(func(tx *bbolt.Tx) error {
+		var err error
+		entry, err = getUTXO(tx, op)
+		return err
+	})
+	return entry, err
+}
+
+// Count returns the number of unspent outputs in the set.
+func (u *UTXOSet) Count() int {
+	count := 0
+	u.DB.DB.View(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket(utxoBucket); b != nil {
+			count = b.Stats().KeyN
+		}
+		return nil
+	})
+	return count
+}
+
+func getUTXO(tx *bbolt.Tx, op OutPoint) (*UTXO, error) {
+	set := tx.Bucket(utxoBucket)
+	if set == nil {
+		return nil, fmt.Errorf("%w: %s", ErrMissingInput, op)
+	}
+	data := set.Get(op.key())
+	if data == nil {
+		return nil, fmt.Errorf("%w: %s", ErrMissingInput, op)
+	}
+	return decodeUTXO(data)
+}
+
+func putUTXO(tx *bbolt.Tx, entry UTXO) error {
+	set, err := tx.CreateBucketIfNotExists(utxoBucket)
+	if err != nil {
+		return err
+	}
+	idx, err := tx.CreateBucketIfNotExists(utxoAddrBucket)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		return err
+	}
+	if err := set.Put(entry.key(), buf.Bytes()); err != nil {
+		return err
+	}
+	return idx.Put(addrKey(entry.Output.Address, entry.OutPoint), []byte{})
+}
+
+func deleteUTXO(tx *bbolt.Tx, entry UTXO) error {
+	if err := tx.Bucket(utxoBucket).Delete(entry.key()); err != nil {
+		return err
+	}
+	return tx.Bucket(utxoAddrBucket).Delete(addrKey(entry.Output.Address, entry.OutPoint))
+}
+
+func decodeUTXO(data []byte) (*UTXO, error) {
+	var entry UTXO
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
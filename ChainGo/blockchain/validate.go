@@ -0,0 +1,283 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// MedianTimeBlocks is how many previous blocks the median time past is
+	// taken over.
+	MedianTimeBlocks = 11
+	// MaxFutureBlockTime is how far, in seconds, a block timestamp may be
+	// ahead of the local clock.
+	MaxFutureBlockTime = 2 * 60 * 60
+)
+
+// Consensus rule violations. ValidateBlock wraps these with details, so
+// callers can tell rules apart with errors.Is.
+var (
+	ErrBadHeaderHash    = errors.New("block hash does not match header")
+	ErrBadProofOfWork   = errors.New("proof of work invalid")
+	ErrBadDifficulty    = errors.New("wrong difficulty")
+	ErrBadMerkleRoot    = errors.New("merkle root does not match transactions")
+	ErrBadPrevHash      = errors.New("previous hash mismatch")
+	ErrBadHeight        = errors.New("wrong height")
+	ErrBadGenesis       = errors.New("invalid genesis block")
+	ErrTimeTooOld       = errors.New("timestamp before median time past")
+	ErrTimeTooNew       = errors.New("timestamp too far in the future")
+	ErrNoCoinbase       = errors.New("first transaction is not a coinbase")
+	ErrMultipleCoinbase = errors.New("more than one coinbase")
+	ErrBadCoinbase      = errors.New("invalid coinbase")
+	ErrDuplicateTx      = errors.New("duplicate transaction")
+	ErrBadSignature     = errors.New("invalid signature")
+)
+
+// ParentState is the chain context a block is validated against: the block
+// it builds on and the values derived from that block's ancestors.
+type ParentState struct {
+	Hash       []byte
+	Height     int
+	Version    uint32 // Lowest version the child block may have
+	Bits       uint32 // Target the child block must meet
+	MedianTime int64  // Median timestamp of the last MedianTimeBlocks blocks
+	Seed       []byte // Randomness of the parent block; see Block.Seed
+}
+
+// CheckBlock applies the rules that need nothing but the block itself:
+// header hash, version, size, Merkle root and the shape and signatures of
+// its transactions. The seal is checked by the consensus engine.
+func (p *ChainParams) CheckBlock(block *Block) error {
+	if block.Version > BlockVersion {
+		return fmt.Errorf("%w: block version %d", ErrBadVersion, block.Version)
+	}
+	if !bytes.Equal(block.Hash, block.HeaderHash()) {
+		return fmt.Errorf("%w: %x", ErrBadHeaderHash, block.Hash)
+	}
+	if size := block.Size(); size > p.MaxBlockSize {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrBlockTooLarge, size, p.MaxBlockSize)
+	}
+	if !bytes.Equal(block.MerkleRoot, block.ComputeMerkleRoot()) {
+		return ErrBadMerkleRoot
+	}
+	if len(block.Transactions) == 0 || !block.Transactions[0].IsCoinbase() {
+		return ErrNoCoinbase
+	}
+
+	seen := make(map[string]bool)
+	gas := 0
+	for i, t := range block.Transactions {
+		hash := string(t.Hash())
+		if seen[hash] {
+			return fmt.Errorf("%w: %x", ErrDuplicateTx, t.Hash())
+		}
+		seen[hash] = true
+
+		if (t.Version == 0) != (block.Version == 0) || t.Version > block.Version {
+			return fmt.Errorf("%w: transaction %d has version %d in a version %d block", ErrBadVersion, i, t.Version, block.Version)
+		}
+		if i == 0 {
+			continue
+		}
+		if t.IsCoinbase() {
+			return fmt.Errorf("%w: transaction %d", ErrMultipleCoinbase, i)
+		}
+		if err := CheckSignature(t); err != nil {
+			return fmt.Errorf("transaction %d: %w", i, err)
+		}
+		if gas += t.GasLimit(); gas > p.MaxBlockGas {
+			return fmt.Errorf("%w: more than %d", ErrBlockGas, p.MaxBlockGas)
+		}
+	}
+	return p.checkCoinbase(block)
+}
+
+// checkCoinbase requires the coinbase to commit to the block height. Its
+// amount depends on the fees of the block and is checked when the block is
+// connected.
+func (p *ChainParams) checkCoinbase(block *Block) error {
+	cb := block.Transactions[0]
+	if cb.Inputs[0].Vout != block.Height {
+		return fmt.Errorf("%w: committed to height %d, block is at %d", ErrBadCoinbase, cb.Inputs[0].Vout, block.Height)
+	}
+	if cb.ChainID != p.ChainID {
+		return fmt.Errorf("%w: %w: expected %d, got %d", ErrBadCoinbase, ErrWrongChainID, p.ChainID, cb.ChainID)
+	}
+	if err := cb.CheckAmounts(); err != nil {
+		return fmt.Errorf("%w: %w", ErrBadCoinbase, err)
+	}
+	return nil
+}
+
+// CheckSignature verifies that a transaction is signed by the key that owns
+// its From address, or by enough holders of a multisig From, and that each
+// cosigner signs once and is not From. Whether the signers own the inputs
+// is checked against the UTXO set.
+func CheckSignature(t *Transaction) error {
+	if t.Multisig != nil {
+		if err := checkMultisig(t); err != nil {
+			return err
+		}
+	} else if len(t.Signatures) > 0 {
+		return fmt.Errorf("%w: multisig signatures without a multisig policy", ErrBadSignature)
+	} else if AddressFromPublicKey(t.PublicKey) != t.From {
+		return fmt.Errorf("%w: public key does not belong to %s", ErrBadSignature, t.From)
+	}
+	seen := make(map[string]bool)
+	for _, signer := range t.Signers() {
+		if seen[signer] {
+			return fmt.Errorf("%w: %s signs twice", ErrBadSignature, signer)
+		}
+		seen[signer] = true
+	}
+	if !t.Verify() {
+		return fmt.Errorf("%w: transaction %x", ErrBadSignature, t.Hash())
+	}
+	return nil
+}
+
+// checkMultisig requires the policy of a multisig transaction to belong to
+// From and to be met by its signatures.
+func checkMultisig(t *Transaction) error {
+	if err := t.Multisig.Check(); err != nil {
+		return fmt.Errorf("%w: %w", ErrBadSignature, err)
+	}
+	if t.Multisig.Address() != t.From {
+		return fmt.Errorf("%w: multisig policy does not belong to %s", ErrBadSignature, t.From)
+	}
+	if len(t.PublicKey) > 0 || t.R != "" || t.S != "" {
+		return fmt.Errorf("%w: multisig transaction carries a single-key signature", ErrBadSignature)
+	}
+	have, need, err := t.MultisigProgress()
+	if err != nil {
+		return err
+	}
+	if have < need {
+		return fmt.Errorf("%w: %d of %d multisig signatures", ErrBadSignature, have, need)
+	}
+	return nil
+}
+
+// ValidateBlock applies every consensus rule that does not need the UTXO
+// set. parent is nil for the genesis block. Spending rules and the coinbase
+// amount are enforced when the block is connected.
+func (p *ChainParams) ValidateBlock(block *Block, parent *ParentState) error {
+	if parent == nil {
+		genesis, err := p.GenesisBlock()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(block.Hash, genesis.Hash) {
+			return fmt.Errorf("%w: hash %x, expected %x", ErrBadGenesis, block.Hash, genesis.Hash)
+		}
+		return p.CheckBlock(block)
+	}
+
+	if err := p.ValidateHeader(block, parent); err != nil {
+		return err
+	}
+	for i, t := range block.Transactions {
+		if err := t.CheckFinal(block.Height, parent.MedianTime); err != nil {
+			return fmt.Errorf("transaction %d: %w", i, err)
+		}
+	}
+	return p.CheckBlock(block)
+}
+
+// ValidateHeader applies the rules ValidateBlock checks on the header of a
+// block that is not the genesis block: its hash, the link to parent, the
+// seal and the timestamp. It needs no transactions, so headers can be
+// checked before their blocks are fetched.
+func (p *ChainParams) ValidateHeader(block *Block, parent *ParentState) error {
+	if !bytes.Equal(block.Hash, block.HeaderHash()) {
+		return fmt.Errorf("%w: %x", ErrBadHeaderHash, block.Hash)
+	}
+	if !bytes.Equal(block.PrevHash, parent.Hash) {
+		return fmt.Errorf("%w: %x", ErrBadPrevHash, block.PrevHash)
+	}
+	if block.Height != parent.Height+1 {
+		return fmt.Errorf("%w: claims %d, parent is at %d", ErrBadHeight, block.Height, parent.Height)
+	}
+	if block.Version < parent.Version {
+		return fmt.Errorf("%w: block version %d below parent version %d", ErrBadVersion, block.Version, parent.Version)
+	}
+	if err := p.Consensus.VerifyHeader(block, parent); err != nil {
+		return err
+	}
+	// Blocks may share a timestamp when mined within the same second, so
+	// only a timestamp strictly before the median is rejected.
+	if block.Timestamp < parent.MedianTime {
+		return fmt.Errorf("%w: %d < %d", ErrTimeTooOld, block.Timestamp, parent.MedianTime)
+	}
+	if limit := time.Now().Unix() + MaxFutureBlockTime; block.Timestamp > limit {
+		return fmt.Errorf("%w: %d > %d", ErrTimeTooNew, block.Timestamp, limit)
+	}
+	return nil
+}
+
+// ParentStateAt builds the context for a child of the block at height,
+// given a lookup of that block's ancestors by height.
+func (p *ChainParams) ParentStateAt(height int, blockAt func(int) *Block) (*ParentState, error) {
+	parent := blockAt(height)
+	if parent == nil {
+		return nil, fmt.Errorf("no block at height %d", height)
+	}
+	mtp, err := MedianTimePast(height, blockAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ParentState{
+		Hash:       parent.Hash,
+		Height:     parent.Height,
+		Version:    parent.Version,
+		Bits:       p.NextBits(height+1, blockAt),
+		MedianTime: mtp,
+		Seed:       parent.Seed(),
+	}, nil
+}
+
+// MedianTimePast returns the median timestamp of the MedianTimeBlocks
+// blocks ending at height.
+func MedianTimePast(height int, blockAt func(int) *Block) (int64, error) {
+	var times []int64
+	for h := height; h >= 0 && h > height-MedianTimeBlocks; h-- {
+		b := blockAt(h)
+		if b == nil {
+			return 0, fmt.Errorf("no block at height %d", h)
+		}
+		times = append(times, b.Timestamp)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2], nil
+}
+
+// parentState returns the context for a child of the stored block hash,
+// which may be on a side branch.
+func (bc *Blockchain) parentState(tx *bbolt.Tx, hash []byte) (*ParentState, error) {
+	node, err := getNode(tx, hash)
+	if err != nil {
+		return nil, err
+	}
+	return bc.Params.ParentStateAt(node.Height, branchBlockAt(tx, hash))
+}
+
+// ValidateBlock checks block against the consensus rules as a child of its
+// stored parent.
+func (bc *Blockchain) ValidateBlock(block *Block) error {
+	if len(block.PrevHash) == 0 {
+		return bc.Params.ValidateBlock(block, nil)
+	}
+	return bc.DB.DB.View(func(tx *bbolt.Tx) error {
+		parent, err := bc.parentState(tx, block.PrevHash)
+		if err != nil {
+			return fmt.Errorf("%w: %x", ErrOrphanBlock, block.PrevHash)
+		}
+		return bc.Params.ValidateBlock(block, parent)
+	})
+}
@@ -0,0 +1,661 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Contract code is byte code for a stack machine. Stack items are byte
+// strings of at most MaxContractItem bytes; arithmetic reads them as
+// big-endian signed integers of up to 8 bytes and writes 8-byte results.
+// The machine has no access to anything but the stack, the calling
+// transaction and the contract's own storage, so every node computes the
+// same result. Every instruction costs gas, which bounds how long it runs.
+const (
+	MaxContractItem  = 1024
+	MaxContractStack = 1024
+)
+
+// Contract opcodes. PUSH is followed by a length byte and that many bytes
+// of data.
+const (
+	OpStop     byte = 0x00
+	OpPush     byte = 0x01
+	OpPop      byte = 0x02
+	OpDup      byte = 0x03
+	OpSwap     byte = 0x04
+	OpOver     byte = 0x05
+	OpAdd      byte = 0x10
+	OpSub      byte = 0x11
+	OpMul      byte = 0x12
+	OpDiv      byte = 0x13
+	OpMod      byte = 0x14
+	OpLt       byte = 0x15
+	OpGt       byte = 0x16
+	OpEq       byte = 0x17
+	OpNot      byte = 0x18
+	OpAnd      byte = 0x19
+	OpOr       byte = 0x1a
+	OpJump     byte = 0x20
+	OpJumpI    byte = 0x21
+	OpJumpDest byte = 0x22
+	OpSha256   byte = 0x30
+	OpConcat   byte = 0x31
+	OpSize     byte = 0x32
+	OpCaller   byte = 0x40
+	OpAddress  byte = 0x41
+	OpHeight   byte = 0x42
+	OpArg      byte = 0x43
+	OpArgc     byte = 0x44
+	OpInit     byte = 0x45
+	OpSLoad    byte = 0x50
+	OpSStore   byte = 0x51
+	OpLog      byte = 0x60
+	OpReturn   byte = 0x61
+	OpRevert   byte = 0x62
+)
+
+// contractOp describes an opcode: its assembler name and base gas cost.
+type contractOp struct {
+	name string
+	gas  int
+}
+
+var contractOps = map[byte]contractOp{
+	OpStop:     {"STOP", 0},
+	OpPush:     {"PUSH", 1},
+	OpPop:      {"POP", 1},
+	OpDup:      {"DUP", 1},
+	OpSwap:     {"SWAP", 1},
+	OpOver:     {"OVER", 1},
+	OpAdd:      {"ADD", 3},
+	OpSub:      {"SUB", 3},
+	OpMul:      {"MUL", 5},
+	OpDiv:      {"DIV", 5},
+	OpMod:      {"MOD", 5},
+	OpLt:       {"LT", 3},
+	OpGt:       {"GT", 3},
+	OpEq:       {"EQ", 3},
+	OpNot:      {"NOT", 3},
+	OpAnd:      {"AND", 3},
+	OpOr:       {"OR", 3},
+	OpJump:     {"JUMP", 8},
+	OpJumpI:    {"JUMPI", 10},
+	OpJumpDest: {"JUMPDEST", 1},
+	OpSha256:   {"SHA256", 30}, // Plus 6 per 32 bytes hashed
+	OpConcat:   {"CONCAT", 3},  // Plus 3 per 32 bytes joined
+	OpSize:     {"SIZE", 2},
+	OpCaller:   {"CALLER", 2},
+	OpAddress:  {"ADDRESS", 2},
+	OpHeight:   {"HEIGHT", 2},
+	OpArg:      {"ARG", 3},
+	OpArgc:     {"ARGC", 2},
+	OpInit:     {"INIT", 2},
+	OpSLoad:    {"SLOAD", 50},
+	OpSStore:   {"SSTORE", 200}, // Plus 100 per 32 bytes of key and value
+	OpLog:      {"LOG", 20},     // Plus 8 per 32 bytes logged
+	OpReturn:   {"RETURN", 0},
+	OpRevert:   {"REVERT", 0},
+}
+
+var contractOpCodes = func() map[string]byte {
+	codes := make(map[string]byte)
+	for code, op := range contractOps {
+		codes[op.name] = code
+	}
+	return codes
+}()
+
+var (
+	ErrBadContract      = errors.New("malformed contract code")
+	ErrOutOfGas         = errors.New("out of gas")
+	ErrContractReverted = errors.New("contract reverted")
+	ErrContractFault    = errors.New("contract fault")
+)
+
+// AnalyzeContract checks that code decodes into known instructions and
+// returns the offsets of its JUMPDEST instructions, the only valid jump
+// targets. A JUMPDEST byte inside pushed data is not one.
+func AnalyzeContract(code []byte) (map[int]bool, error) {
+	if len(code) > MaxContractSize {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrBadContract, len(code), MaxContractSize)
+	}
+	dests := make(map[int]bool)
+	for pc := 0; pc < len(code); pc++ {
+		switch code[pc] {
+		case OpPush:
+			if pc+1 >= len(code) || pc+1+int(code[pc+1]) >= len(code) {
+				return nil, fmt.Errorf("%w: PUSH at %d runs past the end", ErrBadContract, pc)
+			}
+			pc += 1 + int(code[pc+1])
+		case OpJumpDest:
+			dests[pc] = true
+		default:
+			if _, ok := contractOps[code[pc]]; !ok {
+				return nil, fmt.Errorf("%w: unknown opcode 0x%02x at %d", ErrBadContract, code[pc], pc)
+			}
+		}
+	}
+	return dests, nil
+}
+
+// AssembleContract translates contract assembly into byte code. Tokens are
+// separated by white space and # starts a comment. A token is an opcode
+// name; a decimal number, pushed as an 8-byte integer; 0x followed by hex
+// digits, pushed as data; a double-quoted string without spaces, pushed as
+// its bytes; "name:", which marks a jump target; or "@name", which pushes
+// the offset of that target.
+func AssembleContract(asm string) ([]byte, error) {
+	var tokens []string
+	for _, line := range strings.Split(asm, "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		tokens = append(tokens, strings.Fields(line)...)
+	}
+
+	// Label references always assemble to a 10-byte push, so offsets are
+	// known after one pass.
+	labels := make(map[string]int)
+	size := 0
+	for _, tok := range tokens {
+		switch {
+		case strings.HasSuffix(tok, ":"):
+			name := strings.TrimSuffix(tok, ":")
+			if _, ok := labels[name]; ok {
+				return nil, fmt.Errorf("%w: label %s defined twice", ErrBadContract, name)
+			}
+			labels[name] = size
+			size++
+		case strings.HasPrefix(tok, "@"):
+			size += 10
+		default:
+			data, isPush, err := assembleToken(tok)
+			if err != nil {
+				return nil, err
+			}
+			if isPush {
+				size += 2 + len(data)
+			} else {
+				size++
+			}
+		}
+	}
+
+	var code []byte
+	for _, tok := range tokens {
+		switch {
+		case strings.HasSuffix(tok, ":"):
+			code = append(code, OpJumpDest)
+		case strings.HasPrefix(tok, "@"):
+			offset, ok := labels[tok[1:]]
+			if !ok {
+				return nil, fmt.Errorf("%w: unknown label %s", ErrBadContract, tok[1:])
+			}
+			code = appendPush(code, EncodeContractInt(int64(offset)))
+		default:
+			data, isPush, _ := assembleToken(tok)
+			if isPush {
+				code = appendPush(code, data)
+			} else {
+				code = append(code, contractOpCodes[strings.ToUpper(tok)])
+			}
+		}
+	}
+	if _, err := AnalyzeContract(code); err != nil {
+		return nil, err
+	}
+	return code, nil
+}
+
+// assembleToken returns the data a token pushes, or reports that it is an
+// opcode.
+func assembleToken(tok string) ([]byte, bool, error) {
+	switch {
+	case strings.HasPrefix(tok, "0x"):
+		data, err := hex.DecodeString(tok[2:])
+		if err != nil {
+			return nil, false, fmt.Errorf("%w: bad data %q", ErrBadContract, tok)
+		}
+		if len(data) > 255 {
+			return nil, false, fmt.Errorf("%w: push of %d bytes, limit 255", ErrBadContract, len(data))
+		}
+		return data, true, nil
+	case len(tok) >= 2 && strings.HasPrefix(tok, `"`) && strings.HasSuffix(tok, `"`):
+		return []byte(tok[1 : len(tok)-1]), true, nil
+	}
+	if n, err := strconv.ParseInt(tok, 10, 64); err == nil {
+		return EncodeContractInt(n), true, nil
+	}
+	if _, ok := contractOpCodes[strings.ToUpper(tok)]; !ok || strings.ToUpper(tok) == "PUSH" {
+		return nil, false, fmt.Errorf("%w: unknown token %q", ErrBadContract, tok)
+	}
+	return nil, false, nil
+}
+
+func appendPush(code, data []byte) []byte {
+	code = append(code, OpPush, byte(len(data)))
+	return append(code, data...)
+}
+
+// DisassembleContract renders code one instruction per line, prefixed with
+// its offset.
+func DisassembleContract(code []byte) string {
+	var lines []string
+	for pc := 0; pc < len(code); pc++ {
+		op, ok := contractOps[code[pc]]
+		switch {
+		case !ok:
+			lines = append(lines, fmt.Sprintf("%04d  0x%02x ?", pc, code[pc]))
+		case code[pc] == OpPush && pc+1 < len(code):
+			end := min(pc+2+int(code[pc+1]), len(code))
+			lines = append(lines, fmt.Sprintf("%04d  PUSH 0x%x", pc, code[pc+2:end]))
+			pc = end - 1
+		default:
+			lines = append(lines, fmt.Sprintf("%04d  %s", pc, op.name))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ContractContext is what a running contract can learn about its call.
+type ContractContext struct {
+	Caller  string
+	Address string
+	Height  int
+	Args    [][]byte
+	Init    bool // True while the contract is being deployed
+}
+
+// ExecResult is the outcome of running a contract. Writes holds the
+// storage changes in the order they were first made; they are only
+// applied if the run succeeded. An empty value deletes the key.
+type ExecResult struct {
+	GasUsed int
+	Return  []byte
+	Logs    [][]byte
+	Writes  []StorageWrite
+}
+
+// StorageWrite is a change to one key of contract storage.
+type StorageWrite struct {
+	Key   []byte
+	Value []byte
+}
+
+// contractVM runs one contract call.
+type contractVM struct {
+	code  []byte
+	dests map[int]bool
+	ctx   ContractContext
+	load  func(key []byte) []byte
+
+	gasLimit int
+	gasUsed  int
+	stack    [][]byte
+	writes   map[string]int // Key to index in result.Writes
+	result   ExecResult
+}
+
+// ExecuteContract runs code with gasLimit gas. load reads the contract's
+// committed storage. A failed run returns the result so far, with the gas
+// used, and an error wrapping ErrOutOfGas, ErrContractReverted or
+// ErrContractFault.
+func ExecuteContract(code []byte, ctx ContractContext, gasLimit int, load func(key []byte) []byte) (*ExecResult, error) {
+	dests, err := AnalyzeContract(code)
+	if err != nil {
+		return &ExecResult{}, err
+	}
+	vm := &contractVM{
+		code:     code,
+		dests:    dests,
+		ctx:      ctx,
+		load:     load,
+		gasLimit: gasLimit,
+		writes:   make(map[string]int),
+	}
+	err = vm.run()
+	vm.result.GasUsed = vm.gasUsed
+	return &vm.result, err
+}
+
+func (vm *contractVM) run() error {
+	for pc := 0; pc < len(vm.code); pc++ {
+		code := vm.code[pc]
+		if err := vm.useGas(contractOps[code].gas); err != nil {
+			return err
+		}
+
+		switch code {
+		case OpStop:
+			return nil
+		case OpPush:
+			n := int(vm.code[pc+1])
+			if err := vm.push(vm.code[pc+2 : pc+2+n]); err != nil {
+				return err
+			}
+			pc += 1 + n
+		case OpJump, OpJumpI:
+			target, err := vm.popInt()
+			if err != nil {
+				return err
+			}
+			if code == OpJumpI {
+				cond, err := vm.pop()
+				if err != nil {
+					return err
+				}
+				if !contractBool(cond) {
+					continue
+				}
+			}
+			if target < 0 || target >= int64(len(vm.code)) || !vm.dests[int(target)] {
+				return fmt.Errorf("%w: jump to %d at %d is not a JUMPDEST", ErrContractFault, target, pc)
+			}
+			pc = int(target) // The JUMPDEST itself is skipped
+		case OpReturn:
+			ret, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			vm.result.Return = ret
+			return nil
+		case OpRevert:
+			msg, err := vm.pop()
+			if err != nil {
+				return err
+			}
+			vm.result.Return = msg
+			return fmt.Errorf("%w: %s", ErrContractReverted, msg)
+		default:
+			if err := vm.step(code); err != nil {
+				return fmt.Errorf("%w at %d", err, pc)
+			}
+		}
+	}
+	return nil
+}
+
+func (vm *contractVM) step(code byte) error {
+	switch code {
+	case OpPop:
+		_, err := vm.pop()
+		return err
+	case OpDup, OpOver:
+		depth := 1
+		if code == OpOver {
+			depth = 2
+		}
+		if len(vm.stack) < depth {
+			return fmt.Errorf("%w: stack underflow", ErrContractFault)
+		}
+		return vm.push(vm.stack[len(vm.stack)-depth])
+	case OpSwap:
+		if len(vm.stack) < 2 {
+			return fmt.Errorf("%w: stack underflow", ErrContractFault)
+		}
+		n := len(vm.stack)
+		vm.stack[n-1], vm.stack[n-2] = vm.stack[n-2], vm.stack[n-1]
+	case OpAdd, OpSub, OpMul, OpDiv, OpMod, OpLt, OpGt, OpAnd, OpOr:
+		b, err := vm.popInt()
+		if err != nil {
+			return err
+		}
+		a, err := vm.popInt()
+		if err != nil {
+			return err
+		}
+		r, err := contractArith(code, a, b)
+		if err != nil {
+			return err
+		}
+		return vm.push(EncodeContractInt(r))
+	case OpEq:
+		b, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		a, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		return vm.pushBool(bytes.Equal(a, b))
+	case OpNot:
+		a, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		return vm.pushBool(!contractBool(a))
+	case OpSha256:
+		a, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		if err := vm.useGas(6 * ((len(a) + 31) / 32)); err != nil {
+			return err
+		}
+		hash := sha256.Sum256(a)
+		return vm.push(hash[:])
+	case OpConcat:
+		b, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		a, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		if err := vm.useGas(3 * ((len(a) + len(b) + 31) / 32)); err != nil {
+			return err
+		}
+		return vm.push(append(append([]byte{}, a...), b...))
+	case OpSize:
+		a, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		return vm.push(EncodeContractInt(int64(len(a))))
+	case OpCaller:
+		return vm.push([]byte(vm.ctx.Caller))
+	case OpAddress:
+		return vm.push([]byte(vm.ctx.Address))
+	case OpHeight:
+		return vm.push(EncodeContractInt(int64(vm.ctx.Height)))
+	case OpArg:
+		i, err := vm.popInt()
+		if err != nil {
+			return err
+		}
+		if i < 0 || i >= int64(len(vm.ctx.Args)) {
+			return vm.push(nil)
+		}
+		return vm.push(vm.ctx.Args[i])
+	case OpArgc:
+		return vm.push(EncodeContractInt(int64(len(vm.ctx.Args))))
+	case OpInit:
+		return vm.pushBool(vm.ctx.Init)
+	case OpSLoad:
+		key, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		return vm.push(vm.sload(key))
+	case OpSStore:
+		value, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		key, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		if len(key) == 0 {
+			return fmt.Errorf("%w: empty storage key", ErrContractFault)
+		}
+		if err := vm.useGas(100 * ((len(key) + len(value) + 31) / 32)); err != nil {
+			return err
+		}
+		vm.sstore(key, value)
+	case OpLog:
+		msg, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		if err := vm.useGas(8 * ((len(msg) + 31) / 32)); err != nil {
+			return err
+		}
+		vm.result.Logs = append(vm.result.Logs, msg)
+	}
+	return nil
+}
+
+func contractArith(code byte, a, b int64) (int64, error) {
+	switch code {
+	case OpAdd:
+		if (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b) {
+			return 0, fmt.Errorf("%w: overflow in ADD", ErrContractFault)
+		}
+		return a + b, nil
+	case OpSub:
+		if (b < 0 && a > math.MaxInt64+b) || (b > 0 && a < math.MinInt64+b) {
+			return 0, fmt.Errorf("%w: overflow in SUB", ErrContractFault)
+		}
+		return a - b, nil
+	case OpMul:
+		if a != 0 && b != 0 {
+			r := a * b
+			if r/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+				return 0, fmt.Errorf("%w: overflow in MUL", ErrContractFault)
+			}
+			return r, nil
+		}
+		return 0, nil
+	case OpDiv, OpMod:
+		if b == 0 {
+			return 0, fmt.Errorf("%w: division by zero", ErrContractFault)
+		}
+		if a == math.MinInt64 && b == -1 {
+			return 0, fmt.Errorf("%w: overflow in division", ErrContractFault)
+		}
+		if code == OpDiv {
+			return a / b, nil
+		}
+		return a % b, nil
+	case OpLt:
+		return boolInt(a < b), nil
+	case OpGt:
+		return boolInt(a > b), nil
+	case OpAnd:
+		return boolInt(a != 0 && b != 0), nil
+	case OpOr:
+		return boolInt(a != 0 || b != 0), nil
+	}
+	return 0, fmt.Errorf("%w: not an arithmetic opcode 0x%02x", ErrContractFault, code)
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (vm *contractVM) useGas(gas int) error {
+	if vm.gasUsed+gas > vm.gasLimit {
+		vm.gasUsed = vm.gasLimit
+		return fmt.Errorf("%w: limit %d", ErrOutOfGas, vm.gasLimit)
+	}
+	vm.gasUsed += gas
+	return nil
+}
+
+func (vm *contractVM) sload(key []byte) []byte {
+	if i, ok := vm.writes[string(key)]; ok {
+		return vm.result.Writes[i].Value
+	}
+	return vm.load(key)
+}
+
+func (vm *contractVM) sstore(key, value []byte) {
+	key = append([]byte{}, key...)
+	if i, ok := vm.writes[string(key)]; ok {
+		vm.result.Writes[i].Value = value
+		return
+	}
+	vm.writes[string(key)] = len(vm.result.Writes)
+	vm.result.Writes = append(vm.result.Writes, StorageWrite{Key: key, Value: value})
+}
+
+func (vm *contractVM) push(item []byte) error {
+	if len(item) > MaxContractItem {
+		return fmt.Errorf("%w: item of %d bytes, limit %d", ErrContractFault, len(item), MaxContractItem)
+	}
+	if len(vm.stack) >= MaxContractStack {
+		return fmt.Errorf("%w: stack overflow", ErrContractFault)
+	}
+	vm.stack = append(vm.stack, item)
+	return nil
+}
+
+func (vm *contractVM) pushBool(b bool) error {
+	return vm.push(EncodeContractInt(boolInt(b)))
+}
+
+func (vm *contractVM) pop() ([]byte, error) {
+	if len(vm.stack) == 0 {
+		return nil, fmt.Errorf("%w: stack underflow", ErrContractFault)
+	}
+	top := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return top, nil
+}
+
+func (vm *contractVM) popInt() (int64, error) {
+	top, err := vm.pop()
+	if err != nil {
+		return 0, err
+	}
+	return DecodeContractInt(top)
+}
+
+// EncodeContractInt writes n the way contracts produce and expect
+// numbers: 8 bytes, big-endian.
+func EncodeContractInt(n int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(n))
+	return b
+}
+
+// DecodeContractInt reads a big-endian signed integer of up to 8 bytes.
+// The empty string is 0.
+func DecodeContractInt(b []byte) (int64, error) {
+	if len(b) > 8 {
+		return 0, fmt.Errorf("%w: %d-byte number", ErrContractFault, len(b))
+	}
+	var n int64
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		n = -1 // Sign-extend
+	}
+	for _, c := range b {
+		n = n<<8 | int64(c)
+	}
+	return n, nil
+}
+
+// contractBool is false for the empty string and for strings of zero
+// bytes, and true otherwise.
+func contractBool(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return true
+		}
+	}
+	return false
+}
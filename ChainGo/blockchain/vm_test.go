@@ -0,0 +1,178 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestExecuteContract(t *testing.T) {
+	word := "0x" + strings.Repeat("ab", 32)
+	ctx := ContractContext{Caller: "alice", Address: "contract", Height: 7, Args: [][]byte{[]byte("x"), []byte("y")}}
+	committed := map[string][]byte{"old": []byte("stored")}
+
+	tests := []struct {
+		name    string
+		asm     string
+		init    bool
+		gas     int
+		want    error
+		ret     []byte
+		gasUsed int
+		writes  []StorageWrite
+		logs    [][]byte
+	}{
+		{name: "add", asm: "2 3 ADD RETURN", ret: EncodeContractInt(5), gasUsed: 5},
+		{name: "sub", asm: "2 3 SUB RETURN", ret: EncodeContractInt(-1), gasUsed: 5},
+		{name: "mul", asm: "6 7 MUL RETURN", ret: EncodeContractInt(42), gasUsed: 7},
+		{name: "div", asm: "7 2 DIV RETURN", ret: EncodeContractInt(3), gasUsed: 7},
+		{name: "mod", asm: "7 2 MOD RETURN", ret: EncodeContractInt(1), gasUsed: 7},
+		{name: "lt", asm: "1 2 LT RETURN", ret: EncodeContractInt(1), gasUsed: 5},
+		{name: "eq compares bytes", asm: "0x01 1 EQ RETURN", ret: EncodeContractInt(0), gasUsed: 5},
+		{name: "not", asm: "0x0000 NOT RETURN", ret: EncodeContractInt(1), gasUsed: 4},
+		{name: "overflow", asm: "9223372036854775807 1 ADD", want: ErrContractFault},
+		{name: "division by zero", asm: "1 0 DIV", want: ErrContractFault},
+		{name: "number too long", asm: "0x010203040506070809 1 ADD", want: ErrContractFault},
+		{name: "underflow", asm: "ADD", want: ErrContractFault},
+		{name: "stop", asm: "1 STOP 2 RETURN", gasUsed: 1},
+		{name: "falls off the end", asm: "1 2", gasUsed: 2},
+		{name: "revert", asm: `"no" REVERT`, want: ErrContractReverted, ret: []byte("no"), gasUsed: 1},
+		{name: "out of gas", asm: "1 1 ADD", gas: 4, want: ErrOutOfGas, gasUsed: 4},
+		{name: "sha256 per word", asm: word + " SHA256", gasUsed: 1 + 30 + 6},
+		{name: "concat per word", asm: word + " " + word + " CONCAT SIZE RETURN", ret: EncodeContractInt(64), gasUsed: 1 + 1 + 3 + 6 + 2},
+		{name: "jump", asm: "@end JUMP 1 0 DIV end: 7 RETURN", ret: EncodeContractInt(7), gasUsed: 1 + 8 + 1},
+		{name: "jumpi taken", asm: "1 @end JUMPI 1 RETURN end: 2 RETURN", ret: EncodeContractInt(2), gasUsed: 1 + 1 + 10 + 1},
+		{name: "jumpi not taken", asm: "0 @end JUMPI 1 RETURN end: 2 RETURN", ret: EncodeContractInt(1), gasUsed: 1 + 1 + 10 + 1},
+		{name: "jump into push data", asm: "3 JUMP 0x22", want: ErrContractFault},
+		{name: "caller", asm: "CALLER RETURN", ret: []byte("alice"), gasUsed: 2},
+		{name: "address", asm: "ADDRESS RETURN", ret: []byte("contract"), gasUsed: 2},
+		{name: "height", asm: "HEIGHT RETURN", ret: EncodeContractInt(7), gasUsed: 2},
+		{name: "args", asm: "0 ARG 1 ARG CONCAT RETURN", ret: []byte("xy"), gasUsed: 1 + 3 + 1 + 3 + 3 + 3},
+		{name: "missing arg is empty", asm: "5 ARG RETURN", ret: []byte{}, gasUsed: 4},
+		{name: "argc", asm: "ARGC RETURN", ret: EncodeContractInt(2), gasUsed: 2},
+		{name: "init", asm: "INIT RETURN", init: true, ret: EncodeContractInt(1), gasUsed: 2},
+		{name: "sload committed", asm: `"old" SLOAD RETURN`, ret: []byte("stored"), gasUsed: 51},
+		{
+			name:    "sstore then sload",
+			asm:     `"k" "v" SSTORE "k" "w" SSTORE "k" SLOAD RETURN`,
+			ret:     []byte("w"),
+			gasUsed: 2 + 200 + 100 + 2 + 200 + 100 + 1 + 50,
+			writes:  []StorageWrite{{Key: []byte("k"), Value: []byte("w")}},
+		},
+		{name: "sstore empty key", asm: `0x "v" SSTORE`, want: ErrContractFault},
+		{name: "log", asm: `"hello" LOG`, gasUsed: 1 + 20 + 8, logs: [][]byte{[]byte("hello")}},
+		{
+			name:    "sstore per word",
+			asm:     `"k" ` + word + ` SSTORE`,
+			gasUsed: 2 + 200 + 200,
+			writes:  []StorageWrite{{Key: []byte("k"), Value: bytes.Repeat([]byte{0xab}, 32)}},
+		},
+		{name: "sstore out of gas", asm: `"k" ` + word + ` SSTORE`, gas: 2 + 200 + 199, want: ErrOutOfGas, gasUsed: 2 + 200 + 199},
+		{name: "log per word", asm: word + " " + word + ` CONCAT LOG`, gasUsed: 1 + 1 + 3 + 6 + 20 + 16, logs: [][]byte{bytes.Repeat([]byte{0xab}, 64)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := AssembleContract(tt.asm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, gas := ctx, tt.gas
+			c.Init = tt.init
+			if gas == 0 {
+				gas = 100000
+			}
+			res, err := ExecuteContract(code, c, gas, func(key []byte) []byte { return committed[string(key)] })
+			if tt.want == nil && err != nil {
+				t.Fatalf("error %v, want none", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("error %v, want %v", err, tt.want)
+			}
+			if tt.want == ErrContractFault {
+				return
+			}
+			if !bytes.Equal(res.Return, tt.ret) {
+				t.Errorf("return %x, want %x", res.Return, tt.ret)
+			}
+			if res.GasUsed != tt.gasUsed {
+				t.Errorf("gas used %d, want %d", res.GasUsed, tt.gasUsed)
+			}
+			if len(res.Writes) != len(tt.writes) {
+				t.Fatalf("writes %v, want %v", res.Writes, tt.writes)
+			}
+			for i, w := range res.Writes {
+				if !bytes.Equal(w.Key, tt.writes[i].Key) || !bytes.Equal(w.Value, tt.writes[i].Value) {
+					t.Errorf("write %d = %s=%s, want %s=%s", i, w.Key, w.Value, tt.writes[i].Key, tt.writes[i].Value)
+				}
+			}
+			if len(res.Logs) != len(tt.logs) {
+				t.Fatalf("logs %q, want %q", res.Logs, tt.logs)
+			}
+			for i, l := range res.Logs {
+				if !bytes.Equal(l, tt.logs[i]) {
+					t.Errorf("log %d = %q, want %q", i, l, tt.logs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAssembleContractRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		asm  string
+	}{
+		{"unknown opcode", "FROB"},
+		{"bare push", "PUSH"},
+		{"bad hex", "0xzz"},
+		{"push too long", "0x" + strings.Repeat("00", 256)},
+		{"label defined twice", "a: a:"},
+		{"unknown label", "@nowhere JUMP"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := AssembleContract(tt.asm); !errors.Is(err, ErrBadContract) {
+				t.Errorf("error %v, want %v", err, ErrBadContract)
+			}
+		})
+	}
+}
+
+func TestAnalyzeContract(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  []byte
+		dests []int
+		bad   bool
+	}{
+		{"empty", nil, nil, false},
+		{"jumpdest", []byte{OpJumpDest, OpStop, OpJumpDest}, []int{0, 2}, false},
+		{"jumpdest in push data", []byte{OpPush, 1, OpJumpDest, OpJumpDest}, []int{3}, false},
+		{"push past the end", []byte{OpPush, 2, 0}, nil, true},
+		{"push without length", []byte{OpPush}, nil, true},
+		{"unknown opcode", []byte{0xff}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dests, err := AnalyzeContract(tt.code)
+			if tt.bad {
+				if !errors.Is(err, ErrBadContract) {
+					t.Fatalf("error %v, want %v", err, ErrBadContract)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(dests) != len(tt.dests) {
+				t.Fatalf("dests %v, want %v", dests, tt.dests)
+			}
+			for _, d := range tt.dests {
+				if !dests[d] {
+					t.Errorf("offset %d is not a JUMPDEST", d)
+				}
+			}
+		})
+	}
+}
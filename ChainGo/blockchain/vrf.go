@@ -0,0 +1,160 @@
+package blockchain
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+// A verifiable random function on P-256, after ECVRF-P256-SHA256-TAI of
+// RFC 9381. The holder of a key proves an output for an input; anyone with
+// the public key can check the proof, and every valid proof for a key and
+// input gives the same output, so the holder cannot choose it.
+
+const (
+	vrfSuite      = 0x01
+	vrfPointLen   = 33
+	vrfChallenge  = 16
+	vrfScalarLen  = 32
+	VRFProofSize  = vrfPointLen + vrfChallenge + vrfScalarLen
+	vrfMaxCounter = 256
+)
+
+var ErrBadVRFProof = errors.New("invalid VRF proof")
+
+// VRFProve returns the proof and output of the key of w for alpha.
+func VRFProve(w *Wallet, alpha []byte) (proof, output []byte, err error) {
+	curve := elliptic.P256()
+	n := curve.Params().N
+	pk := vrfPublicKey(curve, w.PrivateKey.PublicKey.X, w.PrivateKey.PublicKey.Y)
+	hx, hy, err := vrfHashToCurve(curve, pk, alpha)
+	if err != nil {
+		return nil, nil, err
+	}
+	x := w.PrivateKey.D.Bytes()
+	gx, gy := curve.ScalarMult(hx, hy, x)
+
+	k, err := rand.Int(rand.Reader, new(big.Int).Sub(n, big.NewInt(1)))
+	if err != nil {
+		return nil, nil, err
+	}
+	k.Add(k, big.NewInt(1))
+	ux, uy := curve.ScalarBaseMult(k.Bytes())
+	vx, vy := curve.ScalarMult(hx, hy, k.Bytes())
+	c := vrfChallengeOf(curve, [][2]*big.Int{{hx, hy}, {gx, gy}, {ux, uy}, {vx, vy}})
+
+	s := new(big.Int).Mul(c, w.PrivateKey.D)
+	s.Add(s, k).Mod(s, n)
+
+	proof = elliptic.MarshalCompressed(curve, gx, gy)
+	proof = append(proof, padTo(c.Bytes(), vrfChallenge)...)
+	proof = append(proof, padTo(s.Bytes(), vrfScalarLen)...)
+	return proof, vrfOutput(curve, gx, gy), nil
+}
+
+// VRFVerify checks proof against the public key pub, in the wallet format,
+// and alpha, and returns the output it proves.
+func VRFVerify(pub, alpha, proof []byte) ([]byte, error) {
+	curve := elliptic.P256()
+	n := curve.Params().N
+	if len(proof) != VRFProofSize {
+		return nil, ErrBadVRFProof
+	}
+	yx, yy, ok := ParsePublicKey(pub)
+	if !ok {
+		return nil, ErrBadVRFProof
+	}
+	gx, gy := elliptic.UnmarshalCompressed(curve, proof[:vrfPointLen])
+	if gx == nil {
+		return nil, ErrBadVRFProof
+	}
+	c := new(big.Int).SetBytes(proof[vrfPointLen : vrfPointLen+vrfChallenge])
+	s := new(big.Int).SetBytes(proof[vrfPointLen+vrfChallenge:])
+	if s.Cmp(n) >= 0 {
+		return nil, ErrBadVRFProof
+	}
+	hx, hy, err := vrfHashToCurve(curve, vrfPublicKey(curve, yx, yy), alpha)
+	if err != nil {
+		return nil, err
+	}
+
+	// U = s*B - c*Y, V = s*H - c*Gamma
+	sbx, sby := curve.ScalarBaseMult(s.Bytes())
+	cyx, cyy := curve.ScalarMult(yx, yy, c.Bytes())
+	ux, uy := vrfSub(curve, sbx, sby, cyx, cyy)
+	shx, shy := curve.ScalarMult(hx, hy, s.Bytes())
+	cgx, cgy := curve.ScalarMult(gx, gy, c.Bytes())
+	vx, vy := vrfSub(curve, shx, shy, cgx, cgy)
+	if vrfChallengeOf(curve, [][2]*big.Int{{hx, hy}, {gx, gy}, {ux, uy}, {vx, vy}}).Cmp(c) != 0 {
+		return nil, ErrBadVRFProof
+	}
+	return vrfOutput(curve, gx, gy), nil
+}
+
+// VRFOutput returns the output of a proof without checking it; use it only
+// on proofs that were verified before.
+func VRFOutput(proof []byte) []byte {
+	curve := elliptic.P256()
+	if len(proof) != VRFProofSize {
+		return nil
+	}
+	gx, gy := elliptic.UnmarshalCompressed(curve, proof[:vrfPointLen])
+	if gx == nil {
+		return nil
+	}
+	return vrfOutput(curve, gx, gy)
+}
+
+func vrfPublicKey(curve elliptic.Curve, x, y *big.Int) []byte {
+	return elliptic.MarshalCompressed(curve, x, y)
+}
+
+// vrfHashToCurve maps pk and alpha to a point by try-and-increment.
+func vrfHashToCurve(curve elliptic.Curve, pk, alpha []byte) (*big.Int, *big.Int, error) {
+	for ctr := 0; ctr < vrfMaxCounter; ctr++ {
+		h := sha256.New()
+		h.Write([]byte{vrfSuite, 0x01})
+		h.Write(pk)
+		h.Write(alpha)
+		h.Write([]byte{byte(ctr), 0x00})
+		x, y := elliptic.UnmarshalCompressed(curve, append([]byte{0x02}, h.Sum(nil)...))
+		if x != nil {
+			return x, y, nil
+		}
+	}
+	return nil, nil, ErrBadVRFProof
+}
+
+func vrfChallengeOf(curve elliptic.Curve, points [][2]*big.Int) *big.Int {
+	h := sha256.New()
+	h.Write([]byte{vrfSuite, 0x02})
+	for _, p := range points {
+		h.Write(elliptic.MarshalCompressed(curve, p[0], p[1]))
+	}
+	h.Write([]byte{0x00})
+	return new(big.Int).SetBytes(h.Sum(nil)[:vrfChallenge])
+}
+
+func vrfOutput(curve elliptic.Curve, gx, gy *big.Int) []byte {
+	h := sha256.New()
+	h.Write([]byte{vrfSuite, 0x03})
+	h.Write(elliptic.MarshalCompressed(curve, gx, gy))
+	h.Write([]byte{0x00})
+	return h.Sum(nil)
+}
+
+// vrfSub returns A - B.
+func vrfSub(curve elliptic.Curve, ax, ay, bx, by *big.Int) (*big.Int, *big.Int) {
+	negY := new(big.Int).Sub(curve.Params().P, by)
+	negY.Mod(negY, curve.Params().P)
+	return curve.Add(ax, ay, bx, negY)
+}
+
+func padTo(b []byte, n int) []byte {
+	if len(b) >= n {
+		return b
+	}
+	return append(make([]byte, n-len(b)), b...)
+}
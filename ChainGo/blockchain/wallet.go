@@ -8,6 +8,7 @@ import (
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
+	"fmt"
 	"math/big"
 )
 
@@ -24,8 +25,31 @@ func NewWallet() *Wallet {
 func newKeyPair() (ecdsa.PrivateKey, []byte) {
 	curve := elliptic.P256()
 	priv, _ := ecdsa.GenerateKey(curve, rand.Reader)
-	pub := append(priv.PublicKey.X.Bytes(), priv.PublicKey.Y.Bytes()...)
-	return *priv, pub
+	return *priv, marshalPublicKey(priv.PublicKey.X, priv.PublicKey.Y)
+}
+
+// marshalPublicKey encodes a public key as its X and Y coordinates, 32
+// bytes each.
+func marshalPublicKey(x, y *big.Int) []byte {
+	return append(padTo(x.Bytes(), 32), padTo(y.Bytes(), 32)...)
+}
+
+// ParsePublicKey decodes a public key and checks that it is on the curve.
+// Keys made before coordinates were padded to 32 bytes drop leading zero
+// bytes, so a key shorter than 64 bytes is split where both halves fit
+// and give a point on the curve.
+func ParsePublicKey(pub []byte) (x, y *big.Int, ok bool) {
+	curve := elliptic.P256()
+	if len(pub) > 64 || len(pub) < 2 {
+		return nil, nil, false
+	}
+	for i := max(len(pub)-32, 1); i <= 32 && i < len(pub); i++ {
+		x, y = new(big.Int).SetBytes(pub[:i]), new(big.Int).SetBytes(pub[i:])
+		if curve.IsOnCurve(x, y) {
+			return x, y, true
+		}
+	}
+	return nil, nil, false
 }
 
 func (w *Wallet) PrivateKeyHex() string {
@@ -36,7 +60,12 @@ func (w *Wallet) PrivateKeyHex() string {
 }
 
 func (w *Wallet) Address() string {
-	pubHash := sha256.Sum256(w.PublicKey)
+	return AddressFromPublicKey(w.PublicKey)
+}
+
+// AddressFromPublicKey derives the address owned by a public key.
+func AddressFromPublicKey(pubKey []byte) string {
+	pubHash := sha256.Sum256(pubKey)
 	return hex.EncodeToString(pubHash[:])
 }
 
@@ -47,11 +76,14 @@ func (w *Wallet) Sign(data []byte) (rText, sText string) {
 }
 
 func VerifySignature(pubKey []byte, data []byte, rText, sText string) bool {
-	curve := elliptic.P256()
-	keyLen := len(pubKey) / 2
-	x := new(big.Int).SetBytes(pubKey[:keyLen])
-	y := new(big.Int).SetBytes(pubKey[keyLen:])
-	pub := ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	if len(pubKey) == 0 {
+		return false
+	}
+	x, y, ok := ParsePublicKey(pubKey)
+	if !ok {
+		return false
+	}
+	pub := ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
 
 	r := new(big.Int)
 	s := new(big.Int)
@@ -103,18 +135,30 @@ func DeserializeWallet(data []byte) (*Wallet, error) {
 	if len(sw.PrivateKeyD) > 0 {
 		curve := elliptic.P256()
 		wallet.PrivateKey = &ecdsa.PrivateKey{
-			PublicKey: ecdsa.PublicKey{
-				Curve: curve,
-				X:     new(big.Int),
-				Y:     new(big.Int),
-			},
-			D: new(big.Int).SetBytes(sw.PrivateKeyD),
+			PublicKey: ecdsa.PublicKey{Curve: curve},
+			D:         new(big.Int).SetBytes(sw.PrivateKeyD),
 		}
-		// Reconstruct public key coordinates from stored public key
-		keyLen := len(sw.PublicKey) / 2
-		wallet.PrivateKey.PublicKey.X.SetBytes(sw.PublicKey[:keyLen])
-		wallet.PrivateKey.PublicKey.Y.SetBytes(sw.PublicKey[keyLen:])
+		// Derive the coordinates from the private key; the stored public
+		// key keeps its encoding, which the address is the hash of.
+		wallet.PrivateKey.PublicKey.X, wallet.PrivateKey.PublicKey.Y = curve.ScalarBaseMult(sw.PrivateKeyD)
 	}
 
 	return wallet, nil
 }
+
+// WalletFromPrivateKey rebuilds a wallet from the hex private key returned
+// by PrivateKeyHex.
+func WalletFromPrivateKey(keyHex string) (*Wallet, error) {
+	d, err := hex.DecodeString(keyHex)
+	if err != nil || len(d) == 0 {
+		return nil, fmt.Errorf("invalid private key")
+	}
+	curve := elliptic.P256()
+	priv := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	if priv.D.Sign() <= 0 || priv.D.Cmp(curve.Params().N) >= 0 {
+		return nil, fmt.Errorf("invalid private key")
+	}
+	priv.PublicKey.Curve = curve
+	priv.PublicKey.X, priv.PublicKey.Y = curve.ScalarBaseMult(d)
+	return &Wallet{PrivateKey: priv, PublicKey: marshalPublicKey(priv.PublicKey.X, priv.PublicKey.Y)}, nil
+}
@@ -0,0 +1,104 @@
+package blockchain
+
+import (
+	"crypto/elliptic"
+	"fmt"
+	"math/big"
+	"testing"
+)
+
+// legacyKey finds a private key whose public key has a coordinate with a
+// leading zero byte, which keys made before padding dropped, and returns
+// its wallet and that legacy encoding.
+func legacyKey(t *testing.T, shortX bool) (*Wallet, []byte) {
+	t.Helper()
+	curve := elliptic.P256()
+	for d := int64(1); d < 100000; d++ {
+		x, y := curve.ScalarBaseMult(big.NewInt(d).Bytes())
+		short := y
+		if shortX {
+			short = x
+		}
+		if len(short.Bytes()) < 32 {
+			w, err := WalletFromPrivateKey(fmt.Sprintf("%064x", d))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return w, append(x.Bytes(), y.Bytes()...)
+		}
+	}
+	t.Fatal("no key with a short coordinate")
+	return nil, nil
+}
+
+func TestParsePublicKey(t *testing.T) {
+	w := NewWallet()
+	shortX, legacyX := legacyKey(t, true)
+	shortY, legacyY := legacyKey(t, false)
+	offCurve := append([]byte{}, w.PublicKey...)
+	offCurve[63] ^= 1
+
+	tests := []struct {
+		name   string
+		pub    []byte
+		wallet *Wallet
+	}{
+		{"padded", w.PublicKey, w},
+		{"legacy short x", legacyX, shortX},
+		{"legacy short y", legacyY, shortY},
+		{"padded short x", shortX.PublicKey, shortX},
+		{"off the curve", offCurve, nil},
+		{"too long", append(append([]byte{}, w.PublicKey...), 0), nil},
+		{"too short", []byte{1}, nil},
+		{"empty", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x, y, ok := ParsePublicKey(tt.pub)
+			if tt.wallet == nil {
+				if ok {
+					t.Fatalf("parsed %x", tt.pub)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("could not parse %x", tt.pub)
+			}
+			want := tt.wallet.PrivateKey.PublicKey
+			if x.Cmp(want.X) != 0 || y.Cmp(want.Y) != 0 {
+				t.Errorf("point (%x, %x), want (%x, %x)", x, y, want.X, want.Y)
+			}
+			r, s := tt.wallet.Sign([]byte("data"))
+			if !VerifySignature(tt.pub, []byte("data"), r, s) {
+				t.Error("signature does not verify against the key")
+			}
+		})
+	}
+}
+
+func TestWalletKeyEncoding(t *testing.T) {
+	shortX, _ := legacyKey(t, true)
+	for _, w := range []*Wallet{NewWallet(), shortX} {
+		if len(w.PublicKey) != 64 {
+			t.Errorf("public key of %d bytes, want 64", len(w.PublicKey))
+		}
+		again, err := WalletFromPrivateKey(w.PrivateKeyHex())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.Address() != w.Address() {
+			t.Errorf("address %s after reloading the key, want %s", again.Address(), w.Address())
+		}
+		data, err := w.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored, err := DeserializeWallet(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restored.Address() != w.Address() || restored.PrivateKey.PublicKey.X.Cmp(w.PrivateKey.PublicKey.X) != 0 {
+			t.Errorf("wallet %s after a serialization round trip, want %s", restored.Address(), w.Address())
+		}
+	}
+}
@@ -2,7 +2,10 @@ module github.com/Vishal-2029
 
 go 1.24.4
 
-require github.com/gofiber/fiber/v2 v2.52.9
+require (
+	github.com/gofiber/fiber/v2 v2.52.9
+	go.etcd.io/bbolt v1.4.3
+)
 
 require (
 	github.com/andybalholm/brotli v1.1.0 // indirect
@@ -15,6 +18,5 @@ require (
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasthttp v1.51.0 // indirect
 	github.com/valyala/tcplisten v1.0.0 // indirect
-	go.etcd.io/bbolt v1.4.3 // indirect
 	golang.org/x/sys v0.29.0 // indirect
 )
@@ -1,12 +1,20 @@
 package internal
 
 import (
+	"bytes"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/Vishal-2029/blockchain"
+	"github.com/Vishal-2029/mempool"
 	"github.com/Vishal-2029/network"
 	"github.com/Vishal-2029/pkg"
 	"github.com/gofiber/fiber/v2"
@@ -14,10 +22,16 @@ import (
 
 var mu sync.Mutex
 var chain *blockchain.Blockchain
-var pendingTx []*blockchain.Transaction
+var pool *mempool.Mempool
 var node *network.Node
 var wallets = make(map[string]*blockchain.Wallet)
 var db *pkg.BoltDB
+var apiPort string
+
+// defaultTxSize is the size fee suggestions assume when there are no recent
+// transactions to measure; it is about that of a signed one-input,
+// two-output transfer.
+const defaultTxSize = 700
 
 func logInfo(tag, msg string) {
 	fmt.Printf("[INFO] [%s] %s\n", tag, msg)
@@ -31,6 +45,20 @@ func logError(tag, msg string) {
 
 func SetBlockchain(bc *blockchain.Blockchain) {
 	chain = bc
+	pool = mempool.New(bc, mempool.DefaultConfig)
+	chain.OnTipChange = resetPool
+}
+
+// resetPool keeps the mempool in line with the best chain after a peer
+// block moved the tip: transactions from blocks that left the chain go back
+// to the pool, and pending transactions that the new blocks confirmed or
+// invalidated are dropped.
+func resetPool(disconnected, connected []*blockchain.Block) {
+	before := pool.Count()
+	pool.Reset(disconnected, connected)
+	if len(disconnected) > 0 {
+		logInfo("REORG", fmt.Sprintf("Reorganised %d blocks, %d transactions pending (was %d)", len(disconnected), pool.Count(), before))
+	}
 }
 
 func SetNode(n *network.Node) {
@@ -91,27 +119,123 @@ func CreateWalletHandler(c *fiber.Ctx) error {
 }
 
 func GetWalletBalanceHandler(c *fiber.Ctx) error {
-	address := c.Params("address")
+	address, err := resolveAddress(c.Params("address"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
 
-	// Calculate balance by scanning all transactions in the blockchain
-	balance := 0
-	for _, block := range chain.Block {
-		for _, tx := range block.Transactions {
-			if tx.To == address {
-				balance += tx.Amount
-			}
-			if tx.From == address {
-				balance -= tx.Amount
-			}
+	balance, err := chain.UTXO.Balance(address)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Vaulted outputs count towards the balance but can't be spent yet.
+	utxos, err := chain.UTXO.FindByAddress(address)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	locked := 0
+	for _, u := range utxos {
+		if !blockchain.IsReleased(u.Output, chain.Height()+1) {
+			locked += u.Output.Amount
 		}
 	}
 
 	return c.JSON(fiber.Map{
 		"address": address,
 		"balance": balance,
+		"locked":  locked,
+		"tokens":  chain.TokenBalances(address),
+		"names":   chain.NamesOf(address),
+	})
+}
+
+func GetWalletUTXOsHandler(c *fiber.Ctx) error {
+	address, err := resolveAddress(c.Params("address"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	utxos, err := chain.UTXO.FindByAddress(address)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var list []fiber.Map
+	for _, u := range utxos {
+		entry := fiber.Map{
+			"txid":          fmt.Sprintf("%x", u.TxID),
+			"vout":          u.Vout,
+			"amount":        u.Output.Amount,
+			"height":        u.Height,
+			"coinbase":      u.Coinbase,
+			"mature":        chain.Params.IsMature(u, chain.Height()+1),
+			"releaseHeight": u.Output.ReleaseHeight,
+			"locked":        !blockchain.IsReleased(u.Output, chain.Height()+1),
+		}
+		if len(u.Output.Script) > 0 {
+			entry["script"] = u.Output.Script.String()
+		}
+		list = append(list, entry)
+	}
+
+	return c.JSON(fiber.Map{
+		"address": address,
+		"count":   len(utxos),
+		"utxos":   list,
+	})
+}
+
+func GetWalletNonceHandler(c *fiber.Ctx) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	address := c.Params("address")
+
+	confirmed, err := chain.NextNonce(address)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	pending, err := pendingNonce(address)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{
+		"address":      address,
+		"nonce":        confirmed,
+		"pendingNonce": pending,
+		"chainId":      chain.Params.ChainID,
 	})
 }
 
+// pendingNonce returns the nonce the next transaction from address must use,
+// counting transactions that are still waiting in the mempool.
+func pendingNonce(address string) (uint64, error) {
+	return pool.NextNonce(address)
+}
+
+// spendableOutputs returns the unspent outputs of address that are mature,
+// released and not already claimed by a pending transaction. Outputs claimed by the
+// pending transaction with hash replacing stay spendable, so a replacement
+// can reuse them.
+func spendableOutputs(address, replacing string) ([]blockchain.UTXO, error) {
+	utxos, err := chain.UTXO.FindByAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	claimed := pool.Claimed(replacing)
+	height := chain.Height() + 1
+	var spendable []blockchain.UTXO
+	for _, u := range utxos {
+		if !claimed[u.OutPoint.String()] && chain.Params.IsMature(u, height) && blockchain.IsReleased(u.Output, height) {
+			spendable = append(spendable, u)
+		}
+	}
+	return spendable, nil
+}
+
 // ========== TRANSACTION HANDLERS ==========
 
 func CreateTransactionHandler(c *fiber.Ctx) error {
@@ -119,42 +243,128 @@ func CreateTransactionHandler(c *fiber.Ctx) error {
 	defer mu.Unlock()
 
 	var body struct {
-		From       string `json:"from"`
-		To         string `json:"to"`
-		Amount     int    `json:"amount"`
-		PrivateKey string `json:"privateKey"` // User provides private key
+		From       string  `json:"from"`
+		To         string  `json:"to"`
+		Amount     int     `json:"amount"`
+		Fee        int     `json:"fee"`           // Optional, paid to the miner; see /api/fees/estimate
+		Nonce      *uint64 `json:"nonce"`         // Optional, defaults to the next pending nonce; a pending nonce replaces that transaction
+		PrivateKey string  `json:"privateKey"`    // User provides private key
+		LockTime   int64   `json:"lockTime"`      // Optional earliest height or Unix time for the transaction
+		Release    int     `json:"releaseHeight"` // Optional height before which the recipient can't spend the payment
+		LockScript string  `json:"lockScript"`    // Optional script locking the payment instead of the "to" address
+		Memo       string  `json:"memo"`          // Optional text recorded with the transaction
 	}
 
 	if err := c.BodyParser(&body); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid JSON"})
 	}
 
-	// Find wallet by private key
-	var wallet *blockchain.Wallet
-	for addr, w := range wallets {
-		if w.PrivateKeyHex() == body.PrivateKey {
-			wallet = w
-			// Verify the from address matches
-			if addr != body.From {
-				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-					"error": "Private key does not match from address",
-				})
+	// Either address may be given as a registered name.
+	var err error
+	if body.From, err = resolveAddress(body.From); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if body.To != "" {
+		if body.To, err = resolveAddress(body.To); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	var lockScript blockchain.Script
+	if body.LockScript != "" {
+		script, err := blockchain.ParseScript(body.LockScript)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if body.To != "" && body.To != script.Address() {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "to must be empty or the script's address when lockScript is given"})
+		}
+		lockScript = script
+		body.To = script.Address()
+	}
+
+	wallet, err := findWallet(body.From, body.PrivateKey)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	nonce, err := pendingNonce(body.From)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	// A nonce that is already pending asks to replace that transaction.
+	var replacing *mempool.Entry
+	if body.Nonce != nil && *body.Nonce < nonce {
+		for _, e := range pool.BySender(body.From) {
+			if e.Tx.Nonce == *body.Nonce {
+				replacing = e
 			}
-			break
 		}
 	}
+	if replacing != nil {
+		nonce = *body.Nonce
+	} else if body.Nonce != nil {
+		if err := blockchain.CheckNonce(nonce, *body.Nonce); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	if body.Amount <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Amount must be positive",
+		})
+	}
+	if body.Fee < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Fee must not be negative",
+		})
+	}
+	if body.LockTime < 0 || body.Release < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Lock time and release height must not be negative",
+		})
+	}
 
-	if wallet == nil {
+	replacingHash := ""
+	if replacing != nil {
+		replacingHash = replacing.Hash
+	}
+	spendable, err := spendableOutputs(body.From, replacingHash)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Check the amount against what is left after other pending spends
+	balance, err := chain.UTXO.Balance(body.From)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	available := 0
+	for _, u := range spendable {
+		available += u.Output.Amount
+	}
+	if body.Amount+body.Fee > available {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid private key or wallet not found",
+			"error":     fmt.Sprintf("%v: spendable %d, requested %d", blockchain.ErrInsufficientFunds, available, body.Amount+body.Fee),
+			"balance":   balance,
+			"pending":   balance - available,
+			"spendable": available,
 		})
 	}
 
 	// Create and sign transaction
-	tx := &blockchain.Transaction{
-		From:   body.From,
-		To:     body.To,
-		Amount: body.Amount,
+	tx, err := blockchain.NewUTXOTransaction(chain.Params.ChainID, body.From, body.To, body.Amount, body.Fee, nonce, spendable)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	tx.LockTime = body.LockTime
+	tx.Outputs[0].ReleaseHeight = body.Release // The payment comes first
+	tx.Outputs[0].Script = lockScript
+	if body.Memo != "" {
+		tx.Memo = []byte(body.Memo)
+	}
+	if err := tx.CheckMemo(); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
 
 	// Sign the transaction
@@ -167,8 +377,11 @@ func CreateTransactionHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	// Add to pending transactions
-	pendingTx = append(pendingTx, tx)
+	// The mempool checks that the transaction applies after everything
+	// already pending, or outbids the transaction it replaces
+	if _, err := pool.Add(tx); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
 
 	// Broadcast to P2P network
 	if node != nil {
@@ -179,13 +392,140 @@ func CreateTransactionHandler(c *fiber.Ctx) error {
 		node.Broadcast(newTxMsg)
 	}
 
-	return c.JSON(fiber.Map{
+	resp := fiber.Map{
 		"message": "Transaction created, signed, and verified successfully",
 		"transaction": fiber.Map{
-			"from":   tx.From,
-			"to":     tx.To,
-			"amount": tx.Amount,
-			"signed": true,
+			"hash":     fmt.Sprintf("%x", tx.Hash()),
+			"from":     tx.From,
+			"to":       tx.To,
+			"amount":   tx.Amount,
+			"fee":      tx.Fee,
+			"feeRate":  blockchain.FeeRate(tx),
+			"size":     tx.Size(),
+			"nonce":    tx.Nonce,
+			"chainId":  tx.ChainID,
+			"lockTime": tx.LockTime,
+			"memo":     body.Memo,
+			"inputs":   len(tx.Inputs),
+			"outputs":  tx.Outputs,
+			"signed":   true,
+		},
+	}
+	if replacing != nil {
+		resp["replaced"] = replacing.Hash
+	}
+	return c.JSON(resp)
+}
+
+// CreateBatchTransactionHandler builds one transaction paying many
+// recipients. Cosigners optionally fund part of it from their own outputs
+// and sign it alongside the sender.
+func CreateBatchTransactionHandler(c *fiber.Ctx) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var body struct {
+		From       string                `json:"from"`
+		PrivateKey string                `json:"privateKey"`
+		Payments   []blockchain.TxOutput `json:"payments"`
+		Fee        int                   `json:"fee"`
+		Nonce      *uint64               `json:"nonce"`
+		LockTime   int64                 `json:"lockTime"`
+		Cosigners  []struct {
+			Address    string `json:"address"`
+			PrivateKey string `json:"privateKey"`
+			Amount     int    `json:"amount"` // Paid from the cosigner's outputs
+		} `json:"cosigners"`
+	}
+
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid JSON"})
+	}
+	if len(body.Payments) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "At least one payment is required"})
+	}
+	for i := range body.Payments {
+		if len(body.Payments[i].Script) > 0 {
+			continue
+		}
+		address, err := resolveAddress(body.Payments[i].Address)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("payment %d: %v", i, err)})
+		}
+		body.Payments[i].Address = address
+	}
+	if body.Fee < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Fee must not be negative"})
+	}
+
+	wallet, err := findWallet(body.From, body.PrivateKey)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	signers := []*blockchain.Wallet{wallet}
+	var contributions []blockchain.Contribution
+	for _, cs := range body.Cosigners {
+		w, err := findWallet(cs.Address, cs.PrivateKey)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("cosigner %s: %v", cs.Address, err)})
+		}
+		spendable, err := spendableOutputs(cs.Address, "")
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		signers = append(signers, w)
+		contributions = append(contributions, blockchain.Contribution{Address: cs.Address, Amount: cs.Amount, Spendable: spendable})
+	}
+
+	nonce, err := pendingNonce(body.From)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if body.Nonce != nil {
+		if err := blockchain.CheckNonce(nonce, *body.Nonce); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	spendable, err := spendableOutputs(body.From, "")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	tx, err := blockchain.NewBatchTransaction(chain.Params.ChainID, body.From, body.Payments, body.Fee, nonce, spendable, contributions...)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	tx.LockTime = body.LockTime
+	for _, w := range signers {
+		tx.Sign(w)
+	}
+
+	if _, err := pool.Add(tx); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if node != nil {
+		node.Broadcast(network.Message{Type: "TRANSACTION", Data: tx})
+	}
+
+	logSuccess("TX_BATCH", fmt.Sprintf("%d payments totalling %d from %s", len(body.Payments), tx.Amount, body.From))
+	return c.JSON(fiber.Map{
+		"message": "Batch transaction created and signed successfully",
+		"transaction": fiber.Map{
+			"hash":     fmt.Sprintf("%x", tx.Hash()),
+			"from":     tx.From,
+			"signers":  tx.Signers(),
+			"payments": len(body.Payments),
+			"amount":   tx.Amount,
+			"fee":      tx.Fee,
+			"feeRate":  blockchain.FeeRate(tx),
+			"size":     tx.Size(),
+			"nonce":    tx.Nonce,
+			"chainId":  tx.ChainID,
+			"lockTime": tx.LockTime,
+			"inputs":   len(tx.Inputs),
+			"outputs":  tx.Outputs,
+			"signed":   true,
 		},
 	})
 }
@@ -195,12 +535,18 @@ func GetPendingTransactionsHandler(c *fiber.Ctx) error {
 	mu.Lock()
 	defer mu.Unlock()
 
+	entries := pool.Entries()
 	var txList []fiber.Map
-	for _, tx := range pendingTx {
+	for _, e := range entries {
+		tx := e.Tx
 		txList = append(txList, fiber.Map{
+			"hash":      e.Hash,
 			"from":      tx.From,
 			"to":        tx.To,
 			"amount":    tx.Amount,
+			"fee":       tx.Fee,
+			"feeRate":   blockchain.FeeRate(tx),
+			"nonce":     tx.Nonce,
 			"signed":    tx.R != "" && tx.S != "",
 			"verified":  tx.Verify(), // Check if still valid
 			"publicKey": hex.EncodeToString(tx.PublicKey),
@@ -208,7 +554,7 @@ func GetPendingTransactionsHandler(c *fiber.Ctx) error {
 	}
 
 	return c.JSON(fiber.Map{
-		"count":        len(pendingTx),
+		"count":        len(entries),
 		"transactions": txList,
 	})
 }
@@ -216,45 +562,162 @@ func GetPendingTransactionsHandler(c *fiber.Ctx) error {
 func GetTransactionHandler(c *fiber.Ctx) error {
 	hash := c.Params("hash")
 
-	// Search for transaction in blockchain
-	for _, block := range chain.Block {
-		for _, tx := range block.Transactions {
-			txHash := fmt.Sprintf("%x", tx.Hash())
-			if txHash == hash {
-				return c.JSON(fiber.Map{
-					"hash":  hash,
-					"block": fmt.Sprintf("%x", block.Hash),
-					"data":  tx,
-				})
-			}
+	txHash, err := hex.DecodeString(hash)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid transaction hash"})
+	}
+
+	// Look the transaction up in the transaction index
+	tx, block, err := chain.FindTransaction(txHash)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Transaction not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"hash":  hash,
+		"block": fmt.Sprintf("%x", block.Hash),
+		"data":  tx,
+	})
+}
+
+func GetTransactionProofHandler(c *fiber.Ctx) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	txHash, err := hex.DecodeString(c.Params("hash"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid transaction hash"})
+	}
+
+	_, block, err := chain.FindTransaction(txHash)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Transaction not found",
+		})
+	}
+
+	proof, err := merkleProofJSON(block, txHash)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(proof)
+}
+
+// merkleProofJSON proves that the transaction txHash is in block.
+func merkleProofJSON(block *blockchain.Block, txHash []byte) (fiber.Map, error) {
+	index, branch, err := block.MerkleProof(txHash)
+	if err != nil {
+		return nil, err
+	}
+
+	var steps []fiber.Map
+	for _, step := range branch {
+		steps = append(steps, fiber.Map{
+			"hash": fmt.Sprintf("%x", step.Hash),
+			"left": step.Left,
+		})
+	}
+
+	return fiber.Map{
+		"txHash":     fmt.Sprintf("%x", txHash),
+		"blockHash":  fmt.Sprintf("%x", block.Hash),
+		"blockIndex": block.Height,
+		"merkleRoot": fmt.Sprintf("%x", block.MerkleRoot),
+		"txIndex":    index,
+		"branch":     steps,
+	}, nil
+}
+
+func VerifyTransactionProofHandler(c *fiber.Ctx) error {
+	var body struct {
+		TxHash     string `json:"txHash"`
+		MerkleRoot string `json:"merkleRoot"`
+		Branch     []struct {
+			Hash string `json:"hash"`
+			Left bool   `json:"left"`
+		} `json:"branch"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid JSON"})
+	}
+
+	txHash, err1 := hex.DecodeString(body.TxHash)
+	root, err2 := hex.DecodeString(body.MerkleRoot)
+	if err1 != nil || err2 != nil || len(txHash) != 32 || len(root) != 32 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "txHash and merkleRoot must be 32-byte hex hashes"})
+	}
+
+	var branch []blockchain.MerkleStep
+	for _, step := range body.Branch {
+		h, err := hex.DecodeString(step.Hash)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid hex in branch"})
 		}
+		branch = append(branch, blockchain.MerkleStep{Hash: h, Left: step.Left})
 	}
 
-	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-		"error": "Transaction not found",
+	return c.JSON(fiber.Map{
+		"valid": blockchain.VerifyMerkleProof(txHash, branch, root),
 	})
 }
 
 // ========== BLOCKCHAIN HANDLERS ==========
 
+func blockJSON(block *blockchain.Block) fiber.Map {
+	m := fiber.Map{
+		"index":        block.Height,
+		"version":      block.Version,
+		"hash":         fmt.Sprintf("%x", block.Hash),
+		"previousHash": fmt.Sprintf("%x", block.PrevHash),
+		"timestamp":    block.Timestamp,
+		"transactions": block.Transactions,
+		"nonce":        block.Nonce,
+		"bits":         fmt.Sprintf("%08x", block.Bits),
+		"merkleRoot":   fmt.Sprintf("%x", block.MerkleRoot),
+	}
+	if len(block.StateRoot) > 0 {
+		m["stateRoot"] = fmt.Sprintf("%x", block.StateRoot)
+	}
+	if len(block.Signer) > 0 {
+		m["sealer"] = blockchain.AddressFromPublicKey(block.Signer)
+	}
+	if len(block.Proof) > 0 {
+		m["proof"] = fmt.Sprintf("%x", block.Proof)
+	}
+	return m
+}
+
+// GetChainHandler returns the chain in height order. Blocks are read from
+// disk one at a time; ?start= and ?limit= page through long chains.
 func GetChainHandler(c *fiber.Ctx) error {
 	mu.Lock()
 	defer mu.Unlock()
 
-	var chainData []fiber.Map
-	for i, block := range chain.Block {
-		chainData = append(chainData, fiber.Map{
-			"index":        i,
-			"hash":         fmt.Sprintf("%x", block.Hash),
-			"previousHash": fmt.Sprintf("%x", block.PrevHash),
-			"timestamp":    block.Timestamp,
-			"transactions": block.Transactions,
-			"nonce":        block.Nonce,
+	height := chain.Height()
+	start := c.QueryInt("start", 0)
+	end := height
+	if limit := c.QueryInt("limit", 0); limit > 0 && start+limit-1 < end {
+		end = start + limit - 1
+	}
+	if start < 0 || start > height {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid start index",
 		})
 	}
 
+	var chainData []fiber.Map
+	for i := start; i <= end; i++ {
+		block, err := chain.BlockAtHeight(i)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		chainData = append(chainData, blockJSON(block))
+	}
+
 	return c.JSON(fiber.Map{
-		"length": len(chain.Block),
+		"length": height + 1,
 		"chain":  chainData,
 	})
 }
@@ -264,42 +727,31 @@ func GetBlockByIndexHandler(c *fiber.Ctx) error {
 	defer mu.Unlock()
 
 	index, err := strconv.Atoi(c.Params("index"))
-	if err != nil || index < 0 || index >= len(chain.Block) {
+	if err != nil || index < 0 || index > chain.Height() {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Invalid block index",
 		})
 	}
 
-	block := chain.Block[index]
-	return c.JSON(fiber.Map{
-		"index":        index,
-		"hash":         fmt.Sprintf("%x", block.Hash),
-		"previousHash": fmt.Sprintf("%x", block.PrevHash),
-		"timestamp":    block.Timestamp,
-		"transactions": block.Transactions,
-		"nonce":        block.Nonce,
-	})
+	block, err := chain.BlockAtHeight(index)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(blockJSON(block))
 }
 
 func GetLatestBlockHandler(c *fiber.Ctx) error {
 	mu.Lock()
 	defer mu.Unlock()
 
-	if len(chain.Block) == 0 {
+	block := chain.Tip()
+	if block == nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"error": "No blocks in chain",
 		})
 	}
 
-	block := chain.Block[len(chain.Block)-1]
-	return c.JSON(fiber.Map{
-		"index":        len(chain.Block) - 1,
-		"hash":         fmt.Sprintf("%x", block.Hash),
-		"previousHash": fmt.Sprintf("%x", block.PrevHash),
-		"timestamp":    block.Timestamp,
-		"transactions": block.Transactions,
-		"nonce":        block.Nonce,
-	})
+	return c.JSON(blockJSON(block))
 }
 
 func ValidateHandler(c *fiber.Ctx) error {
@@ -316,7 +768,7 @@ func ValidateHandler(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{
 		"status":  "valid",
 		"message": "Blockchain is valid",
-		"blocks":  len(chain.Block),
+		"blocks":  chain.Height() + 1,
 	})
 }
 
@@ -325,7 +777,7 @@ func DeleteBlockHandler(c *fiber.Ctx) error {
 	defer mu.Unlock()
 
 	index, err := strconv.Atoi(c.Params("index"))
-	if err != nil || index < 0 || index >= len(chain.Block) {
+	if err != nil || index < 0 || index > chain.Height() {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Invalid block index",
 		})
@@ -339,8 +791,12 @@ func DeleteBlockHandler(c *fiber.Ctx) error {
 	}
 
 	// Delete this block and all subsequent blocks
-	deletedCount := len(chain.Block) - index
-	chain.Block = chain.Block[:index]
+	deletedCount := chain.Height() + 1 - index
+	if err := chain.Truncate(index); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	// Pending transactions may depend on outputs that no longer exist.
+	pool.Reset(nil, nil)
 
 	logSuccess("BLOCK_DELETE", fmt.Sprintf("Deleted %d blocks starting from index %d", deletedCount, index))
 
@@ -348,7 +804,29 @@ func DeleteBlockHandler(c *fiber.Ctx) error {
 		"message":      "Blocks deleted successfully",
 		"deletedFrom":  index,
 		"deletedCount": deletedCount,
-		"newLength":    len(chain.Block),
+		"newLength":    chain.Height() + 1,
+	})
+}
+
+func GetReorgsHandler(c *fiber.Ctx) error {
+	reorgs := chain.Reorgs()
+	forks, err := chain.Forks()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	maxDepth := 0
+	for _, r := range reorgs {
+		if r.Depth > maxDepth {
+			maxDepth = r.Depth
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"count":    len(reorgs),
+		"maxDepth": maxDepth,
+		"reorgs":   reorgs,
+		"forks":    forks,
 	})
 }
 
@@ -371,21 +849,47 @@ func MineHandler(c *fiber.Ctx) error {
 		minerAddr = "Genesis"
 	}
 
-	rewardTx := &blockchain.Transaction{
-		From:      "Coinbase",
-		To:        minerAddr,
-		Amount:    50, // Block reward
-		PublicKey: []byte{},
-		R:         "",
-		S:         "",
+	block, err := mineBlock(minerAddr)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{
+		"message": "Block mined successfully",
+		"block":   block,
+	})
+}
+
+// sealMu serialises mineBlock. It is separate from mu so that the dev
+// sealer can mine from inside handlers that hold mu.
+var sealMu sync.Mutex
+
+// mineBlock seals a block of pending transactions on the tip, paying the
+// reward to minerAddr, broadcasts it and returns a summary of it.
+func mineBlock(minerAddr string) (fiber.Map, error) {
+	sealMu.Lock()
+	defer sealMu.Unlock()
+
+	// Fill the block from the pending pool, best fee rate first. Anything
+	// that no longer applies (e.g. overdrawn after a reorg) is dropped.
+	selected, fees, rejected := chain.BlockTemplate(pool.Transactions())
+	for _, err := range rejected {
+		logError("MINE", fmt.Sprintf("Dropping pending transaction: %v", err))
 	}
 
+	height := chain.Height() + 1
+	subsidy := chain.Params.Subsidy(height)
+	reward := subsidy + fees
+	rewardTx := blockchain.NewCoinbaseTx(chain.Params.ChainID, minerAddr, reward, height) // Block reward
+
 	// Prepare transactions for the block: Reward + Pending
 	blockTx := []*blockchain.Transaction{rewardTx}
-	blockTx = append(blockTx, pendingTx...)
+	blockTx = append(blockTx, selected...)
 
-	chain.AddBlock(blockTx)
-	minedBlock := chain.Block[len(chain.Block)-1]
+	minedBlock, err := chain.AddBlock(blockTx)
+	if err != nil {
+		logError("MINE", fmt.Sprintf("Block rejected: %v", err))
+		return nil, err
+	}
 
 	// BROADCAST NEW BLOCK TO P2P NETWORK
 	if node != nil {
@@ -396,48 +900,1605 @@ func MineHandler(c *fiber.Ctx) error {
 		node.Broadcast(newBlockMsg)
 	}
 
-	// Clear pending transactions after successful mining
-	pendingTx = nil
-
-	return c.JSON(fiber.Map{
-		"message": "Block mined successfully",
-		"block": fiber.Map{
-			"index":        len(chain.Block) - 1,
-			"hash":         fmt.Sprintf("%x", minedBlock.Hash),
-			"timestamp":    minedBlock.Timestamp,
-			"transactions": len(minedBlock.Transactions),
-			"reward":       50,
-			"miner":        minerAddr,
-		},
-	})
+	// Keep what did not fit in the block pending; rejected transactions are
+	// dropped by re-checking the rest against the new tip.
+	pool.Reset(nil, []*blockchain.Block{minedBlock})
+
+	return fiber.Map{
+		"index":        minedBlock.Height,
+		"hash":         fmt.Sprintf("%x", minedBlock.Hash),
+		"timestamp":    minedBlock.Timestamp,
+		"transactions": len(minedBlock.Transactions),
+		"dropped":      len(rejected),
+		"reward":       reward,
+		"subsidy":      subsidy,
+		"fees":         fees,
+		"size":         minedBlock.Size(),
+		"miner":        minerAddr,
+	}, nil
 }
 
-// ========== NODE STATS HANDLERS ==========
+// ========== DEV HANDLERS ==========
 
-func GetNodeInfoHandler(c *fiber.Ctx) error {
-	return c.JSON(fiber.Map{
-		"name":        "ChainGo Node",
-		"version":     "1.0.0",
-		"status":      "running",
-		"networkPort": 9000,
-		"apiPort":     8080,
-	})
+// maxGenerate caps the blocks one generate request mines.
+const maxGenerate = 1000
+
+var (
+	devPeriod time.Duration           // Seal interval; 0 seals whenever a transaction is added
+	devMiner  = blockchain.DevAccount // Address auto-sealed blocks pay
+)
+
+// SetDevSealing sets how a node on a dev network seals blocks by itself:
+// every period, or whenever a transaction enters the pool if period is 0,
+// paying the reward to miner.
+func SetDevSealing(period time.Duration, miner string) {
+	devPeriod = period
+	if miner != "" {
+		devMiner = miner
+	}
+}
+
+// addDevAccount lets API requests spend from the dev account. It is kept
+// in memory only; its key is public anyway.
+func addDevAccount() {
+	wallet, err := blockchain.WalletFromPrivateKey(blockchain.DevAccountKey)
+	if err != nil {
+		logError("DEV", fmt.Sprintf("Could not load the dev account: %v", err))
+		return
+	}
+	wallets[wallet.Address()] = wallet
+	logInfo("DEV", fmt.Sprintf("Dev account %s is funded; requests may spend from it without a private key", wallet.Address()))
+}
+
+// startSealer makes the node seal blocks by itself, as set by
+// SetDevSealing. The returned function stops it, waiting for a block being
+// sealed.
+func startSealer() (stop func()) {
+	seal := func() {
+		if block, err := mineBlock(devMiner); err != nil {
+			logError("SEAL", fmt.Sprintf("Could not seal: %v", err))
+		} else {
+			logSuccess("SEAL", fmt.Sprintf("Sealed block %v with %v transactions", block["index"], block["transactions"]))
+		}
+	}
+	if devPeriod == 0 {
+		// Sealed before Add returns, so the transaction is confirmed by the
+		// time the request that submitted it is answered.
+		pool.OnAdd = func(*mempool.Entry) { seal() }
+		logInfo("SEAL", "Sealing a block whenever a transaction enters the pool")
+		return func() {}
+	}
+	ticker := time.NewTicker(devPeriod)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				seal()
+			case <-done:
+				return
+			}
+		}
+	}()
+	logInfo("SEAL", fmt.Sprintf("Sealing a block every %s", devPeriod))
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-stopped
+	}
+}
+
+// GenerateHandler mines ?n= blocks (default 1) at once, paying the reward
+// to ?address= or the node's dev miner. Only dev networks serve it.
+func GenerateHandler(c *fiber.Ctx) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	n := 1
+	if q := c.Query("n"); q != "" {
+		var err error
+		if n, err = strconv.Atoi(q); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "n must be an integer"})
+		}
+	}
+	if n < 1 || n > maxGenerate {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("n must be between 1 and %d", maxGenerate)})
+	}
+	miner := c.Query("address", devMiner)
+
+	hashes := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		block, err := mineBlock(miner)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error(), "hashes": hashes})
+		}
+		hashes = append(hashes, block["hash"].(string))
+	}
+	return c.JSON(fiber.Map{
+		"message": fmt.Sprintf("Generated %d blocks", n),
+		"height":  chain.Height(),
+		"hashes":  hashes,
+	})
+}
+
+// ========== NODE STATS HANDLERS ==========
+
+func GetNodeInfoHandler(c *fiber.Ctx) error {
+	networkPort := ""
+	if node != nil {
+		networkPort = strings.TrimPrefix(node.Address, ":")
+	}
+	return c.JSON(fiber.Map{
+		"name":        "ChainGo Node",
+		"version":     "1.0.0",
+		"status":      "running",
+		"network":     chain.Params.Name,
+		"chainId":     chain.Params.ChainID,
+		"magic":       fmt.Sprintf("%x", chain.Params.Magic),
+		"consensus":   chain.Params.Consensus.Name(),
+		"networkPort": networkPort,
+		"apiPort":     apiPort,
+	})
 }
 
 func GetChainStatsHandler(c *fiber.Ctx) error {
 	mu.Lock()
 	defer mu.Unlock()
 
-	totalTransactions := 0
-	for _, block := range chain.Block {
-		totalTransactions += len(block.Transactions)
+	tip := chain.Tip()
+
+	return c.JSON(fiber.Map{
+		"blocks":              tip.Height + 1,
+		"pendingTransactions": pool.Count(),
+		"mempoolBytes":        pool.Bytes(),
+		"totalTransactions":   chain.TxCount(),
+		"latestBlockHash":     fmt.Sprintf("%x", tip.Hash),
+		"bits":                fmt.Sprintf("%08x", tip.Bits),
+		"difficulty":          chain.Params.Difficulty(tip.Bits),
+		"nextBits":            fmt.Sprintf("%08x", chain.NextBits()),
+		"targetBlockTime":     chain.Params.TargetBlockTime,
+		"chainWork":           chain.ChainWork().String(),
+	})
+}
+
+func GetSupplyHandler(c *fiber.Ctx) error {
+	params := chain.Params
+	height := chain.Height()
+	nextHalving := params.NextHalving(height)
+
+	return c.JSON(fiber.Map{
+		"height":              height,
+		"circulatingSupply":   chain.Supply(),
+		"scheduledSupply":     params.ScheduledSupply(height),
+		"maxSupply":           params.MaxSupply,
+		"subsidy":             params.Subsidy(height + 1),
+		"nextHalvingHeight":   nextHalving,
+		"blocksUntilHalving":  nextHalving - height,
+		"subsidyAfterHalving": params.Subsidy(nextHalving),
+		"halvingInterval":     params.HalvingInterval,
+		"coinbaseMaturity":    params.CoinbaseMaturity,
+	})
+}
+
+func GetFeeEstimateHandler(c *fiber.Ctx) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	est, err := chain.EstimateFees(pool.Transactions())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Suggest absolute fees for a transaction of the requested size,
+	// defaulting to the typical recent size.
+	size := c.QueryInt("size", est.TypicalSize)
+	if size <= 0 {
+		size = defaultTxSize
+	}
+
+	return c.JSON(fiber.Map{
+		"unit":     "coins per 1000 bytes",
+		"feeRates": est,
+		"size":     size,
+		"fees": fiber.Map{
+			"low":    blockchain.FeeFor(est.Low, size),
+			"medium": blockchain.FeeFor(est.Medium, size),
+			"high":   blockchain.FeeFor(est.High, size),
+		},
+	})
+}
+
+// ========== MULTISIG HANDLERS ==========
+
+func CreateMultisigHandler(c *fiber.Ctx) error {
+	var body struct {
+		Threshold  int      `json:"threshold"`
+		PublicKeys []string `json:"publicKeys"` // Hex encoded
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid JSON"})
+	}
+
+	var keys [][]byte
+	for _, k := range body.PublicKeys {
+		key, err := hex.DecodeString(k)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("invalid public key %q", k)})
+		}
+		keys = append(keys, key)
+	}
+	policy, err := blockchain.NewMultisigPolicy(body.Threshold, keys)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	data, err := policy.Serialize()
+	if err == nil {
+		err = db.SaveMultisig(policy.Address(), data)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	logSuccess("MULTISIG", fmt.Sprintf("Created %d-of-%d address %s", policy.Threshold, len(policy.PublicKeys), policy.Address()))
+	return c.JSON(multisigJSON(policy))
+}
+
+func GetMultisigHandler(c *fiber.Ctx) error {
+	policy, err := loadMultisig(c.Params("address"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+	balance, err := chain.UTXO.Balance(policy.Address())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	resp := multisigJSON(policy)
+	resp["balance"] = balance
+	return c.JSON(resp)
+}
+
+// CreateMultisigTxHandler builds an unsigned transaction from a multisig
+// address. It is kept until enough key holders have signed it and it is
+// finalised.
+func CreateMultisigTxHandler(c *fiber.Ctx) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var body struct {
+		From     string  `json:"from"` // Multisig address
+		To       string  `json:"to"`
+		Amount   int     `json:"amount"`
+		Fee      int     `json:"fee"`
+		Nonce    *uint64 `json:"nonce"`
+		LockTime int64   `json:"lockTime"`
+		Release  int     `json:"releaseHeight"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid JSON"})
+	}
+	if body.Fee < 0 || body.LockTime < 0 || body.Release < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Fee, lock time and release height must not be negative"})
+	}
+
+	policy, err := loadMultisig(body.From)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	nonce, err := pendingNonce(body.From)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if body.Nonce != nil {
+		if err := blockchain.CheckNonce(nonce, *body.Nonce); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	spendable, err := spendableOutputs(body.From, "")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	tx, err := blockchain.NewUTXOTransaction(chain.Params.ChainID, body.From, body.To, body.Amount, body.Fee, nonce, spendable)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	tx.LockTime = body.LockTime
+	tx.Outputs[0].ReleaseHeight = body.Release
+	tx.Multisig = policy
+
+	if err := db.SavePartialTx(fmt.Sprintf("%x", tx.Hash()), tx.Serialize()); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(partialTxJSON(tx))
+}
+
+func GetMultisigTxHandler(c *fiber.Ctx) error {
+	tx, err := loadPartialTx(c.Params("hash"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(partialTxJSON(tx))
+}
+
+// SignMultisigTxHandler adds one key holder's signature, either made here
+// with a wallet stored on this node or made elsewhere over the transaction
+// hash.
+func SignMultisigTxHandler(c *fiber.Ctx) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var body struct {
+		Address    string `json:"address"` // With privateKey: sign with a wallet on this node
+		PrivateKey string `json:"privateKey"`
+		PublicKey  string `json:"publicKey"` // With r and s: add an external signature
+		R          string `json:"r"`
+		S          string `json:"s"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid JSON"})
+	}
+
+	hash := c.Params("hash")
+	tx, err := loadPartialTx(hash)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if body.PrivateKey != "" {
+		wallet, err := findWallet(body.Address, body.PrivateKey)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if !tx.Multisig.HasKey(wallet.PublicKey) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Wallet key is not part of the multisig policy"})
+		}
+		tx.Sign(wallet)
+	} else {
+		pubKey, err := hex.DecodeString(body.PublicKey)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid public key"})
+		}
+		sig := blockchain.Signature{PublicKey: pubKey, R: body.R, S: body.S}
+		if err := tx.AddMultisigSignature(sig); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	if err := db.SavePartialTx(hash, tx.Serialize()); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(partialTxJSON(tx))
+}
+
+// FinalizeMultisigTxHandler submits a multisig transaction once it holds
+// enough signatures.
+func FinalizeMultisigTxHandler(c *fiber.Ctx) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	hash := c.Params("hash")
+	tx, err := loadPartialTx(hash)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+	have, need, err := tx.MultisigProgress()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if have < need {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":      fmt.Sprintf("Transaction has %d of %d required signatures", have, need),
+			"signatures": have,
+			"threshold":  need,
+		})
+	}
+
+	if _, err := pool.Add(tx); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if node != nil {
+		node.Broadcast(network.Message{Type: "TRANSACTION", Data: tx})
+	}
+	if err := db.DeletePartialTx(hash); err != nil {
+		logError("MULTISIG", fmt.Sprintf("Could not delete finalised transaction %s: %v", hash, err))
+	}
+
+	logSuccess("MULTISIG", fmt.Sprintf("Submitted %s with %d of %d signatures", hash, have, need))
+	return c.JSON(fiber.Map{
+		"message":     "Multisig transaction submitted",
+		"transaction": partialTxJSON(tx),
+	})
+}
+
+func loadMultisig(address string) (*blockchain.MultisigPolicy, error) {
+	data, err := db.GetMultisig(address)
+	if err != nil {
+		return nil, err
+	}
+	return blockchain.DeserializeMultisigPolicy(data)
+}
+
+func loadPartialTx(hash string) (*blockchain.Transaction, error) {
+	data, err := db.GetPartialTx(hash)
+	if err != nil {
+		return nil, err
+	}
+	return blockchain.DeserializeTransaction(data), nil
+}
+
+func multisigJSON(policy *blockchain.MultisigPolicy) fiber.Map {
+	var keys []string
+	for _, k := range policy.PublicKeys {
+		keys = append(keys, hex.EncodeToString(k))
+	}
+	return fiber.Map{
+		"address":    policy.Address(),
+		"threshold":  policy.Threshold,
+		"publicKeys": keys,
+	}
+}
+
+func partialTxJSON(tx *blockchain.Transaction) fiber.Map {
+	have, need, err := tx.MultisigProgress()
+	var signedBy []string
+	for _, sig := range tx.Signatures {
+		signedBy = append(signedBy, hex.EncodeToString(sig.PublicKey))
+	}
+	resp := fiber.Map{
+		"hash":       fmt.Sprintf("%x", tx.Hash()),
+		"from":       tx.From,
+		"to":         tx.To,
+		"amount":     tx.Amount,
+		"fee":        tx.Fee,
+		"nonce":      tx.Nonce,
+		"lockTime":   tx.LockTime,
+		"outputs":    tx.Outputs,
+		"signatures": have,
+		"threshold":  need,
+		"signedBy":   signedBy,
+		"complete":   err == nil && have >= need,
+	}
+	if err != nil {
+		resp["error"] = err.Error()
+	}
+	return resp
+}
+
+// ========== CONTRACT HANDLERS ==========
+
+// defaultGasLimit is the gas bought when a deploy or call names no limit.
+const defaultGasLimit = 10000
+
+// contractTxBody holds what deploy and call requests share.
+type contractTxBody struct {
+	From       string            `json:"from"`
+	PrivateKey string            `json:"privateKey"`
+	Args       []json.RawMessage `json:"args"`     // Numbers, "0x" hex or strings
+	GasLimit   int               `json:"gasLimit"` // Optional, defaults to defaultGasLimit
+	Fee        *int              `json:"fee"`      // Optional, defaults to the cost of the gas limit
+	Nonce      *uint64           `json:"nonce"`
+}
+
+// DeployContractHandler deploys contract code given as assembly or hex.
+func DeployContractHandler(c *fiber.Ctx) error {
+	var body struct {
+		contractTxBody
+		Code string `json:"code"` // Hex byte code
+		Asm  string `json:"asm"`  // Or assembly
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid JSON"})
+	}
+
+	var code []byte
+	var err error
+	if body.Asm != "" {
+		code, err = blockchain.AssembleContract(body.Asm)
+	} else {
+		code, err = hex.DecodeString(body.Code)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if len(code) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "code or asm is required"})
+	}
+	return submitContractTx(c, body.contractTxBody, &blockchain.ContractCall{Code: code})
+}
+
+// CallContractHandler calls a deployed contract in a transaction.
+func CallContractHandler(c *fiber.Ctx) error {
+	var body struct {
+		contractTxBody
+		Address string `json:"address"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid JSON"})
+	}
+	if body.Address == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "address is required"})
+	}
+	return submitContractTx(c, body.contractTxBody, &blockchain.ContractCall{Address: body.Address})
+}
+
+// submitContractTx builds, signs and submits a contract transaction whose
+// fee is paid by body.From.
+func submitContractTx(c *fiber.Ctx, body contractTxBody, call *blockchain.ContractCall) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	wallet, err := findWallet(body.From, body.PrivateKey)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if call.Args, err = parseContractArgs(body.Args); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	call.GasLimit = body.GasLimit
+	if call.GasLimit == 0 {
+		call.GasLimit = defaultGasLimit
+	}
+	fee := blockchain.GasFee(call.GasLimit)
+	if body.Fee != nil {
+		fee = *body.Fee
+	}
+
+	nonce, err := pendingNonce(body.From)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if body.Nonce != nil {
+		if err := blockchain.CheckNonce(nonce, *body.Nonce); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	spendable, err := spendableOutputs(body.From, "")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	tx, err := blockchain.NewContractTransaction(chain.Params.ChainID, body.From, call, fee, nonce, spendable)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	tx.Sign(wallet)
+
+	if _, err := pool.Add(tx); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if node != nil {
+		node.Broadcast(network.Message{Type: "TRANSACTION", Data: tx})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Contract transaction submitted; see its receipt once mined",
+		"transaction": fiber.Map{
+			"hash":     fmt.Sprintf("%x", tx.Hash()),
+			"from":     tx.From,
+			"contract": tx.To,
+			"deploy":   len(call.Code) > 0,
+			"fee":      tx.Fee,
+			"gasLimit": call.GasLimit,
+			"nonce":    tx.Nonce,
+		},
+	})
+}
+
+// DefaultReadGasLimit is the gas a contract read over the API may use
+// unless SetReadGasLimit says otherwise. Reads are free and need no key,
+// so it is well below MaxTxGas.
+const DefaultReadGasLimit = 100000
+
+var readGasLimit = DefaultReadGasLimit
+
+// SetReadGasLimit sets the gas a contract read over the API may use.
+func SetReadGasLimit(gas int) {
+	readGasLimit = gas
+}
+
+// ReadContractHandler runs a contract against the current state without a
+// transaction, e.g. to read a value it stores.
+func ReadContractHandler(c *fiber.Ctx) error {
+	var body struct {
+		Address string            `json:"address"`
+		Caller  string            `json:"caller"`
+		Args    []json.RawMessage `json:"args"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid JSON"})
+	}
+	args, err := parseContractArgs(body.Args)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	receipt, err := chain.ReadContract(body.Address, body.Caller, args, readGasLimit)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(receiptJSON(receipt))
+}
+
+func GetContractHandler(c *fiber.Ctx) error {
+	address := c.Params("address")
+	contract, err := chain.Contract(address)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+	storage, err := chain.ContractStorage(address)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	values := make(fiber.Map, len(storage))
+	for key, value := range storage {
+		values[key] = contractValueJSON(value)
+	}
+	return c.JSON(fiber.Map{
+		"address":   contract.Address,
+		"creator":   contract.Creator,
+		"height":    contract.Height,
+		"code":      hex.EncodeToString(contract.Code),
+		"asm":       strings.Split(blockchain.DisassembleContract(contract.Code), "\n"),
+		"storage":   values,
+		"stateRoot": fmt.Sprintf("%x", chain.StateRoot()),
+	})
+}
+
+func GetReceiptHandler(c *fiber.Ctx) error {
+	txHash, err := hex.DecodeString(c.Params("hash"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid transaction hash"})
+	}
+	receipt, err := chain.Receipt(txHash)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(receiptJSON(receipt))
+}
+
+func receiptJSON(r *blockchain.Receipt) fiber.Map {
+	logs := make([]fiber.Map, len(r.Logs))
+	for i, l := range r.Logs {
+		logs[i] = contractValueJSON(l)
+	}
+	resp := fiber.Map{
+		"contract": r.Contract,
+		"height":   r.Height,
+		"success":  r.Success,
+		"gasUsed":  r.GasUsed,
+		"gasLimit": r.GasLimit,
+		"return":   contractValueJSON(r.Return),
+		"logs":     logs,
+	}
+	if r.TxHash != "" {
+		resp["txHash"] = r.TxHash
+		resp["deploy"] = r.Deploy
+	}
+	if r.Error != "" {
+		resp["error"] = r.Error
+	}
+	return resp
+}
+
+// contractValueJSON shows a contract value as hex, and also as a number or
+// text when it looks like one.
+func contractValueJSON(v []byte) fiber.Map {
+	m := fiber.Map{"hex": hex.EncodeToString(v)}
+	if len(v) == 8 {
+		n, _ := blockchain.DecodeContractInt(v)
+		m["int"] = n
+	}
+	if len(v) > 0 && utf8.Valid(v) && strings.IndexFunc(string(v), func(r rune) bool { return !unicode.IsPrint(r) }) < 0 {
+		m["text"] = string(v)
+	}
+	return m
+}
+
+// parseContractArgs converts JSON arguments to contract values: numbers
+// become 8-byte integers, strings starting with 0x are hex and other
+// strings are their bytes.
+func parseContractArgs(raw []json.RawMessage) ([][]byte, error) {
+	args := make([][]byte, 0, len(raw))
+	for i, r := range raw {
+		var n int64
+		if err := json.Unmarshal(r, &n); err == nil {
+			args = append(args, blockchain.EncodeContractInt(n))
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(r, &s); err != nil {
+			return nil, fmt.Errorf("argument %d must be an integer or a string", i)
+		}
+		if strings.HasPrefix(s, "0x") {
+			data, err := hex.DecodeString(s[2:])
+			if err != nil {
+				return nil, fmt.Errorf("argument %d: invalid hex", i)
+			}
+			args = append(args, data)
+			continue
+		}
+		args = append(args, []byte(s))
+	}
+	return args, nil
+}
+
+// ========== TOKEN HANDLERS ==========
+
+// tokenTxBody holds what token requests share.
+type tokenTxBody struct {
+	From       string  `json:"from"`
+	PrivateKey string  `json:"privateKey"`
+	Symbol     string  `json:"symbol"`
+	Amount     int     `json:"amount"`
+	To         string  `json:"to"`
+	Fee        int     `json:"fee"` // Optional; token transactions may pay no fee
+	Nonce      *uint64 `json:"nonce"`
+}
+
+// IssueTokenHandler creates a token, crediting its initial supply to the
+// issuer.
+func IssueTokenHandler(c *fiber.Ctx) error {
+	var body struct {
+		tokenTxBody
+		Name     string `json:"name"`
+		Supply   int    `json:"supply"`
+		Mintable bool   `json:"mintable"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid JSON"})
+	}
+	return submitTokenTx(c, body.tokenTxBody, &blockchain.TokenOp{
+		Kind:     blockchain.TokenIssue,
+		Symbol:   body.Symbol,
+		Name:     body.Name,
+		Amount:   body.Supply,
+		Mintable: body.Mintable,
+	})
+}
+
+// MintTokenHandler creates new units of a mintable token for its issuer or
+// for to.
+func MintTokenHandler(c *fiber.Ctx) error {
+	return tokenOpHandler(c, blockchain.TokenMint)
+}
+
+func TransferTokenHandler(c *fiber.Ctx) error {
+	return tokenOpHandler(c, blockchain.TokenTransfer)
+}
+
+func BurnTokenHandler(c *fiber.Ctx) error {
+	return tokenOpHandler(c, blockchain.TokenBurn)
+}
+
+func tokenOpHandler(c *fiber.Ctx, kind string) error {
+	var body tokenTxBody
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid JSON"})
+	}
+	return submitTokenTx(c, body, &blockchain.TokenOp{
+		Kind:   kind,
+		Symbol: body.Symbol,
+		Amount: body.Amount,
+		To:     body.To,
+	})
+}
+
+// submitTokenTx builds, signs and submits a token transaction whose fee is
+// paid by body.From.
+func submitTokenTx(c *fiber.Ctx, body tokenTxBody, op *blockchain.TokenOp) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	wallet, err := findWallet(body.From, body.PrivateKey)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if op.To != "" {
+		if op.To, err = resolveAddress(op.To); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	nonce, err := pendingNonce(body.From)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if body.Nonce != nil {
+		if err := blockchain.CheckNonce(nonce, *body.Nonce); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	spendable, err := spendableOutputs(body.From, "")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	tx, err := blockchain.NewTokenTransaction(chain.Params.ChainID, body.From, op, body.Fee, nonce, spendable)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	tx.Sign(wallet)
+
+	if _, err := pool.Add(tx); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if node != nil {
+		node.Broadcast(network.Message{Type: "TRANSACTION", Data: tx})
+	}
+
+	logSuccess("TOKEN", fmt.Sprintf("%s %d %s from %s", op.Kind, op.Amount, op.Symbol, tx.From))
+	return c.JSON(fiber.Map{
+		"message": "Token transaction submitted",
+		"transaction": fiber.Map{
+			"hash":  fmt.Sprintf("%x", tx.Hash()),
+			"from":  tx.From,
+			"token": op,
+			"fee":   tx.Fee,
+			"nonce": tx.Nonce,
+		},
+	})
+}
+
+func GetTokenHandler(c *fiber.Ctx) error {
+	token, err := chain.Token(c.Params("symbol"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(token)
+}
+
+func ListTokensHandler(c *fiber.Ctx) error {
+	tokens, err := chain.Tokens()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{
+		"count":  len(tokens),
+		"tokens": tokens,
+	})
+}
+
+// ========== NAME HANDLERS ==========
+
+// nameTxBody holds what name registry requests share.
+type nameTxBody struct {
+	From       string  `json:"from"`
+	PrivateKey string  `json:"privateKey"`
+	Name       string  `json:"name"`
+	To         string  `json:"to"`  // New owner, or for register an owner other than from
+	Fee        int     `json:"fee"` // Optional; name transactions may pay no fee
+	Nonce      *uint64 `json:"nonce"`
+}
+
+// RegisterNameHandler claims a free or expired name for from, or for to.
+func RegisterNameHandler(c *fiber.Ctx) error {
+	return nameOpHandler(c, blockchain.NameRegister)
+}
+
+// RenewNameHandler extends a registration by another lifetime.
+func RenewNameHandler(c *fiber.Ctx) error {
+	return nameOpHandler(c, blockchain.NameRenew)
+}
+
+func TransferNameHandler(c *fiber.Ctx) error {
+	return nameOpHandler(c, blockchain.NameTransfer)
+}
+
+// nameOpHandler builds, signs and submits a name transaction whose fee is
+// paid by from.
+func nameOpHandler(c *fiber.Ctx, kind string) error {
+	var body nameTxBody
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid JSON"})
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	wallet, err := findWallet(body.From, body.PrivateKey)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	op := &blockchain.NameOp{Kind: kind, Name: strings.ToLower(body.Name)}
+	if body.To != "" {
+		if op.To, err = resolveAddress(body.To); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	nonce, err := pendingNonce(body.From)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if body.Nonce != nil {
+		if err := blockchain.CheckNonce(nonce, *body.Nonce); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	spendable, err := spendableOutputs(body.From, "")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	tx, err := blockchain.NewNameTransaction(chain.Params.ChainID, body.From, op, body.Fee, nonce, spendable)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	tx.Sign(wallet)
+
+	if _, err := pool.Add(tx); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if node != nil {
+		node.Broadcast(network.Message{Type: "TRANSACTION", Data: tx})
+	}
+
+	logSuccess("NAME", fmt.Sprintf("%s %s from %s", op.Kind, op.Name, tx.From))
+	return c.JSON(fiber.Map{
+		"message": "Name transaction submitted",
+		"transaction": fiber.Map{
+			"hash":  fmt.Sprintf("%x", tx.Hash()),
+			"from":  tx.From,
+			"name":  op,
+			"fee":   tx.Fee,
+			"nonce": tx.Nonce,
+		},
+	})
+}
+
+// GetNameHandler shows the registration of a name and whether it still
+// resolves.
+func GetNameHandler(c *fiber.Ctx) error {
+	record, err := chain.Name(strings.ToLower(c.Params("name")))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{
+		"name":       record.Name,
+		"owner":      record.Owner,
+		"registered": record.Registered,
+		"expires":    record.Expires,
+		"active":     chain.Height()+1 < record.Expires,
+	})
+}
+
+// ========== NOTARY HANDLERS ==========
+
+// NotarizeHandler anchors a document digest on chain in the memo of a
+// transaction that pays only its fee.
+func NotarizeHandler(c *fiber.Ctx) error {
+	var body struct {
+		From       string  `json:"from"`
+		PrivateKey string  `json:"privateKey"`
+		Digest     string  `json:"digest"` // Hex, e.g. the SHA-256 of the document
+		Fee        int     `json:"fee"`
+		Nonce      *uint64 `json:"nonce"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid JSON"})
+	}
+	digest, err := hex.DecodeString(body.Digest)
+	if err != nil || len(digest) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "digest must be non-empty hex"})
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	wallet, err := findWallet(body.From, body.PrivateKey)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	nonce, err := pendingNonce(body.From)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if body.Nonce != nil {
+		if err := blockchain.CheckNonce(nonce, *body.Nonce); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	spendable, err := spendableOutputs(body.From, "")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	tx, err := blockchain.NewMemoTransaction(chain.Params.ChainID, body.From, digest, body.Fee, nonce, spendable)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	tx.Sign(wallet)
+
+	if _, err := pool.Add(tx); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if node != nil {
+		node.Broadcast(network.Message{Type: "TRANSACTION", Data: tx})
+	}
+
+	logSuccess("NOTARIZE", fmt.Sprintf("Digest %x anchored by %s", digest, tx.From))
+	return c.JSON(fiber.Map{
+		"message": "Digest submitted; it is anchored once the transaction is mined",
+		"digest":  hex.EncodeToString(digest),
+		"transaction": fiber.Map{
+			"hash":  fmt.Sprintf("%x", tx.Hash()),
+			"from":  tx.From,
+			"fee":   tx.Fee,
+			"nonce": tx.Nonce,
+		},
+	})
+}
+
+// GetNotarizationHandler proves when a digest was first anchored: the
+// block it is in, with its height and timestamp, and a Merkle proof that
+// the anchoring transaction is in that block.
+func GetNotarizationHandler(c *fiber.Ctx) error {
+	digest, err := hex.DecodeString(c.Params("digest"))
+	if err != nil || len(digest) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "digest must be non-empty hex"})
+	}
+
+	anchors, err := chain.FindMemo(digest)
+	if err != nil {
+		for _, t := range pool.Transactions() {
+			if bytes.Equal(t.Memo, digest) {
+				return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+					"digest":  hex.EncodeToString(digest),
+					"status":  "pending",
+					"txHash":  fmt.Sprintf("%x", t.Hash()),
+					"message": "The anchoring transaction is waiting to be mined",
+				})
+			}
+		}
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	first := anchors[0]
+	proof, err := merkleProofJSON(first.Block, first.Tx.Hash())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{
+		"digest":        hex.EncodeToString(digest),
+		"status":        "anchored",
+		"txHash":        fmt.Sprintf("%x", first.Tx.Hash()),
+		"from":          first.Tx.From,
+		"block":         fmt.Sprintf("%x", first.Block.Hash),
+		"height":        first.Block.Height,
+		"timestamp":     first.Block.Timestamp,
+		"time":          time.Unix(first.Block.Timestamp, 0).UTC().Format(time.RFC3339),
+		"confirmations": chain.Height() - first.Block.Height + 1,
+		"anchors":       len(anchors),
+		"proof":         proof,
+	})
+}
+
+// ========== VALIDATOR HANDLERS ==========
+
+// VoteValidatorHandler submits the vote of a validator to add a validator
+// to, or remove one from, the validator set of a proof-of-authority chain.
+func VoteValidatorHandler(c *fiber.Ctx) error {
+	var body struct {
+		From       string  `json:"from"`
+		PrivateKey string  `json:"privateKey"`
+		Kind       string  `json:"kind"` // "add" or "remove"
+		Validator  string  `json:"validator"`
+		Fee        int     `json:"fee"`
+		Nonce      *uint64 `json:"nonce"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid JSON"})
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	wallet, err := findWallet(body.From, body.PrivateKey)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	op := &blockchain.GovernanceOp{Kind: body.Kind}
+	if op.Validator, err = resolveAddress(body.Validator); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	nonce, err := pendingNonce(body.From)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if body.Nonce != nil {
+		if err := blockchain.CheckNonce(nonce, *body.Nonce); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	spendable, err := spendableOutputs(body.From, "")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	tx, err := blockchain.NewGovernanceTransaction(chain.Params.ChainID, body.From, op, body.Fee, nonce, spendable)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	tx.Sign(wallet)
+
+	if _, err := pool.Add(tx); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if node != nil {
+		node.Broadcast(network.Message{Type: "TRANSACTION", Data: tx})
+	}
+
+	logSuccess("GOVERNANCE", fmt.Sprintf("%s votes to %s %s", tx.From, op.Kind, op.Validator))
+	return c.JSON(fiber.Map{
+		"message": "Vote submitted; the change is made once a majority of validators has voted",
+		"transaction": fiber.Map{
+			"hash":       fmt.Sprintf("%x", tx.Hash()),
+			"from":       tx.From,
+			"governance": op,
+			"fee":        tx.Fee,
+			"nonce":      tx.Nonce,
+		},
+	})
+}
+
+// GetValidatorsHandler shows the consensus engine and, under proof of
+// authority, the validator set, whose turn it is and the pending votes.
+func GetValidatorsHandler(c *fiber.Ctx) error {
+	validators := chain.Validators()
+	if validators == nil {
+		return c.JSON(fiber.Map{"consensus": chain.Params.Consensus.Name()})
+	}
+	votes := chain.GovernanceVotes()
+	if votes == nil {
+		votes = []blockchain.GovernanceVote{}
+	}
+	return c.JSON(fiber.Map{
+		"consensus":  chain.Params.Consensus.Name(),
+		"validators": validators,
+		"nextSealer": chain.NextSealer(),
+		"majority":   len(validators)/2 + 1,
+		"votes":      votes,
+	})
+}
+
+// ========== STAKE HANDLERS ==========
+
+// DepositStakeHandler bonds coins of the sender as stake on a
+// proof-of-stake chain.
+func DepositStakeHandler(c *fiber.Ctx) error {
+	return submitStake(c, blockchain.StakeDeposit)
+}
+
+// WithdrawStakeHandler unbonds stake of the sender. The coins are paid
+// back locked until the unbonding period of the chain has passed.
+func WithdrawStakeHandler(c *fiber.Ctx) error {
+	return submitStake(c, blockchain.StakeWithdraw)
+}
+
+func submitStake(c *fiber.Ctx, kind string) error {
+	var body struct {
+		From       string  `json:"from"`
+		PrivateKey string  `json:"privateKey"`
+		Amount     int     `json:"amount"`
+		Fee        int     `json:"fee"`
+		Nonce      *uint64 `json:"nonce"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid JSON"})
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	wallet, err := findWallet(body.From, body.PrivateKey)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	nonce, err := pendingNonce(body.From)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if body.Nonce != nil {
+		if err := blockchain.CheckNonce(nonce, *body.Nonce); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	spendable, err := spendableOutputs(body.From, "")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	// The withdrawal is released after unbonding counted from the next
+	// block; a later block only releases it later.
+	release := chain.Height() + 1 + chain.Params.StakeUnbonding
+	op := &blockchain.StakeOp{Kind: kind, Amount: body.Amount}
+	tx, err := blockchain.NewStakeTransaction(chain.Params.ChainID, body.From, op, body.Fee, nonce, spendable, release)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	tx.Sign(wallet)
+
+	if _, err := pool.Add(tx); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if node != nil {
+		node.Broadcast(network.Message{Type: "TRANSACTION", Data: tx})
+	}
+
+	logSuccess("STAKE", fmt.Sprintf("%s %ss %d", tx.From, kind, body.Amount))
+	m := fiber.Map{
+		"hash":  fmt.Sprintf("%x", tx.Hash()),
+		"from":  tx.From,
+		"stake": op,
+		"fee":   tx.Fee,
+		"nonce": tx.Nonce,
+	}
+	if kind == blockchain.StakeWithdraw {
+		m["releaseHeight"] = release
+	}
+	return c.JSON(fiber.Map{
+		"message":     "Stake transaction added to the pool",
+		"transaction": m,
+	})
+}
+
+// SlashHandler submits evidence that a validator signed two blocks at the
+// same height, burning its stake. The blocks are given by hash and may be
+// on a side branch.
+func SlashHandler(c *fiber.Ctx) error {
+	var body struct {
+		From       string  `json:"from"`
+		PrivateKey string  `json:"privateKey"`
+		First      string  `json:"first"`
+		Second     string  `json:"second"`
+		Fee        int     `json:"fee"`
+		Nonce      *uint64 `json:"nonce"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid JSON"})
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	wallet, err := findWallet(body.From, body.PrivateKey)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	var headers [2]*blockchain.Block
+	for i, h := range []string{body.First, body.Second} {
+		hash, err := hex.DecodeString(h)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid block hash"})
+		}
+		if headers[i], err = chain.BlockByHash(hash); err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	nonce, err := pendingNonce(body.From)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	if body.Nonce != nil {
+		if err := blockchain.CheckNonce(nonce, *body.Nonce); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	spendable, err := spendableOutputs(body.From, "")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	tx, err := blockchain.NewSlashTransaction(chain.Params.ChainID, body.From, headers[0], headers[1], body.Fee, nonce, spendable)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	tx.Sign(wallet)
+
+	if _, err := pool.Add(tx); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if node != nil {
+		node.Broadcast(network.Message{Type: "TRANSACTION", Data: tx})
+	}
+
+	offender := blockchain.AddressFromPublicKey(headers[0].Signer)
+	logSuccess("SLASH", fmt.Sprintf("%s reports %s for height %d", tx.From, offender, headers[0].Height))
+	return c.JSON(fiber.Map{
+		"message": "Slashing evidence added to the pool",
+		"transaction": fiber.Map{
+			"hash":     fmt.Sprintf("%x", tx.Hash()),
+			"from":     tx.From,
+			"offender": offender,
+			"height":   headers[0].Height,
+			"fee":      tx.Fee,
+			"nonce":    tx.Nonce,
+		},
+	})
+}
+
+// GetStakesHandler shows the consensus engine and, under proof of stake,
+// the bonded stakes, the proposer drawn for the next block and the
+// recorded slashings.
+func GetStakesHandler(c *fiber.Ctx) error {
+	stakes := chain.Stakes()
+	if stakes == nil {
+		return c.JSON(fiber.Map{"consensus": chain.Params.Consensus.Name()})
+	}
+	total := 0
+	for _, s := range stakes {
+		total += s.Amount
+	}
+	slashes := chain.Slashes()
+	if slashes == nil {
+		slashes = []blockchain.Slash{}
+	}
+	return c.JSON(fiber.Map{
+		"consensus":    chain.Params.Consensus.Name(),
+		"total":        total,
+		"stakes":       stakes,
+		"nextProposer": chain.NextProposer(),
+		"unbonding":    chain.Params.StakeUnbonding,
+		"slashes":      slashes,
+	})
+}
+
+// GetStakeHandler returns the bonded stake of one address.
+func GetStakeHandler(c *fiber.Ctx) error {
+	address, err := resolveAddress(c.Params("address"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+	stakes := chain.Stakes()
+	if stakes == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "the chain does not use proof of stake"})
+	}
+	amount, total := 0, 0
+	for _, s := range stakes {
+		total += s.Amount
+		if s.Address == address {
+			amount = s.Amount
+		}
+	}
+	return c.JSON(fiber.Map{
+		"address": address,
+		"stake":   amount,
+		"total":   total,
+	})
+}
+
+// ========== SCRIPT HANDLERS ==========
+
+// CompileScriptHandler assembles a script and returns its byte code and the
+// address that outputs locked by it are paid to.
+func CompileScriptHandler(c *fiber.Ctx) error {
+	var body struct {
+		Asm string `json:"asm"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid JSON"})
+	}
+	script, err := blockchain.ParseScript(body.Asm)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{
+		"hex":     hex.EncodeToString(script),
+		"asm":     script.String(),
+		"address": script.Address(),
+		"size":    len(script),
+	})
+}
+
+// SpendScriptHandler spends a script-locked output. The unlocking script
+// is written like any other, except that the token SIG stands for the
+// sender's signature of the transaction and SIG:<address> for the
+// signature of one of the listed signers. The sender pays the nonce and
+// signs the transaction as usual.
+func SpendScriptHandler(c *fiber.Ctx) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var body struct {
+		From       string `json:"from"`
+		PrivateKey string `json:"privateKey"`
+		TxID       string `json:"txid"`
+		Vout       int    `json:"vout"`
+		Unlock     string `json:"unlock"`
+		To         string `json:"to"` // Optional, defaults to the sender
+		Fee        int    `json:"fee"`
+		LockTime   int64  `json:"lockTime"` // Needed by OP_CHECKLOCKTIMEVERIFY
+		Signers    []struct {
+			Address    string `json:"address"`
+			PrivateKey string `json:"privateKey"`
+		} `json:"signers"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid JSON"})
+	}
+	if body.Fee < 0 || body.LockTime < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Fee and lock time must not be negative"})
+	}
+
+	wallet, err := findWallet(body.From, body.PrivateKey)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	signers := map[string]*blockchain.Wallet{"SIG": wallet}
+	for _, s := range body.Signers {
+		w, err := findWallet(s.Address, s.PrivateKey)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("signer %s: %v", s.Address, err)})
+		}
+		signers["SIG:"+s.Address] = w
+	}
+
+	txid, err := hex.DecodeString(body.TxID)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid txid"})
+	}
+	op := blockchain.OutPoint{TxID: txid, Vout: body.Vout}
+	utxo, err := chain.UTXO.Get(op)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+	if len(utxo.Output.Script) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "output is not locked by a script"})
+	}
+	if pool.Claimed("")[op.String()] {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "output is already spent by a pending transaction"})
+	}
+	amount := utxo.Output.Amount - body.Fee
+	if amount <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("fee %d leaves nothing of the output's %d", body.Fee, utxo.Output.Amount)})
+	}
+
+	nonce, err := pendingNonce(body.From)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	to, paid := body.To, amount
+	if to == "" || to == body.From {
+		to, paid = body.From, 0
+	}
+	tx := &blockchain.Transaction{
+		Version:  blockchain.TxVersion,
+		From:     body.From,
+		To:       to,
+		Amount:   paid,
+		Fee:      body.Fee,
+		Inputs:   []blockchain.TxInput{{TxID: txid, Vout: body.Vout}},
+		Outputs:  []blockchain.TxOutput{{Amount: amount, Address: to}},
+		Nonce:    nonce,
+		ChainID:  chain.Params.ChainID,
+		LockTime: body.LockTime,
+	}
+
+	// Signatures cover the transaction hash, which leaves out unlocking
+	// scripts, so they can be made before the unlocking script exists.
+	hash := tx.Hash()
+	tokens := strings.Fields(body.Unlock)
+	for i, tok := range tokens {
+		w, ok := signers[tok]
+		if !ok {
+			continue
+		}
+		sig, err := blockchain.SignatureBytes(w.Sign(hash))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+		tokens[i] = "0x" + hex.EncodeToString(sig)
+	}
+	unlock, err := blockchain.ParseScript(strings.Join(tokens, " "))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := blockchain.VerifyScript(unlock, utxo.Output.Script, tx); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	tx.Inputs[0].Unlock = unlock
+	tx.Sign(wallet)
+
+	if _, err := pool.Add(tx); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if node != nil {
+		node.Broadcast(network.Message{Type: "TRANSACTION", Data: tx})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Script output spent",
+		"transaction": fiber.Map{
+			"hash":     fmt.Sprintf("%x", tx.Hash()),
+			"from":     tx.From,
+			"to":       tx.To,
+			"amount":   tx.Amount,
+			"fee":      tx.Fee,
+			"nonce":    tx.Nonce,
+			"lockTime": tx.LockTime,
+			"spends":   op.String(),
+			"lock":     utxo.Output.Script.String(),
+			"unlock":   unlock.String(),
+		},
+	})
+}
+
+// ========== MEMPOOL HANDLERS ==========
+
+func entryJSON(e *mempool.Entry) fiber.Map {
+	return fiber.Map{
+		"hash":    e.Hash,
+		"from":    e.Tx.From,
+		"to":      e.Tx.To,
+		"amount":  e.Tx.Amount,
+		"fee":     e.Tx.Fee,
+		"feeRate": e.FeeRate,
+		"size":    e.Size,
+		"nonce":   e.Tx.Nonce,
+		"added":   e.Added.Unix(),
+	}
+}
+
+func GetMempoolHandler(c *fiber.Ctx) error {
+	entries := pool.Entries()
+	senders := make(map[string]bool)
+	txList := []fiber.Map{}
+	for _, e := range entries {
+		senders[e.Tx.From] = true
+		txList = append(txList, entryJSON(e))
+	}
+
+	cfg := pool.Config()
+	return c.JSON(fiber.Map{
+		"count":   len(entries),
+		"bytes":   pool.Bytes(),
+		"senders": len(senders),
+		"limits": fiber.Map{
+			"maxCount":       cfg.MaxCount,
+			"maxBytes":       cfg.MaxBytes,
+			"ttlSeconds":     int(cfg.TTL.Seconds()),
+			"replaceFeeBump": cfg.ReplaceFeeBump,
+		},
+		"transactions": txList,
+	})
+}
+
+func GetMempoolSenderHandler(c *fiber.Ctx) error {
+	address := c.Params("address")
+
+	confirmed, err := chain.NextNonce(address)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+	txList := []fiber.Map{}
+	for _, e := range pool.BySender(address) {
+		txList = append(txList, entryJSON(e))
+	}
+
+	return c.JSON(fiber.Map{
+		"address":      address,
+		"nonce":        confirmed,
+		"pendingNonce": confirmed + uint64(len(txList)),
+		"count":        len(txList),
+		"transactions": txList,
+	})
+}
+
+func GetMempoolTxHandler(c *fiber.Ctx) error {
+	e, ok := pool.Get(c.Params("hash"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Transaction not in mempool"})
+	}
+	return c.JSON(entryJSON(e))
+}
+
+func EvictMempoolTxHandler(c *fiber.Ctx) error {
+	evicted, err := pool.Evict(c.Params("hash"))
+	if errors.Is(err, mempool.ErrNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
 
+	logInfo("MEMPOOL", fmt.Sprintf("Evicted %d transactions", len(evicted)))
 	return c.JSON(fiber.Map{
-		"blocks":              len(chain.Block),
-		"pendingTransactions": len(pendingTx),
-		"totalTransactions":   totalTransactions,
-		"latestBlockHash":     fmt.Sprintf("%x", chain.Block[len(chain.Block)-1].Hash),
+		"message": "Transaction evicted",
+		"evicted": evicted,
 	})
 }
 
@@ -475,11 +2536,7 @@ func ListPeersHandler(c *fiber.Ctx) error {
 
 func SyncHandler(c *fiber.Ctx) error {
 	if node != nil {
-		msg := network.Message{
-			Type: "CHAIN_REQUEST",
-			Data: node.Address, // Send our listening address so peer can dial back
-		}
-		node.Broadcast(msg)
+		node.RequestSync()
 		return c.JSON(fiber.Map{"message": "Sync requested from peers"})
 	}
 	return c.JSON(fiber.Map{"error": "Node not initialized"})
@@ -487,6 +2544,45 @@ func SyncHandler(c *fiber.Ctx) error {
 
 // ========== HELPER FUNCTIONS ==========
 
+// findWallet returns the stored wallet with the given private key, which
+// must own address. On dev networks the dev account needs no key.
+func findWallet(address, privateKey string) (*blockchain.Wallet, error) {
+	if privateKey == "" && address == blockchain.DevAccount && chain.Params.Dev {
+		if w, ok := wallets[address]; ok {
+			return w, nil
+		}
+	}
+	for addr, w := range wallets {
+		if w.PrivateKeyHex() == privateKey {
+			if addr != address {
+				return nil, errors.New("Private key does not match from address")
+			}
+			return w, nil
+		}
+	}
+	return nil, errors.New("Invalid private key or wallet not found")
+}
+
+// resolveAddress returns the address the registered name s points to, or s
+// itself if it is an address or no such name is registered. Names are stored
+// lowercase and only matched exactly, so a literal such as "Genesis" never
+// resolves to whoever registered "genesis".
+func resolveAddress(s string) (string, error) {
+	if len(s) == 64 {
+		if _, err := hex.DecodeString(s); err == nil {
+			return s, nil
+		}
+	}
+	if s != strings.ToLower(s) {
+		return s, nil
+	}
+	owner, err := chain.ResolveName(s)
+	if errors.Is(err, blockchain.ErrNoName) {
+		return s, nil
+	}
+	return owner, err
+}
+
 func formatTransaction(tx *blockchain.Transaction) string {
 	return tx.From + "->" + tx.To + ":" + strconv.Itoa(tx.Amount)
 }
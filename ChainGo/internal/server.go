@@ -1,8 +1,12 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/Vishal-2029/blockchain"
 	"github.com/Vishal-2029/pkg"
@@ -11,12 +15,17 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/logger"
 )
 
-func StartServer(db *pkg.BoltDB, port string) {
-	bc := blockchain.NewBlockchain(db)
+func StartServer(db *pkg.BoltDB, port string, params *blockchain.ChainParams) {
+	bc, err := blockchain.NewBlockchain(db, params)
+	if err != nil {
+		log.Fatal(err)
+	}
 	SetBlockchain(bc)
+	apiPort = port
 
 	if node != nil {
 		node.SetBlockchain(bc)
+		node.SetMempool(pool)
 	}
 
 	app := fiber.New(fiber.Config{AppName: "ChainGo Blockchain API"})
@@ -29,14 +38,74 @@ func StartServer(db *pkg.BoltDB, port string) {
 	// Wallet routes
 	api.Post("/wallet/create", CreateWalletHandler)
 	api.Get("/wallet/balance/:address", GetWalletBalanceHandler)
+	api.Get("/wallet/utxos/:address", GetWalletUTXOsHandler)
+	api.Get("/wallet/nonce/:address", GetWalletNonceHandler)
 
 	// Transaction routes
 	api.Post("/transaction/create", CreateTransactionHandler)
+	api.Post("/transaction/batch", CreateBatchTransactionHandler)
 	api.Get("/transaction/pending", GetPendingTransactionsHandler)
+	api.Post("/transaction/proof/verify", VerifyTransactionProofHandler)
 	api.Get("/transaction/:hash", GetTransactionHandler)
+	api.Get("/transaction/:hash/proof", GetTransactionProofHandler)
+
+	// Contract routes
+	api.Post("/contract/deploy", DeployContractHandler)
+	api.Post("/contract/call", CallContractHandler)
+	api.Post("/contract/read", ReadContractHandler)
+	api.Get("/contract/receipt/:hash", GetReceiptHandler)
+	api.Get("/contract/:address", GetContractHandler)
+
+	// Token routes
+	api.Post("/token/issue", IssueTokenHandler)
+	api.Post("/token/mint", MintTokenHandler)
+	api.Post("/token/transfer", TransferTokenHandler)
+	api.Post("/token/burn", BurnTokenHandler)
+	api.Get("/tokens", ListTokensHandler)
+	api.Get("/token/:symbol", GetTokenHandler)
+
+	// Name registry routes
+	api.Post("/name/register", RegisterNameHandler)
+	api.Post("/name/renew", RenewNameHandler)
+	api.Post("/name/transfer", TransferNameHandler)
+	api.Get("/name/:name", GetNameHandler)
+
+	// Notary routes
+	api.Post("/notarize", NotarizeHandler)
+	api.Get("/notarize/:digest", GetNotarizationHandler)
+
+	// Validators (proof of authority)
+	api.Get("/validators", GetValidatorsHandler)
+	api.Post("/validators/vote", VoteValidatorHandler)
+
+	// Staking (proof of stake)
+	api.Get("/stake", GetStakesHandler)
+	api.Get("/stake/:address", GetStakeHandler)
+	api.Post("/stake/deposit", DepositStakeHandler)
+	api.Post("/stake/withdraw", WithdrawStakeHandler)
+	api.Post("/stake/slash", SlashHandler)
+
+	// Multisig routes
+	api.Post("/multisig/create", CreateMultisigHandler)
+	api.Post("/multisig/transaction", CreateMultisigTxHandler)
+	api.Get("/multisig/transaction/:hash", GetMultisigTxHandler)
+	api.Post("/multisig/transaction/:hash/sign", SignMultisigTxHandler)
+	api.Post("/multisig/transaction/:hash/finalize", FinalizeMultisigTxHandler)
+	api.Get("/multisig/:address", GetMultisigHandler)
+
+	// Script routes
+	api.Post("/script/compile", CompileScriptHandler)
+	api.Post("/script/spend", SpendScriptHandler)
+
+	// Mempool routes
+	api.Get("/mempool", GetMempoolHandler)
+	api.Get("/mempool/sender/:address", GetMempoolSenderHandler)
+	api.Get("/mempool/tx/:hash", GetMempoolTxHandler)
+	api.Delete("/mempool/tx/:hash", EvictMempoolTxHandler)
 
 	// Blockchain routes
 	api.Get("/chain", GetChainHandler)
+	api.Get("/chain/reorgs", GetReorgsHandler)
 	api.Get("/chain/:index", GetBlockByIndexHandler)
 	api.Get("/block/latest", GetLatestBlockHandler)
 	api.Delete("/block/delete/:index", DeleteBlockHandler)
@@ -46,15 +115,40 @@ func StartServer(db *pkg.BoltDB, port string) {
 	api.Get("/mine", MineHandler)  // Keep GET for simple browser support
 	api.Post("/mine", MineHandler) // Add POST for providing miner address
 
+	// Dev routes, on dev networks only
+	stopSealer := func() {}
+	if params.Dev {
+		api.Get("/dev/generate", GenerateHandler)
+		api.Post("/dev/generate", GenerateHandler)
+		addDevAccount()
+		stopSealer = startSealer()
+	}
+
 	// Node Stats routes
 	api.Get("/info", GetNodeInfoHandler)
 	api.Get("/stats", GetChainStatsHandler)
+	api.Get("/supply", GetSupplyHandler)
+	api.Get("/fees/estimate", GetFeeEstimateHandler)
 
 	// Networking routes
 	api.Post("/peer/add", AddPeerHandler)
 	api.Get("/peer/list", ListPeersHandler)
 	api.Get("/sync", SyncHandler)
 
+	// Stop sealing and serving on SIGINT or SIGTERM, so the caller can
+	// close the database.
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		stopSealer()
+		if err := app.Shutdown(); err != nil {
+			log.Println("shutdown:", err)
+		}
+	}()
+
 	fmt.Printf("🚀 ChainGo Fiber API running on %s\n", port)
-	log.Fatal(app.Listen(":" + port))
+	if err := app.Listen(":" + port); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -3,18 +3,84 @@ package main
 import (
 	"flag"
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/Vishal-2029/blockchain"
 	"github.com/Vishal-2029/internal"
 	"github.com/Vishal-2029/network"
 	"github.com/Vishal-2029/pkg"
 )
 
 func main() {
-	apiPort := flag.String("api", "8080", "API Port")
-	p2pPort := flag.String("p2p", "9000", "P2P Port")
-	dbFile := flag.String("db", "chaingo.db", "Database file")
+	networkName := flag.String("network", blockchain.DefaultParams.Name, "Network profile: "+strings.Join(blockchain.NetworkNames(), ", "))
+	apiPort := flag.String("api", "", "API Port (default: the network's)")
+	p2pPort := flag.String("p2p", "", "P2P Port (default: the network's)")
+	dbFile := flag.String("db", "", "Database file (default: chaingo.db on mainnet, chaingo-<network>.db otherwise)")
+	blockTime := flag.Int64("blocktime", 0, "Target block interval in seconds (default: the network's)")
+	genesisFile := flag.String("genesis", "", "Genesis spec file (JSON); the network's genesis is used if empty")
+	devPeriod := flag.Int64("dev-period", 0, "Dev network: seconds between sealed blocks; 0 seals whenever a transaction enters the pool")
+	devMiner := flag.String("dev-miner", "", "Dev network: address that receives the rewards of blocks the node seals (default: the dev account "+blockchain.DevAccount+")")
+	readGas := flag.Int("read-gas", internal.DefaultReadGasLimit, fmt.Sprintf("Gas limit of contract reads over the API, at most %d", blockchain.MaxTxGas))
+	validatorKey := flag.String("validator-key", "", "Hex private key this node seals blocks with under proof of authority or proof of stake")
 	flag.Parse()
 
+	params, err := blockchain.NetworkParams(*networkName)
+	if err != nil {
+		panic(err)
+	}
+	if *apiPort == "" {
+		*apiPort = params.APIPort
+	}
+	if *p2pPort == "" {
+		*p2pPort = params.P2PPort
+	}
+	if *dbFile == "" {
+		*dbFile = "chaingo.db"
+		if params.Name != blockchain.MainnetParams.Name {
+			*dbFile = "chaingo-" + params.Name + ".db"
+		}
+	}
+	if *blockTime < 0 {
+		panic("blocktime must be positive")
+	}
+	if *blockTime > 0 {
+		params.TargetBlockTime = *blockTime
+	}
+	if *readGas <= 0 || *readGas > blockchain.MaxTxGas {
+		panic(fmt.Sprintf("read-gas must be between 1 and %d", blockchain.MaxTxGas))
+	}
+	if *devPeriod < 0 {
+		panic("dev-period must not be negative")
+	}
+	if (*devPeriod > 0 || *devMiner != "") && !params.Dev {
+		panic("-dev-period and -dev-miner need -network dev")
+	}
+	if *genesisFile != "" {
+		spec, err := blockchain.LoadGenesisSpec(*genesisFile)
+		if err != nil {
+			panic(err)
+		}
+		if err := params.SetGenesis(spec); err != nil {
+			panic(err)
+		}
+	}
+
+	if *validatorKey != "" {
+		key, err := blockchain.WalletFromPrivateKey(*validatorKey)
+		if err != nil {
+			panic(err)
+		}
+		switch engine := params.Consensus.(type) {
+		case *blockchain.PoaEngine:
+			engine.Key = key
+		case *blockchain.PosEngine:
+			engine.Key = key
+		default:
+			panic("-validator-key needs a proof-of-authority or proof-of-stake genesis spec")
+		}
+	}
+
 	db, err := pkg.NewBoltDB(*dbFile)
 	if err != nil {
 		panic(err)
@@ -22,17 +88,20 @@ func main() {
 	defer db.Close()
 
 	fmt.Printf("Using persistent BoltDB storage: %s\n", *dbFile)
+	fmt.Printf("Network: %s (chain ID %d, %s)\n", params.Name, params.ChainID, params.Consensus.Name())
 
 	// Create and set node for networking features
-	node := network.NewNode(":" + *p2pPort)
+	node := network.NewNode(":"+*p2pPort, params.Magic)
 	internal.SetNode(node)
 
 	// NEW: Set database for wallet persistence
 	internal.SetDatabase(db)
+	internal.SetDevSealing(time.Duration(*devPeriod)*time.Second, *devMiner)
+	internal.SetReadGasLimit(*readGas)
 
 	go func() {
 		node.Start()
 	}()
 
-	internal.StartServer(db, *apiPort)
+	internal.StartServer(db, *apiPort, params)
 }
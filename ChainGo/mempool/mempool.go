@@ -0,0 +1,526 @@
+package mempool
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Vishal-2029/blockchain"
+)
+
+var (
+	ErrAlreadyKnown           = errors.New("transaction already in mempool")
+	ErrNotFound               = errors.New("transaction not in mempool")
+	ErrReplacementUnderpriced = errors.New("replacement does not pay enough to replace")
+	ErrPoolFull               = errors.New("mempool full")
+	ErrCoinbase               = errors.New("coinbase transactions cannot be relayed")
+)
+
+// Config sets the limits of a mempool.
+type Config struct {
+	MaxCount int           // Most transactions held at once
+	MaxBytes int           // Most encoded bytes held at once
+	TTL      time.Duration // How long a transaction may wait before it expires
+	// ReplaceFeeBump is how much more fee a replacement has to pay than the
+	// transaction it replaces.
+	ReplaceFeeBump int
+}
+
+// DefaultConfig holds about five full blocks for up to a day.
+var DefaultConfig = Config{
+	MaxCount:       5000,
+	MaxBytes:       5000000,
+	TTL:            24 * time.Hour,
+	ReplaceFeeBump: 1,
+}
+
+// Entry is a pending transaction with the data the pool keeps about it.
+type Entry struct {
+	Tx      *blockchain.Transaction
+	Hash    string // Hex transaction hash
+	Size    int
+	FeeRate float64
+	Added   time.Time
+
+	seq uint64 // Arrival order, kept by replacements
+}
+
+// Mempool holds transactions waiting to be mined. Every entry applies on
+// top of the current tip after the entries before it, and the entries of
+// one sender always form an unbroken run of nonces.
+//
+// An entry depends on the earlier entries of its sender and on the entries
+// whose outputs it spends. One that carries a contract, token, name,
+// governance or stake operation also depends on every earlier entry that
+// carries one, since they share key/value state. A new transaction is
+// checked on top of its dependencies only, and removing an entry removes
+// the entries that depend on it.
+type Mempool struct {
+	chain *blockchain.Blockchain
+	cfg   Config
+
+	// OnAdd, if set, is called after Add accepted a transaction, outside
+	// the pool's lock.
+	OnAdd func(*Entry)
+
+	mu         sync.Mutex
+	entries    map[string]*Entry   // By hash
+	bySender   map[string][]*Entry // In nonce order
+	spentBy    map[string]*Entry   // By outpoint spent
+	bytes      int
+	seq        uint64
+	nextExpiry time.Time // No entry expires before
+}
+
+func New(chain *blockchain.Blockchain, cfg Config) *Mempool {
+	return &Mempool{
+		chain:    chain,
+		cfg:      cfg,
+		entries:  make(map[string]*Entry),
+		bySender: make(map[string][]*Entry),
+		spentBy:  make(map[string]*Entry),
+	}
+}
+
+// Config returns the limits the pool runs with.
+func (m *Mempool) Config() Config {
+	return m.cfg
+}
+
+// Add validates t against the tip and the pending transactions before it
+// and adds it to the pool. A transaction with the same sender and nonce as
+// a pending one replaces it if it pays at least ReplaceFeeBump more fee at
+// a higher fee rate; pending transactions it conflicts with are dropped.
+// When the pool is over its limits, the lowest fee-rate transactions are
+// evicted, which may be t itself.
+func (m *Mempool) Add(t *blockchain.Transaction) (*Entry, error) {
+	entry, err := m.add(t)
+	if err == nil && m.OnAdd != nil {
+		m.OnAdd(entry)
+	}
+	return entry, err
+}
+
+func (m *Mempool) add(t *blockchain.Transaction) (*Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireLocked(time.Now())
+
+	hash := fmt.Sprintf("%x", t.Hash())
+	if _, ok := m.entries[hash]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrAlreadyKnown, hash)
+	}
+	if t.IsCoinbase() {
+		return nil, ErrCoinbase
+	}
+	if err := blockchain.CheckSignature(t); err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{
+		Tx:      t,
+		Hash:    hash,
+		Size:    t.Size(),
+		FeeRate: blockchain.FeeRate(t),
+		Added:   time.Now(),
+	}
+
+	confirmed, err := m.chain.NextNonce(t.From)
+	if err != nil {
+		return nil, err
+	}
+	queue := m.bySender[t.From]
+	next := confirmed + uint64(len(queue))
+
+	var replaced *Entry
+	switch {
+	case t.Nonce == next:
+		m.seq++
+		entry.seq = m.seq
+	case t.Nonce >= confirmed && t.Nonce < next:
+		replaced = queue[t.Nonce-confirmed]
+		if t.Fee < replaced.Tx.Fee+m.cfg.ReplaceFeeBump || entry.FeeRate <= replaced.FeeRate {
+			return nil, fmt.Errorf("%w: fee %d at rate %.2f, pending transaction pays %d at rate %.2f (bump %d)",
+				ErrReplacementUnderpriced, t.Fee, entry.FeeRate, replaced.Tx.Fee, replaced.FeeRate, m.cfg.ReplaceFeeBump)
+		}
+		entry.seq = replaced.seq
+	case t.Nonce < confirmed:
+		return nil, blockchain.CheckNonce(confirmed, t.Nonce)
+	default:
+		return nil, blockchain.CheckNonce(next, t.Nonce)
+	}
+
+	// No entry that stays ahead of the new transaction may spend what it
+	// spends; a replacement takes the place of the one it replaces, and
+	// conflicts after it are dropped below.
+	for _, in := range t.Inputs {
+		op := blockchain.OutPoint{TxID: in.TxID, Vout: in.Vout}
+		if e := m.spentBy[op.String()]; e != nil && e != replaced && (replaced == nil || e.seq < entry.seq) {
+			return nil, fmt.Errorf("%w: %s is spent by pending transaction %s", blockchain.ErrMissingInput, op, e.Hash)
+		}
+	}
+	// The new transaction must apply after its dependencies that stay
+	// ahead of it.
+	var ahead []*blockchain.Transaction
+	for _, e := range m.dependenciesLocked(t) {
+		if e != replaced && e.seq < entry.seq {
+			ahead = append(ahead, e.Tx)
+		}
+	}
+	if err := m.chain.CheckTransaction(t, ahead); err != nil {
+		return nil, err
+	}
+
+	if replaced != nil {
+		m.deleteLocked(replaced)
+		m.insertLocked(entry)
+		// Anything that conflicts with the replacement is dropped.
+		m.revalidateLocked(nil)
+	} else {
+		m.insertLocked(entry)
+	}
+
+	m.trimLocked()
+	if _, ok := m.entries[hash]; !ok {
+		return nil, fmt.Errorf("%w: fee rate %.2f too low", ErrPoolFull, entry.FeeRate)
+	}
+	return entry, nil
+}
+
+// Get looks a pending transaction up by hex hash.
+func (m *Mempool) Get(hash string) (*Entry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireLocked(time.Now())
+	e, ok := m.entries[hash]
+	return e, ok
+}
+
+// Entries returns all pending transactions in the order they apply.
+func (m *Mempool) Entries() []*Entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireLocked(time.Now())
+	return m.orderedLocked()
+}
+
+// Transactions returns all pending transactions in the order they apply.
+func (m *Mempool) Transactions() []*blockchain.Transaction {
+	var txs []*blockchain.Transaction
+	for _, e := range m.Entries() {
+		txs = append(txs, e.Tx)
+	}
+	return txs
+}
+
+// BySender returns the pending transactions of address in nonce order.
+func (m *Mempool) BySender(address string) []*Entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireLocked(time.Now())
+	return append([]*Entry{}, m.bySender[address]...)
+}
+
+// Count returns the number of pending transactions.
+func (m *Mempool) Count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries)
+}
+
+// Bytes returns the encoded size of all pending transactions.
+func (m *Mempool) Bytes() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bytes
+}
+
+// NextNonce returns the nonce the next transaction from address must use,
+// counting its pending transactions.
+func (m *Mempool) NextNonce(address string) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireLocked(time.Now())
+	confirmed, err := m.chain.NextNonce(address)
+	if err != nil {
+		return 0, err
+	}
+	return confirmed + uint64(len(m.bySender[address])), nil
+}
+
+// Claimed returns the outpoints spent by pending transactions, except the
+// one with hash skip.
+func (m *Mempool) Claimed(skip string) map[string]bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	claimed := make(map[string]bool)
+	for hash, e := range m.entries {
+		if hash == skip {
+			continue
+		}
+		for _, in := range e.Tx.Inputs {
+			claimed[blockchain.OutPoint{TxID: in.TxID, Vout: in.Vout}.String()] = true
+		}
+	}
+	return claimed
+}
+
+// Evict removes a pending transaction together with the entries that
+// depend on it, which cannot apply without it, and returns their hashes.
+func (m *Mempool) Evict(hash string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[hash]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, hash)
+	}
+	return m.removeLocked(e), nil
+}
+
+// Reset brings the pool in line with a new tip. Transactions confirmed by
+// the connected blocks are removed, transactions of the disconnected blocks
+// come back, and everything is re-checked against the new tip; entries that
+// no longer apply are dropped. It matches Blockchain.OnTipChange.
+func (m *Mempool) Reset(disconnected, connected []*blockchain.Block) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	confirmed := make(map[string]bool)
+	for _, block := range connected {
+		for _, t := range block.Transactions {
+			confirmed[fmt.Sprintf("%x", t.Hash())] = true
+		}
+	}
+
+	// Returned transactions are older than anything pending, so they go
+	// first, oldest block first.
+	var returned []*Entry
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		for _, t := range disconnected[i].Transactions {
+			hash := fmt.Sprintf("%x", t.Hash())
+			if t.IsCoinbase() || confirmed[hash] || m.entries[hash] != nil {
+				continue
+			}
+			returned = append(returned, &Entry{
+				Tx:      t,
+				Hash:    hash,
+				Size:    t.Size(),
+				FeeRate: blockchain.FeeRate(t),
+				Added:   time.Now(),
+			})
+		}
+	}
+	for hash, e := range m.entries {
+		if confirmed[hash] {
+			m.deleteLocked(e)
+		}
+	}
+
+	m.revalidateLocked(returned)
+	m.trimLocked()
+	m.expireLocked(time.Now())
+}
+
+// revalidateLocked re-checks the given extra entries followed by the pool
+// against the tip and keeps only those that still apply, in order.
+func (m *Mempool) revalidateLocked(extra []*Entry) {
+	candidates := append(extra, m.orderedLocked()...)
+	var txs []*blockchain.Transaction
+	for _, e := range candidates {
+		txs = append(txs, e.Tx)
+	}
+	valid, _ := m.chain.SelectTransactions(txs)
+	keep := make(map[*blockchain.Transaction]bool)
+	for _, t := range valid {
+		keep[t] = true
+	}
+
+	m.entries = make(map[string]*Entry)
+	m.bySender = make(map[string][]*Entry)
+	m.spentBy = make(map[string]*Entry)
+	m.bytes = 0
+	for i, e := range candidates {
+		if !keep[e.Tx] {
+			continue
+		}
+		e.seq = uint64(i + 1)
+		m.insertLocked(e)
+	}
+	m.seq = uint64(len(candidates))
+}
+
+// orderedLocked returns the entries in the order they apply.
+func (m *Mempool) orderedLocked() []*Entry {
+	ordered := make([]*Entry, 0, len(m.entries))
+	for _, e := range m.entries {
+		ordered = append(ordered, e)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].seq < ordered[j].seq })
+	return ordered
+}
+
+func (m *Mempool) insertLocked(e *Entry) {
+	m.entries[e.Hash] = e
+	m.bytes += e.Size
+	queue := append(m.bySender[e.Tx.From], e)
+	sort.Slice(queue, func(i, j int) bool { return queue[i].Tx.Nonce < queue[j].Tx.Nonce })
+	m.bySender[e.Tx.From] = queue
+	for _, in := range e.Tx.Inputs {
+		m.spentBy[blockchain.OutPoint{TxID: in.TxID, Vout: in.Vout}.String()] = e
+	}
+	if expiry := e.Added.Add(m.cfg.TTL); m.nextExpiry.IsZero() || expiry.Before(m.nextExpiry) {
+		m.nextExpiry = expiry
+	}
+}
+
+// deleteLocked removes a single entry without touching its sender's later
+// transactions.
+func (m *Mempool) deleteLocked(e *Entry) {
+	delete(m.entries, e.Hash)
+	m.bytes -= e.Size
+	for _, in := range e.Tx.Inputs {
+		op := blockchain.OutPoint{TxID: in.TxID, Vout: in.Vout}.String()
+		if m.spentBy[op] == e {
+			delete(m.spentBy, op)
+		}
+	}
+	queue := m.bySender[e.Tx.From]
+	for i, q := range queue {
+		if q == e {
+			queue = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) == 0 {
+		delete(m.bySender, e.Tx.From)
+	} else {
+		m.bySender[e.Tx.From] = queue
+	}
+}
+
+// hasStateOp reports whether t changes key/value state besides coins.
+func hasStateOp(t *blockchain.Transaction) bool {
+	return t.Contract != nil || t.Token != nil || t.Name != nil || t.Governance != nil || t.Stake != nil || t.Evidence != nil
+}
+
+// dependenciesLocked returns the entries t needs applied before it, and
+// their dependencies in turn, in the order they apply.
+func (m *Mempool) dependenciesLocked(t *blockchain.Transaction) []*Entry {
+	seen := make(map[*Entry]bool)
+	var deps []*Entry
+	var visit func(t *blockchain.Transaction)
+	visit = func(t *blockchain.Transaction) {
+		var direct []*Entry
+		for _, e := range m.bySender[t.From] {
+			if e.Tx.Nonce < t.Nonce {
+				direct = append(direct, e)
+			}
+		}
+		for _, in := range t.Inputs {
+			if e := m.entries[fmt.Sprintf("%x", in.TxID)]; e != nil {
+				direct = append(direct, e)
+			}
+		}
+		if hasStateOp(t) {
+			for _, e := range m.entries {
+				if hasStateOp(e.Tx) && e.Tx != t {
+					direct = append(direct, e)
+				}
+			}
+		}
+		for _, e := range direct {
+			if !seen[e] {
+				seen[e] = true
+				deps = append(deps, e)
+				visit(e.Tx)
+			}
+		}
+	}
+	visit(t)
+	sort.Slice(deps, func(i, j int) bool { return deps[i].seq < deps[j].seq })
+	return deps
+}
+
+// removeLocked removes e and the entries that depend on it and returns
+// their hashes. Later transactions of a sender and spenders of removed
+// outputs are dropped outright; if a removed entry changed key/value
+// state, the rest of the pool is re-checked too.
+func (m *Mempool) removeLocked(e *Entry) []string {
+	var removed []string
+	stateOp := false
+	queue := []*Entry{e}
+	for len(queue) > 0 {
+		x := queue[0]
+		queue = queue[1:]
+		if _, ok := m.entries[x.Hash]; !ok {
+			continue
+		}
+		m.deleteLocked(x)
+		removed = append(removed, x.Hash)
+		stateOp = stateOp || hasStateOp(x.Tx)
+		for _, q := range m.bySender[x.Tx.From] {
+			if q.Tx.Nonce > x.Tx.Nonce {
+				queue = append(queue, q)
+			}
+		}
+		for vout := range x.Tx.Outputs {
+			op := blockchain.OutPoint{TxID: x.Tx.Hash(), Vout: vout}
+			if q := m.spentBy[op.String()]; q != nil {
+				queue = append(queue, q)
+			}
+		}
+	}
+	if stateOp {
+		before := make(map[string]bool, len(m.entries))
+		for hash := range m.entries {
+			before[hash] = true
+		}
+		m.revalidateLocked(nil)
+		for hash := range before {
+			if _, ok := m.entries[hash]; !ok {
+				removed = append(removed, hash)
+			}
+		}
+	}
+	return removed
+}
+
+// trimLocked evicts transactions until the pool is within its limits.
+// Only the last transaction of a sender can go without breaking its nonce
+// run, so the lowest fee rate among those is evicted first, with whatever
+// depends on it.
+func (m *Mempool) trimLocked() {
+	for len(m.entries) > m.cfg.MaxCount || m.bytes > m.cfg.MaxBytes {
+		var worst *Entry
+		for _, queue := range m.bySender {
+			tail := queue[len(queue)-1]
+			if worst == nil || tail.FeeRate < worst.FeeRate ||
+				(tail.FeeRate == worst.FeeRate && tail.seq > worst.seq) {
+				worst = tail
+			}
+		}
+		m.removeLocked(worst)
+	}
+}
+
+// expireLocked drops transactions older than the TTL together with the
+// entries that depend on them. The pool is only scanned once the oldest
+// entry may have expired.
+func (m *Mempool) expireLocked(now time.Time) {
+	if m.cfg.TTL <= 0 || now.Before(m.nextExpiry) {
+		return
+	}
+	for _, e := range m.orderedLocked() {
+		if _, ok := m.entries[e.Hash]; ok && now.Sub(e.Added) > m.cfg.TTL {
+			m.removeLocked(e)
+		}
+	}
+	m.nextExpiry = time.Time{}
+	for _, e := range m.entries {
+		if expiry := e.Added.Add(m.cfg.TTL); m.nextExpiry.IsZero() || expiry.Before(m.nextExpiry) {
+			m.nextExpiry = expiry
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package mempool
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Vishal-2029/blockchain"
+	"github.com/Vishal-2029/pkg"
+)
+
+// newTestChain opens a regtest chain in a temporary database.
+func newTestChain(t *testing.T) *blockchain.Blockchain {
+	t.Helper()
+	db, err := pkg.NewBoltDB(filepath.Join(t.TempDir(), "chain.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	params, err := blockchain.NetworkParams(blockchain.RegtestParams.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := blockchain.NewBlockchain(db, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bc
+}
+
+// mineTestBlock adds a block of txs to bc, paying the reward to "miner".
+func mineTestBlock(t *testing.T, bc *blockchain.Blockchain, txs ...*blockchain.Transaction) *blockchain.Block {
+	t.Helper()
+	height := bc.Height() + 1
+	reward := bc.Params.Subsidy(height)
+	for _, tx := range txs {
+		reward += tx.Fee
+	}
+	coinbase := blockchain.NewCoinbaseTx(bc.Params.ChainID, "miner", reward, height)
+	block, err := bc.AddBlock(append([]*blockchain.Transaction{coinbase}, txs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// fundTestWallets mines two blocks paying each wallet, and one more so
+// that the rewards can be spent.
+func fundTestWallets(t *testing.T, bc *blockchain.Blockchain, ws ...*blockchain.Wallet) {
+	t.Helper()
+	for _, w := range ws {
+		for i := 0; i < 2; i++ {
+			height := bc.Height() + 1
+			coinbase := blockchain.NewCoinbaseTx(bc.Params.ChainID, w.Address(), bc.Params.Subsidy(height), height)
+			if _, err := bc.AddBlock([]*blockchain.Transaction{coinbase}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	mineTestBlock(t, bc)
+}
+
+// coins returns the confirmed outputs of w in a fixed order.
+func coins(t *testing.T, bc *blockchain.Blockchain, w *blockchain.Wallet) []blockchain.UTXO {
+	t.Helper()
+	utxos, err := bc.UTXO.FindByAddress(w.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(utxos, func(i, j int) bool { return utxos[i].Height < utxos[j].Height })
+	return utxos
+}
+
+// payTestTx builds and signs a transaction from w paying each payment out
+// of utxo.
+func payTestTx(t *testing.T, bc *blockchain.Blockchain, w *blockchain.Wallet, nonce uint64, utxo blockchain.UTXO, fee int, payments ...blockchain.TxOutput) *blockchain.Transaction {
+	t.Helper()
+	tx, err := blockchain.NewBatchTransaction(bc.Params.ChainID, w.Address(), payments, fee, nonce, []blockchain.UTXO{utxo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Sign(w)
+	return tx
+}
+
+// hashes returns the sorted hashes of txs.
+func hashes(txs ...*blockchain.Transaction) []string {
+	out := []string{}
+	for _, tx := range txs {
+		out = append(out, fmt.Sprintf("%x", tx.Hash()))
+	}
+	sort.Strings(out)
+	return out
+}
+
+// pending returns the sorted hashes of the pool's entries.
+func pending(m *Mempool) []string {
+	out := []string{}
+	for _, e := range m.Entries() {
+		out = append(out, e.Hash)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestReplaceByFee(t *testing.T) {
+	alice, bob := blockchain.NewWallet(), blockchain.NewWallet()
+	bc := newTestChain(t)
+	fundTestWallets(t, bc, alice)
+	utxos := coins(t, bc, alice)
+	pay := blockchain.TxOutput{Amount: 5, Address: bob.Address()}
+	first := payTestTx(t, bc, alice, 0, utxos[0], 10, pay)
+	second := payTestTx(t, bc, alice, 1, utxos[1], 10, pay)
+
+	var batch []blockchain.TxOutput
+	for i := 0; i < 10; i++ {
+		batch = append(batch, blockchain.TxOutput{Amount: 1, Address: blockchain.NewWallet().Address()})
+	}
+	tests := []struct {
+		name string
+		bump int
+		tx   *blockchain.Transaction
+		want error
+	}{
+		{"same fee", 1, payTestTx(t, bc, alice, 0, utxos[0], 10, blockchain.TxOutput{Amount: 6, Address: bob.Address()}), ErrReplacementUnderpriced},
+		{"higher fee at a lower rate", 1, payTestTx(t, bc, alice, 0, utxos[0], 11, batch...), ErrReplacementUnderpriced},
+		{"less than the bump", 5, payTestTx(t, bc, alice, 0, utxos[0], 14, pay), ErrReplacementUnderpriced},
+		{"higher fee and rate", 5, payTestTx(t, bc, alice, 0, utxos[0], 15, pay), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig
+			cfg.ReplaceFeeBump = tt.bump
+			m := New(bc, cfg)
+			for _, tx := range []*blockchain.Transaction{first, second} {
+				if _, err := m.Add(tx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := m.Add(tt.tx)
+			want := hashes(first, second)
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("error %v, want none", err)
+				}
+				want = hashes(tt.tx, second)
+			} else if !errors.Is(err, tt.want) {
+				t.Fatalf("error %v, want %v", err, tt.want)
+			}
+			if got := pending(m); !reflect.DeepEqual(got, want) {
+				t.Errorf("pending %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestTrim(t *testing.T) {
+	alice, bob, carol := blockchain.NewWallet(), blockchain.NewWallet(), blockchain.NewWallet()
+	bc := newTestChain(t)
+	fundTestWallets(t, bc, alice, bob, carol)
+
+	// A step adds a transaction from a sender with nonce and fee, each from
+	// its own output, and expects err.
+	type step struct {
+		from  *blockchain.Wallet
+		nonce uint64
+		fee   int
+		err   error
+	}
+	tests := []struct {
+		name  string
+		cfg   func(size int) Config // size is that of the largest transaction
+		steps []step
+		kept  []int // Steps pending at the end
+	}{
+		{
+			"count keeps the highest rates",
+			func(int) Config { return Config{MaxCount: 2, MaxBytes: 1 << 20} },
+			[]step{{alice, 0, 1, nil}, {bob, 0, 3, nil}, {carol, 0, 2, nil}},
+			[]int{1, 2},
+		},
+		{
+			"new transaction is the lowest",
+			func(int) Config { return Config{MaxCount: 2, MaxBytes: 1 << 20} },
+			[]step{{alice, 0, 3, nil}, {bob, 0, 2, nil}, {carol, 0, 1, ErrPoolFull}},
+			[]int{0, 1},
+		},
+		{
+			"only the last of a sender is evicted",
+			func(int) Config { return Config{MaxCount: 2, MaxBytes: 1 << 20} },
+			[]step{{alice, 0, 1, nil}, {alice, 1, 5, nil}, {bob, 0, 3, ErrPoolFull}},
+			[]int{0, 1},
+		},
+		{
+			"bytes keep the highest rates",
+			func(size int) Config { return Config{MaxCount: 100, MaxBytes: 2*size + size/2} },
+			[]step{{alice, 0, 1, nil}, {bob, 0, 3, nil}, {carol, 0, 2, nil}},
+			[]int{1, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			used := make(map[*blockchain.Wallet]int)
+			var txs []*blockchain.Transaction
+			size := 0
+			for _, s := range tt.steps {
+				tx := payTestTx(t, bc, s.from, s.nonce, coins(t, bc, s.from)[used[s.from]], s.fee, blockchain.TxOutput{Amount: 1, Address: "shop"})
+				used[s.from]++
+				txs = append(txs, tx)
+				size = max(size, tx.Size())
+			}
+			m := New(bc, tt.cfg(size))
+			for i, s := range tt.steps {
+				_, err := m.Add(txs[i])
+				if s.err == nil && err != nil {
+					t.Fatalf("step %d: error %v, want none", i, err)
+				}
+				if !errors.Is(err, s.err) {
+					t.Fatalf("step %d: error %v, want %v", i, err, s.err)
+				}
+			}
+			var kept []*blockchain.Transaction
+			for _, i := range tt.kept {
+				kept = append(kept, txs[i])
+			}
+			if got, want := pending(m), hashes(kept...); !reflect.DeepEqual(got, want) {
+				t.Errorf("pending %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// chainedPool fills a pool with two transactions of alice, a payment to
+// bob, a spend by bob of that payment while it is pending, and an
+// unrelated transaction of carol.
+func chainedPool(t *testing.T, cfg Config) (*Mempool, map[string]*blockchain.Transaction) {
+	t.Helper()
+	alice, bob, carol := blockchain.NewWallet(), blockchain.NewWallet(), blockchain.NewWallet()
+	bc := newTestChain(t)
+	fundTestWallets(t, bc, alice, carol)
+	m := New(bc, cfg)
+
+	txs := make(map[string]*blockchain.Transaction)
+	txs["alice"] = payTestTx(t, bc, alice, 0, coins(t, bc, alice)[0], 1, blockchain.TxOutput{Amount: 30, Address: bob.Address()})
+	txs["alice next"] = payTestTx(t, bc, alice, 1, coins(t, bc, alice)[1], 1, blockchain.TxOutput{Amount: 5, Address: "shop"})
+	unconfirmed := blockchain.UTXO{
+		OutPoint: blockchain.OutPoint{TxID: txs["alice"].Hash(), Vout: 0},
+		Output:   txs["alice"].Outputs[0],
+	}
+	txs["bob"] = payTestTx(t, bc, bob, 0, unconfirmed, 1, blockchain.TxOutput{Amount: 10, Address: "shop"})
+	txs["carol"] = payTestTx(t, bc, carol, 0, coins(t, bc, carol)[0], 1, blockchain.TxOutput{Amount: 5, Address: "shop"})
+	for _, name := range []string{"alice", "alice next", "bob", "carol"} {
+		if _, err := m.Add(txs[name]); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	return m, txs
+}
+
+func TestEvict(t *testing.T) {
+	tests := []struct {
+		evict string
+		kept  []string
+	}{
+		{"alice", []string{"carol"}},
+		{"alice next", []string{"alice", "bob", "carol"}},
+		{"bob", []string{"alice", "alice next", "carol"}},
+		{"carol", []string{"alice", "alice next", "bob"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.evict, func(t *testing.T) {
+			m, txs := chainedPool(t, DefaultConfig)
+			removed, err := m.Evict(fmt.Sprintf("%x", txs[tt.evict].Hash()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var kept, gone []*blockchain.Transaction
+			for name, tx := range txs {
+				if slices.Contains(tt.kept, name) {
+					kept = append(kept, tx)
+				} else {
+					gone = append(gone, tx)
+				}
+			}
+			sort.Strings(removed)
+			if want := hashes(gone...); !reflect.DeepEqual(removed, want) {
+				t.Errorf("removed %v, want %v", removed, want)
+			}
+			if got, want := pending(m), hashes(kept...); !reflect.DeepEqual(got, want) {
+				t.Errorf("pending %v, want %v", got, want)
+			}
+		})
+	}
+	m, _ := chainedPool(t, DefaultConfig)
+	if _, err := m.Evict("00"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("evicting an unknown transaction: error %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	tests := []struct {
+		name string
+		aged []string
+		kept []string
+	}{
+		{"none", nil, []string{"alice", "alice next", "bob", "carol"}},
+		{"a leaf", []string{"carol"}, []string{"alice", "alice next", "bob"}},
+		{"with dependents", []string{"alice"}, []string{"carol"}},
+		{"all", []string{"alice", "alice next", "bob", "carol"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, txs := chainedPool(t, Config{MaxCount: 100, MaxBytes: 1 << 20, TTL: time.Hour})
+			m.mu.Lock()
+			for _, name := range tt.aged {
+				m.entries[fmt.Sprintf("%x", txs[name].Hash())].Added = time.Now().Add(-2 * time.Hour)
+			}
+			m.nextExpiry = time.Time{}
+			m.mu.Unlock()
+
+			var kept []*blockchain.Transaction
+			for _, name := range tt.kept {
+				kept = append(kept, txs[name])
+			}
+			if got, want := pending(m), hashes(kept...); !reflect.DeepEqual(got, want) {
+				t.Errorf("pending %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// TestResetAfterReorg confirms two transactions of alice and then
+// reorganizes onto a branch built on another chain, checking which of them
+// come back to the pool.
+func TestResetAfterReorg(t *testing.T) {
+	alice, bob, dan := blockchain.NewWallet(), blockchain.NewWallet(), blockchain.NewWallet()
+	tests := []struct {
+		name string
+		// branch returns what the blocks of the other branch hold, given
+		// alice's transactions. It has to outgrow the block confirming
+		// them.
+		branch func(t *testing.T, b *blockchain.Blockchain, sent []*blockchain.Transaction) [][]*blockchain.Transaction
+		kept   []int // Of alice's transactions
+	}{
+		{"both return", func(t *testing.T, b *blockchain.Blockchain, sent []*blockchain.Transaction) [][]*blockchain.Transaction {
+			return [][]*blockchain.Transaction{nil, nil}
+		}, []int{0, 1}},
+		{"conflict dropped", func(t *testing.T, b *blockchain.Blockchain, sent []*blockchain.Transaction) [][]*blockchain.Transaction {
+			spend := payTestTx(t, b, alice, 0, coins(t, b, alice)[0], 1, blockchain.TxOutput{Amount: 20, Address: dan.Address()})
+			return [][]*blockchain.Transaction{{spend}, nil}
+		}, []int{1}},
+		{"confirmed again", func(t *testing.T, b *blockchain.Blockchain, sent []*blockchain.Transaction) [][]*blockchain.Transaction {
+			return [][]*blockchain.Transaction{nil, sent}
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := newTestChain(t), newTestChain(t)
+			fundTestWallets(t, a, alice)
+			for h := 1; h <= a.Height(); h++ {
+				block, err := a.BlockAtHeight(h)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := b.ProcessBlock(block); err != nil {
+					t.Fatal(err)
+				}
+			}
+			m := New(a, DefaultConfig)
+			a.OnTipChange = m.Reset
+
+			utxos := coins(t, a, alice)
+			sent := []*blockchain.Transaction{
+				payTestTx(t, a, alice, 0, utxos[0], 1, blockchain.TxOutput{Amount: 10, Address: bob.Address()}),
+				payTestTx(t, a, alice, 1, utxos[1], 1, blockchain.TxOutput{Amount: 10, Address: bob.Address()}),
+			}
+			for _, tx := range sent {
+				if _, err := m.Add(tx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			confirmed := mineTestBlock(t, a, sent...)
+			m.Reset(nil, []*blockchain.Block{confirmed})
+			if m.Count() != 0 {
+				t.Fatalf("%d pending after the block, want 0", m.Count())
+			}
+
+			for _, txs := range tt.branch(t, b, sent) {
+				mineTestBlock(t, b, txs...)
+			}
+			for h := confirmed.Height; h <= b.Height(); h++ {
+				block, err := b.BlockAtHeight(h)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := a.ProcessBlock(block); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if a.Height() != b.Height() {
+				t.Fatalf("height %d after the reorg, want %d", a.Height(), b.Height())
+			}
+
+			var kept []*blockchain.Transaction
+			for _, i := range tt.kept {
+				kept = append(kept, sent[i])
+			}
+			if got, want := pending(m), hashes(kept...); !reflect.DeepEqual(got, want) {
+				t.Errorf("pending %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -1,21 +1,45 @@
 package network
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/Vishal-2029/blockchain"
+	"github.com/Vishal-2029/mempool"
+)
+
+const (
+	// readTimeout is how long a peer may take to send its message.
+	readTimeout = 30 * time.Second
+	// dialTimeout is how long connecting to a peer and writing a message
+	// may take.
+	dialTimeout = 10 * time.Second
+	// orphanSyncInterval is the least time between the sync requests that
+	// orphan blocks trigger.
+	orphanSyncInterval = 5 * time.Second
+	// maxBlocksRequested caps the hashes of one GET_BLOCKS.
+	maxBlocksRequested = 500
 )
 
 type Node struct {
 	Address    string
+	Magic      [4]byte // Network magic of every message sent and accepted
 	Peers      *PeerManager
 	Blockchain *blockchain.Blockchain
+	Mempool    *mempool.Mempool
+
+	syncMu     sync.Mutex
+	lastOrphan time.Time // When an orphan block last triggered a sync
 }
 
-func NewNode(address string) *Node {
+func NewNode(address string, magic [4]byte) *Node {
 	return &Node{
 		Address: address,
+		Magic:   magic,
 		Peers:   NewPeerManager(),
 	}
 }
@@ -24,6 +48,10 @@ func (n *Node) SetBlockchain(bc *blockchain.Blockchain) {
 	n.Blockchain = bc
 }
 
+func (n *Node) SetMempool(pool *mempool.Mempool) {
+	n.Mempool = pool
+}
+
 func (n *Node) Start() {
 	listener, err := net.Listen("tcp", n.Address)
 	if err != nil {
@@ -50,16 +78,23 @@ func (n *Node) handleConnection(conn net.Conn) {
 	// Add this peer to our list if valid
 	// n.Peers.AddPeer(remoteAddr)
 
-	buf := make([]byte, 409600) // Increase buffer for large chains
-	nBytes, err := conn.Read(buf)
+	// Senders close the connection after writing, so read until EOF, but
+	// no longer than readTimeout and no more than one message may hold.
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	limit := n.maxMessageSize()
+	data, err := io.ReadAll(io.LimitReader(conn, int64(limit)+1))
 	if err != nil {
 		// fmt.Printf("Error reading from %s: %v\n", remoteAddr, err)
 		return
 	}
+	if len(data) > limit {
+		fmt.Printf("Dropping message from %s: larger than %d bytes\n", remoteAddr, limit)
+		return
+	}
 
-	// fmt.Printf("📨 Received %d bytes from %s\n", nBytes, remoteAddr)
+	// fmt.Printf("📨 Received %d bytes from %s\n", len(data), remoteAddr)
 
-	msg, err := DecodeMessage(buf[:nBytes])
+	msg, err := DecodeMessage(n.Magic, data)
 	if err != nil {
 		fmt.Println("Error decoding message:", err)
 		return
@@ -68,71 +103,227 @@ func (n *Node) handleConnection(conn net.Conn) {
 	switch msg.Type {
 	case "BLOCK":
 		// fmt.Printf("Received new BLOCK from peer: %s\n", remoteAddr)
-		// Handle new block logic here
+		n.handleBlock(msg.Data)
 	case "TRANSACTION":
 		// fmt.Printf("Received new TRANSACTION from peer: %s\n", remoteAddr)
-		// Handle new tx logic here
-	case "CHAIN_REQUEST":
-		targetAddr, ok := msg.Data.(string)
-		if ok {
-			fmt.Printf("Peer %s requested chain sync. Replying to %s\n", remoteAddr, targetAddr)
-			go n.sendChainTo(targetAddr)
-		} else {
-			// Fallback if data is missing (legacy support?), use connection if we could (but we can't).
-			// Just log error.
-			fmt.Printf("Peer %s requested chain sync but provided invalid address\n", remoteAddr)
-		}
-	case "CHAIN_RESPONSE":
-		n.handleChainResponse(msg.Data)
+		n.handleTransaction(msg.Data)
+	case "GET_HEADERS":
+		n.handleGetHeaders(msg.Data.(*Inventory))
+	case "HEADERS":
+		n.handleHeaders(msg.Data.(*Batch))
+	case "GET_BLOCKS":
+		n.handleGetBlocks(msg.Data.(*Inventory))
+	case "BLOCKS":
+		n.handleBlocks(msg.Data.(*Batch))
 	default:
 		fmt.Printf("Unknown message type from %s: %s\n", remoteAddr, msg.Type)
 	}
 }
 
-func (n *Node) sendChainTo(addr string) {
+// maxMessageSize is the largest message accepted from a peer: a BLOCKS
+// batch is filled up to one block's size limit and may hold a single block
+// of that size, plus room for the framing.
+func (n *Node) maxMessageSize() int {
+	params := blockchain.DefaultParams
+	if n.Blockchain != nil {
+		params = n.Blockchain.Params
+	}
+	return 2 * params.MaxBlockSize
+}
+
+// toBlock accepts a block as carried by a message. DecodeMessage hands
+// back pointers; values are accepted too for messages built by hand.
+func toBlock(data interface{}) (*blockchain.Block, bool) {
+	switch b := data.(type) {
+	case *blockchain.Block:
+		return b, true
+	case blockchain.Block:
+		return &b, true
+	}
+	return nil, false
+}
+
+func (n *Node) handleBlock(data interface{}) {
 	if n.Blockchain == nil {
 		return
 	}
+	block, ok := toBlock(data)
+	if !ok {
+		fmt.Printf("Received invalid block data type: %T\n", data)
+		return
+	}
 
-	msg := Message{
-		Type: "CHAIN_RESPONSE",
-		Data: n.Blockchain.Block,
+	err := n.Blockchain.ProcessBlock(block)
+	switch {
+	case err == nil:
+		fmt.Printf("📦 Accepted block %d (%x) from peer\n", block.Height, block.Hash)
+	case errors.Is(err, blockchain.ErrKnownBlock):
+	case errors.Is(err, blockchain.ErrOrphanBlock):
+		// We are missing its ancestors; ask the peers for the headers after
+		// our chain, at most once per orphanSyncInterval.
+		n.syncMu.Lock()
+		due := time.Since(n.lastOrphan) >= orphanSyncInterval
+		if due {
+			n.lastOrphan = time.Now()
+		}
+		n.syncMu.Unlock()
+		if due {
+			fmt.Printf("Received orphan block %d, requesting headers\n", block.Height)
+			n.RequestSync()
+		}
+	default:
+		fmt.Printf("Rejected block %d from peer: %v\n", block.Height, err)
 	}
+}
 
-	fmt.Printf("Sending chain to %s\n", addr)
-	n.sendMessage(addr, msg)
+// toTransaction accepts a transaction as decoded from a message, like
+// toBlock.
+func toTransaction(data interface{}) (*blockchain.Transaction, bool) {
+	switch t := data.(type) {
+	case *blockchain.Transaction:
+		return t, true
+	case blockchain.Transaction:
+		return &t, true
+	}
+	return nil, false
 }
 
-func (n *Node) unused_sendChain(conn net.Conn) {
-	// Deprecated
-	if n.Blockchain == nil {
+// handleTransaction adds a peer's transaction to the mempool and relays it
+// if it was new and valid. Transactions already in the pool are not
+// relayed again, which ends the flood.
+func (n *Node) handleTransaction(data interface{}) {
+	if n.Mempool == nil {
+		return
+	}
+	t, ok := toTransaction(data)
+	if !ok {
+		fmt.Printf("Received invalid transaction data type: %T\n", data)
 		return
 	}
 
-	msg := Message{
-		Type: "CHAIN_RESPONSE",
-		Data: n.Blockchain.Block,
+	_, err := n.Mempool.Add(t)
+	switch {
+	case err == nil:
+		n.Broadcast(Message{Type: "TRANSACTION", Data: t})
+	case errors.Is(err, mempool.ErrAlreadyKnown):
+	default:
+		fmt.Printf("Rejected transaction %x from peer: %v\n", t.Hash(), err)
 	}
+}
 
-	data, _ := EncodeMessage(msg)
-	conn.Write(data)
-	fmt.Printf("Sent blockchain (height: %d) to peer\n", len(n.Blockchain.Block))
+// RequestSync asks every peer for the headers of its chain after ours.
+// Syncing is headers first: the headers show which blocks are missing, only
+// those are fetched, and each batch of blocks asks the peer for the headers
+// after it, until the peer has nothing more.
+func (n *Node) RequestSync() {
+	if n.Blockchain == nil {
+		return
+	}
+	n.Broadcast(Message{Type: "GET_HEADERS", Data: &Inventory{From: n.Address, Hashes: n.Blockchain.Locator()}})
 }
 
-func (n *Node) handleChainResponse(data interface{}) {
-	// Attempt to cast to slice of blocks
-	newChain, ok := data.([]*blockchain.Block)
-	if !ok {
-		fmt.Printf("Received invalid chain data type: %T\n", data)
+// handleGetHeaders answers with the headers of our best chain after the
+// fork point the locator shows.
+func (n *Node) handleGetHeaders(inv *Inventory) {
+	if n.Blockchain == nil {
+		return
+	}
+	headers, err := n.Blockchain.HeadersAfter(inv.Hashes, blockchain.MaxHeadersPerMessage)
+	if err != nil {
+		fmt.Println("Error reading headers:", err)
+		return
+	}
+	n.sendMessage(inv.From, Message{Type: "HEADERS", Data: &Batch{From: n.Address, Blocks: headers}})
+}
+
+// handleHeaders checks that a peer's headers form a sealed chain from a
+// block we have and asks for the blocks among them we don't have.
+func (n *Node) handleHeaders(batch *Batch) {
+	if n.Blockchain == nil || len(batch.Blocks) == 0 {
+		return
+	}
+	headers := batch.Blocks
+	if err := n.Blockchain.CheckHeaders(headers); err != nil {
+		fmt.Printf("Ignoring headers from %s: %v\n", batch.From, err)
+		return
+	}
+	var missing [][]byte
+	for _, header := range headers {
+		if len(missing) < maxBlocksRequested && !n.Blockchain.HasBlock(header.Hash) {
+			missing = append(missing, header.Hash)
+		}
+	}
+	if len(missing) == 0 {
+		// We have them all; ask for more if the peer stopped at its limit.
+		if len(headers) == blockchain.MaxHeadersPerMessage {
+			n.requestHeadersAfter(batch.From, headers[len(headers)-1].Hash)
+		}
 		return
 	}
+	fmt.Printf("Requesting %d blocks from %s\n", len(missing), batch.From)
+	n.sendMessage(batch.From, Message{Type: "GET_BLOCKS", Data: &Inventory{From: n.Address, Hashes: missing}})
+}
 
-	fmt.Printf("📦 Received valid blockchain from peer. Height: %d\n", len(newChain))
+// requestHeadersAfter asks addr for the headers after hash, falling back
+// to our own chain if the peer does not have it on its best chain.
+func (n *Node) requestHeadersAfter(addr string, hash []byte) {
+	locator := append([][]byte{hash}, n.Blockchain.Locator()...)
+	n.sendMessage(addr, Message{Type: "GET_HEADERS", Data: &Inventory{From: n.Address, Hashes: locator}})
+}
 
-	// In a real implementation:
-	// if len(newChain) > len(n.Blockchain.Block) && n.Blockchain.ValidateChain(newChain) {
-	//     n.Blockchain.ReplaceChain(newChain)
-	// }
+// handleGetBlocks sends the requested blocks we have, on any branch, in the
+// order asked, as many as fit in one block's size limit.
+func (n *Node) handleGetBlocks(inv *Inventory) {
+	if n.Blockchain == nil {
+		return
+	}
+	budget := n.Blockchain.Params.MaxBlockSize
+	var blocks []*blockchain.Block
+	for i, hash := range inv.Hashes {
+		if i >= maxBlocksRequested {
+			break
+		}
+		block, err := n.Blockchain.BlockByHash(hash)
+		if err != nil {
+			break
+		}
+		size := block.Size()
+		if len(blocks) > 0 && size > budget {
+			break
+		}
+		blocks = append(blocks, block)
+		budget -= size
+	}
+	if len(blocks) == 0 {
+		return
+	}
+	n.sendMessage(inv.From, Message{Type: "BLOCKS", Data: &Batch{From: n.Address, Blocks: blocks}})
+}
+
+// handleBlocks feeds a batch of blocks through ProcessBlock and, if any was
+// new, asks the peer for the headers after the last one. The rest are
+// stored as a branch and the chain reorganises onto it once it has more
+// cumulative work.
+func (n *Node) handleBlocks(batch *Batch) {
+	if n.Blockchain == nil || len(batch.Blocks) == 0 {
+		return
+	}
+	added := 0
+	for _, block := range batch.Blocks {
+		err := n.Blockchain.ProcessBlock(block)
+		if errors.Is(err, blockchain.ErrKnownBlock) {
+			continue
+		}
+		if err != nil {
+			fmt.Printf("Stopped importing blocks from %s at block %d: %v\n", batch.From, block.Height, err)
+			return
+		}
+		added++
+	}
+	fmt.Printf("Imported %d blocks from %s, tip is now at height %d\n", added, batch.From, n.Blockchain.Height())
+	if added > 0 {
+		n.requestHeadersAfter(batch.From, batch.Blocks[len(batch.Blocks)-1].Hash)
+	}
 }
 
 func (n *Node) Broadcast(msg Message) {
@@ -145,7 +336,7 @@ func (n *Node) Broadcast(msg Message) {
 }
 
 func (n *Node) sendMessage(addr string, msg Message) {
-	conn, err := net.Dial("tcp", addr)
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
 	if err != nil {
 		// fmt.Printf("Failed to connect to peer %s: %v\n", addr, err)
 		n.Peers.mu.Lock()
@@ -155,10 +346,11 @@ func (n *Node) sendMessage(addr string, msg Message) {
 	}
 	defer conn.Close()
 
-	data, err := EncodeMessage(msg)
+	data, err := EncodeMessage(n.Magic, msg)
 	if err != nil {
 		return
 	}
 
+	conn.SetWriteDeadline(time.Now().Add(dialTimeout))
 	conn.Write(data)
 }
@@ -2,32 +2,117 @@ package network
 
 import (
 	"bytes"
-	"encoding/gob"
+	"fmt"
 
 	"github.com/Vishal-2029/blockchain"
 )
 
-func init() {
-	gob.Register(blockchain.Block{})
-	gob.Register(blockchain.Transaction{})
-	gob.Register([]*blockchain.Block{})
-}
+// The magic of the network and blockchain.EncodingVersion start every
+// message on the wire. The message type follows as a string, then its
+// payload in the canonical encoding of the blockchain package; see
+// ENCODING.md.
 
 type Message struct {
-	Type string      // "BLOCK", "TRANSACTION", "CHAIN_REQUEST", "CHAIN_RESPONSE"
-	Data interface{} // serialized block, transaction, or chain
+	Type string      // "BLOCK", "TRANSACTION", "GET_HEADERS", "HEADERS", "GET_BLOCKS", "BLOCKS"
+	Data interface{} // *Block, *Transaction, *Inventory or *Batch
+}
+
+// Inventory asks a peer for headers after the first locator hash on its
+// chain (GET_HEADERS) or for the blocks with the given hashes
+// (GET_BLOCKS). From is the address to reply to.
+type Inventory struct {
+	From   string
+	Hashes [][]byte
 }
 
-func EncodeMessage(msg Message) ([]byte, error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(msg)
-	return buf.Bytes(), err
+// Batch answers an Inventory with headers (HEADERS) or blocks (BLOCKS).
+// From is the address of the sender, to ask it for more.
+type Batch struct {
+	From   string
+	Blocks []*blockchain.Block
 }
 
-func DecodeMessage(data []byte) (Message, error) {
+func EncodeMessage(magic [4]byte, msg Message) ([]byte, error) {
+	var e blockchain.Encoder
+	e.PutRaw(magic[:])
+	e.PutU8(blockchain.EncodingVersion)
+	e.PutString(msg.Type)
+
+	switch msg.Type {
+	case "BLOCK":
+		block, ok := toBlock(msg.Data)
+		if !ok {
+			return nil, fmt.Errorf("BLOCK message carries %T", msg.Data)
+		}
+		e.EncodeBlock(block)
+	case "TRANSACTION":
+		t, ok := toTransaction(msg.Data)
+		if !ok {
+			return nil, fmt.Errorf("TRANSACTION message carries %T", msg.Data)
+		}
+		e.EncodeTransaction(t)
+	case "GET_HEADERS", "GET_BLOCKS":
+		inv, ok := msg.Data.(*Inventory)
+		if !ok {
+			return nil, fmt.Errorf("%s message carries %T", msg.Type, msg.Data)
+		}
+		e.PutString(inv.From)
+		e.PutU32(uint32(len(inv.Hashes)))
+		for _, hash := range inv.Hashes {
+			e.PutBytes(hash)
+		}
+	case "HEADERS", "BLOCKS":
+		batch, ok := msg.Data.(*Batch)
+		if !ok {
+			return nil, fmt.Errorf("%s message carries %T", msg.Type, msg.Data)
+		}
+		e.PutString(batch.From)
+		e.PutU32(uint32(len(batch.Blocks)))
+		for _, block := range batch.Blocks {
+			e.EncodeBlock(block)
+		}
+	default:
+		return nil, fmt.Errorf("unknown message type %q", msg.Type)
+	}
+	return e.Bytes(), nil
+}
+
+// DecodeMessage reads a message, refusing messages of other networks than
+// the one magic belongs to.
+func DecodeMessage(magic [4]byte, data []byte) (Message, error) {
 	var msg Message
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	err := dec.Decode(&msg)
-	return msg, err
+	if !bytes.HasPrefix(data, magic[:]) {
+		return msg, fmt.Errorf("%w: message is not for network %x", blockchain.ErrBadEncoding, magic)
+	}
+	d := blockchain.NewDecoder(data[len(magic):])
+	if v := d.U8(); v != blockchain.EncodingVersion {
+		return msg, fmt.Errorf("%w: message encoding version %d", blockchain.ErrBadVersion, v)
+	}
+	msg.Type = d.Text()
+
+	switch msg.Type {
+	case "BLOCK":
+		msg.Data = d.Block()
+	case "TRANSACTION":
+		msg.Data = d.Transaction()
+	case "GET_HEADERS", "GET_BLOCKS":
+		inv := &Inventory{From: d.Text()}
+		inv.Hashes = make([][]byte, d.Count())
+		for i := range inv.Hashes {
+			inv.Hashes[i] = d.Bytes()
+		}
+		msg.Data = inv
+	case "HEADERS", "BLOCKS":
+		batch := &Batch{From: d.Text()}
+		batch.Blocks = make([]*blockchain.Block, d.Count())
+		for i := range batch.Blocks {
+			batch.Blocks[i] = d.Block()
+		}
+		msg.Data = batch
+	default:
+		if d.Err() == nil {
+			return msg, fmt.Errorf("unknown message type %q", msg.Type)
+		}
+	}
+	return msg, d.Finish()
 }
@@ -2,6 +2,7 @@ package pkg
 
 import (
 	"errors"
+	"fmt"
 
 	"go.etcd.io/bbolt"
 )
@@ -11,8 +12,10 @@ type BoltDB struct {
 }
 
 var (
-	blocksBucket  = []byte("chaingo_blocks")
-	walletsBucket = []byte("chaingo_wallets")
+	blocksBucket    = []byte("chaingo_blocks")
+	walletsBucket   = []byte("chaingo_wallets")
+	multisigBucket  = []byte("chaingo_multisig")   // Multisig policies by address
+	partialTxBucket = []byte("chaingo_partial_tx") // Multisig transactions collecting signatures
 )
 
 func NewBoltDB(path string) (*BoltDB, error) {
@@ -28,6 +31,13 @@ func NewBoltDB(path string) (*BoltDB, error) {
 			return err
 		}
 		_, err = tx.CreateBucketIfNotExists(walletsBucket) // NEW
+		if err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(multisigBucket); err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(partialTxBucket)
 		return err
 	})
 
@@ -80,6 +90,59 @@ func (b *BoltDB) GetAllWallets() (map[string][]byte, error) {
 	return wallets, err
 }
 
+func (b *BoltDB) SaveMultisig(address string, policyData []byte) error {
+	return b.put(multisigBucket, address, policyData)
+}
+
+func (b *BoltDB) GetMultisig(address string) ([]byte, error) {
+	return b.get(multisigBucket, address, "multisig address not found")
+}
+
+func (b *BoltDB) SavePartialTx(hash string, txData []byte) error {
+	return b.put(partialTxBucket, hash, txData)
+}
+
+func (b *BoltDB) GetPartialTx(hash string) ([]byte, error) {
+	return b.get(partialTxBucket, hash, "partial transaction not found")
+}
+
+func (b *BoltDB) DeletePartialTx(hash string) error {
+	return b.DB.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(partialTxBucket)
+		if bucket == nil {
+			return errors.New("partial transactions bucket missing")
+		}
+		return bucket.Delete([]byte(hash))
+	})
+}
+
+func (b *BoltDB) put(name []byte, key string, value []byte) error {
+	return b.DB.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(name)
+		if bucket == nil {
+			return fmt.Errorf("%s bucket missing", name)
+		}
+		return bucket.Put([]byte(key), value)
+	})
+}
+
+func (b *BoltDB) get(name []byte, key, notFound string) ([]byte, error) {
+	var val []byte
+	err := b.DB.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(name)
+		if bucket == nil {
+			return fmt.Errorf("%s bucket missing", name)
+		}
+		v := bucket.Get([]byte(key))
+		if v == nil {
+			return errors.New(notFound)
+		}
+		val = append([]byte{}, v...)
+		return nil
+	})
+	return val, err
+}
+
 func (b *BoltDB) Close() error {
 	return b.DB.Close()
 }